@@ -12,6 +12,7 @@ import (
 	"context"
 	"fmt"
 	"geekai/core/types"
+	"geekai/service/tracing"
 	"geekai/store/model"
 	"geekai/utils"
 	"geekai/utils/resp"
@@ -19,6 +20,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/nfnt/resize"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 	"golang.org/x/image/webp"
 	"gorm.io/gorm"
 	"image"
@@ -51,6 +53,8 @@ func NewServer(appConfig *types.AppConfig) *AppServer {
 func (s *AppServer) Init(debug bool, client *redis.Client) {
 	// 允许跨域请求 API
 	s.Engine.Use(corsMiddleware())
+	// 为 API 请求创建链路，透传调用方的链路上下文
+	s.Engine.Use(otelgin.Middleware(tracing.ServiceName, otelgin.WithFilter(tracingFilter)))
 	s.Engine.Use(staticResourceMiddleware())
 	s.Engine.Use(authorizeMiddleware(s, client))
 	s.Engine.Use(parameterHandlerMiddleware())
@@ -74,6 +78,11 @@ func (s *AppServer) Run(db *gorm.DB) error {
 	return s.Engine.Run(s.Config.Listen)
 }
 
+// tracingFilter 只追踪 API 请求，WebSocket 长连接和监控指标的抓取不记录链路
+func tracingFilter(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/api/") && r.URL.Path != "/api/ws" && r.URL.Path != "/api/admin/metrics"
+}
+
 // 全局异常处理
 func errorHandler(c *gin.Context) {
 	defer func() {
@@ -157,23 +166,30 @@ func authorizeMiddleware(s *AppServer, client *redis.Client) gin.HandlerFunc {
 
 		})
 
-		if err != nil && needLogin(c) {
-			resp.NotAuth(c, fmt.Sprintf("Error with parse auth token: %v", err))
-			c.Abort()
+		// 无需登录的接口，token 无效时直接放行，但不能设置登录用户
+		if err != nil {
+			if needLogin(c) {
+				resp.NotAuth(c, fmt.Sprintf("Error with parse auth token: %v", err))
+				c.Abort()
+			}
 			return
 		}
 
 		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid && needLogin(c) {
-			resp.NotAuth(c, "Token is invalid")
-			c.Abort()
+		if !ok || !token.Valid {
+			if needLogin(c) {
+				resp.NotAuth(c, "Token is invalid")
+				c.Abort()
+			}
 			return
 		}
 
 		expr := utils.IntValue(utils.InterfaceToString(claims["expired"]), 0)
-		if expr > 0 && int64(expr) < time.Now().Unix() && needLogin(c) {
-			resp.NotAuth(c, "Token is expired")
-			c.Abort()
+		if expr > 0 && int64(expr) < time.Now().Unix() {
+			if needLogin(c) {
+				resp.NotAuth(c, "Token is expired")
+				c.Abort()
+			}
 			return
 		}
 
@@ -181,9 +197,11 @@ func authorizeMiddleware(s *AppServer, client *redis.Client) gin.HandlerFunc {
 		if isAdminApi {
 			key = fmt.Sprintf("admin/%v", claims["user_id"])
 		}
-		if _, err := client.Get(context.Background(), key).Result(); err != nil && needLogin(c) {
-			resp.NotAuth(c, "Token is not found in redis")
-			c.Abort()
+		if _, err := client.Get(context.Background(), key).Result(); err != nil {
+			if needLogin(c) {
+				resp.NotAuth(c, "Token is not found in redis")
+				c.Abort()
+			}
 			return
 		}
 		c.Set(types.LoginUserID, claims["user_id"])
@@ -197,6 +215,7 @@ func needLogin(c *gin.Context) bool {
 		c.Request.URL.Path == "/api/admin/login" ||
 		c.Request.URL.Path == "/api/admin/logout" ||
 		c.Request.URL.Path == "/api/admin/login/captcha" ||
+		c.Request.URL.Path == "/api/admin/metrics" ||
 		c.Request.URL.Path == "/api/user/register" ||
 		c.Request.URL.Path == "/api/chat/history" ||
 		c.Request.URL.Path == "/api/chat/detail" ||
@@ -213,8 +232,8 @@ func needLogin(c *gin.Context) bool {
 		c.Request.URL.Path == "/api/product/list" ||
 		c.Request.URL.Path == "/api/menu/list" ||
 		c.Request.URL.Path == "/api/markMap/client" ||
-		c.Request.URL.Path == "/api/payment/doPay" ||
 		c.Request.URL.Path == "/api/payment/payWays" ||
+		(c.Request.Method == http.MethodGet && c.Request.URL.Path == "/api/payment/doPay") ||
 		c.Request.URL.Path == "/api/suno/detail" ||
 		c.Request.URL.Path == "/api/suno/play" ||
 		c.Request.URL.Path == "/api/download" ||
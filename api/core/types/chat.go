@@ -70,6 +70,7 @@ type ChatModel struct {
 	MaxContext  int     `json:"max_context"` // 最大上下文长度
 	Temperature float32 `json:"temperature"` // 模型温度
 	KeyId       int     `json:"key_id"`      // 绑定 API KEY
+	RateLimit   int     `json:"rate_limit"`  // 每个用户每分钟最多请求次数，0 表示不限制
 }
 
 type ApiError struct {
@@ -94,6 +95,9 @@ const (
 	PowerInvite   = PowerType(4) // 邀请奖励
 	PowerRedeem   = PowerType(5) // 众筹
 	PowerGift     = PowerType(6) // 系统赠送
+	PowerRevoke   = PowerType(7) // 订单退款，扣回充值的算力
+	PowerExpire   = PowerType(8) // 充值的算力过期
+	PowerTransfer = PowerType(9) // 用户之间转赠算力
 )
 
 func (t PowerType) String() string {
@@ -106,6 +110,12 @@ func (t PowerType) String() string {
 		return "退款"
 	case PowerRedeem:
 		return "兑换"
+	case PowerRevoke:
+		return "退款扣回"
+	case PowerExpire:
+		return "算力过期"
+	case PowerTransfer:
+		return "转赠"
 
 	}
 	return "其他"
@@ -117,3 +127,10 @@ const (
 	PowerSub = PowerMark(0)
 	PowerAdd = PowerMark(1)
 )
+
+// 算力分组，充值产品可以指定算力只能用于对话或者绘画，默认分组的算力可以用于所有功能
+const (
+	PowerBucketDefault = ""
+	PowerBucketChat    = "chat"
+	PowerBucketImage   = "image"
+)
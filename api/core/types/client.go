@@ -18,6 +18,7 @@ var ErrConClosed = errors.New("connection Closed")
 // WsClient websocket client
 type WsClient struct {
 	Id     string
+	UserId uint // 登录用户 ID
 	Conn   *websocket.Conn
 	lock   sync.Mutex
 	mt     int
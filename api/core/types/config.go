@@ -30,7 +30,95 @@ type AppConfig struct {
 	HuPiPayConfig   HuPiPayConfig   // 虎皮椒支付配置
 	GeekPayConfig   GeekPayConfig   // GEEK 支付配置
 	WechatPayConfig WechatPayConfig // 微信支付渠道配置
+	StripeConfig    StripeConfig    // Stripe 支付配置
+	PaypalConfig    PaypalConfig    // PayPal 支付配置
+	CryptoConfig    CryptoConfig    // USDT 加密货币支付配置
 	TikaHost        string          // TiKa 服务器地址
+	PaySignKey      string          // 支付链接签名秘钥，为空时自动生成并保存到数据库
+	WebhookConfig   WebhookConfig   // 订单事件回调配置
+	FeishuConfig    FeishuConfig    // 飞书群机器人通知配置
+	DingTalkConfig  DingTalkConfig  // 钉钉群机器人通知配置
+	PayAlertConfig  PayAlertConfig  // 支付回调校验失败告警配置
+	KafkaConfig     KafkaConfig     // 领域事件发布配置
+	OrderCaptcha    CaptchaConfig   // 下单人机验证配置
+	GeoIPConfig     GeoIPConfig     // 按照 IP 所在地区定价的 GeoIP 配置
+	StrictPayConfig bool            // 已启用的支付通道配置不完整时是否拒绝启动
+	TrustedProxies  []string        // 可信的反向代理地址，支持 CIDR，只有来自这些地址的请求才会读取 X-Forwarded-For
+	MetricsToken    string          // Prometheus 采集监控指标的令牌，为空表示不开放监控指标接口
+	PayTimeout      int             // 调用支付渠道接口的超时时间（秒），0 表示使用默认的 10 秒
+	// 雪花算法的节点 ID（0 - 1023），多实例部署时每个实例必须不同，否则生成的订单号可能重复
+	SnowflakeWorkerId int
+	// 同一个部署托管多个品牌时，每个品牌（商户）单独的支付配置
+	Merchants []MerchantConfig
+	// 前端展示支付方式使用的名称、图标和排序
+	PayWays []PayWayConfig
+	// 收到交易争议（拒付）时是否扣回订单发放的算力
+	DisputeRevokePower bool
+}
+
+// PayWayConfig 支付方式的展示配置，新增支付方式时只需要修改配置，无需修改前端
+type PayWayConfig struct {
+	PayWay    string   // 支付渠道，如 alipay、geekpay、balance
+	PayType   string   // 支付类型，如 alipay、wxpay，为空时匹配该渠道的所有支付类型
+	Name      string   // 展示名称，为空时使用默认名称
+	Icon      string   // 图标地址
+	Sort      int      // 排序，越小越靠前
+	Platforms []string // 支持的平台：mobile、pc，为空时使用默认值
+}
+
+// WebhookConfig 订单支付成功之后推送给第三方系统的回调配置
+type WebhookConfig struct {
+	Enabled    bool
+	URLs       []string // 回调地址列表
+	Secret     string   // 签名秘钥，使用 HMAC-SHA256 对请求体签名
+	MaxRetries int      // 最大重试次数，默认 5 次
+}
+
+// FeishuConfig 飞书群聊自定义机器人配置，有新的订单支付成功时发送通知
+type FeishuConfig struct {
+	Enabled    bool
+	WebhookURL string   // 机器人的 Webhook 地址
+	Secret     string   // 签名秘钥，机器人没有开启签名校验时留空
+	Topics     []string // 订阅的消息类型：order_paid, payment_alert, dispute，为空时接收所有消息
+}
+
+// DingTalkConfig 钉钉群聊自定义机器人配置
+type DingTalkConfig struct {
+	Enabled    bool
+	WebhookURL string   // 机器人的 Webhook 地址
+	Secret     string   // 加签秘钥，机器人没有开启加签时留空
+	Topics     []string // 订阅的消息类型：order_paid, payment_alert, dispute，为空时接收所有消息
+}
+
+// PayAlertConfig 统计窗口内某个支付渠道回调校验的失败率超过阈值时发送告警，可能是渠道证书过期或者有人伪造回调
+type PayAlertConfig struct {
+	Window     int     // 统计窗口（秒），默认 300 秒
+	MinSamples int     // 窗口内最少的回调次数，回调次数太少时不告警，默认 5 次
+	Threshold  float64 // 失败率阈值，默认 0.5
+	Interval   int     // 同一个渠道两次告警的最小间隔（秒），默认 1800 秒
+}
+
+// CaptchaConfig 下单人机验证配置，同一个 IP 短时间内下单次数较多时才要求验证，防止机器人批量创建订单
+type CaptchaConfig struct {
+	Enabled   bool
+	Provider  string  // 验证服务：recaptcha 或者 hcaptcha
+	SiteKey   string  // 前端渲染验证组件使用的站点密钥
+	SecretKey string  // 服务端校验使用的密钥
+	Threshold int     // 同一个 IP 每小时下单超过该次数之后需要验证，默认 3 次
+	MinScore  float64 // reCAPTCHA v3 的最低分数，默认 0.5
+}
+
+// GeoIPConfig MaxMind GeoIP2 / GeoLite2 Country 数据库配置，用于按照下单 IP 所在的国家或地区使用区域价格
+type GeoIPConfig struct {
+	Enabled  bool
+	Database string // mmdb 数据库文件路径
+}
+
+// KafkaConfig 订单支付成功等领域事件发布到 Kafka 的配置
+type KafkaConfig struct {
+	Enabled bool
+	Brokers []string // Kafka broker 地址列表，如：127.0.0.1:9092
+	Topic   string   // 事件主题
 }
 
 type SmtpConfig struct {
@@ -49,46 +137,120 @@ type ApiConfig struct {
 }
 
 type AlipayConfig struct {
-	Enabled         bool   // 是否启用该支付通道
-	SandBox         bool   // 是否沙盒环境
-	AppId           string // 应用 ID
-	UserId          string // 支付宝用户 ID
-	PrivateKey      string // 用户私钥文件路径
-	PublicKey       string // 用户公钥文件路径
-	AlipayPublicKey string // 支付宝公钥文件路径
-	RootCert        string // Root 秘钥路径
-	NotifyURL       string // 异步通知地址
-	ReturnURL       string // 同步通知地址
+	Enabled             bool     // 是否启用该支付通道
+	SandBox             bool     // 是否沙盒环境
+	AppId               string   // 应用 ID
+	UserId              string   // 支付宝用户 ID
+	PrivateKey          string   // 用户私钥文件路径
+	PublicKey           string   // 用户公钥文件路径
+	AlipayPublicKey     string   // 支付宝公钥文件路径
+	RootCert            string   // Root 秘钥路径
+	NotifyURL           string   // 异步通知地址
+	ReturnURL           string   // 同步通知地址
+	OrderTimeout        int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate             float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+	NotifyIPs           []string // 回调来源 IP 白名单，支持 CIDR，为空表示不限制
+	HuabeiMinAmount     float64  // 订单金额不低于该值（元）时可以选择花呗分期，0 表示不开启花呗分期
+	HuabeiSellerPercent int      // 商家承担的分期手续费比例，只能是 0（用户承担）或者 100（商家承担）
+	CyclePay            bool     // 是否已开通周期扣款，开通之后自动续费产品可以使用支付宝签约扣款
+	SignScene           string   // 周期扣款的签约场景码，默认 INDUSTRY|DIGITAL_MEDIA
 }
 
 type WechatPayConfig struct {
-	Enabled    bool   // 是否启用该支付通道
-	AppId      string // 公众号的APPID,如：wxd678efh567hg6787
-	MchId      string // 直连商户的商户号，由微信支付生成并下发
-	SerialNo   string // 商户证书的证书序列号
-	PrivateKey string // 用户私钥文件路径
-	ApiV3Key   string // API V3 秘钥
-	NotifyURL  string // 异步通知地址
+	Enabled      bool     // 是否启用该支付通道
+	Sandbox      bool     // 是否测试商户号，微信支付 V3 没有沙盒环境，开启之后只做测试标记
+	AppId        string   // 公众号的APPID,如：wxd678efh567hg6787
+	MiniAppId    string   // 小程序的 APPID，配置之后开启小程序支付
+	MchId        string   // 直连商户的商户号，由微信支付生成并下发
+	SerialNo     string   // 商户证书的证书序列号
+	PrivateKey   string   // 用户私钥文件路径
+	ApiV3Key     string   // API V3 秘钥
+	NotifyURL    string   // 异步通知地址
+	OrderTimeout int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate      float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+	NotifyIPs    []string // 回调来源 IP 白名单，支持 CIDR，为空表示不限制
+}
+
+// MerchantConfig 多品牌部署时单个商户的支付配置，按照请求的域名匹配商户，
+// 商户没有启用的支付渠道使用默认的渠道配置
+type MerchantConfig struct {
+	Id              string   // 商户 ID，记录在订单中用于对账
+	Hosts           []string // 品牌站点的域名，如 pay.example.com
+	AlipayConfig    AlipayConfig
+	WechatPayConfig WechatPayConfig
 }
 
 type HuPiPayConfig struct { //虎皮椒第四方支付配置
-	Enabled   bool   // 是否启用该支付通道
-	AppId     string // App ID
-	AppSecret string // app 密钥
-	ApiURL    string // 支付网关
-	NotifyURL string // 异步通知地址
-	ReturnURL string // 同步通知地址
+	Enabled      bool     // 是否启用该支付通道
+	Sandbox      bool     // 是否测试环境，需要同时配置测试环境的网关和密钥
+	WapName      string   // 支付页面展示的网站名称，为空则使用系统配置的网站标题
+	AppId        string   // App ID
+	AppSecret    string   // app 密钥
+	ApiURL       string   // 支付网关
+	NotifyURL    string   // 异步通知地址
+	ReturnURL    string   // 同步通知地址
+	OrderTimeout int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate      float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+	NotifyIPs    []string // 回调来源 IP 白名单，支持 CIDR，为空表示不限制
 }
 
 // GeekPayConfig GEEK支付配置
 type GeekPayConfig struct {
-	Enabled    bool
-	AppId      string   // 商户 ID
-	PrivateKey string   // 私钥
-	ApiURL     string   // API 网关
-	NotifyURL  string   // 异步通知地址
-	ReturnURL  string   // 同步通知地址
-	Methods    []string // 支付方式
+	Enabled      bool
+	Sandbox      bool     // 是否测试环境，需要同时配置测试环境的网关和密钥
+	AppId        string   // 商户 ID
+	PrivateKey   string   // 私钥
+	ApiURL       string   // API 网关
+	NotifyURL    string   // 异步通知地址
+	ReturnURL    string   // 同步通知地址
+	Methods      []string // 支付方式
+	OrderTimeout int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate      float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+	NotifyIPs    []string // 回调来源 IP 白名单，支持 CIDR，为空表示不限制
+}
+
+// StripeConfig Stripe 支付配置
+type StripeConfig struct {
+	Enabled       bool
+	Sandbox       bool     // 是否测试模式，开启之后只允许使用 sk_test_ 开头的测试密钥
+	SecretKey     string   // API 密钥，如：sk_live_xxx
+	WebhookSecret string   // Webhook 签名密钥，如：whsec_xxx
+	ApiURL        string   // API 网关，默认 https://api.stripe.com
+	ReturnURL     string   // 支付成功跳转地址
+	OrderTimeout  int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate       float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+	NotifyIPs     []string // 回调来源 IP 白名单，支持 CIDR，为空表示不限制
+}
+
+// PaypalConfig PayPal 支付配置
+type PaypalConfig struct {
+	Enabled      bool
+	Sandbox      bool     // 是否沙盒环境
+	ClientId     string   // 应用 Client ID
+	Secret       string   // 应用 Secret
+	WebhookId    string   // Webhook ID，用于校验回调签名
+	ReturnURL    string   // 支付成功跳转地址
+	OrderTimeout int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate      float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+	NotifyIPs    []string // 回调来源 IP 白名单，支持 CIDR，为空表示不限制
+}
+
+// CryptoConfig USDT(TRC20) 支付配置
+type CryptoConfig struct {
+	Enabled      bool
+	Sandbox      bool     // 是否使用 Nile 测试网
+	ApiURL       string   // TronGrid API 地址，默认 https://api.trongrid.io
+	ApiKey       string   // TronGrid API Key
+	Contract     string   // USDT 合约地址，默认为 TRC20 USDT 官方合约
+	Addresses    []string // 收款地址池，每个待支付订单独占一个地址
+	ExchangeRate float64  // 汇率，1 USDT 兑换多少人民币
+	Tolerance    float64  // 允许的支付金额误差（USDT）
+	Interval     int      // 入账查询间隔（秒），默认 30 秒
+	OrderTimeout int      // 订单超时时间（秒），0 表示使用系统配置的超时时间
+	FeeRate      float64  // 支付渠道手续费费率，如 0.006 表示 0.6%
+
+	// 订单结束（支付、取消）之后收款地址的冷却时间（秒），默认 24 小时，冷却期内地址不会分配给新订单，避免迟到的转账记到新订单上
+	AddressCooldown int
 }
 
 type XXLConfig struct { // XXL 任务调度配置
@@ -127,22 +289,47 @@ func (c RedisConfig) Url() string {
 	return fmt.Sprintf("%s:%d", c.Host, c.Port)
 }
 
+// RechargeBonusTier 充值满额赠送算力档位，单笔订单实付金额达到 Amount 元赠送 Power 算力
+type RechargeBonusTier struct {
+	Amount float64 `json:"amount"`
+	Power  int     `json:"power"`
+}
+
 type SystemConfig struct {
-	Title         string `json:"title,omitempty"`           // 网站标题
-	Slogan        string `json:"slogan,omitempty"`          // 网站 slogan
-	AdminTitle    string `json:"admin_title,omitempty"`     // 管理后台标题
-	Logo          string `json:"logo,omitempty"`            // 方形 Logo
-	InitPower     int    `json:"init_power,omitempty"`      // 新用户注册赠送算力值
-	DailyPower    int    `json:"daily_power,omitempty"`     // 每日赠送算力
-	InvitePower   int    `json:"invite_power,omitempty"`    // 邀请新用户赠送算力值
-	VipMonthPower int    `json:"vip_month_power,omitempty"` // VIP 会员每月赠送的算力值
+	Title               string              `json:"title,omitempty"`                 // 网站标题
+	Slogan              string              `json:"slogan,omitempty"`                // 网站 slogan
+	AdminTitle          string              `json:"admin_title,omitempty"`           // 管理后台标题
+	Logo                string              `json:"logo,omitempty"`                  // 方形 Logo
+	InitPower           int                 `json:"init_power,omitempty"`            // 新用户注册赠送算力值
+	DailyPower          int                 `json:"daily_power,omitempty"`           // 每日赠送算力
+	InvitePower         int                 `json:"invite_power,omitempty"`          // 邀请新用户赠送算力值
+	ReferralPower       int                 `json:"referral_power,omitempty"`        // 被邀请用户首次购买成功之后奖励邀请人的算力，0 表示不奖励
+	VipMonthPower       int                 `json:"vip_month_power,omitempty"`       // VIP 会员每月赠送的算力值
+	PowerExpireDays     int                 `json:"power_expire_days,omitempty"`     // 充值算力的有效期（天），0 表示永不过期
+	TransferDailyLimit  int                 `json:"transfer_daily_limit,omitempty"`  // 每个用户每天最多转赠的算力，0 表示不限制
+	TransferMinBalance  int                 `json:"transfer_min_balance,omitempty"`  // 转赠之后转出用户至少保留的算力
+	RechargeBonusTiers  []RechargeBonusTier `json:"recharge_bonus_tiers,omitempty"`  // 充值满额赠送算力档位
+	LowBalanceThreshold int                 `json:"low_balance_threshold,omitempty"` // 算力余额低于该值时提醒用户充值，0 表示不提醒
 
 	RegisterWays    []string `json:"register_ways,omitempty"`    // 注册方式：支持手机（mobile），邮箱注册（email），账号密码注册
 	EnabledRegister bool     `json:"enabled_register,omitempty"` // 是否开放注册
 
-	OrderPayTimeout int    `json:"order_pay_timeout,omitempty"` //订单支付超时时间
-	VipInfoText     string `json:"vip_info_text,omitempty"`     // 会员页面充值说明
-	DefaultModels   []int  `json:"default_models,omitempty"`    // 默认开通的 AI 模型
+	OrderPayTimeout       int     `json:"order_pay_timeout,omitempty"`       //订单支付超时时间
+	VipInfoText           string  `json:"vip_info_text,omitempty"`           // 会员页面充值说明
+	CustomPayMin          float64 `json:"custom_pay_min,omitempty"`          // 自定义金额充值最小金额（元），为 0 表示不开放自定义充值
+	CustomPayMax          float64 `json:"custom_pay_max,omitempty"`          // 自定义金额充值最大金额（元）
+	OrderMinAmount        float64 `json:"order_min_amount,omitempty"`        // 单笔订单最小实付金额，0 表示不限制
+	OrderMaxAmount        float64 `json:"order_max_amount,omitempty"`        // 单笔订单最大实付金额，0 表示不限制
+	SplitPayRatio         float64 `json:"split_pay_ratio,omitempty"`         // 组合支付时算力最多抵扣的订单比例（0 - 1），0 表示不开放组合支付
+	PowerPerYuan          int     `json:"power_per_yuan,omitempty"`          // 自定义金额充值每元兑换的算力
+	UsdtExchangeRate      float64 `json:"usdt_exchange_rate,omitempty"`      // 1 USDT 兑换的人民币，0 表示使用配置文件中的汇率
+	EmailReceiptEnabled   bool    `json:"email_receipt_enabled,omitempty"`   // 支付成功之后是否发送邮件收据
+	OrderRateLimit        int     `json:"order_rate_limit,omitempty"`        // 每个用户每分钟最多创建的待支付订单数，默认 5 个
+	VipExpireNotifyDays   int     `json:"vip_expire_notify_days,omitempty"`  // VIP 会员到期前多少天发送续费提醒邮件，0 表示不提醒
+	InvoiceTaxRate        float64 `json:"invoice_tax_rate,omitempty"`        // 发票税率，如 0.06 表示 6%，订单金额为含税金额，0 表示发票不显示税额
+	CallbackLogDays       int     `json:"callback_log_days,omitempty"`       // 支付回调原始日志保留天数，默认 180 天
+	SubscriptionGraceDays int     `json:"subscription_grace_days,omitempty"` // 自动续费扣款失败之后的宽限天数，宽限期内每天重试，默认 3 天
+	DefaultModels         []int   `json:"default_models,omitempty"`          // 默认开通的 AI 模型
 
 	MjPower       int `json:"mj_power,omitempty"`        // MJ 绘画消耗算力
 	MjActionPower int `json:"mj_action_power,omitempty"` // MJ 操作（放大，变换）消耗算力
@@ -0,0 +1,156 @@
+package types
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"strings"
+)
+
+// 支付通道配置校验，只校验已启用的通道。
+// 异步通知地址和跳转地址为空时会根据当前站点地址自动生成，所以不是必填项
+
+// field 待校验的配置项
+type field struct {
+	name  string
+	empty bool
+}
+
+// requireFields 返回缺失的必填配置项
+func requireFields(fields ...field) error {
+	missing := make([]string, 0)
+	for _, f := range fields {
+		if f.empty {
+			missing = append(missing, f.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (c AlipayConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return requireFields(
+		field{"AppId", c.AppId == ""},
+		field{"PrivateKey", c.PrivateKey == ""},
+		field{"PublicKey", c.PublicKey == ""},
+		field{"AlipayPublicKey", c.AlipayPublicKey == ""},
+		field{"RootCert", c.RootCert == ""},
+	)
+}
+
+func (c WechatPayConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return requireFields(
+		field{"AppId", c.AppId == ""},
+		field{"MchId", c.MchId == ""},
+		field{"SerialNo", c.SerialNo == ""},
+		field{"PrivateKey", c.PrivateKey == ""},
+		field{"ApiV3Key", c.ApiV3Key == ""},
+	)
+}
+
+func (c HuPiPayConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return requireFields(
+		field{"AppId", c.AppId == ""},
+		field{"AppSecret", c.AppSecret == ""},
+		field{"ApiURL", c.ApiURL == ""},
+	)
+}
+
+func (c GeekPayConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return requireFields(
+		field{"AppId", c.AppId == ""},
+		field{"PrivateKey", c.PrivateKey == ""},
+		field{"ApiURL", c.ApiURL == ""},
+		field{"Methods", len(c.Methods) == 0},
+	)
+}
+
+func (c StripeConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return requireFields(
+		field{"SecretKey", c.SecretKey == ""},
+		field{"WebhookSecret", c.WebhookSecret == ""},
+	)
+}
+
+func (c PaypalConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	return requireFields(
+		field{"ClientId", c.ClientId == ""},
+		field{"Secret", c.Secret == ""},
+		field{"WebhookId", c.WebhookId == ""},
+	)
+}
+
+func (c CryptoConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	// 汇率可以在管理后台的系统配置中设置，这里不要求必填
+	return requireFields(
+		field{"Addresses", len(c.Addresses) == 0},
+	)
+}
+
+// 管理后台可以设置的兑换比例范围，防止误操作设置了过大或者过小的值
+const (
+	maxPowerPerYuan     = 100000
+	maxUsdtExchangeRate = 100
+)
+
+// ValidateExchangeRates 校验系统配置中的兑换比例，0 表示未设置
+func (c SystemConfig) ValidateExchangeRates() error {
+	if c.PowerPerYuan < 0 || c.PowerPerYuan > maxPowerPerYuan {
+		return fmt.Errorf("每元兑换的算力必须在 1 - %d 之间", maxPowerPerYuan)
+	}
+	if c.UsdtExchangeRate < 0 || c.UsdtExchangeRate > maxUsdtExchangeRate {
+		return fmt.Errorf("USDT 汇率必须大于 0 并且不能超过 %d", maxUsdtExchangeRate)
+	}
+	return nil
+}
+
+// ValidatePayment 校验所有已启用的支付通道配置，返回每个通道的错误信息
+func (c *AppConfig) ValidatePayment() []error {
+	errs := make([]error, 0)
+	items := []struct {
+		name string
+		err  error
+	}{
+		{"AlipayConfig", c.AlipayConfig.Validate()},
+		{"HuPiPayConfig", c.HuPiPayConfig.Validate()},
+		{"GeekPayConfig", c.GeekPayConfig.Validate()},
+		{"WechatPayConfig", c.WechatPayConfig.Validate()},
+		{"StripeConfig", c.StripeConfig.Validate()},
+		{"PaypalConfig", c.PaypalConfig.Validate()},
+		{"CryptoConfig", c.CryptoConfig.Validate()},
+	}
+	for _, item := range items {
+		if item.err != nil {
+			errs = append(errs, fmt.Errorf("[%s] %v", item.name, item.err))
+		}
+	}
+	return errs
+}
@@ -9,25 +9,142 @@ package types
 
 type OrderStatus int
 
+// DefaultCurrency 默认结算货币，国内的支付渠道只支持人民币结算
+const DefaultCurrency = "CNY"
+
+// Currencies 支持的结算货币，都是两位小数的货币，金额统一按照最小货币单位（分）存储
+var Currencies = []string{"CNY", "USD", "EUR", "GBP", "HKD"}
+
+// RegionPrice 产品在指定国家或地区的价格，按照下单 IP 所在的国家或地区匹配
+type RegionPrice struct {
+	Regions  []string `json:"regions"` // ISO 3166-1 国家或地区代码，如 US, HK
+	Price    float64  `json:"price"`
+	Discount float64  `json:"discount"`
+	Currency string   `json:"currency"`
+}
+
 const (
 	OrderNotPaid     = OrderStatus(0)
 	OrderScanned     = OrderStatus(1) // 已扫码
 	OrderPaidSuccess = OrderStatus(2)
+	OrderCancelled   = OrderStatus(3) // 超时未支付，已取消
+	OrderRefunded    = OrderStatus(4) // 已退款
+	OrderOrphaned    = OrderStatus(5) // 已支付，但是下单用户或者受赠用户已经删除，需要人工处理
 )
 
 type OrderRemark struct {
-	Days     int     `json:"days"`  // 有效期
-	Power    int     `json:"power"` // 增加算力点数
-	Name     string  `json:"name"`  // 产品名称
-	Price    float64 `json:"price"`
-	Discount float64 `json:"discount"`
+	Version        int            `json:"version"`               // 备注版本，参考 OrderRemarkVersion
+	Days           int            `json:"days"`                  // 有效期
+	Power          int            `json:"power"`                 // 增加算力点数
+	Bucket         string         `json:"bucket,omitempty"`      // 算力分组，空字符串表示默认分组
+	Bonus          int            `json:"bonus,omitempty"`       // 充值满额赠送的算力
+	Name           string         `json:"name"`                  // 产品名称
+	Beneficiary    string         `json:"beneficiary,omitempty"` // 受赠用户名
+	Price          float64        `json:"price"`
+	Discount       float64        `json:"discount"`
+	Crypto         *CryptoRemark  `json:"crypto,omitempty"`          // 加密货币支付信息
+	Coupon         *CouponRemark  `json:"coupon,omitempty"`          // 使用的优惠券
+	ManualBy       uint           `json:"manual_by,omitempty"`       // 手动结算订单的管理员 ID
+	ManualAt       int64          `json:"manual_at,omitempty"`       // 手动结算时间
+	Refunds        []RefundRemark `json:"refunds,omitempty"`         // 退款记录，支持多次部分退款
+	Items          []OrderItem    `json:"items,omitempty"`           // 购物车订单的商品明细，Power 和 Days 为全部商品的合计
+	PowerPaid      int            `json:"power_paid,omitempty"`      // 组合支付中使用算力抵扣的部分，支付完成之前处于冻结状态
+	Recurring      bool           `json:"recurring,omitempty"`       // 自动续费订阅的首次订单或者续费订单
+	SubscriptionNo string         `json:"subscription_no,omitempty"` // 续费订单对应的支付渠道订阅 ID
+	DisputePower   int            `json:"dispute_power,omitempty"`   // 交易争议时扣回的算力
+	ReferrerId     uint           `json:"referrer_id,omitempty"`     // 首次购买获得邀请奖励的邀请人
+	ReferralPower  int            `json:"referral_power,omitempty"`  // 奖励给邀请人的算力，订单全额退款时扣回
+
+	// 下单时的链路上下文（W3C traceparent），支付回调和结算的 Span 挂在这条链路下
+	Trace map[string]string `json:"trace,omitempty"`
+}
+
+// OrderItem 购物车订单中的商品
+type OrderItem struct {
+	ProductId uint    `json:"product_id"`
+	Name      string  `json:"name"`
+	Quantity  int     `json:"quantity"`
+	Price     float64 `json:"price"`    // 单价
+	Discount  float64 `json:"discount"` // 单件优惠金额
+	Days      int     `json:"days"`     // 单件会员天数
+	Power     int     `json:"power"`    // 单件算力
+
+	// 商品行号，多件商品的订单对账和部分退款时用来定位商品
+	ItemNo string `json:"item_no,omitempty"`
+}
+
+// RefundRemark 订单退款记录
+type RefundRemark struct {
+	RefundNo string `json:"refund_no"` // 支付渠道退款交易号
+	Amount   int64  `json:"amount"`    // 退款金额（分）
+	Power    int    `json:"power"`     // 扣回的算力
+	RefundBy uint   `json:"refund_by"` // 操作退款的管理员 ID
+	RefundAt int64  `json:"refund_at"` // 退款时间
+	Status   string `json:"status"`    // 退款状态：pending、processing、success、failed，查询渠道之后更新
+
+	// 退回给下单用户的组合支付抵扣算力
+	PowerPaid int `json:"power_paid,omitempty"`
+}
+
+// RefundedCents 已退款金额（分）
+func (r OrderRemark) RefundedCents() int64 {
+	var total int64
+	for _, v := range r.Refunds {
+		total += v.Amount
+	}
+	return total
+}
+
+// RefundedPowerPaid 退款时已经退回的组合支付抵扣算力
+func (r OrderRemark) RefundedPowerPaid() int {
+	var total int
+	for _, v := range r.Refunds {
+		total += v.PowerPaid
+	}
+	return total
+}
+
+// TotalPower 订单发放的全部算力，包含充值满额赠送的算力
+func (r OrderRemark) TotalPower() int {
+	return r.Power + r.Bonus
+}
+
+// RevokedPower 退款和交易争议已扣回的算力
+func (r OrderRemark) RevokedPower() int {
+	total := r.DisputePower
+	for _, v := range r.Refunds {
+		total += v.Power
+	}
+	return total
+}
+
+// CouponRemark 订单使用的优惠券
+type CouponRemark struct {
+	Id       uint   `json:"id"`
+	Code     string `json:"code"`
+	Discount int64  `json:"discount"` // 优惠金额（分）
+}
+
+// CryptoRemark 加密货币支付信息
+type CryptoRemark struct {
+	Address     string   `json:"address"`               // 收款地址
+	Amount      string   `json:"amount"`                // 应付 USDT 数量
+	PaidAmount  string   `json:"paid_amount,omitempty"` // 实际到账 USDT 数量
+	TxHash      string   `json:"tx_hash,omitempty"`     // 用于结算订单的交易哈希，分多笔转账时为最后一笔
+	TxHashes    []string `json:"tx_hashes,omitempty"`   // 计入订单的全部交易哈希
+	Discrepancy string   `json:"discrepancy,omitempty"` // 少付或者多付的金额说明
 }
 
 var PayMethods = map[string]string{
-	"alipay": "支付宝商号",
-	"wechat": "微信商号",
-	"hupi":   "虎皮椒",
-	"geek":   "易支付",
+	"alipay":  "支付宝商号",
+	"wechat":  "微信商号",
+	"hupi":    "虎皮椒",
+	"geek":    "易支付",
+	"stripe":  "Stripe",
+	"paypal":  "PayPal",
+	"crypto":  "加密货币",
+	"balance": "算力余额",
+	"redeem":  "兑换码",
 }
 var PayNames = map[string]string{
 	"alipay": "支付宝",
@@ -36,4 +153,8 @@ var PayNames = map[string]string{
 	"jdpay":  "京东支付",
 	"douyin": "抖音支付",
 	"paypal": "PayPal支付",
+	"card":   "银行卡支付",
+	"usdt":   "USDT(TRC20)",
+	"power":  "算力支付",
+	"code":   "兑换码",
 }
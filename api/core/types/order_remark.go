@@ -0,0 +1,122 @@
+package types
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// OrderRemarkVersion 当前的订单备注版本，修改 OrderRemark 中已有字段的含义时需要升级版本，并在 upgrade 中兼容旧版本。
+// 版本历史：
+//
+//	0: 没有 version 字段，早期版本使用 calls 和 img_calls 记录对话和绘图次数，之后改为 power 记录算力
+//	1: 增加 version 字段
+const OrderRemarkVersion = 1
+
+// orderRemarkJSON 用于序列化，避免 MarshalJSON 和 UnmarshalJSON 递归调用
+type orderRemarkJSON OrderRemark
+
+// MarshalJSON 保存订单备注时总是写入当前版本号
+func (r OrderRemark) MarshalJSON() ([]byte, error) {
+	r.Version = OrderRemarkVersion
+	return json.Marshal(orderRemarkJSON(r))
+}
+
+// UnmarshalJSON 兼容各个历史版本的订单备注，解码之后升级到当前版本。
+// 数量和金额字段同时接受数字和字符串，避免因为个别字段格式不一致导致订单无法结算
+func (r *OrderRemark) UnmarshalJSON(data []byte) error {
+	var v struct {
+		orderRemarkJSON
+		Days     flexInt   `json:"days"`
+		Power    flexInt   `json:"power"`
+		Bonus    flexInt   `json:"bonus"`
+		Price    flexFloat `json:"price"`
+		Discount flexFloat `json:"discount"`
+		Calls    flexInt   `json:"calls"`     // 版本 0：对话次数
+		ImgCalls flexInt   `json:"img_calls"` // 版本 0：绘图次数
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*r = OrderRemark(v.orderRemarkJSON)
+	r.Days = int(v.Days)
+	r.Power = int(v.Power)
+	r.Bonus = int(v.Bonus)
+	r.Price = float64(v.Price)
+	r.Discount = float64(v.Discount)
+	r.upgrade(int(v.Calls), int(v.ImgCalls))
+	return nil
+}
+
+// upgrade 把旧版本的订单备注升级到当前版本
+func (r *OrderRemark) upgrade(calls int, imgCalls int) {
+	if r.Version < 1 && r.Power == 0 {
+		// 次数改为算力之后按照 1 次 1 算力换算，只用于展示和退款时扣回算力
+		r.Power = calls + imgCalls
+	}
+	r.Version = OrderRemarkVersion
+}
+
+// DecodeOrderRemark 解码订单备注，备注为空时返回空的备注
+func DecodeOrderRemark(src string, remark *OrderRemark) error {
+	src = strings.TrimSpace(src)
+	if src == "" || src == "null" {
+		*remark = OrderRemark{Version: OrderRemarkVersion}
+		return nil
+	}
+	return json.Unmarshal([]byte(src), remark)
+}
+
+// flexInt 兼容数字、数字字符串和 null 的整数
+type flexInt int
+
+func (n *flexInt) UnmarshalJSON(data []byte) error {
+	f, err := parseFlexNumber(data)
+	if err != nil {
+		return err
+	}
+	*n = flexInt(f)
+	return nil
+}
+
+// flexFloat 兼容数字、数字字符串和 null 的浮点数
+type flexFloat float64
+
+func (n *flexFloat) UnmarshalJSON(data []byte) error {
+	f, err := parseFlexNumber(data)
+	if err != nil {
+		return err
+	}
+	*n = flexFloat(f)
+	return nil
+}
+
+func parseFlexNumber(data []byte) (float64, error) {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return 0, nil
+	}
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return 0, err
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return 0, nil
+		}
+		return strconv.ParseFloat(s, 64)
+	}
+	var f float64
+	err := json.Unmarshal(data, &f)
+	return f, err
+}
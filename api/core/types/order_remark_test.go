@@ -0,0 +1,113 @@
+package types
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeOrderRemark(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		want    OrderRemark
+		wantErr bool
+	}{
+		{
+			name: "empty",
+			src:  "",
+			want: OrderRemark{Version: OrderRemarkVersion},
+		},
+		{
+			name: "null",
+			src:  " null ",
+			want: OrderRemark{Version: OrderRemarkVersion},
+		},
+		{
+			name: "v0 calls",
+			src:  `{"days":30,"calls":100,"img_calls":20,"name":"月卡","price":19.9,"discount":5}`,
+			want: OrderRemark{Version: OrderRemarkVersion, Days: 30, Power: 120, Name: "月卡", Price: 19.9, Discount: 5},
+		},
+		{
+			name: "v0 power",
+			src:  `{"days":0,"power":500,"name":"充值","price":9.99,"discount":0}`,
+			want: OrderRemark{Version: OrderRemarkVersion, Power: 500, Name: "充值", Price: 9.99},
+		},
+		{
+			name: "v0 power wins over calls",
+			src:  `{"power":500,"calls":100,"name":"充值"}`,
+			want: OrderRemark{Version: OrderRemarkVersion, Power: 500, Name: "充值"},
+		},
+		{
+			name: "string numbers",
+			src:  `{"days":"30","power":" 100 ","bonus":"","price":"19.90","discount":null}`,
+			want: OrderRemark{Version: OrderRemarkVersion, Days: 30, Power: 100, Price: 19.9},
+		},
+		{
+			name: "v1 calls ignored",
+			src:  `{"version":1,"power":0,"calls":100,"name":"会员"}`,
+			want: OrderRemark{Version: OrderRemarkVersion, Name: "会员"},
+		},
+		{
+			name: "v1 items and refunds",
+			src: `{"version":1,"days":60,"power":300,"name":"购物车","price":39.8,"discount":0,` +
+				`"items":[{"product_id":1,"name":"月卡","quantity":2,"price":19.9,"discount":0,"days":30,"power":150}],` +
+				`"refunds":[{"refund_no":"R1","amount":990,"power":50,"refund_by":1,"refund_at":1700000000,"status":"success"}]}`,
+			want: OrderRemark{
+				Version: OrderRemarkVersion, Days: 60, Power: 300, Name: "购物车", Price: 39.8,
+				Items:   []OrderItem{{ProductId: 1, Name: "月卡", Quantity: 2, Price: 19.9, Days: 30, Power: 150}},
+				Refunds: []RefundRemark{{RefundNo: "R1", Amount: 990, Power: 50, RefundBy: 1, RefundAt: 1700000000, Status: "success"}},
+			},
+		},
+		{
+			name:    "invalid number",
+			src:     `{"days":"abc"}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			src:     `{"days":`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got OrderRemark
+			err := DecodeOrderRemark(tt.src, &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeOrderRemark() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("DecodeOrderRemark() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrderRemarkMarshalVersion(t *testing.T) {
+	remark := OrderRemark{Days: 30, Power: 100, Name: "月卡"}
+	data, err := json.Marshal(remark)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		t.Fatal(err)
+	}
+	if raw["version"] != float64(OrderRemarkVersion) {
+		t.Errorf("version = %v, want %d", raw["version"], OrderRemarkVersion)
+	}
+
+	var got OrderRemark
+	if err := DecodeOrderRemark(string(data), &got); err != nil {
+		t.Fatal(err)
+	}
+	remark.Version = OrderRemarkVersion
+	if !reflect.DeepEqual(got, remark) {
+		t.Errorf("round trip = %+v, want %+v", got, remark)
+	}
+}
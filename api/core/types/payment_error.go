@@ -0,0 +1,60 @@
+package types
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// PaymentError 支付接口返回的错误码，通过响应的 error_code 字段返回，客户端根据错误码处理错误，message 只用于展示。
+// 错误码发布之后不能修改含义，只能新增
+type PaymentError string
+
+const (
+	PayErrInvalidArgs          = PaymentError("invalid_args")           // 请求参数错误
+	PayErrNotAuthorized        = PaymentError("not_authorized")         // 未登录，或者不能使用当前用户的余额
+	PayErrProductNotFound      = PaymentError("product_not_found")      // 产品不存在
+	PayErrProductDisabled      = PaymentError("product_disabled")       // 产品已下架
+	PayErrProductNotSupported  = PaymentError("product_not_supported")  // 产品不支持当前购买方式，如余额购买、组合支付和自动续费
+	PayErrCartInvalid          = PaymentError("cart_invalid")           // 购物车商品数量错误，或者商品不能一起结算
+	PayErrPayWayNotSupported   = PaymentError("pay_way_not_supported")  // 支付渠道不存在或者未启用
+	PayErrCurrencyNotSupported = PaymentError("currency_not_supported") // 支付渠道不支持产品的结算货币
+	PayErrCustomPayDisabled    = PaymentError("custom_pay_disabled")    // 未开放自定义金额充值
+	PayErrAmountOutOfRange     = PaymentError("amount_out_of_range")    // 订单金额或者充值金额超出范围
+	PayErrCouponInvalid        = PaymentError("coupon_invalid")         // 优惠券不存在、不适用或者使用次数已达上限
+	PayErrCouponExpired        = PaymentError("coupon_expired")         // 优惠券已过期
+	PayErrInsufficientPower    = PaymentError("insufficient_power")     // 算力余额不足
+	PayErrBeneficiaryNotFound  = PaymentError("beneficiary_not_found")  // 受赠用户不存在
+	PayErrBeneficiaryDisabled  = PaymentError("beneficiary_disabled")   // 受赠用户已被禁用
+	PayErrRedeemCodeInvalid    = PaymentError("redeem_code_invalid")    // 兑换码不存在
+	PayErrRedeemCodeUsed       = PaymentError("redeem_code_used")       // 兑换码已使用
+	PayErrRedeemCodeExpired    = PaymentError("redeem_code_expired")    // 兑换码已过期
+	PayErrOrderNotFound        = PaymentError("order_not_found")        // 订单不存在
+	PayErrOrderNotPaid         = PaymentError("order_not_paid")         // 订单未支付
+	PayErrTooManyOrders        = PaymentError("too_many_orders")        // 待支付订单过多
+	PayErrCaptchaRequired      = PaymentError("captcha_required")       // 需要人机验证或者验证没有通过，data 为验证组件参数
+	PayErrGatewayTimeout       = PaymentError("gateway_timeout")        // 支付渠道响应超时，可以稍后重试
+	PayErrGatewayError         = PaymentError("gateway_error")          // 支付渠道下单失败
+	PayErrInternal             = PaymentError("internal_error")         // 系统内部错误
+)
+
+// 错误码对应的业务状态码，没有列出的错误码使用 Failed，保持和之前返回的 code 一致
+var paymentErrorBizCodes = map[PaymentError]BizCode{
+	PayErrNotAuthorized:       NotAuthorized,
+	PayErrProductNotFound:     NotFound,
+	PayErrBeneficiaryNotFound: NotFound,
+	PayErrRedeemCodeInvalid:   NotFound,
+	PayErrRedeemCodeUsed:      Conflict,
+	PayErrOrderNotFound:       NotFound,
+	PayErrCaptchaRequired:     CaptchaFailed,
+	PayErrGatewayTimeout:      Timeout,
+}
+
+// BizCode 错误码对应的业务状态码
+func (e PaymentError) BizCode() BizCode {
+	if code, ok := paymentErrorBizCodes[e]; ok {
+		return code
+	}
+	return Failed
+}
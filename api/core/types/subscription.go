@@ -0,0 +1,21 @@
+package types
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// SubscriptionStatus 订阅状态：
+// active -> cancelling（取消自动续费）-> cancelled（当前周期结束）
+// cancelling -> active（恢复自动续费）
+// active -> past_due（续费扣款失败）-> active（重试扣款成功）或者 cancelled（超过宽限期）
+type SubscriptionStatus string
+
+const (
+	SubscriptionActive     = SubscriptionStatus("active")     // 正常自动续费
+	SubscriptionCancelling = SubscriptionStatus("cancelling") // 已取消自动续费，当前周期结束之后失效
+	SubscriptionCancelled  = SubscriptionStatus("cancelled")  // 已失效
+	SubscriptionPastDue    = SubscriptionStatus("past_due")   // 续费扣款失败，宽限期内继续尝试扣款
+)
@@ -15,6 +15,8 @@ type BizVo struct {
 	Total    int         `json:"total,omitempty"`
 	Message  string      `json:"message,omitempty"`
 	Data     interface{} `json:"data,omitempty"`
+
+	ErrorCode string `json:"error_code,omitempty"` // 支付接口返回的错误码，参考 PaymentError
 }
 
 // ReplyMessage 对话回复消息结构
@@ -34,13 +36,15 @@ const (
 	MsgTypeErr  = WsMsgType("error")
 	MsgTypePing = WsMsgType("ping") // 心跳消息
 
-	ChPing = WsChannel("ping")
-	ChChat = WsChannel("chat")
-	ChMj   = WsChannel("mj")
-	ChSd   = WsChannel("sd")
-	ChDall = WsChannel("dall")
-	ChSuno = WsChannel("suno")
-	ChLuma = WsChannel("luma")
+	ChPing   = WsChannel("ping")
+	ChChat   = WsChannel("chat")
+	ChMj     = WsChannel("mj")
+	ChSd     = WsChannel("sd")
+	ChDall   = WsChannel("dall")
+	ChSuno   = WsChannel("suno")
+	ChLuma   = WsChannel("luma")
+	ChPay    = WsChannel("payment") // 支付结果通知
+	ChNotice = WsChannel("notice")  // 系统提醒
 )
 
 // InputMessage 对话输入消息结构
@@ -65,6 +69,11 @@ const (
 	Success       = BizCode(0)
 	Failed        = BizCode(1)
 	NotAuthorized = BizCode(401) // 未授权
+	NotFound      = BizCode(404) // 资源不存在
+	Conflict      = BizCode(409) // 资源状态冲突，例如订单已支付，兑换码已使用
+	RateLimited   = BizCode(429) // 请求过于频繁
+	CaptchaFailed = BizCode(428) // 需要人机验证，或者人机验证没有通过
+	Timeout       = BizCode(504) // 上游服务响应超时，可以稍后重试
 
 	OkMsg       = "Success"
 	ErrorMsg    = "系统开小差了"
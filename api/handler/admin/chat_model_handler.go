@@ -42,6 +42,7 @@ func (h *ChatModelHandler) Save(c *gin.Context) {
 		MaxContext  int     `json:"max_context"` // 最大上下文长度
 		Temperature float32 `json:"temperature"` // 模型温度
 		KeyId       int     `json:"key_id,omitempty"`
+		RateLimit   int     `json:"rate_limit"` // 每个用户每分钟最多请求次数
 		CreatedAt   int64   `json:"created_at"`
 	}
 	if err := c.ShouldBindJSON(&data); err != nil {
@@ -65,6 +66,7 @@ func (h *ChatModelHandler) Save(c *gin.Context) {
 	item.MaxContext = data.MaxContext
 	item.Temperature = data.Temperature
 	item.KeyId = data.KeyId
+	item.RateLimit = data.RateLimit
 
 	var res *gorm.DB
 	if data.Id > 0 {
@@ -58,6 +58,13 @@ func (h *ConfigHandler) Update(c *gin.Context) {
 		return
 	}
 
+	if data.Key == "system" {
+		if err := data.Config.ValidateExchangeRates(); err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+	}
+
 	value := utils.JsonEncode(&data.Config)
 	config := model.Config{Key: data.Key, Config: value}
 	res := h.DB.FirstOrCreate(&config, model.Config{Key: data.Key})
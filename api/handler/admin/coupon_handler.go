@@ -0,0 +1,159 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/types"
+	"geekai/handler"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CouponHandler 优惠券管理
+type CouponHandler struct {
+	handler.BaseHandler
+}
+
+func NewCouponHandler(app *core.AppServer, db *gorm.DB) *CouponHandler {
+	return &CouponHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}}
+}
+
+func (h *CouponHandler) List(c *gin.Context) {
+	page := h.GetInt(c, "page", 1)
+	pageSize := h.GetInt(c, "page_size", 20)
+	code := h.GetTrim(c, "code")
+
+	session := h.DB.Session(&gorm.Session{})
+	if code != "" {
+		session = session.Where("code LIKE ?", "%"+code+"%")
+	}
+	var total int64
+	session.Model(&model.Coupon{}).Count(&total)
+	var coupons []model.Coupon
+	offset := (page - 1) * pageSize
+	err := session.Order("id DESC").Offset(offset).Limit(pageSize).Find(&coupons).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	productIds := make([]uint, 0)
+	for _, v := range coupons {
+		productIds = append(productIds, v.ProductId)
+	}
+	var products []model.Product
+	h.DB.Where("id IN ?", productIds).Find(&products)
+	var productMap = make(map[uint]model.Product)
+	for _, p := range products {
+		productMap[p.Id] = p
+	}
+
+	items := make([]vo.Coupon, 0)
+	for _, v := range coupons {
+		var coupon vo.Coupon
+		err = utils.CopyObject(v, &coupon)
+		if err != nil {
+			continue
+		}
+		coupon.Id = v.Id
+		coupon.ProductName = productMap[v.ProductId].Name
+		coupon.CreatedAt = v.CreatedAt.Unix()
+		items = append(items, coupon)
+	}
+	resp.SUCCESS(c, vo.NewPage(total, page, pageSize, items))
+}
+
+// Save 新增或者更新优惠券，优惠码为空时自动生成
+func (h *CouponHandler) Save(c *gin.Context) {
+	var data struct {
+		Id           uint   `json:"id"`
+		Code         string `json:"code"`
+		Type         string `json:"type"`
+		Value        int64  `json:"value"`
+		UsageLimit   int    `json:"usage_limit"`
+		PerUserLimit int    `json:"per_user_limit"`
+		ProductId    uint   `json:"product_id"`
+		ExpiredAt    int64  `json:"expired_at"`
+		Enabled      bool   `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	switch data.Type {
+	case "percent":
+		if data.Value <= 0 || data.Value >= 100 {
+			resp.ERROR(c, "折扣必须在 1-99 之间")
+			return
+		}
+	case "fixed":
+		if data.Value <= 0 {
+			resp.ERROR(c, "立减金额必须大于 0")
+			return
+		}
+	default:
+		resp.ERROR(c, "不支持的优惠类型")
+		return
+	}
+
+	code := strings.ToUpper(strings.TrimSpace(data.Code))
+	if code == "" {
+		var err error
+		code, err = utils.GenRedeemCode(12)
+		if err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+		code = strings.ToUpper(code)
+	}
+
+	var item model.Coupon
+	if data.Id > 0 {
+		err := h.DB.Where("id", data.Id).First(&item).Error
+		if err != nil {
+			resp.ERROR(c, "优惠券不存在")
+			return
+		}
+	} else {
+		item.CreatedAt = time.Now()
+	}
+	item.Code = code
+	item.Type = data.Type
+	item.Value = data.Value
+	item.UsageLimit = data.UsageLimit
+	item.PerUserLimit = data.PerUserLimit
+	item.ProductId = data.ProductId
+	item.ExpiredAt = data.ExpiredAt
+	item.Enabled = data.Enabled
+	err := h.DB.Save(&item).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, item)
+}
+
+func (h *CouponHandler) Remove(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	if id > 0 {
+		err := h.DB.Where("id", id).Delete(&model.Coupon{}).Error
+		if err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+	}
+	resp.SUCCESS(c)
+}
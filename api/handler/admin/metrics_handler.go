@@ -0,0 +1,46 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"crypto/subtle"
+	"geekai/core"
+	"geekai/handler"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gorm.io/gorm"
+)
+
+// MetricsHandler 输出 Prometheus 监控指标。
+// Prometheus 不方便使用后台登录令牌，所以该接口使用配置文件中的 MetricsToken 单独鉴权
+type MetricsHandler struct {
+	handler.BaseHandler
+}
+
+func NewMetricsHandler(app *core.AppServer, db *gorm.DB) *MetricsHandler {
+	return &MetricsHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}}
+}
+
+// Metrics 需要在请求头中携带 Authorization: Bearer <MetricsToken>，没有配置 MetricsToken 时不开放
+func (h *MetricsHandler) Metrics(c *gin.Context) {
+	token := h.App.Config.MetricsToken
+	if token == "" {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	auth := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(token)) != 1 {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	promhttp.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -8,13 +8,20 @@ package admin
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"encoding/csv"
+	"errors"
+	"fmt"
 	"geekai/core"
 	"geekai/core/types"
 	"geekai/handler"
+	"geekai/service"
+	"geekai/service/payment"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
 	"geekai/utils/resp"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -23,15 +30,24 @@ import (
 
 type OrderHandler struct {
 	handler.BaseHandler
+	paymentHandler   *handler.PaymentHandler
+	reconcileService *payment.ReconcileService
+	qrcodeLogo       *service.QrcodeLogoService
 }
 
-func NewOrderHandler(app *core.AppServer, db *gorm.DB) *OrderHandler {
-	return &OrderHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}}
+func NewOrderHandler(app *core.AppServer, db *gorm.DB, paymentHandler *handler.PaymentHandler, reconcileService *payment.ReconcileService, qrcodeLogo *service.QrcodeLogoService) *OrderHandler {
+	return &OrderHandler{
+		BaseHandler:      handler.BaseHandler{App: app, DB: db},
+		paymentHandler:   paymentHandler,
+		reconcileService: reconcileService,
+		qrcodeLogo:       qrcodeLogo,
+	}
 }
 
 func (h *OrderHandler) List(c *gin.Context) {
 	var data struct {
 		OrderNo  string   `json:"order_no"`
+		ClientIP string   `json:"client_ip"`
 		Status   int      `json:"status"`
 		PayTime  []string `json:"pay_time"`
 		Page     int      `json:"page"`
@@ -46,6 +62,9 @@ func (h *OrderHandler) List(c *gin.Context) {
 	if data.OrderNo != "" {
 		session = session.Where("order_no", data.OrderNo)
 	}
+	if data.ClientIP != "" {
+		session = session.Where("client_ip", data.ClientIP)
+	}
 	if len(data.PayTime) == 2 {
 		start := utils.Str2stamp(data.PayTime[0] + " 00:00:00")
 		end := utils.Str2stamp(data.PayTime[1] + " 00:00:00")
@@ -65,19 +84,7 @@ func (h *OrderHandler) List(c *gin.Context) {
 			var order vo.Order
 			err := utils.CopyObject(item, &order)
 			if err == nil {
-				order.Id = item.Id
-				order.CreatedAt = item.CreatedAt.Unix()
-				order.UpdatedAt = item.UpdatedAt.Unix()
-				payMethod, ok := types.PayMethods[item.PayWay]
-				if !ok {
-					payMethod = item.PayWay
-				}
-				payName, ok := types.PayNames[item.PayType]
-				if !ok {
-					payName = item.PayWay
-				}
-				order.PayMethod = payMethod
-				order.PayName = payName
+				fillOrderVo(item, &order)
 				list = append(list, order)
 			} else {
 				logger.Error(err)
@@ -87,6 +94,182 @@ func (h *OrderHandler) List(c *gin.Context) {
 	resp.SUCCESS(c, vo.NewPage(total, data.Page, data.PageSize, list))
 }
 
+// fillOrderVo 补充 CopyObject 无法直接复制的字段
+func fillOrderVo(item model.Order, order *vo.Order) {
+	order.Id = item.Id
+	order.CreatedAt = item.CreatedAt.Unix()
+	order.UpdatedAt = item.UpdatedAt.Unix()
+	payMethod, ok := types.PayMethods[item.PayWay]
+	if !ok {
+		payMethod = item.PayWay
+	}
+	payName, ok := types.PayNames[item.PayType]
+	if !ok {
+		payName = item.PayWay
+	}
+	order.PayMethod = payMethod
+	order.PayName = payName
+}
+
+// Search 客服按照用户名、订单号等条件查询订单，日期范围按照下单时间过滤，格式为 2006-01-02
+func (h *OrderHandler) Search(c *gin.Context) {
+	page := h.GetInt(c, "page", 1)
+	pageSize := h.GetInt(c, "page_size", 20)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	session, err := h.searchSession(c)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	var total int64
+	session.Model(&model.Order{}).Count(&total)
+	var items []model.Order
+	err = session.Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&items).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	list := make([]vo.OrderDetail, 0)
+	for _, item := range items {
+		var order vo.OrderDetail
+		err = utils.CopyObject(item, &order)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		fillOrderVo(item, &order.Order)
+		list = append(list, order)
+	}
+	resp.SUCCESS(c, vo.NewPage(total, page, pageSize, list))
+}
+
+// searchSession 根据查询参数生成订单查询条件，订单查询和导出共用
+func (h *OrderHandler) searchSession(c *gin.Context) (*gorm.DB, error) {
+	username := h.GetTrim(c, "username")
+	orderNo := h.GetTrim(c, "order_no")
+	payWay := h.GetTrim(c, "pay_way")
+	status := h.GetInt(c, "status", -1)
+	startDate := h.GetTrim(c, "start_date")
+	endDate := h.GetTrim(c, "end_date")
+
+	// 过滤条件都使用有索引的字段，用户名和订单号只支持精确匹配
+	session := h.DB.Session(&gorm.Session{})
+	if username != "" {
+		session = session.Where("username", username)
+	}
+	if orderNo != "" {
+		session = session.Where("order_no", orderNo)
+	}
+	if payWay != "" {
+		session = session.Where("pay_way", payWay)
+	}
+	if status >= 0 {
+		session = session.Where("status", status)
+	}
+	if startDate != "" {
+		start, err := time.ParseInLocation("2006-01-02", startDate, time.Local)
+		if err != nil {
+			return nil, errors.New("开始日期格式错误")
+		}
+		session = session.Where("created_at >= ?", start)
+	}
+	if endDate != "" {
+		end, err := time.ParseInLocation("2006-01-02", endDate, time.Local)
+		if err != nil {
+			return nil, errors.New("结束日期格式错误")
+		}
+		session = session.Where("created_at < ?", end.AddDate(0, 0, 1))
+	}
+	return session, nil
+}
+
+// maxExportRows 单次导出的最大订单数量，超出时需要缩小日期范围分批导出
+const maxExportRows = 100000
+
+var orderStatusNames = map[types.OrderStatus]string{
+	types.OrderNotPaid:     "未支付",
+	types.OrderScanned:     "已扫码",
+	types.OrderPaidSuccess: "已支付",
+	types.OrderCancelled:   "已取消",
+	types.OrderRefunded:    "已退款",
+	types.OrderOrphaned:    "用户已删除",
+}
+
+// Export 按照订单查询的条件导出 CSV 文件，逐行读取数据库并写入响应，不会把全部订单加载到内存中
+func (h *OrderHandler) Export(c *gin.Context) {
+	session, err := h.searchSession(c)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	var total int64
+	session.Model(&model.Order{}).Count(&total)
+	if total > maxExportRows {
+		resp.ERROR(c, fmt.Sprintf("导出的订单超过 %d 条，请缩小日期范围分批导出", maxExportRows))
+		return
+	}
+
+	rows, err := session.Model(&model.Order{}).Order("id DESC").Rows()
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("orders-%s.csv", time.Now().Format("20060102150405"))
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	// 写入 UTF-8 BOM，避免 Excel 打开时中文乱码
+	_, _ = c.Writer.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(c.Writer)
+	_ = w.Write([]string{"订单号", "用户ID", "用户名", "产品ID", "产品名称", "金额", "货币", "手续费", "退款金额", "状态", "支付渠道", "支付方式", "交易号", "支付时间", "下单时间"})
+	count := 0
+	for rows.Next() {
+		var item model.Order
+		if err = h.DB.ScanRows(rows, &item); err != nil {
+			logger.Error("error with scan order: ", err)
+			break
+		}
+		payTime := ""
+		if item.PayTime > 0 {
+			payTime = time.Unix(item.PayTime, 0).Format("2006-01-02 15:04:05")
+		}
+		_ = w.Write([]string{
+			item.OrderNo,
+			strconv.Itoa(int(item.UserId)),
+			item.Username,
+			strconv.Itoa(int(item.ProductId)),
+			item.Subject,
+			utils.FormatCents(item.Cents()),
+			item.CurrencyCode(),
+			utils.FormatCents(item.Fee),
+			utils.FormatCents(item.RefundCents),
+			orderStatusNames[item.Status],
+			item.PayWay,
+			item.PayType,
+			item.TradeNo,
+			payTime,
+			item.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+		// 每 500 行刷新一次缓冲区，尽快把数据发送给客户端
+		if count++; count%500 == 0 {
+			w.Flush()
+			c.Writer.Flush()
+		}
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		logger.Error("error with export orders: ", err)
+	}
+}
+
+// Remove 软删除订单，用于清理测试订单，删除之后不计入收入统计，可以通过 Restore 恢复
 func (h *OrderHandler) Remove(c *gin.Context) {
 	id := h.GetInt(c, "id", 0)
 
@@ -98,11 +281,6 @@ func (h *OrderHandler) Remove(c *gin.Context) {
 			return
 		}
 
-		if item.Status == types.OrderPaidSuccess {
-			resp.ERROR(c, "已支付订单不允许删除！")
-			return
-		}
-
 		err := h.DB.Where("id = ?", id).Delete(&model.Order{}).Error
 		if err != nil {
 			resp.ERROR(c, err.Error())
@@ -112,6 +290,21 @@ func (h *OrderHandler) Remove(c *gin.Context) {
 	resp.SUCCESS(c)
 }
 
+// Restore 恢复软删除的订单
+func (h *OrderHandler) Restore(c *gin.Context) {
+	id := h.GetInt(c, "id", 0)
+	res := h.DB.Unscoped().Model(&model.Order{}).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	if res.Error != nil {
+		resp.ERROR(c, res.Error.Error())
+		return
+	}
+	if res.RowsAffected == 0 {
+		resp.ERROR(c, "记录不存在或者未被删除！")
+		return
+	}
+	resp.SUCCESS(c)
+}
+
 func (h *OrderHandler) Clear(c *gin.Context) {
 	var orders []model.Order
 	err := h.DB.Where("status <> ?", 2).Where("pay_time", 0).Find(&orders).Error
@@ -133,3 +326,301 @@ func (h *OrderHandler) Clear(c *gin.Context) {
 	}
 	resp.SUCCESS(c)
 }
+
+// MarkOrderPaid 手动将订单标记为已支付并发放权益，已支付的订单不会重复处理
+func (h *OrderHandler) MarkOrderPaid(c *gin.Context) {
+	var data struct {
+		OrderNo string `json:"order_no"`
+		TradeNo string `json:"trade_no"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.OrderNo == "" {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	var manager model.AdminUser
+	err := h.DB.Where("id", h.GetLoginUserId(c)).First(&manager).Error
+	if err != nil || !manager.Status {
+		resp.NotAuth(c)
+		return
+	}
+
+	err = h.paymentHandler.ManualSettle(c.Request.Context(), data.OrderNo, data.TradeNo, manager.Id)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	logger.Infof("管理员 %s 手动结算订单：%s", manager.Username, data.OrderNo)
+	resp.SUCCESS(c)
+}
+
+// RefundOrder 订单原路退款，同时扣回订单发放的算力，退款金额为空表示全额退款
+func (h *OrderHandler) RefundOrder(c *gin.Context) {
+	var data struct {
+		OrderNo string `json:"order_no"`
+		Amount  string `json:"amount"`
+		Reason  string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.OrderNo == "" {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	var amount int64
+	if data.Amount != "" {
+		cents, err := utils.ParseCents(data.Amount)
+		if err != nil || cents <= 0 {
+			resp.ERROR(c, "退款金额不合法")
+			return
+		}
+		amount = cents
+	}
+
+	var manager model.AdminUser
+	err := h.DB.Where("id", h.GetLoginUserId(c)).First(&manager).Error
+	if err != nil || !manager.Status {
+		resp.NotAuth(c)
+		return
+	}
+
+	err = h.paymentHandler.RefundOrder(data.OrderNo, amount, data.Reason, manager.Id)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	logger.Infof("管理员 %s 退款订单：%s", manager.Username, data.OrderNo)
+	resp.SUCCESS(c)
+}
+
+// RefundStatus 向支付渠道查询订单的退款状态，并更新订单的退款状态
+func (h *OrderHandler) RefundStatus(c *gin.Context) {
+	orderNo := h.GetTrim(c, "order_no")
+	if orderNo == "" {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	state, err := h.paymentHandler.QueryRefund(orderNo)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, gin.H{
+		"order_no": orderNo,
+		"status":   state.Status,
+		"refunded": utils.FormatCents(state.Refunded),
+		"refunds":  state.Refunds,
+	})
+}
+
+// ReconcileReports 对账差异报告
+func (h *OrderHandler) ReconcileReports(c *gin.Context) {
+	page := h.GetInt(c, "page", 1)
+	pageSize := h.GetInt(c, "page_size", 20)
+	batchNo := h.GetTrim(c, "batch_no")
+	gateway := h.GetTrim(c, "gateway")
+	reportType := h.GetTrim(c, "type")
+
+	session := h.DB.Session(&gorm.Session{})
+	if batchNo != "" {
+		session = session.Where("batch_no", batchNo)
+	}
+	if gateway != "" {
+		session = session.Where("gateway", gateway)
+	}
+	if reportType != "" {
+		session = session.Where("type", reportType)
+	}
+	var total int64
+	session.Model(&model.ReconcileReport{}).Count(&total)
+	var items []model.ReconcileReport
+	offset := (page - 1) * pageSize
+	err := session.Order("id DESC").Offset(offset).Limit(pageSize).Find(&items).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	list := make([]vo.ReconcileReport, 0)
+	for _, item := range items {
+		var report vo.ReconcileReport
+		err = utils.CopyObject(item, &report)
+		if err != nil {
+			continue
+		}
+		report.CreatedAt = item.CreatedAt.Unix()
+		list = append(list, report)
+	}
+	resp.SUCCESS(c, vo.NewPage(total, page, pageSize, list))
+}
+
+// Reconcile 手动对账，默认核对最近 24 小时的订单
+func (h *OrderHandler) Reconcile(c *gin.Context) {
+	hours := h.GetInt(c, "hours", 24)
+	if hours <= 0 || hours > 24*7 {
+		resp.ERROR(c, "对账时间范围必须在 1-168 小时之间")
+		return
+	}
+	end := time.Now()
+	reports, err := h.reconcileService.Reconcile(h.paymentHandler.Merchants(), end.Add(-time.Duration(hours)*time.Hour), end)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, gin.H{"counter": len(reports)})
+}
+
+// Health 检测已启用支付渠道的连通性和密钥是否可用，用于监控告警
+func (h *OrderHandler) Health(c *gin.Context) {
+	gateways := h.paymentHandler.Gateways().All()
+	items := make([]gin.H, len(gateways))
+	var wg sync.WaitGroup
+	for i, gateway := range gateways {
+		checker, ok := gateway.(payment.HealthChecker)
+		if !ok {
+			items[i] = gin.H{"name": gateway.Name(), "status": "unknown", "latency": 0, "message": "不支持健康检查"}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, name string, checker payment.HealthChecker) {
+			defer wg.Done()
+			start := time.Now()
+			err := checker.HealthCheck()
+			item := gin.H{"name": name, "status": "up", "latency": time.Since(start).Milliseconds(), "message": "OK"}
+			if err != nil {
+				logger.Errorf("支付渠道 %s 健康检查失败：%v", name, err)
+				item["status"] = "down"
+				item["message"] = err.Error()
+			}
+			items[i] = item
+		}(i, gateway.Name(), checker)
+	}
+	wg.Wait()
+
+	healthy := true
+	for _, item := range items {
+		if item["status"] == "down" {
+			healthy = false
+		}
+	}
+	resp.SUCCESS(c, gin.H{"healthy": healthy, "items": items})
+}
+
+// payTypes 已启用支付渠道的全部支付类型
+func (h *OrderHandler) payTypes() []string {
+	payTypes := make([]string, 0)
+	for _, gateway := range h.paymentHandler.Gateways().All() {
+		for _, payType := range gateway.PayTypes() {
+			if !utils.Contains(payTypes, payType) {
+				payTypes = append(payTypes, payType)
+			}
+		}
+	}
+	return payTypes
+}
+
+// QrcodeLogos 支付类型的二维码 Logo 设置，custom 表示是否上传了自定义 Logo
+func (h *OrderHandler) QrcodeLogos(c *gin.Context) {
+	items := make([]gin.H, 0)
+	for _, payType := range h.payTypes() {
+		items = append(items, gin.H{"pay_type": payType, "custom": h.qrcodeLogo.Custom(payType)})
+	}
+	resp.SUCCESS(c, items)
+}
+
+// UploadQrcodeLogo 上传支付类型的二维码 Logo，替换内置的 Logo
+func (h *OrderHandler) UploadQrcodeLogo(c *gin.Context) {
+	payType := c.PostForm("pay_type")
+	if !utils.Contains(h.payTypes(), payType) {
+		resp.ERROR(c, "不支持的支付类型："+payType)
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	reader, err := file.Open()
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	defer reader.Close()
+	err = h.qrcodeLogo.Save(payType, reader)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// RemoveQrcodeLogo 删除上传的二维码 Logo，恢复使用内置的 Logo
+func (h *OrderHandler) RemoveQrcodeLogo(c *gin.Context) {
+	err := h.qrcodeLogo.Remove(h.GetTrim(c, "pay_type"))
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Stats 营收统计，按照日、周、月、支付渠道和结算货币分组统计订单数量、收入、退款、手续费和净收入
+func (h *OrderHandler) Stats(c *gin.Context) {
+	period := h.GetTrim(c, "period")
+	start, err := time.ParseInLocation("2006-01-02", h.GetTrim(c, "start"), time.Local)
+	if err != nil {
+		start = time.Now().AddDate(0, 0, -30)
+	}
+	end, err := time.ParseInLocation("2006-01-02", h.GetTrim(c, "end"), time.Local)
+	if err != nil {
+		end = time.Now()
+	}
+	end = end.AddDate(0, 0, 1)
+
+	var format string
+	switch period {
+	case "week":
+		format = "%x-%v"
+	case "month":
+		format = "%Y-%m"
+	default:
+		period = "day"
+		format = "%Y-%m-%d"
+	}
+
+	var items []struct {
+		Bucket      string
+		PayWay      string
+		Currency    string
+		Count       int64
+		Revenue     int64
+		RefundCents int64
+		Fee         int64
+	}
+	// 默认不统计软删除的测试订单
+	session := h.DB.Session(&gorm.Session{})
+	if h.GetBool(c, "include_deleted") {
+		session = session.Unscoped()
+	}
+	err = session.Model(&model.Order{}).
+		Select("FROM_UNIXTIME(pay_time, ?) AS bucket, pay_way, currency, COUNT(*) AS count, SUM(amount_cents) AS revenue, SUM(refund_cents) AS refund_cents, SUM(fee) AS fee", format).
+		Where("status IN ? AND pay_time >= ? AND pay_time < ?", []types.OrderStatus{types.OrderPaidSuccess, types.OrderRefunded}, start.Unix(), end.Unix()).
+		Group("bucket, pay_way, currency").Order("bucket ASC, pay_way ASC, currency ASC").
+		Scan(&items).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	list := make([]gin.H, 0, len(items))
+	for _, item := range items {
+		list = append(list, gin.H{
+			"bucket":   item.Bucket,
+			"pay_way":  item.PayWay,
+			"currency": item.Currency,
+			"count":    item.Count,
+			"revenue":  utils.FormatCents(item.Revenue),
+			"refunded": utils.FormatCents(item.RefundCents),
+			"fee":      utils.FormatCents(item.Fee),
+			"net":      utils.FormatCents(item.Revenue - item.Fee - item.RefundCents), // 净收入 = 收入 - 手续费 - 退款
+		})
+	}
+	resp.SUCCESS(c, gin.H{"period": period, "items": list})
+}
@@ -0,0 +1,119 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core"
+	"geekai/core/types"
+	"geekai/handler"
+	"geekai/store/model"
+	"geekai/utils"
+	"geekai/utils/resp"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// PowerCostHandler 统一管理各个模型每次调用消耗的算力。
+// 对话模型的算力保存在模型表中，每次对话都会从数据库读取模型；绘画等任务的算力保存在系统配置中，
+// 修改之后同步更新 AppServer 中缓存的系统配置，两者都不需要重启服务即可生效
+type PowerCostHandler struct {
+	handler.BaseHandler
+}
+
+func NewPowerCostHandler(app *core.AppServer, db *gorm.DB) *PowerCostHandler {
+	return &PowerCostHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}}
+}
+
+type powerCost struct {
+	Type  string `json:"type"` // chat: 对话模型，task: 绘画、音乐、视频等任务
+	Key   string `json:"key"`  // 对话模型 ID 或者任务名称
+	Name  string `json:"name"`
+	Power int    `json:"power"`
+}
+
+// taskPowers 返回任务名称对应的系统配置项
+func taskPowers(config *types.SystemConfig) map[string]*int {
+	return map[string]*int{
+		"mj":        &config.MjPower,
+		"mj_action": &config.MjActionPower,
+		"sd":        &config.SdPower,
+		"dall":      &config.DallPower,
+		"suno":      &config.SunoPower,
+		"luma":      &config.LumaPower,
+	}
+}
+
+var taskNames = []struct{ Key, Name string }{
+	{"mj", "MidJourney 绘画"},
+	{"mj_action", "MidJourney 放大变换"},
+	{"sd", "Stable Diffusion 绘画"},
+	{"dall", "DALL-E-3 绘画"},
+	{"suno", "Suno 音乐"},
+	{"luma", "Luma 视频"},
+}
+
+func (h *PowerCostHandler) List(c *gin.Context) {
+	var chatModels []model.ChatModel
+	err := h.DB.Order("sort_num ASC").Find(&chatModels).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	items := make([]powerCost, 0)
+	for _, m := range chatModels {
+		items = append(items, powerCost{Type: "chat", Key: fmt.Sprintf("%d", m.Id), Name: m.Name, Power: m.Power})
+	}
+	powers := taskPowers(h.App.SysConfig)
+	for _, t := range taskNames {
+		items = append(items, powerCost{Type: "task", Key: t.Key, Name: t.Name, Power: *powers[t.Key]})
+	}
+	resp.SUCCESS(c, items)
+}
+
+func (h *PowerCostHandler) Update(c *gin.Context) {
+	var data powerCost
+	if err := c.ShouldBindJSON(&data); err != nil || data.Power < 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	switch data.Type {
+	case "chat":
+		res := h.DB.Model(&model.ChatModel{}).Where("id", utils.IntValue(data.Key, 0)).UpdateColumn("power", data.Power)
+		if res.Error != nil {
+			resp.ERROR(c, res.Error.Error())
+			return
+		}
+		if res.RowsAffected == 0 {
+			resp.ERROR(c, "模型不存在")
+			return
+		}
+	case "task":
+		config := *h.App.SysConfig
+		power, ok := taskPowers(&config)[data.Key]
+		if !ok {
+			resp.ERROR(c, "不支持的任务类型")
+			return
+		}
+		*power = data.Power
+		err := h.DB.Model(&model.Config{}).Where("marker", "system").UpdateColumn("config_json", utils.JsonEncode(config)).Error
+		if err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+		// 更新系统配置缓存
+		*h.App.SysConfig = config
+	default:
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	resp.SUCCESS(c)
+}
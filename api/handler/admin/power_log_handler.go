@@ -8,9 +8,11 @@ package admin
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"fmt"
 	"geekai/core"
 	"geekai/core/types"
 	"geekai/handler"
+	"geekai/service/power"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
@@ -22,10 +24,11 @@ import (
 
 type PowerLogHandler struct {
 	handler.BaseHandler
+	powerService *power.Service
 }
 
-func NewPowerLogHandler(app *core.AppServer, db *gorm.DB) *PowerLogHandler {
-	return &PowerLogHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}}
+func NewPowerLogHandler(app *core.AppServer, db *gorm.DB, powerService *power.Service) *PowerLogHandler {
+	return &PowerLogHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}, powerService: powerService}
 }
 
 func (h *PowerLogHandler) List(c *gin.Context) {
@@ -82,3 +85,38 @@ func (h *PowerLogHandler) List(c *gin.Context) {
 	}
 	resp.SUCCESS(c, gin.H{"data": vo.NewPage(total, data.Page, data.PageSize, list), "stat": totalPower})
 }
+
+// Refund 手动退回用户算力，related_id 为关联的任务标识，同一个任务只会退回一次
+func (h *PowerLogHandler) Refund(c *gin.Context) {
+	var data struct {
+		UserId    uint   `json:"user_id"`
+		Amount    int    `json:"amount"`
+		Reason    string `json:"reason"`
+		RelatedId string `json:"related_id"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.UserId == 0 || data.Amount <= 0 || data.RelatedId == "" {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	var manager model.AdminUser
+	err := h.DB.Where("id", h.GetLoginUserId(c)).First(&manager).Error
+	if err != nil || !manager.Status {
+		resp.NotAuth(c)
+		return
+	}
+
+	var user model.User
+	if err := h.DB.Where("id", data.UserId).First(&user).Error; err != nil {
+		resp.ERROR(c, "用户不存在")
+		return
+	}
+
+	reason := fmt.Sprintf("管理员退回算力，原因：%s，管理员ID：%d", data.Reason, manager.Id)
+	err = h.powerService.Refund(user.Id, data.Amount, reason, data.RelatedId)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
@@ -17,6 +17,8 @@ import (
 	"geekai/utils/resp"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -30,32 +32,113 @@ func NewProductHandler(app *core.AppServer, db *gorm.DB) *ProductHandler {
 
 func (h *ProductHandler) Save(c *gin.Context) {
 	var data struct {
-		Id        uint    `json:"id"`
-		Name      string  `json:"name"`
-		Price     float64 `json:"price"`
-		Discount  float64 `json:"discount"`
-		Enabled   bool    `json:"enabled"`
-		Days      int     `json:"days"`
-		Power     int     `json:"power"`
-		CreatedAt int64   `json:"created_at"`
+		Id         uint    `json:"id"`
+		Name       string  `json:"name"`
+		Price      float64 `json:"price"`
+		Currency   string  `json:"currency"`
+		Discount   float64 `json:"discount"`
+		Enabled    bool    `json:"enabled"`
+		Days       int     `json:"days"`
+		Power      int     `json:"power"`
+		PowerPrice int     `json:"power_price"`
+		Bucket     string  `json:"bucket"`
+		Recurring  bool    `json:"recurring"`
+		NotifyURL  string  `json:"notify_url"`
+		ReturnURL  string  `json:"return_url"`
+		CreatedAt  int64   `json:"created_at"`
+		// 区域价格，没有匹配到区域价格的用户使用默认价格
+		RegionPrices []types.RegionPrice `json:"region_prices"`
 	}
 	if err := c.ShouldBindJSON(&data); err != nil {
 		resp.ERROR(c, types.InvalidArgs)
 		return
 	}
 
+	currency := strings.ToUpper(strings.TrimSpace(data.Currency))
+	if currency == "" {
+		currency = types.DefaultCurrency
+	}
+	if !utils.Contains(types.Currencies, currency) {
+		resp.ERROR(c, "不支持的结算货币："+currency)
+		return
+	}
+
+	// 售价不能小于等于优惠金额，否则会生成 0 元订单
+	if utils.YuanToCents(data.Price)-utils.YuanToCents(data.Discount) <= 0 {
+		resp.ERROR(c, "商品售价必须大于优惠金额")
+		return
+	}
+
+	if data.Recurring && data.Days <= 0 {
+		resp.ERROR(c, "自动续费的产品必须设置会员天数")
+		return
+	}
+
+	data.NotifyURL = strings.TrimSpace(data.NotifyURL)
+	data.ReturnURL = strings.TrimSpace(data.ReturnURL)
+	for _, u := range []string{data.NotifyURL, data.ReturnURL} {
+		if u != "" && !isHTTPSURL(u) {
+			resp.ERROR(c, "回调地址必须是 https 开头的完整地址："+u)
+			return
+		}
+	}
+
+	regions := make(map[string]bool)
+	for i, price := range data.RegionPrices {
+		if len(price.Regions) == 0 {
+			resp.ERROR(c, "区域价格必须设置国家或地区")
+			return
+		}
+		for j, region := range price.Regions {
+			region = strings.ToUpper(strings.TrimSpace(region))
+			if len(region) != 2 {
+				resp.ERROR(c, "无效的国家或地区代码："+region)
+				return
+			}
+			if regions[region] {
+				resp.ERROR(c, "国家或地区重复设置了区域价格："+region)
+				return
+			}
+			regions[region] = true
+			data.RegionPrices[i].Regions[j] = region
+		}
+		price.Currency = strings.ToUpper(strings.TrimSpace(price.Currency))
+		if price.Currency == "" {
+			price.Currency = currency
+		}
+		if !utils.Contains(types.Currencies, price.Currency) {
+			resp.ERROR(c, "不支持的结算货币："+price.Currency)
+			return
+		}
+		if utils.YuanToCents(price.Price)-utils.YuanToCents(price.Discount) <= 0 {
+			resp.ERROR(c, "区域售价必须大于优惠金额")
+			return
+		}
+		data.RegionPrices[i].Currency = price.Currency
+	}
+
 	item := model.Product{
-		Name:     data.Name,
-		Price:    data.Price,
-		Discount: data.Discount,
-		Days:     data.Days,
-		Power:    data.Power,
-		Enabled:  data.Enabled}
+		Name:       data.Name,
+		Price:      data.Price,
+		Currency:   currency,
+		Discount:   data.Discount,
+		Days:       data.Days,
+		Power:      data.Power,
+		PowerPrice: data.PowerPrice,
+		Bucket:     data.Bucket,
+		Recurring:  data.Recurring,
+		NotifyURL:  data.NotifyURL,
+		ReturnURL:  data.ReturnURL,
+		Enabled:    data.Enabled}
+	if len(data.RegionPrices) > 0 {
+		item.RegionPrices = utils.JsonEncode(data.RegionPrices)
+	}
 	item.Id = data.Id
 	if item.Id > 0 {
 		item.CreatedAt = time.Unix(data.CreatedAt, 0)
 	}
-	err := h.DB.Save(&item).Error
+	// 销量和排序由下单和排序接口维护，编辑产品时不能覆盖
+	err := h.DB.Omit("sales", "sort_num").Save(&item).Error
 	if err != nil {
 		resp.ERROR(c, err.Error())
 		return
@@ -72,6 +155,12 @@ func (h *ProductHandler) Save(c *gin.Context) {
 	resp.SUCCESS(c, itemVo)
 }
 
+// isHTTPSURL 是否为 https 开头的完整地址
+func isHTTPSURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
 // List 数据列表
 func (h *ProductHandler) List(c *gin.Context) {
 	var items []model.Product
@@ -124,14 +213,24 @@ func (h *ProductHandler) Sort(c *gin.Context) {
 		return
 	}
 
-	for index, id := range data.Ids {
-		err := h.DB.Model(&model.Product{}).Where("id", id).Update("sort_num", data.Sorts[index]).Error
-		if err != nil {
-			resp.ERROR(c, err.Error())
-			return
-		}
+	if len(data.Ids) != len(data.Sorts) {
+		resp.ERROR(c, types.InvalidArgs)
+		return
 	}
 
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		for index, id := range data.Ids {
+			err := tx.Model(&model.Product{}).Where("id", id).Update("sort_num", data.Sorts[index]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
 	resp.SUCCESS(c)
 }
 
@@ -0,0 +1,169 @@
+package admin
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"geekai/core"
+	"geekai/core/types"
+	"geekai/handler"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// RedeemCodeHandler 产品兑换码（礼品卡）管理
+type RedeemCodeHandler struct {
+	handler.BaseHandler
+}
+
+func NewRedeemCodeHandler(app *core.AppServer, db *gorm.DB) *RedeemCodeHandler {
+	return &RedeemCodeHandler{BaseHandler: handler.BaseHandler{App: app, DB: db}}
+}
+
+func (h *RedeemCodeHandler) List(c *gin.Context) {
+	page := h.GetInt(c, "page", 1)
+	pageSize := h.GetInt(c, "page_size", 20)
+	code := c.Query("code")
+	batch := c.Query("batch")
+	productId := h.GetInt(c, "product_id", 0)
+	status := h.GetInt(c, "status", -1)
+
+	session := h.DB.Session(&gorm.Session{})
+	if code != "" {
+		session = session.Where("code LIKE ?", "%"+code+"%")
+	}
+	if batch != "" {
+		session = session.Where("batch", batch)
+	}
+	if productId > 0 {
+		session = session.Where("product_id", productId)
+	}
+	if status == 0 {
+		session = session.Where("redeemed_at = ?", 0)
+	} else if status == 1 {
+		session = session.Where("redeemed_at > ?", 0)
+	}
+
+	var total int64
+	session.Model(&model.RedeemCode{}).Count(&total)
+	var codes []model.RedeemCode
+	offset := (page - 1) * pageSize
+	err := session.Order("id DESC").Offset(offset).Limit(pageSize).Find(&codes).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	userIds := make([]uint, 0)
+	productIds := make([]uint, 0)
+	for _, v := range codes {
+		userIds = append(userIds, v.UserId)
+		productIds = append(productIds, v.ProductId)
+	}
+	var users []model.User
+	h.DB.Where("id IN ?", userIds).Find(&users)
+	var userMap = make(map[uint]model.User)
+	for _, u := range users {
+		userMap[u.Id] = u
+	}
+	var products []model.Product
+	h.DB.Where("id IN ?", productIds).Find(&products)
+	var productMap = make(map[uint]model.Product)
+	for _, p := range products {
+		productMap[p.Id] = p
+	}
+
+	var items = make([]vo.RedeemCode, 0)
+	for _, v := range codes {
+		var r vo.RedeemCode
+		err = utils.CopyObject(v, &r)
+		if err != nil {
+			continue
+		}
+
+		r.Id = v.Id
+		r.Username = userMap[v.UserId].Username
+		r.ProductName = productMap[v.ProductId].Name
+		r.CreatedAt = v.CreatedAt.Unix()
+		items = append(items, r)
+	}
+
+	resp.SUCCESS(c, vo.NewPage(total, page, pageSize, items))
+}
+
+// Create 批量生成兑换码
+func (h *RedeemCodeHandler) Create(c *gin.Context) {
+	var data struct {
+		ProductId uint   `json:"product_id"`
+		Batch     string `json:"batch"`
+		Num       int    `json:"num"`
+		ExpiredAt int64  `json:"expired_at"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if data.Num <= 0 || data.Num > 1000 {
+		resp.ERROR(c, "生成数量必须在 1-1000 之间")
+		return
+	}
+
+	var product model.Product
+	err := h.DB.Where("id", data.ProductId).First(&product).Error
+	if err != nil {
+		resp.ERROR(c, "Product not found")
+		return
+	}
+
+	codes := make([]model.RedeemCode, 0, data.Num)
+	for i := 0; i < data.Num; i++ {
+		code, err := utils.GenRedeemCode(32)
+		if err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+		codes = append(codes, model.RedeemCode{
+			ProductId: product.Id,
+			Code:      code,
+			Batch:     data.Batch,
+			ExpiredAt: data.ExpiredAt,
+		})
+	}
+	err = h.DB.CreateInBatches(&codes, 100).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	items := make([]string, 0, len(codes))
+	for _, v := range codes {
+		items = append(items, v.Code)
+	}
+	resp.SUCCESS(c, gin.H{"counter": len(items), "codes": items})
+}
+
+func (h *RedeemCodeHandler) Remove(c *gin.Context) {
+	var data struct {
+		Id uint
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+	if data.Id > 0 {
+		err := h.DB.Where("id", data.Id).Delete(&model.RedeemCode{}).Error
+		if err != nil {
+			resp.ERROR(c, err.Error())
+			return
+		}
+	}
+	resp.SUCCESS(c)
+}
@@ -126,9 +126,16 @@ func (h *UserHandler) Save(c *gin.Context) {
 		if oldPower != user.Power {
 			mark := types.PowerAdd
 			amount := user.Power - oldPower
+			var err error
 			if oldPower > user.Power {
 				mark = types.PowerSub
 				amount = oldPower - user.Power
+				err = service.ConsumePowerGrants(h.DB, user.Id, types.PowerBucketDefault, amount)
+			} else {
+				err = service.AddPowerGrant(h.DB, user.Id, types.PowerGift, amount, 0)
+			}
+			if err != nil {
+				logger.Error("error with update power grants: ", err)
 			}
 			h.DB.Create(&model.PowerLog{
 				UserId:    user.Id,
@@ -177,6 +184,11 @@ func (h *UserHandler) Save(c *gin.Context) {
 			u.Nickname = fmt.Sprintf("极客学长@%d", utils.RandomNumber(6))
 		}
 		res = h.DB.Create(&u)
+		if res.Error == nil {
+			if err := service.AddPowerGrant(h.DB, u.Id, types.PowerGift, u.Power, 0); err != nil {
+				logger.Error("error with create power grant: ", err)
+			}
+		}
 		_ = utils.CopyObject(u, &userVo)
 		userVo.Id = u.Id
 		userVo.CreatedAt = u.CreatedAt.Unix()
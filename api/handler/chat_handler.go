@@ -42,9 +42,10 @@ type ChatHandler struct {
 	ReqCancelFunc  *types.LMap[string, context.CancelFunc] // HttpClient 请求取消 handle function
 	ChatContexts   *types.LMap[string, []types.Message]    // 聊天上下文 Map [chatId] => []Message
 	userService    *service.UserService
+	rateLimiter    *service.RateLimiter
 }
 
-func NewChatHandler(app *core.AppServer, db *gorm.DB, redis *redis.Client, manager *oss.UploaderManager, licenseService *service.LicenseService, userService *service.UserService) *ChatHandler {
+func NewChatHandler(app *core.AppServer, db *gorm.DB, redis *redis.Client, manager *oss.UploaderManager, licenseService *service.LicenseService, userService *service.UserService, rateLimiter *service.RateLimiter) *ChatHandler {
 	return &ChatHandler{
 		BaseHandler:    BaseHandler{App: app, DB: db},
 		redis:          redis,
@@ -53,6 +54,7 @@ func NewChatHandler(app *core.AppServer, db *gorm.DB, redis *redis.Client, manag
 		ReqCancelFunc:  types.NewLMap[string, context.CancelFunc](),
 		ChatContexts:   types.NewLMap[string, []types.Message](),
 		userService:    userService,
+		rateLimiter:    rateLimiter,
 	}
 }
 
@@ -81,14 +83,20 @@ func (h *ChatHandler) sendMessage(ctx context.Context, session *types.ChatSessio
 		return errors.New("您的账号已经被禁用，如果疑问，请联系管理员！")
 	}
 
-	if userVo.Power < session.Model.Power {
-		return fmt.Errorf("您当前剩余算力 %d 已不足以支付当前模型的单次对话需要消耗的算力 %d，[立即购买](/member)。", userVo.Power, session.Model.Power)
+	available := service.AvailablePower(h.DB, userVo.Id, types.PowerBucketChat)
+	if available < session.Model.Power {
+		return fmt.Errorf("您当前剩余算力 %d 已不足以支付当前模型的单次对话需要消耗的算力 %d，[立即购买](/member)。", available, session.Model.Power)
 	}
 
 	if userVo.ExpiredTime > 0 && userVo.ExpiredTime <= time.Now().Unix() {
 		return errors.New("您的账号已经过期，请联系管理员！")
 	}
 
+	// 算力充足也要限制高成本模型的请求频率
+	if !h.rateLimiter.AllowModel(ctx, userVo.Id, session.Model.Value, session.Model.RateLimit) {
+		return fmt.Errorf("当前模型每分钟最多请求 %d 次，请稍后再试！", session.Model.RateLimit)
+	}
+
 	// 检查 prompt 长度是否超过了当前模型允许的最大上下文长度
 	promptTokens, err := utils.CalcTokens(prompt, session.Model.Value)
 	if promptTokens > session.Model.MaxContext {
@@ -385,7 +393,7 @@ func (h *ChatHandler) subUserPower(userVo vo.User, session *types.ChatSession, p
 		power = session.Model.Power
 	}
 
-	err := h.userService.DecreasePower(int(userVo.Id), power, model.PowerLog{
+	err := h.userService.DecreasePower(int(userVo.Id), power, types.PowerBucketChat, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  session.Model.Value,
 		Remark: fmt.Sprintf("模型名称：%s, 提问长度：%d，回复长度：%d", session.Model.Name, promptTokens, replyTokens),
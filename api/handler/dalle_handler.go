@@ -8,7 +8,6 @@ package handler
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
-	"fmt"
 	"geekai/core"
 	"geekai/core/types"
 	"geekai/service"
@@ -49,7 +48,7 @@ func (h *DallJobHandler) preCheck(c *gin.Context) bool {
 		resp.NotAuth(c)
 		return false
 	}
-	if user.Power < h.App.SysConfig.DallPower {
+	if service.AvailablePower(h.DB, user.Id, types.PowerBucketImage) < h.App.SysConfig.DallPower {
 		resp.ERROR(c, "当前用户剩余算力不足以完成本次绘画！")
 		return false
 	}
@@ -188,11 +187,7 @@ func (h *DallJobHandler) Remove(c *gin.Context) {
 
 	// 如果任务未完成，或者任务失败，则恢复用户算力
 	if job.Progress != 100 {
-		err := h.userService.IncreasePower(int(job.UserId), job.Power, model.PowerLog{
-			Type:   types.PowerRefund,
-			Model:  "dall-e-3",
-			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", job.Id, job.ErrMsg),
-		})
+		err := h.dallService.RefundPower(job.Id)
 		if err != nil {
 			tx.Rollback()
 			resp.ERROR(c, err.Error())
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"geekai/core"
 	"geekai/core/types"
+	"geekai/service"
 	"geekai/service/dalle"
 	"geekai/service/oss"
 	"geekai/store/model"
@@ -189,7 +190,7 @@ func (h *FunctionHandler) Dall3(c *gin.Context) {
 		return
 	}
 
-	if user.Power < h.App.SysConfig.DallPower {
+	if service.AvailablePower(h.DB, user.Id, types.PowerBucketImage) < h.App.SysConfig.DallPower {
 		resp.ERROR(c, "创建 DALL-E 绘图任务失败，算力不足")
 		return
 	}
@@ -24,13 +24,15 @@ type MarkMapHandler struct {
 	BaseHandler
 	clients     *types.LMap[int, *types.WsClient]
 	userService *service.UserService
+	rateLimiter *service.RateLimiter
 }
 
-func NewMarkMapHandler(app *core.AppServer, db *gorm.DB, userService *service.UserService) *MarkMapHandler {
+func NewMarkMapHandler(app *core.AppServer, db *gorm.DB, userService *service.UserService, rateLimiter *service.RateLimiter) *MarkMapHandler {
 	return &MarkMapHandler{
 		BaseHandler: BaseHandler{App: app, DB: db},
 		clients:     types.NewLMap[int, *types.WsClient](),
 		userService: userService,
+		rateLimiter: rateLimiter,
 	}
 }
 
@@ -60,8 +62,13 @@ func (h *MarkMapHandler) Generate(c *gin.Context) {
 		return
 	}
 
-	if user.Power < chatModel.Power {
-		resp.ERROR(c, fmt.Sprintf("您当前剩余算力（%d）已不足以支付当前模型算力（%d）！", user.Power, chatModel.Power))
+	available := service.AvailablePower(h.DB, user.Id, types.PowerBucketChat)
+	if available < chatModel.Power {
+		resp.ERROR(c, fmt.Sprintf("您当前剩余算力（%d）已不足以支付当前模型算力（%d）！", available, chatModel.Power))
+		return
+	}
+	if !h.rateLimiter.AllowModel(c, user.Id, chatModel.Value, chatModel.RateLimit) {
+		resp.TooManyRequests(c, fmt.Sprintf("当前模型每分钟最多请求 %d 次，请稍后再试！", chatModel.RateLimit))
 		return
 	}
 
@@ -95,7 +102,7 @@ func (h *MarkMapHandler) Generate(c *gin.Context) {
 
 	// 扣减算力
 	if chatModel.Power > 0 {
-		err = h.userService.DecreasePower(int(userId), chatModel.Power, model.PowerLog{
+		err = h.userService.DecreasePower(int(userId), chatModel.Power, types.PowerBucketChat, model.PowerLog{
 			Type:   types.PowerConsume,
 			Model:  chatModel.Value,
 			Remark: fmt.Sprintf("AI绘制思维导图，模型名称：%s, ", chatModel.Value),
@@ -53,7 +53,7 @@ func (h *MidJourneyHandler) preCheck(c *gin.Context) bool {
 		return false
 	}
 
-	if user.Power < h.App.SysConfig.MjPower {
+	if service.AvailablePower(h.DB, user.Id, types.PowerBucketImage) < h.App.SysConfig.MjPower {
 		resp.ERROR(c, "当前用户剩余算力不足以完成本次绘画！")
 		return false
 	}
@@ -189,7 +189,7 @@ func (h *MidJourneyHandler) Image(c *gin.Context) {
 	})
 
 	// update user's power
-	err = h.userService.DecreasePower(job.UserId, job.Power, model.PowerLog{
+	err = h.userService.DecreasePower(job.UserId, job.Power, types.PowerBucketImage, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  "mid-journey",
 		Remark: fmt.Sprintf("%s操作，任务ID：%s", opt, job.TaskId),
@@ -252,7 +252,7 @@ func (h *MidJourneyHandler) Upscale(c *gin.Context) {
 	})
 
 	// update user's power
-	err := h.userService.DecreasePower(job.UserId, job.Power, model.PowerLog{
+	err := h.userService.DecreasePower(job.UserId, job.Power, types.PowerBucketImage, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  "mid-journey",
 		Remark: fmt.Sprintf("Upscale 操作，任务ID：%s", job.TaskId),
@@ -307,7 +307,7 @@ func (h *MidJourneyHandler) Variation(c *gin.Context) {
 		Mode:        h.App.SysConfig.MjMode,
 	})
 
-	err := h.userService.DecreasePower(job.UserId, job.Power, model.PowerLog{
+	err := h.userService.DecreasePower(job.UserId, job.Power, types.PowerBucketImage, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  "mid-journey",
 		Remark: fmt.Sprintf("Variation 操作，任务ID：%s", job.TaskId),
@@ -411,11 +411,7 @@ func (h *MidJourneyHandler) Remove(c *gin.Context) {
 
 	// 如果任务未完成，或者任务失败，则恢复用户算力
 	if job.Progress != 100 {
-		err := h.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-			Type:   types.PowerRefund,
-			Model:  "mid-journey",
-			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", job.Id, job.ErrMsg),
-		})
+		err := h.mjService.RefundPower(job.Id)
 		if err != nil {
 			tx.Rollback()
 			resp.ERROR(c, err.Error())
@@ -8,32 +8,58 @@ package handler
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"fmt"
 	"geekai/core"
 	"geekai/core/types"
+	"geekai/service"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
 	"geekai/utils/resp"
+	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type OrderHandler struct {
 	BaseHandler
+	statusCache *service.OrderStatusCache
 }
 
-func NewOrderHandler(app *core.AppServer, db *gorm.DB) *OrderHandler {
-	return &OrderHandler{BaseHandler: BaseHandler{App: app, DB: db}}
+func NewOrderHandler(app *core.AppServer, db *gorm.DB, statusCache *service.OrderStatusCache) *OrderHandler {
+	return &OrderHandler{BaseHandler: BaseHandler{App: app, DB: db}, statusCache: statusCache}
 }
 
-// List 订单列表
+// List 当前用户的订单列表，status 默认只查询已支付的订单，传 -1 查询全部订单，
+// start 和 end 为下单日期范围，格式为 2006-01-02
 func (h *OrderHandler) List(c *gin.Context) {
 	page := h.GetInt(c, "page", 1)
 	pageSize := h.GetInt(c, "page_size", 20)
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+	status := h.GetInt(c, "status", int(types.OrderPaidSuccess))
+	start := h.GetTrim(c, "start")
+	end := h.GetTrim(c, "end")
+
 	userId := h.GetLoginUserId(c)
-	session := h.DB.Session(&gorm.Session{}).Where("user_id = ? AND status = ?", userId, types.OrderPaidSuccess)
+	session := h.DB.Session(&gorm.Session{}).Where("user_id = ?", userId)
+	if status >= 0 {
+		session = session.Where("status = ?", status)
+	}
+	if t, err := time.ParseInLocation("2006-01-02", start, time.Local); err == nil {
+		session = session.Where("created_at >= ?", t)
+	}
+	if t, err := time.ParseInLocation("2006-01-02", end, time.Local); err == nil {
+		session = session.Where("created_at < ?", t.AddDate(0, 0, 1))
+	}
 	var total int64
 	session.Model(&model.Order{}).Count(&total)
 	var items []model.Order
@@ -67,32 +93,159 @@ func (h *OrderHandler) List(c *gin.Context) {
 	resp.SUCCESS(c, vo.NewPage(total, page, pageSize, list))
 }
 
-// Query 查询订单状态
+// Query 查询订单状态，订单未支付时最多等待 15 秒，期间状态变化时立即返回
 func (h *OrderHandler) Query(c *gin.Context) {
 	orderNo := h.GetTrim(c, "order_no")
-	var order model.Order
-	res := h.DB.Where("order_no = ?", orderNo).First(&order)
-	if res.Error != nil {
-		resp.ERROR(c, "Order not found")
+	status, err := h.orderStatus(orderNo)
+	if err != nil {
+		resp.PaymentFailed(c, types.PayErrOrderNotFound, "Order not found")
 		return
 	}
 
-	if order.Status == types.OrderPaidSuccess {
-		resp.SUCCESS(c, gin.H{"status": order.Status})
+	if status == types.OrderPaidSuccess {
+		resp.SUCCESS(c, gin.H{"status": status})
 		return
 	}
 
 	counter := 0
 	for {
 		time.Sleep(time.Second)
-		var item model.Order
-		h.DB.Where("order_no = ?", orderNo).First(&item)
-		if counter >= 15 || item.Status == types.OrderPaidSuccess || item.Status != order.Status {
-			order.Status = item.Status
+		current, err := h.orderStatus(orderNo)
+		if err == nil && current != status {
+			status = current
+			break
+		}
+		if counter >= 15 {
 			break
 		}
 		counter++
 	}
 
-	resp.SUCCESS(c, gin.H{"status": order.Status})
+	resp.SUCCESS(c, gin.H{"status": status})
+}
+
+// orderStatus 优先从缓存读取订单状态，缓存不存在时查询数据库
+func (h *OrderHandler) orderStatus(orderNo string) (types.OrderStatus, error) {
+	if cached, ok := h.statusCache.Get(orderNo); ok {
+		return cached.Status, nil
+	}
+	var order model.Order
+	err := h.DB.Select("user_id", "status", "pay_time", "pay_way", "merchant_id").Where("order_no = ?", orderNo).First(&order).Error
+	if err != nil {
+		return 0, err
+	}
+	h.statusCache.Fill(orderNo, service.OrderStatus{UserId: order.UserId, Status: order.Status, PayTime: order.PayTime, PayWay: order.PayWay, MerchantId: order.MerchantId})
+	return order.Status, nil
+}
+
+// Invoice 下载已支付订单的 PDF 发票，只能下载自己的订单
+func (h *OrderHandler) Invoice(c *gin.Context) {
+	orderNo := h.GetTrim(c, "order_no")
+	var order model.Order
+	err := h.DB.Where("order_no = ? AND user_id = ?", orderNo, h.GetLoginUserId(c)).First(&order).Error
+	if err != nil {
+		resp.PaymentFailed(c, types.PayErrOrderNotFound, "Order not found")
+		return
+	}
+	if order.Status != types.OrderPaidSuccess {
+		resp.PaymentFailed(c, types.PayErrOrderNotPaid, "只有已支付的订单才能开具发票")
+		return
+	}
+	if order.Cents() <= 0 {
+		resp.PaymentFailed(c, types.PayErrInvalidArgs, "算力兑换和兑换码订单无需开具发票")
+		return
+	}
+
+	invoice, err := h.createInvoice(order)
+	if err != nil {
+		logger.Error("error with create invoice: ", err)
+		resp.PaymentFailed(c, types.PayErrInternal, "生成发票失败")
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s.pdf", invoice.InvoiceNo))
+	c.Data(http.StatusOK, "application/pdf", h.renderInvoice(invoice, order))
+}
+
+// createInvoice 获取订单的发票，首次开票时生成发票号，通过 order_id 唯一索引保证每个订单只有一张发票
+func (h *OrderHandler) createInvoice(order model.Order) (model.Invoice, error) {
+	var invoice model.Invoice
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		invoice = model.Invoice{OrderId: order.Id, UserId: order.UserId, CreatedAt: time.Now()}
+		res := tx.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&invoice)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected > 0 {
+			invoice.InvoiceNo = fmt.Sprintf("INV%08d", invoice.Id)
+			return tx.Model(&invoice).UpdateColumn("invoice_no", invoice.InvoiceNo).Error
+		}
+		return tx.Where("order_id", order.Id).First(&invoice).Error
+	})
+	return invoice, err
+}
+
+// renderInvoice 生成 PDF 发票，订单金额为含税金额，配置了税率时拆分出税额
+func (h *OrderHandler) renderInvoice(invoice model.Invoice, order model.Order) []byte {
+	var remark types.OrderRemark
+	_ = types.DecodeOrderRemark(order.Remark, &remark)
+	payWay, ok := types.PayMethods[order.PayWay]
+	if !ok {
+		payWay = order.PayWay
+	}
+	buyer := order.Username
+	if remark.Beneficiary != "" {
+		buyer = fmt.Sprintf("%s（为 %s 购买）", order.Username, remark.Beneficiary)
+	}
+	currency := order.CurrencyCode()
+	money := func(cents int64) string {
+		return fmt.Sprintf("%s %s", utils.FormatCents(cents), currency)
+	}
+
+	pdf := utils.NewPdf()
+	pdf.Text(50, 70, 22, "发票 INVOICE")
+	pdf.Text(50, 100, 12, h.App.SysConfig.Title)
+	pdf.Line(50, 115, 545, 115)
+
+	y := 145.0
+	for _, line := range []string{
+		"发票号：" + invoice.InvoiceNo,
+		"开票日期：" + invoice.CreatedAt.Format("2006-01-02"),
+		"订单号：" + order.OrderNo,
+		"支付时间：" + utils.Stamp2str(order.PayTime),
+		"支付方式：" + payWay,
+		"购买用户：" + buyer,
+	} {
+		pdf.Text(50, y, 11, line)
+		y += 22
+	}
+
+	y += 15
+	pdf.Line(50, y, 545, y)
+	pdf.Text(55, y+20, 11, "项目")
+	pdf.Text(330, y+20, 11, "数量")
+	pdf.Text(420, y+20, 11, "金额")
+	pdf.Line(50, y+30, 545, y+30)
+	pdf.Text(55, y+50, 11, order.Subject)
+	pdf.Text(330, y+50, 11, "1")
+	pdf.Text(420, y+50, 11, money(order.Cents()))
+	pdf.Line(50, y+60, 545, y+60)
+
+	y += 90
+	rate := h.App.SysConfig.InvoiceTaxRate
+	if rate > 0 {
+		tax := decimal.NewFromInt(order.Cents()).Mul(decimal.NewFromFloat(rate)).
+			Div(decimal.NewFromFloat(1 + rate)).Round(0).IntPart()
+		pdf.Text(330, y, 11, "不含税金额：")
+		pdf.Text(420, y, 11, money(order.Cents()-tax))
+		pdf.Text(330, y+22, 11, fmt.Sprintf("税额（%s%%）：", decimal.NewFromFloat(rate).Shift(2).String()))
+		pdf.Text(420, y+22, 11, money(tax))
+		y += 44
+	}
+	pdf.Text(330, y, 12, "合计：")
+	pdf.Text(420, y, 12, money(order.Cents()))
+	if order.RefundCents > 0 {
+		pdf.Text(330, y+22, 11, "已退款：")
+		pdf.Text(420, y+22, 11, money(order.RefundCents))
+	}
+	return pdf.Bytes()
 }
@@ -0,0 +1,40 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"geekai/core/types"
+	"geekai/utils/resp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// payError 带错误码的支付错误，可以穿过数据库事务返回给 handler，message 直接展示给用户
+type payError struct {
+	code    types.PaymentError
+	message string
+}
+
+func (e *payError) Error() string {
+	return e.message
+}
+
+func newPayError(code types.PaymentError, message string) error {
+	return &payError{code: code, message: message}
+}
+
+// payFailed 返回支付错误，错误链中有 payError 时使用它的错误码和提示，否则使用 fallback 错误码
+func payFailed(c *gin.Context, err error, fallback types.PaymentError) {
+	var e *payError
+	if errors.As(err, &e) {
+		resp.PaymentFailed(c, e.code, e.message)
+		return
+	}
+	resp.PaymentFailed(c, fallback, err.Error())
+}
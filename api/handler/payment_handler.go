@@ -8,22 +8,45 @@ package handler
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"embed"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"geekai/core"
 	"geekai/core/types"
 	"geekai/service"
+	"geekai/service/event"
+	"geekai/service/geoip"
+	"geekai/service/metrics"
+	"geekai/service/notifier"
 	"geekai/service/payment"
+	"geekai/service/tracing"
+	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
 	"geekai/utils/resp"
 	"github.com/shopspring/decimal"
+	"io"
+	"net"
 	"net/http"
-	"sync"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"sort"
 )
 
 type PayWay struct {
@@ -34,15 +57,25 @@ type PayWay struct {
 // PaymentHandler 支付服务回调 handler
 type PaymentHandler struct {
 	BaseHandler
-	alipayService    *payment.AlipayService
-	huPiPayService   *payment.HuPiPayService
-	geekPayService   *payment.GeekPayService
-	wechatPayService *payment.WechatPayService
-	snowflake        *service.Snowflake
-	userService      *service.UserService
-	fs               embed.FS
-	lock             sync.Mutex
-	signKey          string // 用来签名的随机秘钥
+	gateways      *payment.Registry
+	merchants     *payment.Merchants // 多品牌部署时各个商户的支付渠道
+	cryptoService *payment.CryptoService
+	snowflake     *service.Snowflake
+	userService   *service.UserService
+	wsService     *service.WebsocketService
+	smtpService   *service.SmtpService
+	webhook       *service.WebhookService
+	notifier      *notifier.Service
+	statusCache   *service.OrderStatusCache
+	captcha       *service.OrderCaptchaService
+	qrcodeLogo    *service.QrcodeLogoService
+	geoip         *geoip.Service
+	eventBus      *event.Bus
+	monitor       *payment.CallbackMonitor
+	redis         *redis.Client
+	notifyQueue   *store.ReliableQueue // 已经校验通过的支付回调，由后台任务异步结算
+	signKey       string               // 支付链接的签名秘钥，重启之后保持不变
+	fs            embed.FS
 }
 
 func NewPaymentHandler(
@@ -51,404 +84,3485 @@ func NewPaymentHandler(
 	huPiPayService *payment.HuPiPayService,
 	geekPayService *payment.GeekPayService,
 	wechatPayService *payment.WechatPayService,
+	stripeService *payment.StripeService,
+	paypalService *payment.PaypalService,
+	cryptoService *payment.CryptoService,
 	db *gorm.DB,
 	userService *service.UserService,
 	snowflake *service.Snowflake,
-	fs embed.FS) *PaymentHandler {
+	wsService *service.WebsocketService,
+	smtpService *service.SmtpService,
+	webhook *service.WebhookService,
+	notifier *notifier.Service,
+	statusCache *service.OrderStatusCache,
+	captcha *service.OrderCaptchaService,
+	qrcodeLogo *service.QrcodeLogoService,
+	geoipService *geoip.Service,
+	eventBus *event.Bus,
+	monitor *payment.CallbackMonitor,
+	redisCli *redis.Client,
+	fs embed.FS) (*PaymentHandler, error) {
+	// 注册已启用的支付渠道，注册顺序即为前端支付方式的展示顺序
+	gateways := payment.NewRegistry()
+	if server.Config.AlipayConfig.Enabled {
+		gateways.Register(alipayService)
+	}
+	if server.Config.HuPiPayConfig.Enabled {
+		gateways.Register(huPiPayService)
+	}
+	if server.Config.GeekPayConfig.Enabled {
+		gateways.Register(geekPayService)
+	}
+	if server.Config.WechatPayConfig.Enabled {
+		gateways.Register(wechatPayService)
+	}
+	if server.Config.StripeConfig.Enabled {
+		gateways.Register(stripeService)
+	}
+	if server.Config.PaypalConfig.Enabled {
+		gateways.Register(paypalService)
+	}
+	if server.Config.CryptoConfig.Enabled {
+		gateways.Register(cryptoService)
+	}
+	merchants, err := payment.NewMerchants(gateways, server.Config)
+	if err != nil {
+		return nil, err
+	}
+
 	return &PaymentHandler{
-		alipayService:    alipayService,
-		huPiPayService:   huPiPayService,
-		geekPayService:   geekPayService,
-		wechatPayService: wechatPayService,
-		snowflake:        snowflake,
-		userService:      userService,
-		fs:               fs,
-		lock:             sync.Mutex{},
+		gateways:      gateways,
+		merchants:     merchants,
+		cryptoService: cryptoService,
+		snowflake:     snowflake,
+		userService:   userService,
+		wsService:     wsService,
+		smtpService:   smtpService,
+		webhook:       webhook,
+		notifier:      notifier,
+		statusCache:   statusCache,
+		captcha:       captcha,
+		qrcodeLogo:    qrcodeLogo,
+		geoip:         geoipService,
+		eventBus:      eventBus,
+		monitor:       monitor,
+		redis:         redisCli,
+		notifyQueue:   store.NewReliableQueue("Payment_Notify_Queue", redisCli),
+		signKey:       loadSignKey(server.Config, db),
+		fs:            fs,
 		BaseHandler: BaseHandler{
 			App: server,
 			DB:  db,
 		},
-		signKey: utils.RandString(32),
+	}, nil
+}
+
+// loadSignKey 加载支付链接的签名秘钥，优先使用配置文件，其次使用数据库中保存的秘钥，都没有则生成一个并保存
+// 秘钥必须在重启之后保持不变，否则重启之前生成的支付链接和二维码会全部失效
+func loadSignKey(config *types.AppConfig, db *gorm.DB) string {
+	if config.PaySignKey != "" {
+		return config.PaySignKey
+	}
+
+	var data struct {
+		Key string `json:"key"`
+	}
+	var item model.Config
+	err := db.Where("marker", "payment_sign_key").First(&item).Error
+	if err == nil && utils.JsonDecode(item.Config, &data) == nil && data.Key != "" {
+		return data.Key
 	}
+
+	data.Key = utils.RandString(32)
+	err = db.Create(&model.Config{Key: "payment_sign_key", Config: utils.JsonEncode(data)}).Error
+	if err != nil {
+		// 多个实例同时启动时可能已经被其他实例写入，重新读取一次
+		if db.Where("marker", "payment_sign_key").First(&item).Error == nil && utils.JsonDecode(item.Config, &data) == nil {
+			return data.Key
+		}
+		logger.Error("error with save payment sign key: ", err)
+	}
+	return data.Key
 }
 
 func (h *PaymentHandler) Pay(c *gin.Context) {
 	var data struct {
-		PayWay    string `json:"pay_way"`
-		PayType   string `json:"pay_type"`
-		ProductId int    `json:"product_id"`
-		UserId    int    `json:"user_id"`
-		Device    string `json:"device"`
-		Host      string `json:"host"`
+		PayWay       string `json:"pay_way"`
+		PayType      string `json:"pay_type"`
+		ProductId    int    `json:"product_id"`
+		Device       string `json:"device"`
+		Host         string `json:"host"`
+		OpenId       string `json:"openid"`       // 小程序支付时传入小程序用户的 openid
+		Installments int    `json:"installments"` // 花呗分期期数
+		CouponCode   string `json:"coupon_code"`
+		UsePower     bool   `json:"use_power"` // 组合支付，使用算力余额抵扣部分金额
+		// 为好友购买时填写好友的用户名
+		BeneficiaryUsername string `json:"beneficiary_username"`
 	}
 	if err := c.ShouldBindJSON(&data); err != nil {
-		resp.ERROR(c, types.InvalidArgs)
+		resp.PaymentFailed(c, types.PayErrInvalidArgs, types.InvalidArgs)
 		return
 	}
 
 	var product model.Product
 	err := h.DB.Where("id", data.ProductId).First(&product).Error
 	if err != nil {
-		resp.ERROR(c, "Product not found")
+		resp.PaymentFailed(c, types.PayErrProductNotFound, "Product not found")
 		return
 	}
+	// 已下架的产品不能再下单，已有的自动续费订阅不受影响
+	if !product.Enabled {
+		resp.PaymentFailed(c, types.PayErrProductDisabled, "该产品已下架，请选择其他产品")
+		return
+	}
+	// 按照下单 IP 所在的国家或地区使用区域价格
+	product, region := product.ForRegion(h.geoip.Country(c.ClientIP()))
 
 	orderNo, err := h.snowflake.Next(false)
 	if err != nil {
-		resp.ERROR(c, "error with generate trade no: "+err.Error())
+		resp.PaymentFailed(c, types.PayErrInternal, "error with generate trade no: "+err.Error())
 		return
 	}
-	var user model.User
-	err = h.DB.Where("id", data.UserId).First(&user).Error
+	user, err := h.GetLoginUser(c)
 	if err != nil {
-		resp.NotAuth(c)
+		resp.PaymentFailed(c, types.PayErrNotAuthorized, "Not Authorized")
+		return
+	}
+	beneficiary, err := h.findBeneficiary(data.BeneficiaryUsername, user)
+	if err != nil {
+		payFailed(c, err, types.PayErrInternal)
 		return
 	}
 
-	amount, _ := decimal.NewFromFloat(product.Price).Sub(decimal.NewFromFloat(product.Discount)).Float64()
-	var payURL, returnURL, notifyURL string
-	switch data.PayWay {
-	case "alipay":
-		if h.App.Config.AlipayConfig.NotifyURL != "" { // 用于本地调试支付
-			notifyURL = h.App.Config.AlipayConfig.NotifyURL
-		} else {
-			notifyURL = fmt.Sprintf("%s/api/payment/notify/alipay", data.Host)
-		}
-		if h.App.Config.AlipayConfig.ReturnURL != "" { // 用于本地调试支付
-			returnURL = h.App.Config.AlipayConfig.ReturnURL
-		} else {
-			returnURL = fmt.Sprintf("%s/payReturn", data.Host)
-		}
-		money := fmt.Sprintf("%.2f", amount)
-		if data.Device == "wechat" {
-			payURL, err = h.alipayService.PayMobile(payment.AlipayParams{
-				OutTradeNo: orderNo,
-				Subject:    product.Name,
-				TotalFee:   money,
-				ReturnURL:  returnURL,
-				NotifyURL:  notifyURL,
-			})
-		} else {
-			payURL, err = h.alipayService.PayPC(payment.AlipayParams{
-				OutTradeNo: orderNo,
-				Subject:    product.Name,
-				TotalFee:   money,
-				ReturnURL:  returnURL,
-				NotifyURL:  notifyURL,
-			})
-		}
-
-		if err != nil {
-			resp.ERROR(c, "error with generate pay url: "+err.Error())
+	if data.PayWay == "balance" {
+		h.payWithBalance(c, user, beneficiary, product, orderNo)
+		return
+	}
+	merchantId, gateway, ok := h.gateway(c, data.PayWay)
+	if !ok {
+		resp.PaymentFailed(c, types.PayErrPayWayNotSupported, "不支持的支付渠道")
+		return
+	}
+	currency := product.Currency
+	if currency == "" {
+		currency = types.DefaultCurrency
+	}
+	if !payment.SupportsCurrency(gateway, currency) {
+		resp.PaymentFailed(c, types.PayErrCurrencyNotSupported, fmt.Sprintf("该支付方式不支持 %s 结算，请选择其他支付方式", currency))
+		return
+	}
+	// 自动续费每个周期按照相同的金额扣款，不能使用优惠券和算力抵扣，也不能为好友购买
+	if product.Recurring {
+		// 订阅续费使用默认商户的支付渠道，品牌站点暂不支持自动续费
+		if merchantId != "" {
+			resp.PaymentFailed(c, types.PayErrProductNotSupported, "当前站点暂不支持自动续费产品")
 			return
 		}
-		break
-	case "wechat":
-		if h.App.Config.WechatPayConfig.NotifyURL != "" {
-			notifyURL = h.App.Config.WechatPayConfig.NotifyURL
-		} else {
-			notifyURL = fmt.Sprintf("%s/api/payment/notify/wechat", data.Host)
-		}
-		if data.Device == "wechat" {
-			payURL, err = h.wechatPayService.PayUrlH5(payment.WechatPayParams{
-				OutTradeNo: orderNo,
-				TotalFee:   int(amount * 100),
-				Subject:    product.Name,
-				NotifyURL:  notifyURL,
-				ClientIP:   c.ClientIP(),
-			})
-		} else {
-			payURL, err = h.wechatPayService.PayUrlNative(payment.WechatPayParams{
-				OutTradeNo: orderNo,
-				TotalFee:   int(amount * 100),
-				Subject:    product.Name,
-				NotifyURL:  notifyURL,
-			})
-		}
-		if err != nil {
-			resp.ERROR(c, err.Error())
+		if _, ok := gateway.(payment.Subscriber); !ok {
+			resp.PaymentFailed(c, types.PayErrPayWayNotSupported, "该支付方式不支持自动续费，请选择其他支付方式")
 			return
 		}
-		break
-	case "hupi":
-		if h.App.Config.HuPiPayConfig.NotifyURL != "" {
-			notifyURL = h.App.Config.HuPiPayConfig.NotifyURL
-		} else {
-			notifyURL = fmt.Sprintf("%s/api/payment/notify/hupi", data.Host)
+		if data.CouponCode != "" || data.UsePower || beneficiary != nil {
+			resp.PaymentFailed(c, types.PayErrProductNotSupported, "自动续费产品不支持使用优惠券、算力抵扣或者为好友购买")
+			return
 		}
-		if h.App.Config.HuPiPayConfig.ReturnURL != "" {
-			returnURL = h.App.Config.HuPiPayConfig.ReturnURL
-		} else {
-			returnURL = fmt.Sprintf("%s/payReturn", data.Host)
-		}
-		r, err := h.huPiPayService.Pay(payment.HuPiPayParams{
-			Version:      "1.1",
-			TradeOrderId: orderNo,
-			TotalFee:     fmt.Sprintf("%f", amount),
-			Title:        product.Name,
-			NotifyURL:    notifyURL,
-			ReturnURL:    returnURL,
-			WapName:      "GeekAI助手",
-		})
+	}
+
+	// 创建订单
+	cents := utils.YuanToCents(product.Price) - utils.YuanToCents(product.Discount)
+	remark := types.OrderRemark{
+		Days:      product.Days,
+		Power:     product.Power,
+		Bucket:    product.Bucket,
+		Name:      product.Name,
+		Price:     product.Price,
+		Discount:  product.Discount,
+		Recurring: product.Recurring,
+	}
+	if beneficiary != nil {
+		remark.Beneficiary = beneficiary.Username
+	}
+	if data.CouponCode != "" {
+		coupon, discount, err := h.checkCoupon(data.CouponCode, user.Id, product.Id, cents)
 		if err != nil {
-			resp.ERROR(c, err.Error())
+			payFailed(c, err, types.PayErrCouponInvalid)
 			return
 		}
-		payURL = r.URL
-		break
-	case "geek":
-		if h.App.Config.GeekPayConfig.NotifyURL != "" {
-			notifyURL = h.App.Config.GeekPayConfig.NotifyURL
-		} else {
-			notifyURL = fmt.Sprintf("%s/api/payment/notify/geek", data.Host)
-		}
-		if h.App.Config.GeekPayConfig.ReturnURL != "" {
-			data.Host = utils.GetBaseURL(h.App.Config.GeekPayConfig.ReturnURL)
-		}
-		if data.Device == "wechat" { // 微信客户端打开，调回手机端用户中心页面
-			returnURL = fmt.Sprintf("%s/mobile/profile", data.Host)
-		} else {
-			returnURL = fmt.Sprintf("%s/payReturn", data.Host)
-		}
-		params := payment.GeekPayParams{
-			OutTradeNo: orderNo,
-			Method:     "web",
-			Name:       product.Name,
-			Money:      fmt.Sprintf("%f", amount),
-			ClientIP:   c.ClientIP(),
-			Device:     data.Device,
-			Type:       data.PayType,
-			ReturnURL:  returnURL,
-			NotifyURL:  notifyURL,
-		}
-
-		res, err := h.geekPayService.Pay(params)
+		cents -= discount
+		remark.Coupon = &types.CouponRemark{Id: coupon.Id, Code: coupon.Code, Discount: discount}
+	}
+	if data.UsePower {
+		powerPaid, covered, err := h.splitPower(user, product, cents)
 		if err != nil {
-			resp.ERROR(c, err.Error())
+			payFailed(c, err, types.PayErrInternal)
 			return
 		}
-		payURL = res.PayURL
-	default:
-		resp.ERROR(c, "不支持的支付渠道")
+		remark.PowerPaid = powerPaid
+		cents -= covered
+	}
+	order := model.Order{
+		UserId:      user.Id,
+		Username:    user.Username,
+		ProductId:   product.Id,
+		OrderNo:     orderNo,
+		Subject:     product.Name,
+		Amount:      utils.CentsToYuan(cents),
+		AmountCents: cents,
+		Currency:    currency,
+		Status:      types.OrderNotPaid,
+		PayWay:      data.PayWay,
+		PayType:     data.PayType,
+		Remark:      utils.JsonEncode(remark),
+		MerchantId:  merchantId,
+		Region:      region,
+	}
+	if beneficiary != nil {
+		order.BeneficiaryId = beneficiary.Id
+	}
+	h.submitOrder(c, gateway, order, payment.PayContext{
+		PayType:      data.PayType,
+		Device:       data.Device,
+		Host:         data.Host,
+		ClientIP:     c.ClientIP(),
+		Expire:       h.orderTimeout(data.PayWay),
+		DeepLink:     c.Query("format") == "deeplink",
+		SiteName:     h.App.SysConfig.Title,
+		OpenId:       data.OpenId,
+		Installments: data.Installments,
+		Recurring:    product.Recurring,
+		NotifyURL:    product.NotifyURL,
+		ReturnURL:    product.ReturnURL,
+	})
+}
+
+// customPayRangeMessage 自定义充值金额超出范围的提示，没有配置上限时只提示下限
+func customPayRangeMessage(minAmount float64, maxAmount float64) string {
+	if maxAmount <= 0 {
+		return fmt.Sprintf("充值金额不能小于 %.2f 元", minAmount)
+	}
+	return fmt.Sprintf("充值金额必须在 %.2f - %.2f 元之间", minAmount, maxAmount)
+}
+
+// PayCustom 自定义金额充值算力，按照系统配置的兑换比例计算算力
+func (h *PaymentHandler) PayCustom(c *gin.Context) {
+	var data struct {
+		PayWay       string  `json:"pay_way"`
+		PayType      string  `json:"pay_type"`
+		Amount       float64 `json:"amount"`
+		Device       string  `json:"device"`
+		Host         string  `json:"host"`
+		OpenId       string  `json:"openid"`       // 小程序支付时传入小程序用户的 openid
+		Installments int     `json:"installments"` // 花呗分期期数
+		// 为好友充值时填写好友的用户名
+		BeneficiaryUsername string `json:"beneficiary_username"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.PaymentFailed(c, types.PayErrInvalidArgs, types.InvalidArgs)
 		return
 	}
 
-	// 创建订单
-	remark := types.OrderRemark{
-		Days:     product.Days,
-		Power:    product.Power,
-		Name:     product.Name,
-		Price:    product.Price,
-		Discount: product.Discount,
+	config := h.App.SysConfig
+	if config == nil || config.CustomPayMin <= 0 || config.PowerPerYuan <= 0 {
+		resp.PaymentFailed(c, types.PayErrCustomPayDisabled, "当前未开放自定义金额充值")
+		return
 	}
-	order := model.Order{
-		UserId:    user.Id,
-		Username:  user.Username,
-		ProductId: product.Id,
-		OrderNo:   orderNo,
-		Subject:   product.Name,
-		Amount:    amount,
-		Status:    types.OrderNotPaid,
-		PayWay:    data.PayWay,
-		PayType:   data.PayType,
-		Remark:    utils.JsonEncode(remark),
+	// 金额必须在服务端校验，防止用极小的金额兑换大量算力
+	cents := utils.YuanToCents(data.Amount)
+	if cents < utils.YuanToCents(config.CustomPayMin) || (config.CustomPayMax > 0 && cents > utils.YuanToCents(config.CustomPayMax)) {
+		resp.PaymentFailed(c, types.PayErrAmountOutOfRange, customPayRangeMessage(config.CustomPayMin, config.CustomPayMax))
+		return
 	}
-	err = h.DB.Create(&order).Error
-	if err != nil {
-		resp.ERROR(c, "error with create order: "+err.Error())
+	power := int(cents * int64(config.PowerPerYuan) / 100)
+	if power <= 0 {
+		resp.PaymentFailed(c, types.PayErrAmountOutOfRange, "充值金额过小")
 		return
 	}
-	resp.SUCCESS(c, payURL)
-}
 
-// 异步通知回调公共逻辑
-func (h *PaymentHandler) notify(orderNo string, tradeNo string) error {
-	var order model.Order
-	err := h.DB.Where("order_no = ?", orderNo).First(&order).Error
+	merchantId, gateway, ok := h.gateway(c, data.PayWay)
+	if !ok {
+		resp.PaymentFailed(c, types.PayErrPayWayNotSupported, "不支持的支付渠道")
+		return
+	}
+	// 自定义金额按照人民币兑换算力
+	if !payment.SupportsCurrency(gateway, types.DefaultCurrency) {
+		resp.PaymentFailed(c, types.PayErrCurrencyNotSupported, fmt.Sprintf("该支付方式不支持 %s 结算，请选择其他支付方式", types.DefaultCurrency))
+		return
+	}
+	user, err := h.GetLoginUser(c)
 	if err != nil {
-		return fmt.Errorf("error with fetch order: %v", err)
+		resp.PaymentFailed(c, types.PayErrNotAuthorized, "Not Authorized")
+		return
+	}
+	beneficiary, err := h.findBeneficiary(data.BeneficiaryUsername, user)
+	if err != nil {
+		payFailed(c, err, types.PayErrInternal)
+		return
+	}
+	orderNo, err := h.snowflake.Next(false)
+	if err != nil {
+		resp.PaymentFailed(c, types.PayErrInternal, "error with generate trade no: "+err.Error())
+		return
+	}
+
+	subject := fmt.Sprintf("充值%d算力", power)
+	remark := types.OrderRemark{
+		Power: power,
+		Name:  subject,
+		Price: utils.CentsToYuan(cents),
+	}
+	if beneficiary != nil {
+		remark.Beneficiary = beneficiary.Username
+	}
+	order := model.Order{
+		UserId:      user.Id,
+		Username:    user.Username,
+		OrderNo:     orderNo,
+		Subject:     subject,
+		Amount:      utils.CentsToYuan(cents),
+		AmountCents: cents,
+		Currency:    types.DefaultCurrency,
+		Status:      types.OrderNotPaid,
+		PayWay:      data.PayWay,
+		PayType:     data.PayType,
+		Remark:      utils.JsonEncode(remark),
+		MerchantId:  merchantId,
+	}
+	if beneficiary != nil {
+		order.BeneficiaryId = beneficiary.Id
 	}
+	h.submitOrder(c, gateway, order, payment.PayContext{
+		PayType:      data.PayType,
+		Device:       data.Device,
+		Host:         data.Host,
+		ClientIP:     c.ClientIP(),
+		Expire:       h.orderTimeout(data.PayWay),
+		DeepLink:     c.Query("format") == "deeplink",
+		SiteName:     h.App.SysConfig.Title,
+		OpenId:       data.OpenId,
+		Installments: data.Installments,
+	})
+}
 
-	h.lock.Lock()
-	defer h.lock.Unlock()
+// 购物车的商品种类和单个商品购买数量上限
+const (
+	maxCartItems    = 20
+	maxCartQuantity = 99
+)
 
-	// 已支付订单，直接返回
-	if order.Status == types.OrderPaidSuccess {
-		return nil
+// PayCart 购物车结算，多个商品合并成一个订单支付，算力合计之后一次发放。
+// 合并之后的算力只能发放到一个算力分组，所以购物车中的商品必须属于同一个分组，结算货币也必须相同
+func (h *PaymentHandler) PayCart(c *gin.Context) {
+	var data struct {
+		PayWay  string `json:"pay_way"`
+		PayType string `json:"pay_type"`
+		Items   []struct {
+			ProductId uint `json:"product_id"`
+			Quantity  int  `json:"quantity"`
+		} `json:"items"`
+		Device       string `json:"device"`
+		Host         string `json:"host"`
+		OpenId       string `json:"openid"`       // 小程序支付时传入小程序用户的 openid
+		Installments int    `json:"installments"` // 花呗分期期数
+		// 为好友购买时填写好友的用户名
+		BeneficiaryUsername string `json:"beneficiary_username"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil {
+		resp.PaymentFailed(c, types.PayErrInvalidArgs, types.InvalidArgs)
+		return
+	}
+	if len(data.Items) == 0 || len(data.Items) > maxCartItems {
+		resp.PaymentFailed(c, types.PayErrCartInvalid, fmt.Sprintf("购物车商品种类必须在 1 - %d 之间", maxCartItems))
+		return
 	}
 
-	var user model.User
-	err = h.DB.First(&user, order.UserId).Error
+	// 合并相同的商品，保持加入购物车的顺序
+	quantities := make(map[uint]int)
+	productIds := make([]uint, 0)
+	for _, item := range data.Items {
+		if item.Quantity <= 0 {
+			resp.PaymentFailed(c, types.PayErrCartInvalid, "商品数量必须大于 0")
+			return
+		}
+		if _, ok := quantities[item.ProductId]; !ok {
+			productIds = append(productIds, item.ProductId)
+		}
+		quantities[item.ProductId] += item.Quantity
+		if quantities[item.ProductId] > maxCartQuantity {
+			resp.PaymentFailed(c, types.PayErrCartInvalid, fmt.Sprintf("单个商品最多购买 %d 件", maxCartQuantity))
+			return
+		}
+	}
+	var products []model.Product
+	err := h.DB.Where("id IN ?", productIds).Find(&products).Error
 	if err != nil {
-		return fmt.Errorf("error with fetch user info: %v", err)
+		resp.PaymentFailed(c, types.PayErrInternal, err.Error())
+		return
+	}
+	productMap := make(map[uint]model.Product)
+	for _, product := range products {
+		productMap[product.Id] = product
 	}
 
 	var remark types.OrderRemark
-	err = utils.JsonDecode(order.Remark, &remark)
-	if err != nil {
-		return fmt.Errorf("error with decode order remark: %v", err)
+	var cents int64
+	var currency, region string
+	var first model.Product
+	country := h.geoip.Country(c.ClientIP())
+	for i, id := range productIds {
+		product, ok := productMap[id]
+		if !ok {
+			resp.PaymentFailed(c, types.PayErrProductNotFound, fmt.Sprintf("商品 %d 不存在或者已下架", id))
+			return
+		}
+		if !product.Enabled {
+			resp.PaymentFailed(c, types.PayErrProductDisabled, fmt.Sprintf("商品 %d 不存在或者已下架", id))
+			return
+		}
+		product, matched := product.ForRegion(country)
+		if matched != "" {
+			region = matched
+		}
+		if i == 0 {
+			first = product
+			remark.Bucket = product.Bucket
+			remark.Name = product.Name
+			currency = product.CurrencyCode()
+		} else if product.Bucket != remark.Bucket {
+			resp.PaymentFailed(c, types.PayErrCartInvalid, "不同算力分组的商品不能一起结算")
+			return
+		} else if product.CurrencyCode() != currency {
+			resp.PaymentFailed(c, types.PayErrCartInvalid, "不同结算货币的商品不能一起结算")
+			return
+		} else if product.NotifyURL != first.NotifyURL || product.ReturnURL != first.ReturnURL {
+			resp.PaymentFailed(c, types.PayErrCartInvalid, "设置了不同回调地址的商品不能一起结算")
+			return
+		}
+		quantity := quantities[id]
+		cents += (utils.YuanToCents(product.Price) - utils.YuanToCents(product.Discount)) * int64(quantity)
+		remark.Power += product.Power * quantity
+		remark.Days += product.Days * quantity
+		remark.Items = append(remark.Items, types.OrderItem{
+			ProductId: product.Id,
+			Name:      product.Name,
+			Quantity:  quantity,
+			Price:     product.Price,
+			Discount:  product.Discount,
+			Days:      product.Days,
+			Power:     product.Power,
+		})
+	}
+	remark.Price = utils.CentsToYuan(cents)
+	subject := fmt.Sprintf("%s x%d", remark.Name, quantities[productIds[0]])
+	if len(productIds) > 1 {
+		subject = fmt.Sprintf("%s 等 %d 件商品", remark.Name, len(productIds))
 	}
+	remark.Name = subject
 
-	// 增加用户算力
-	err = h.userService.IncreasePower(int(order.UserId), remark.Power, model.PowerLog{
-		Type:   types.PowerRecharge,
-		Model:  order.PayWay,
-		Remark: fmt.Sprintf("充值算力，金额：%f，订单号：%s", order.Amount, order.OrderNo),
-	})
+	merchantId, gateway, ok := h.gateway(c, data.PayWay)
+	if !ok {
+		resp.PaymentFailed(c, types.PayErrPayWayNotSupported, "不支持的支付渠道")
+		return
+	}
+	if !payment.SupportsCurrency(gateway, currency) {
+		resp.PaymentFailed(c, types.PayErrCurrencyNotSupported, fmt.Sprintf("该支付方式不支持 %s 结算，请选择其他支付方式", currency))
+		return
+	}
+	user, err := h.GetLoginUser(c)
 	if err != nil {
-		return err
+		resp.PaymentFailed(c, types.PayErrNotAuthorized, "Not Authorized")
+		return
 	}
-
-	// 更新订单状态
-	order.PayTime = time.Now().Unix()
-	order.Status = types.OrderPaidSuccess
-	order.TradeNo = tradeNo
-	err = h.DB.Updates(&order).Error
+	beneficiary, err := h.findBeneficiary(data.BeneficiaryUsername, user)
 	if err != nil {
-		return fmt.Errorf("error with update order info: %v", err)
+		payFailed(c, err, types.PayErrInternal)
+		return
 	}
-
-	// 更新产品销量
-	err = h.DB.Model(&model.Product{}).Where("id = ?", order.ProductId).
-		UpdateColumn("sales", gorm.Expr("sales + ?", 1)).Error
+	if beneficiary != nil {
+		remark.Beneficiary = beneficiary.Username
+	}
+	// 订单号和每个商品的行号一次生成
+	ids, err := h.snowflake.NextBatch(len(remark.Items)+1, false)
 	if err != nil {
-		return fmt.Errorf("error with update product sales: %v", err)
+		resp.PaymentFailed(c, types.PayErrInternal, "error with generate trade no: "+err.Error())
+		return
+	}
+	orderNo := ids[0]
+	for i := range remark.Items {
+		remark.Items[i].ItemNo = ids[i+1]
 	}
 
-	return nil
+	order := model.Order{
+		UserId:      user.Id,
+		Username:    user.Username,
+		OrderNo:     orderNo,
+		Subject:     subject,
+		Amount:      utils.CentsToYuan(cents),
+		AmountCents: cents,
+		Currency:    currency,
+		Status:      types.OrderNotPaid,
+		PayWay:      data.PayWay,
+		PayType:     data.PayType,
+		Remark:      utils.JsonEncode(remark),
+		MerchantId:  merchantId,
+		Region:      region,
+	}
+	if beneficiary != nil {
+		order.BeneficiaryId = beneficiary.Id
+	}
+	// 订单总金额的上下限在 submitOrder 中统一校验
+	h.submitOrder(c, gateway, order, payment.PayContext{
+		PayType:      data.PayType,
+		Device:       data.Device,
+		Host:         data.Host,
+		ClientIP:     c.ClientIP(),
+		Expire:       h.orderTimeout(data.PayWay),
+		DeepLink:     c.Query("format") == "deeplink",
+		SiteName:     h.App.SysConfig.Title,
+		OpenId:       data.OpenId,
+		Installments: data.Installments,
+		NotifyURL:    first.NotifyURL,
+		ReturnURL:    first.ReturnURL,
+	})
 }
 
-// GetPayWays 获取支付方式
-func (h *PaymentHandler) GetPayWays(c *gin.Context) {
-	payWays := make([]gin.H, 0)
-	if h.App.Config.AlipayConfig.Enabled {
-		payWays = append(payWays, gin.H{"pay_way": "alipay", "pay_type": "alipay"})
+// Gateways 已启用的支付渠道
+func (h *PaymentHandler) Gateways() *payment.Registry {
+	return h.gateways
+}
+
+// Merchants 多品牌部署时各个商户的支付渠道
+func (h *PaymentHandler) Merchants() *payment.Merchants {
+	return h.merchants
+}
+
+// gateway 按照请求的域名匹配商户，返回商户 ID 和商户的支付渠道
+func (h *PaymentHandler) gateway(c *gin.Context, payWay string) (string, payment.PaymentGateway, bool) {
+	merchantId, gateways := h.merchants.Resolve(c.Request.Host)
+	gateway, ok := gateways.Get(payWay)
+	return merchantId, gateway, ok
+}
+
+// orderGateway 订单所属商户的支付渠道
+func (h *PaymentHandler) orderGateway(order model.Order) (payment.PaymentGateway, bool) {
+	return h.merchants.Registry(order.MerchantId).Get(order.PayWay)
+}
+
+// userAgent 下单客户端的 User-Agent，超长的部分截断
+func userAgent(c *gin.Context) string {
+	ua := c.Request.UserAgent()
+	if len(ua) > 255 {
+		ua = ua[:255]
 	}
-	if h.App.Config.HuPiPayConfig.Enabled {
-		payWays = append(payWays, gin.H{"pay_way": "hupi", "pay_type": "wxpay"})
+	return ua
+}
+
+// allowOrder 限制每个用户每分钟创建的待支付订单数量，防止前端异常时大量创建订单
+func (h *PaymentHandler) allowOrder(c *gin.Context, userId uint) bool {
+	limit := 5
+	if h.App.SysConfig != nil && h.App.SysConfig.OrderRateLimit > 0 {
+		limit = h.App.SysConfig.OrderRateLimit
 	}
-	if h.App.Config.GeekPayConfig.Enabled {
-		for _, v := range h.App.Config.GeekPayConfig.Methods {
-			payWays = append(payWays, gin.H{"pay_way": "geek", "pay_type": v})
-		}
+	key := fmt.Sprintf("order_rate_limit/%d", userId)
+	count, err := h.redis.Incr(c, key).Result()
+	if err != nil {
+		logger.Error("error with increase order counter: ", err)
+		return true
 	}
-	if h.App.Config.WechatPayConfig.Enabled {
-		payWays = append(payWays, gin.H{"pay_way": "wechat", "pay_type": "wxpay"})
+	if count == 1 {
+		h.redis.Expire(c, key, time.Minute)
 	}
-	resp.SUCCESS(c, payWays)
+	return count <= int64(limit)
 }
 
-// HuPiPayNotify 虎皮椒支付异步回调
-func (h *PaymentHandler) HuPiPayNotify(c *gin.Context) {
-	err := c.Request.ParseForm()
-	if err != nil {
-		c.String(http.StatusOK, "fail")
-		return
+// checkOrderAmount 校验订单实付金额，防止商品配置错误或者金额被篡改时把 0 元或者异常金额的订单提交给支付渠道。
+// 金额上下限按照订单货币的主单位（如元、美元）比较
+func (h *PaymentHandler) checkOrderAmount(order model.Order) error {
+	cents := order.Cents()
+	if cents <= 0 {
+		return newPayError(types.PayErrAmountOutOfRange, "订单金额必须大于 0")
+	}
+	config := h.App.SysConfig
+	if config == nil {
+		return nil
+	}
+	if config.OrderMinAmount > 0 && cents < utils.YuanToCents(config.OrderMinAmount) {
+		return newPayError(types.PayErrAmountOutOfRange, fmt.Sprintf("订单金额不能小于 %.2f", config.OrderMinAmount))
+	}
+	if config.OrderMaxAmount > 0 && cents > utils.YuanToCents(config.OrderMaxAmount) {
+		return newPayError(types.PayErrAmountOutOfRange, fmt.Sprintf("订单金额不能大于 %.2f", config.OrderMaxAmount))
 	}
+	return nil
+}
 
-	orderNo := c.Request.Form.Get("trade_order_id")
-	tradeNo := c.Request.Form.Get("open_order_id")
-	logger.Infof("收到虎皮椒订单支付回调，%+v", c.Request.Form)
+// 二维码图片的默认尺寸和前端可以指定的尺寸范围（像素）
+const (
+	defaultQrcodeSize = 400
+	minQrcodeSize     = 200
+	maxQrcodeSize     = 800
+)
 
-	if err = h.huPiPayService.Check(orderNo); err != nil {
-		logger.Error("订单校验失败：", err)
-		c.String(http.StatusOK, "fail")
-		return
+// qrcodeSize 前端通过 size 参数指定二维码尺寸，超出范围时取边界值，没有指定时使用默认尺寸
+func qrcodeSize(c *gin.Context) int {
+	size, err := strconv.Atoi(c.Query("size"))
+	if err != nil || size <= 0 {
+		return defaultQrcodeSize
 	}
+	return max(minQrcodeSize, min(size, maxQrcodeSize))
+}
 
-	err = h.notify(orderNo, tradeNo)
-	if err != nil {
-		logger.Error(err)
-		c.String(http.StatusOK, "fail")
+// submitOrder 调用支付渠道下单并保存订单，返回支付地址给前端
+func (h *PaymentHandler) submitOrder(c *gin.Context, gateway payment.PaymentGateway, order model.Order, ctx payment.PayContext) {
+	spanCtx, span := tracing.Start(c.Request.Context(), "payment.submitOrder", trace.WithAttributes(
+		tracing.OrderNo.String(order.OrderNo), tracing.Gateway.String(gateway.Name()), tracing.PayType.String(ctx.PayType)))
+	defer span.End()
+	if err := h.checkOrderAmount(order); err != nil {
+		payFailed(c, err, types.PayErrAmountOutOfRange)
 		return
 	}
+	timeoutCtx, cancel := context.WithTimeout(spanCtx, h.payTimeout())
+	defer cancel()
+	ctx.Context = timeoutCtx
+	ctx.MerchantId = order.MerchantId
+	if h.App.SysConfig != nil {
+		ctx.ExchangeRate = h.App.SysConfig.UsdtExchangeRate
+	}
+	// 小程序支付使用前端传入的小程序 openid，在微信内打开时使用用户通过微信登录时绑定的 openid 发起 JSAPI 支付
+	if ctx.PayType != payment.PayTypeWxMini {
+		ctx.OpenId = ""
+		var user model.User
+		if ctx.Device == "wechat" && h.DB.Select("openid").Where("id", order.UserId).First(&user).Error == nil {
+			ctx.OpenId = user.OpenId
+		}
+	}
+	// 重复点击支付时复用有效期内的待支付订单，避免同时存在多个待支付订单
+	if pending, ok := h.findPendingOrder(order); ok {
+		payURL, qrcode, err := h.resumeOrder(gateway, &pending, ctx, qrcodeSize(c))
+		if err == nil {
+			// 复用的订单沿用创建时记录的链路，支付回调挂在原来的链路下
+			span.SetAttributes(tracing.OrderNo.String(pending.OrderNo), tracing.Outcome.String("resumed"))
+			h.payResponse(c, gateway, pending, payURL, qrcode, ctx)
+			return
+		}
+		logger.Errorf("error with resume order %s: %v", pending.OrderNo, err)
+	}
 
-	c.String(http.StatusOK, "success")
-}
-
-// AlipayNotify 支付宝支付回调
-func (h *PaymentHandler) AlipayNotify(c *gin.Context) {
-	err := c.Request.ParseForm()
-	if err != nil {
-		c.String(http.StatusOK, "fail")
+	if !h.allowOrder(c, order.UserId) {
+		resp.PaymentFailed(c, types.PayErrTooManyOrders, "待支付订单过多，请稍后再试")
 		return
 	}
-
-	result := h.alipayService.TradeVerify(c.Request)
-	logger.Infof("收到支付宝商号订单支付回调：%+v", result)
-	if !result.Success() {
-		logger.Error("订单校验失败：", result.Message)
-		c.String(http.StatusOK, "fail")
+	// 复用待支付订单不需要验证，只有创建新订单时才按照 IP 的下单频率要求人机验证
+	if h.captcha.Required(c, ctx.ClientIP) {
+		if err := h.captcha.Verify(c.GetHeader("X-Captcha-Token"), ctx.ClientIP); err != nil {
+			resp.PaymentFailed(c, types.PayErrCaptchaRequired, err.Error(), h.captcha.Params())
+			return
+		}
+	}
+	order.ClientIP = ctx.ClientIP
+	order.UserAgent = userAgent(c)
+	payURL, err := h.gatewayPay(gateway, &order, ctx)
+	if err != nil {
+		tracing.Fail(span, err)
+	}
+	if errors.Is(err, payment.ErrGatewayTimeout) {
+		logger.Errorf("%s 下单超时，订单号：%s，错误：%v", gateway.Name(), order.OrderNo, err)
+		resp.PaymentFailed(c, types.PayErrGatewayTimeout, payment.ErrGatewayTimeout.Error())
 		return
 	}
-
-	tradeNo := c.Request.Form.Get("trade_no")
-	err = h.notify(result.OutTradeNo, tradeNo)
 	if err != nil {
-		logger.Error(err)
-		c.String(http.StatusOK, "fail")
+		resp.PaymentFailed(c, types.PayErrGatewayError, err.Error())
 		return
 	}
 
-	c.String(http.StatusOK, "success")
-}
+	// 加密货币支付没有收银台页面，直接返回收款地址和二维码给前端展示
+	// 二维码必须在创建订单之前生成，避免生成失败之后留下无效的待支付订单
+	var remark types.OrderRemark
+	remarkErr := types.DecodeOrderRemark(order.Remark, &remark)
+	var qrcode []byte
+	if remark.Crypto != nil {
+		qrcode, err = utils.GenQrcode(payURL, qrcodeSize(c), h.qrcodeLogo.Logo(order.PayType))
+		if err != nil {
+			h.cryptoService.Release(remark.Crypto.Address)
+			resp.PaymentFailed(c, types.PayErrInternal, "error with generate qrcode: "+err.Error())
+			return
+		}
+	}
 
-// GeekPayNotify 支付异步回调
-func (h *PaymentHandler) GeekPayNotify(c *gin.Context) {
-	var params = make(map[string]string)
-	for k := range c.Request.URL.Query() {
-		params[k] = c.Query(k)
+	// 记录下单的链路，支付回调和结算挂在这条链路下，同一个订单的支付过程在一条链路中
+	if carrier := tracing.Inject(spanCtx); carrier != nil && remarkErr == nil {
+		remark.Trace = carrier
+		order.Remark = utils.JsonEncode(remark)
 	}
 
-	logger.Infof("收到GeekPay订单支付回调：%+v", params)
-	// 检查支付状态
-	if params["trade_status"] != "TRADE_SUCCESS" {
-		c.String(http.StatusOK, "success")
+	// 优惠券的使用次数和冻结的算力和订单在同一个事务中写入，避免并发下单超出使用限制
+	err = h.DB.WithContext(spanCtx).Transaction(func(tx *gorm.DB) error {
+		if remark.Coupon != nil {
+			if err := h.useCoupon(tx, remark.Coupon.Id, order); err != nil {
+				return err
+			}
+		}
+		if remark.PowerPaid > 0 {
+			if err := h.holdPower(tx, order, remark.PowerPaid); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&order).Error
+	})
+	if err != nil {
+		if remark.Crypto != nil {
+			h.cryptoService.Release(remark.Crypto.Address)
+		}
+		tracing.Fail(span, err)
+		payFailed(c, fmt.Errorf("error with create order: %w", err), types.PayErrInternal)
 		return
 	}
+	span.SetAttributes(tracing.Outcome.String("created"))
+	metrics.OrdersCreated.WithLabelValues(order.PayWay).Inc()
+	h.payResponse(c, gateway, order, payURL, qrcode, ctx)
+}
 
-	sign := h.geekPayService.Sign(params)
-	if sign != c.Query("sign") {
-		logger.Errorf("签名验证失败, %s, %s", sign, c.Query("sign"))
-		c.String(http.StatusOK, "fail")
-		return
+// findPendingOrder 查找有效期内相同用户、产品、支付方式和金额的待支付订单
+func (h *PaymentHandler) findPendingOrder(order model.Order) (model.Order, bool) {
+	var pending model.Order
+	// 购物车和自定义金额订单没有产品 ID，需要同时比较订单标题，避免复用了不同商品的订单
+	err := h.DB.Where("user_id = ? AND product_id = ? AND beneficiary_id = ? AND merchant_id = ? AND pay_way = ? AND pay_type = ? AND subject = ?",
+		order.UserId, order.ProductId, order.BeneficiaryId, order.MerchantId, order.PayWay, order.PayType, order.Subject).
+		Where("status IN ? AND created_at > ?", []types.OrderStatus{types.OrderNotPaid, types.OrderScanned},
+			time.Now().Add(-h.orderTimeout(order.PayWay))).
+		Order("id DESC").First(&pending).Error
+	if err != nil || pending.Cents() != order.Cents() {
+		return pending, false
 	}
+	return pending, true
+}
 
-	err := h.notify(params["out_trade_no"], params["trade_no"])
+// resumeOrder 为待支付订单重新生成支付地址，加密货币订单继续使用已经分配的收款地址
+func (h *PaymentHandler) resumeOrder(gateway payment.PaymentGateway, order *model.Order, ctx payment.PayContext, size int) (string, []byte, error) {
+	var remark types.OrderRemark
+	err := types.DecodeOrderRemark(order.Remark, &remark)
 	if err != nil {
-		logger.Error(err)
-		c.String(http.StatusOK, "fail")
-		return
+		return "", nil, err
+	}
+	if remark.Crypto != nil {
+		payURL := h.cryptoService.PayURI(remark.Crypto.Address, remark.Crypto.Amount)
+		qrcode, err := utils.GenQrcode(payURL, size, h.qrcodeLogo.Logo(order.PayType))
+		return payURL, qrcode, err
 	}
 
-	c.String(http.StatusOK, "success")
+	// 支付地址的有效期不能超过原订单的有效期
+	ctx.Expire = time.Until(order.CreatedAt.Add(h.orderTimeout(order.PayWay)))
+	if ctx.Expire < time.Minute {
+		return "", nil, errors.New("order is about to expire")
+	}
+	payURL, err := h.gatewayPay(gateway, order, ctx)
+	return payURL, nil, err
 }
 
-// WechatPayNotify 微信商户支付异步回调
-func (h *PaymentHandler) WechatPayNotify(c *gin.Context) {
-	err := c.Request.ParseForm()
-	if err != nil {
-		c.String(http.StatusOK, "fail")
-		return
-	}
+// gatewayPay 调用支付渠道下单，记录渠道接口的耗时和链路
+func (h *PaymentHandler) gatewayPay(gateway payment.PaymentGateway, order *model.Order, ctx payment.PayContext) (string, error) {
+	spanCtx, span := tracing.Start(ctx.Ctx(), "payment.gateway.pay", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.OrderNo.String(order.OrderNo), tracing.Gateway.String(gateway.Name())))
+	ctx.Context = spanCtx
+	start := time.Now()
+	payURL, err := gateway.Pay(order, ctx)
+	metrics.Since(metrics.GatewayDuration, start, gateway.Name(), "pay")
+	tracing.End(span, err)
+	return payURL, err
+}
 
-	result := h.wechatPayService.TradeVerify(c.Request)
-	logger.Infof("收到微信商号订单支付回调：%+v", result)
-	if !result.Success() {
-		logger.Error("订单校验失败：", err)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"code":    "FAIL",
-			"message": err.Error(),
+// payResponse 返回支付信息给前端
+func (h *PaymentHandler) payResponse(c *gin.Context, gateway payment.PaymentGateway, order model.Order, payURL string, qrcode []byte, ctx payment.PayContext) {
+	var remark types.OrderRemark
+	_ = types.DecodeOrderRemark(order.Remark, &remark)
+	if remark.Crypto != nil {
+		resp.SUCCESS(c, gin.H{
+			"order_no": order.OrderNo,
+			"address":  remark.Crypto.Address,
+			"amount":   remark.Crypto.Amount,
+			"pay_url":  payURL,
+			"pay_link": h.payLink(ctx.Host, order.OrderNo),
+			"qrcode":   "data:image/png;base64," + base64.StdEncoding.EncodeToString(qrcode),
+			"expire":   order.CreatedAt.Add(h.orderTimeout(order.PayWay)).Unix(),
 		})
 		return
 	}
-
-	err = h.notify(result.OutTradeNo, result.TradeId)
-	if err != nil {
-		logger.Error(err)
-		c.String(http.StatusOK, "fail")
+	// 微信 JSAPI 等支付方式返回前端调起支付需要的参数
+	if payer, ok := gateway.(payment.ParamsPayer); ok && payer.ReturnsParams(ctx) {
+		var params map[string]interface{}
+		_ = utils.JsonDecode(payURL, &params)
+		resp.SUCCESS(c, gin.H{"order_no": order.OrderNo, "pay_params": params})
+		return
+	}
+	// 原生 App 返回钱包的 scheme 地址，同时返回原始支付地址用于不支持唤起钱包的渠道
+	if ctx.DeepLink {
+		deepLink := ""
+		if linker, ok := gateway.(payment.DeepLinker); ok {
+			deepLink = linker.DeepLink(payURL)
+		}
+		resp.SUCCESS(c, gin.H{"order_no": order.OrderNo, "pay_url": payURL, "deep_link": deepLink, "pay_link": h.payLink(ctx.Host, order.OrderNo)})
+		return
+	}
+	resp.SUCCESS(c, payURL)
+}
+
+// paySign 支付链接的签名，防止伪造订单号打开其他用户的支付页面
+func (h *PaymentHandler) paySign(orderNo string) string {
+	mac := hmac.New(sha256.New, []byte(h.signKey))
+	mac.Write([]byte(orderNo))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// payLink 带签名的支付链接，打开时重新向支付渠道下单并跳转到支付页面，可以生成二维码发给其他人代付
+func (h *PaymentHandler) payLink(host string, orderNo string) string {
+	query := url.Values{"order_no": {orderNo}, "sign": {h.paySign(orderNo)}}
+	return strings.TrimSuffix(host, "/") + "/api/payment/doPay?" + query.Encode()
+}
+
+// DoPay 打开支付链接，校验签名之后为待支付订单重新生成支付地址并跳转
+func (h *PaymentHandler) DoPay(c *gin.Context) {
+	orderNo := h.GetTrim(c, "order_no")
+	if !hmac.Equal([]byte(h.paySign(orderNo)), []byte(c.Query("sign"))) {
+		c.String(http.StatusForbidden, "支付链接签名校验失败")
+		return
+	}
+
+	var order model.Order
+	err := h.DB.Where("order_no = ?", orderNo).First(&order).Error
+	if err != nil {
+		c.String(http.StatusNotFound, "订单不存在")
+		return
+	}
+	if order.Status != types.OrderNotPaid && order.Status != types.OrderScanned {
+		c.String(http.StatusOK, "订单已支付或者已关闭")
+		return
+	}
+	gateway, ok := h.orderGateway(order)
+	if !ok {
+		c.String(http.StatusOK, "不支持的支付渠道")
+		return
+	}
+	ctx := payment.PayContext{
+		PayType:    order.PayType,
+		Host:       requestHost(c),
+		ClientIP:   c.ClientIP(),
+		SiteName:   h.App.SysConfig.Title,
+		MerchantId: order.MerchantId,
+	}
+	var product model.Product
+	if order.ProductId > 0 && h.DB.Where("id", order.ProductId).First(&product).Error == nil {
+		ctx.NotifyURL = product.NotifyURL
+		ctx.ReturnURL = product.ReturnURL
+		ctx.Recurring = product.Recurring
+	}
+	timeoutCtx, cancel := context.WithTimeout(c.Request.Context(), h.payTimeout())
+	defer cancel()
+	ctx.Context = timeoutCtx
+	payURL, _, err := h.resumeOrder(gateway, &order, ctx, 0)
+	if err != nil {
+		logger.Errorf("error with resume order %s: %v", orderNo, err)
+		c.String(http.StatusOK, "订单已过期，请重新下单")
+		return
+	}
+	c.Redirect(http.StatusFound, payURL)
+}
+
+// requestHost 当前请求的站点地址，反向代理转发的 HTTPS 请求通过 X-Forwarded-Proto 识别
+func requestHost(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+var errCouponInvalid = newPayError(types.PayErrCouponInvalid, "优惠券不存在或者已失效")
+
+// checkCoupon 校验优惠券是否可用，返回优惠金额（分）
+func (h *PaymentHandler) checkCoupon(code string, userId uint, productId uint, cents int64) (model.Coupon, int64, error) {
+	var coupon model.Coupon
+	err := h.DB.Where("code = ?", strings.ToUpper(strings.TrimSpace(code))).First(&coupon).Error
+	if err != nil {
+		return coupon, 0, errCouponInvalid
+	}
+	err = h.validateCoupon(h.DB, coupon, userId)
+	if err != nil {
+		return coupon, 0, err
+	}
+	if coupon.ProductId > 0 && coupon.ProductId != productId {
+		return coupon, 0, newPayError(types.PayErrCouponInvalid, "该优惠券不适用于当前产品")
+	}
+
+	var discount int64
+	switch coupon.Type {
+	case "percent":
+		discount = cents - cents*coupon.Value/100
+	case "fixed":
+		// 至少支付 1 分钱，支付渠道不支持 0 元订单
+		discount = min(coupon.Value, cents-1)
+	}
+	if discount <= 0 {
+		return coupon, 0, newPayError(types.PayErrCouponInvalid, "该优惠券不适用于当前订单")
+	}
+	return coupon, discount, nil
+}
+
+// validateCoupon 校验优惠券的有效期和使用次数
+func (h *PaymentHandler) validateCoupon(db *gorm.DB, coupon model.Coupon, userId uint) error {
+	if !coupon.Enabled {
+		return errCouponInvalid
+	}
+	if coupon.ExpiredAt > 0 && coupon.ExpiredAt < time.Now().Unix() {
+		return newPayError(types.PayErrCouponExpired, "优惠券已过期")
+	}
+	if coupon.UsageLimit > 0 && coupon.UsedCount >= coupon.UsageLimit {
+		return newPayError(types.PayErrCouponInvalid, "优惠券已被领完")
+	}
+	if coupon.PerUserLimit > 0 {
+		var count int64
+		db.Model(&model.CouponUsage{}).Where("coupon_id = ? AND user_id = ?", coupon.Id, userId).Count(&count)
+		if count >= int64(coupon.PerUserLimit) {
+			return newPayError(types.PayErrCouponInvalid, "优惠券使用次数已达上限")
+		}
+	}
+	return nil
+}
+
+// useCoupon 锁定优惠券并记录使用次数
+func (h *PaymentHandler) useCoupon(tx *gorm.DB, couponId uint, order model.Order) error {
+	var coupon model.Coupon
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id", couponId).First(&coupon).Error
+	if err != nil {
+		return errCouponInvalid
+	}
+	err = h.validateCoupon(tx, coupon, order.UserId)
+	if err != nil {
+		return err
+	}
+	err = tx.Create(&model.CouponUsage{
+		CouponId:  coupon.Id,
+		UserId:    order.UserId,
+		OrderNo:   order.OrderNo,
+		CreatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&model.Coupon{}).Where("id", coupon.Id).
+		UpdateColumn("used_count", gorm.Expr("used_count + ?", 1)).Error
+}
+
+// releaseCoupons 释放已取消订单占用的优惠券
+func (h *PaymentHandler) releaseCoupons() {
+	var usages []model.CouponUsage
+	cancelled := h.DB.Model(&model.Order{}).Select("order_no").Where("status", types.OrderCancelled)
+	h.DB.Where("order_no IN (?)", cancelled).Limit(500).Find(&usages)
+	for _, usage := range usages {
+		err := h.DB.Transaction(func(tx *gorm.DB) error {
+			res := tx.Where("id", usage.Id).Delete(&model.CouponUsage{})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			return tx.Model(&model.Coupon{}).Where("id = ? AND used_count > 0", usage.CouponId).
+				UpdateColumn("used_count", gorm.Expr("used_count - ?", 1)).Error
+		})
+		if err != nil {
+			logger.Errorf("error with release coupon for order %s: %v", usage.OrderNo, err)
+		}
+	}
+}
+
+var errInsufficientPower = newPayError(types.PayErrInsufficientPower, "算力余额不足")
+
+// splitPower 计算组合支付时算力抵扣的部分，返回抵扣的算力和抵扣的金额（分）。
+// 按照产品的算力价格折算，最多抵扣系统配置比例的订单金额，剩余部分通过支付渠道支付
+func (h *PaymentHandler) splitPower(user model.User, product model.Product, cents int64) (int, int64, error) {
+	ratio := h.App.SysConfig.SplitPayRatio
+	if ratio <= 0 || ratio >= 1 || product.PowerPrice <= 0 {
+		return 0, 0, newPayError(types.PayErrProductNotSupported, "该产品不支持组合支付")
+	}
+	available := service.AvailablePower(h.DB, user.Id, types.PowerBucketDefault)
+	powerPaid := min(available, int(float64(product.PowerPrice)*ratio))
+	if powerPaid <= 0 {
+		return 0, 0, errInsufficientPower
+	}
+	return powerPaid, cents * int64(powerPaid) / int64(product.PowerPrice), nil
+}
+
+// holdPower 冻结组合支付订单抵扣的算力，冻结的算力不能再消费
+func (h *PaymentHandler) holdPower(tx *gorm.DB, order model.Order, amount int) error {
+	res := tx.Model(&model.User{}).Where("id = ? AND power >= ?", order.UserId, amount).
+		UpdateColumns(map[string]interface{}{
+			"power":        gorm.Expr("power - ?", amount),
+			"frozen_power": gorm.Expr("frozen_power + ?", amount),
+		})
+	if res.Error != nil {
+		return fmt.Errorf("冻结算力失败：%v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return errInsufficientPower
+	}
+	return tx.Create(&model.PowerHold{
+		UserId:    order.UserId,
+		OrderNo:   order.OrderNo,
+		Amount:    amount,
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// finishPowerHold 组合支付订单支付成功之后扣除冻结的算力
+func (h *PaymentHandler) finishPowerHold(tx *gorm.DB, order model.Order, amount int) error {
+	res := tx.Where("order_no", order.OrderNo).Delete(&model.PowerHold{})
+	if res.Error != nil {
+		return fmt.Errorf("error with delete power hold: %v", res.Error)
+	}
+	var err error
+	if res.RowsAffected > 0 {
+		err = tx.Model(&model.User{}).Where("id", order.UserId).
+			UpdateColumn("frozen_power", gorm.Expr("frozen_power - ?", amount)).Error
+	} else {
+		// 订单超时取消时冻结的算力已经退回，之后才收到支付回调，直接扣减算力
+		logger.Warnf("组合支付订单 %s 冻结的算力已经退回，直接扣减算力：%d", order.OrderNo, amount)
+		err = tx.Model(&model.User{}).Where("id", order.UserId).
+			UpdateColumn("power", gorm.Expr("power - ?", amount)).Error
+	}
+	if err != nil {
+		return fmt.Errorf("扣减算力失败：%v", err)
+	}
+	err = service.ConsumePowerGrants(tx, order.UserId, types.PowerBucketDefault, amount)
+	if err != nil {
+		return fmt.Errorf("扣减算力失败：%v", err)
+	}
+
+	var user model.User
+	err = tx.Where("id", order.UserId).First(&user).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch user info: %v", err)
+	}
+	return tx.Create(&model.PowerLog{
+		UserId:    user.Id,
+		Username:  user.Username,
+		Type:      types.PowerConsume,
+		Amount:    amount,
+		Balance:   user.Power,
+		Mark:      types.PowerSub,
+		Model:     order.PayWay,
+		Remark:    fmt.Sprintf("组合支付抵扣算力，订单号：%s", order.OrderNo),
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// releasePowerHolds 退回已取消订单冻结的算力，删除的未支付订单不会再被取消，也需要退回
+func (h *PaymentHandler) releasePowerHolds() {
+	expired := h.DB.Unscoped().Model(&model.Order{}).Select("order_no").
+		Where("status = ? OR (deleted_at IS NOT NULL AND status IN ?)", types.OrderCancelled,
+			[]types.OrderStatus{types.OrderNotPaid, types.OrderScanned})
+	var holds []model.PowerHold
+	h.DB.Where("order_no IN (?)", expired).Limit(500).Find(&holds)
+	for _, hold := range holds {
+		err := h.DB.Transaction(func(tx *gorm.DB) error {
+			// 删除成功才退回，和订单结算并发执行时只有一方能够处理冻结的算力
+			res := tx.Where("id", hold.Id).Delete(&model.PowerHold{})
+			if res.Error != nil || res.RowsAffected == 0 {
+				return res.Error
+			}
+			return tx.Model(&model.User{}).Where("id", hold.UserId).UpdateColumns(map[string]interface{}{
+				"power":        gorm.Expr("power + ?", hold.Amount),
+				"frozen_power": gorm.Expr("frozen_power - ?", hold.Amount),
+			}).Error
+		})
+		if err != nil {
+			logger.Errorf("error with release power hold for order %s: %v", hold.OrderNo, err)
+		}
+	}
+}
+
+var errBeneficiaryNotFound = newPayError(types.PayErrBeneficiaryNotFound, "受赠用户不存在")
+
+// findBeneficiary 查找受赠用户，用户名为空或者为自己购买时返回 nil
+func (h *PaymentHandler) findBeneficiary(username string, payer model.User) (*model.User, error) {
+	username = strings.TrimSpace(username)
+	if username == "" || username == payer.Username {
+		return nil, nil
+	}
+	var user model.User
+	err := h.DB.Where("username", username).First(&user).Error
+	if err != nil {
+		return nil, errBeneficiaryNotFound
+	}
+	if !user.Status {
+		return nil, newPayError(types.PayErrBeneficiaryDisabled, "受赠用户已被禁用")
+	}
+	return &user, nil
+}
+
+// payWithBalance 使用算力余额购买产品，扣减算力、创建订单和发放权益在同一个事务中完成
+func (h *PaymentHandler) payWithBalance(c *gin.Context, user model.User, beneficiary *model.User, product model.Product, orderNo string) {
+	if product.PowerPrice <= 0 {
+		resp.PaymentFailed(c, types.PayErrProductNotSupported, "该产品不支持使用算力余额购买")
+		return
+	}
+
+	remark := types.OrderRemark{
+		Days:     product.Days,
+		Power:    product.Power,
+		Bucket:   product.Bucket,
+		Name:     product.Name,
+		Price:    product.Price,
+		Discount: product.Discount,
+	}
+	if beneficiary != nil {
+		remark.Beneficiary = beneficiary.Username
+	}
+	order := model.Order{
+		UserId:    user.Id,
+		Username:  user.Username,
+		ProductId: product.Id,
+		OrderNo:   orderNo,
+		TradeNo:   orderNo,
+		Subject:   product.Name,
+		Amount:    0,
+		Currency:  types.DefaultCurrency,
+		Status:    types.OrderPaidSuccess,
+		PayWay:    "balance",
+		PayType:   "power",
+		Remark:    utils.JsonEncode(remark),
+		PayTime:   time.Now().Unix(),
+		ClientIP:  c.ClientIP(),
+		UserAgent: userAgent(c),
+	}
+	if beneficiary != nil {
+		order.BeneficiaryId = beneficiary.Id
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// 余额不足时不会更新任何记录，保证不会出现部分扣减
+		res := tx.Model(&model.User{}).Where("id = ? AND power >= ?", user.Id, product.PowerPrice).
+			UpdateColumn("power", gorm.Expr("power - ?", product.PowerPrice))
+		if res.Error != nil {
+			return fmt.Errorf("扣减算力失败：%v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return errInsufficientPower
+		}
+		err := service.ConsumePowerGrants(tx, user.Id, types.PowerBucketDefault, product.PowerPrice)
+		if err != nil {
+			return fmt.Errorf("扣减算力失败：%v", err)
+		}
+
+		var balance int
+		err = tx.Model(&model.User{}).Where("id", user.Id).Select("power").Scan(&balance).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Create(&model.PowerLog{
+			UserId:    user.Id,
+			Username:  user.Username,
+			Type:      types.PowerConsume,
+			Amount:    product.PowerPrice,
+			Balance:   balance,
+			Mark:      types.PowerSub,
+			Model:     "balance",
+			Remark:    fmt.Sprintf("算力余额购买产品：%s，订单号：%s", product.Name, orderNo),
+			CreatedAt: time.Now(),
+		}).Error
+		if err != nil {
+			return fmt.Errorf("记录算力日志失败：%v", err)
+		}
+
+		err = tx.Create(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with create order: %v", err)
+		}
+		vipExpireAt, err := h.grantBenefit(tx, order, remark)
+		if err != nil {
+			return err
+		}
+		return h.logFulfillment(tx, order, remark, vipExpireAt, 0)
+	})
+	if err != nil {
+		payFailed(c, err, types.PayErrInternal)
+		return
+	}
+
+	metrics.OrdersCreated.WithLabelValues(order.PayWay).Inc()
+	metrics.OrdersPaid.WithLabelValues(order.PayWay).Inc()
+	resp.SUCCESS(c, gin.H{"order_no": orderNo, "status": order.Status})
+}
+
+var (
+	errInvalidRedeemCode = newPayError(types.PayErrRedeemCodeInvalid, "无效的兑换码！")
+	errRedeemCodeUsed    = newPayError(types.PayErrRedeemCodeUsed, "当前兑换码已使用，请勿重复使用！")
+	errRedeemCodeExpired = newPayError(types.PayErrRedeemCodeExpired, "当前兑换码已过期！")
+)
+
+// RedeemOrder 核销产品兑换码，生成已支付订单并发放产品权益
+func (h *PaymentHandler) RedeemOrder(c *gin.Context) {
+	var data struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.Code == "" {
+		resp.PaymentFailed(c, types.PayErrInvalidArgs, types.InvalidArgs)
+		return
+	}
+
+	user, err := h.GetLoginUser(c)
+	if err != nil {
+		resp.PaymentFailed(c, types.PayErrNotAuthorized, "Not Authorized")
+		return
+	}
+	orderNo, err := h.snowflake.Next(false)
+	if err != nil {
+		resp.PaymentFailed(c, types.PayErrInternal, "error with generate trade no: "+err.Error())
+		return
+	}
+
+	var order model.Order
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定兑换码记录，防止同一个兑换码被并发核销
+		var code model.RedeemCode
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("code", data.Code).First(&code).Error
+		if err != nil {
+			return errInvalidRedeemCode
+		}
+		if code.RedeemedAt > 0 {
+			return errRedeemCodeUsed
+		}
+		if code.ExpiredAt > 0 && code.ExpiredAt < time.Now().Unix() {
+			return errRedeemCodeExpired
+		}
+
+		var product model.Product
+		err = tx.Where("id", code.ProductId).First(&product).Error
+		if err != nil {
+			return fmt.Errorf("兑换码关联的产品不存在：%v", err)
+		}
+
+		remark := types.OrderRemark{
+			Days:     product.Days,
+			Power:    product.Power,
+			Bucket:   product.Bucket,
+			Name:     product.Name,
+			Price:    product.Price,
+			Discount: product.Discount,
+		}
+		order = model.Order{
+			UserId:    user.Id,
+			Username:  user.Username,
+			ProductId: product.Id,
+			OrderNo:   orderNo,
+			TradeNo:   code.Code,
+			Subject:   product.Name,
+			Amount:    0,
+			Currency:  types.DefaultCurrency,
+			Status:    types.OrderPaidSuccess,
+			PayWay:    "redeem",
+			PayType:   "code",
+			Remark:    utils.JsonEncode(remark),
+			PayTime:   time.Now().Unix(),
+			ClientIP:  c.ClientIP(),
+			UserAgent: userAgent(c),
+		}
+		err = tx.Create(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with create order: %v", err)
+		}
+		vipExpireAt, err := h.grantBenefit(tx, order, remark)
+		if err != nil {
+			return err
+		}
+		err = h.logFulfillment(tx, order, remark, vipExpireAt, 0)
+		if err != nil {
+			return err
+		}
+
+		// 更新核销状态
+		return tx.Model(&code).UpdateColumns(map[string]interface{}{
+			"user_id":     user.Id,
+			"order_no":    orderNo,
+			"redeemed_at": order.PayTime,
+		}).Error
+	})
+	if err != nil {
+		payFailed(c, err, types.PayErrInternal)
+		return
+	}
+
+	resp.SUCCESS(c, gin.H{"order_no": order.OrderNo, "subject": order.Subject})
+}
+
+// QueryOrder 查询订单支付状态，供前端展示支付二维码后轮询
+func (h *PaymentHandler) QueryOrder(c *gin.Context) {
+	orderNo := h.GetTrim(c, "order_no")
+	// 优先读取缓存，缓存不存在时查询数据库
+	status, ok := h.statusCache.Get(orderNo)
+	if !ok {
+		var order model.Order
+		err := h.DB.Select("user_id", "status", "pay_time", "pay_way", "merchant_id").Where("order_no = ?", orderNo).First(&order).Error
+		if err != nil {
+			resp.PaymentFailed(c, types.PayErrOrderNotFound, "Order not found")
+			return
+		}
+		status = service.OrderStatus{UserId: order.UserId, Status: order.Status, PayTime: order.PayTime, PayWay: order.PayWay, MerchantId: order.MerchantId}
+		h.statusCache.Fill(orderNo, status)
+	}
+	if status.UserId != h.GetLoginUserId(c) {
+		resp.PaymentFailed(c, types.PayErrOrderNotFound, "Order not found")
+		return
+	}
+
+	// 异步回调可能延迟或者丢失，待支付的订单主动向支付渠道查询，已取消、已退款等订单不需要查询
+	if (status.Status == types.OrderNotPaid || status.Status == types.OrderScanned) && h.allowTradeQuery(c, orderNo) {
+		result := payment.NotifyVo{Status: payment.Failure}
+		if gateway, ok := h.merchants.Registry(status.MerchantId).Get(status.PayWay); ok {
+			if querier, ok := gateway.(payment.TradeQuerier); ok {
+				result = querier.TradeQuery(orderNo)
+			}
+		}
+		if result.Success() && result.OutTradeNo == orderNo {
+			err := h.notify(c.Request.Context(), orderNo, result.TradeId, result.Amount)
+			if err != nil {
+				logger.Errorf("error with reconcile order %s: %v", orderNo, err)
+			} else {
+				var order model.Order
+				if h.DB.Where("order_no = ?", orderNo).First(&order).Error == nil {
+					status.Status = order.Status
+					status.PayTime = order.PayTime
+				}
+			}
+		}
+	}
+
+	resp.SUCCESS(c, gin.H{
+		"order_no": orderNo,
+		"status":   status.Status,
+		"pay_time": status.PayTime,
+		"granted":  status.Status == types.OrderPaidSuccess, // 权益与订单状态在支付成功时一起更新
+	})
+}
+
+// tradeQueryInterval 前端轮询订单状态时，同一个订单向支付渠道主动查询的最小间隔
+const tradeQueryInterval = 10 * time.Second
+
+// allowTradeQuery 限制同一个订单主动查询支付渠道的频率，避免前端轮询触发支付渠道的限流，Redis 出错时不查询
+func (h *PaymentHandler) allowTradeQuery(c *gin.Context, orderNo string) bool {
+	ok, err := h.redis.SetNX(c, fmt.Sprintf("order_trade_query/%s", orderNo), 1, tradeQueryInterval).Result()
+	if err != nil {
+		logger.Error("error with throttle trade query: ", err)
+		return false
+	}
+	return ok
+}
+
+// CancelExpiredOrders 定时取消超时未支付的订单，不同支付渠道的订单超时时间可以不同
+func (h *PaymentHandler) CancelExpiredOrders() {
+	go func() {
+		logger.Info("Running expired order cancelling ...")
+		for {
+			var total int64
+			names := make([]string, 0)
+			// 快要过期的订单使用订单所属商户的支付渠道查询支付状态
+			for _, merchantId := range h.merchants.Ids() {
+				for _, gateway := range h.merchants.Registry(merchantId).All() {
+					h.rescueExpiringOrders(merchantId, gateway)
+				}
+			}
+			for _, gateway := range h.gateways.All() {
+				names = append(names, gateway.Name())
+				session := h.DB.Where("pay_way = ?", gateway.Name())
+				total += h.cancelOrders(session, h.orderTimeout(gateway.Name()))
+			}
+			// 未启用的支付渠道的订单使用系统配置的超时时间
+			session := h.DB.Session(&gorm.Session{})
+			if len(names) > 0 {
+				session = session.Where("pay_way NOT IN ?", names)
+			}
+			total += h.cancelOrders(session, h.orderTimeout(""))
+			if total > 0 {
+				logger.Infof("Cancel expired orders successfully, affect rows: %d", total)
+			}
+			h.releaseCoupons()
+			h.releasePowerHolds()
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// rescueWindow 订单在超时前的这段时间内还没有收到支付回调时主动查询支付状态
+const rescueWindow = 5 * time.Minute
+
+// rescueExpiringOrders 支付渠道的异步回调可能因为网络问题丢失，对即将超时（包括刚刚超时还没有取消）的订单
+// 主动向支付渠道查询支付状态，已经支付的订单直接结算，避免用户付款之后订单被取消
+func (h *PaymentHandler) rescueExpiringOrders(merchantId string, gateway payment.PaymentGateway) {
+	querier, ok := gateway.(payment.TradeQuerier)
+	if !ok {
+		return
+	}
+	deadline := time.Now().Add(-h.orderTimeout(gateway.Name()))
+	var orders []model.Order
+	err := h.DB.Select("order_no").Where("merchant_id = ? AND pay_way = ? AND status IN ? AND created_at >= ? AND created_at < ?", merchantId, gateway.Name(),
+		[]types.OrderStatus{types.OrderNotPaid, types.OrderScanned}, deadline.Add(-rescueWindow), deadline.Add(rescueWindow)).
+		Limit(100).Find(&orders).Error
+	if err != nil {
+		logger.Errorf("error with fetch expiring %s orders: %v", gateway.Name(), err)
+		return
+	}
+	for _, order := range orders {
+		result := querier.TradeQuery(order.OrderNo)
+		if !result.Success() || result.OutTradeNo != order.OrderNo {
+			continue
+		}
+		logger.Warnf("%s 订单 %s 已支付但没有收到支付回调，主动结算", gateway.Name(), order.OrderNo)
+		err = h.notify(context.Background(), order.OrderNo, result.TradeId, result.Amount)
+		if err != nil {
+			logger.Errorf("error with rescue order %s: %v", order.OrderNo, err)
+		}
+	}
+}
+
+// cancelOrders 取消超时未支付的订单，返回取消的订单数量
+func (h *PaymentHandler) cancelOrders(session *gorm.DB, timeout time.Duration) int64 {
+	deadline := time.Now().Add(-timeout)
+	var total int64
+	unpaid := []types.OrderStatus{types.OrderNotPaid, types.OrderScanned}
+	// 分批更新，避免一次锁定过多的记录，先查出订单号，更新之后同步订单状态缓存
+	for {
+		var orderNos []string
+		err := session.Session(&gorm.Session{}).Model(&model.Order{}).
+			Where("status IN ? AND created_at < ?", unpaid, deadline).
+			Limit(500).Pluck("order_no", &orderNos).Error
+		if err != nil {
+			logger.Error("error with fetch expired orders: ", err)
+			break
+		}
+		if len(orderNos) == 0 {
+			break
+		}
+		// 查询之后订单可能刚好支付成功，更新时需要再次判断订单状态
+		res := h.DB.Model(&model.Order{}).Where("order_no IN ? AND status IN ?", orderNos, unpaid).
+			UpdateColumn("status", types.OrderCancelled)
+		if res.Error != nil {
+			logger.Error("error with cancel expired orders: ", res.Error)
+			break
+		}
+		h.statusCache.Delete(orderNos...)
+		total += res.RowsAffected
+		if len(orderNos) < 500 {
+			break
+		}
+	}
+	return total
+}
+
+// orderTimeout 未支付订单的有效期，优先使用支付渠道单独配置的超时时间
+func (h *PaymentHandler) orderTimeout(payWay string) time.Duration {
+	if gateway, ok := h.gateways.Get(payWay); ok {
+		if t, ok := gateway.(payment.OrderTimeouter); ok && t.OrderTimeout() > 0 {
+			return t.OrderTimeout()
+		}
+	}
+	if h.App.SysConfig == nil || h.App.SysConfig.OrderPayTimeout <= 0 {
+		return 30 * time.Minute
+	}
+	return time.Duration(h.App.SysConfig.OrderPayTimeout) * time.Second
+}
+
+// CheckCryptoPayments 轮询加密货币收款地址的入账记录，确认订单支付状态
+func (h *PaymentHandler) CheckCryptoPayments() {
+	if !h.App.Config.CryptoConfig.Enabled {
+		return
+	}
+	go func() {
+		logger.Info("Running crypto payment checking ...")
+		for {
+			time.Sleep(h.cryptoService.Interval())
+			orders, err := h.cryptoService.PendingOrders(h.orderTimeout(h.cryptoService.Name()))
+			if err != nil {
+				logger.Error("error with fetch pending crypto orders: ", err)
+				continue
+			}
+			for _, order := range orders {
+				err = h.checkCryptoOrder(order)
+				if err != nil {
+					logger.Errorf("error with check crypto order %s: %v", order.OrderNo, err)
+				}
+			}
+		}
+	}()
+}
+
+func (h *PaymentHandler) checkCryptoOrder(order model.Order) error {
+	var remark types.OrderRemark
+	err := types.DecodeOrderRemark(order.Remark, &remark)
+	if err != nil || remark.Crypto == nil {
+		return fmt.Errorf("invalid order remark: %v", err)
+	}
+
+	transfers, err := h.cryptoService.Transfers(remark.Crypto.Address, order.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	// 同一个订单可能分多笔转账，累计到账金额，已经计入其他订单的交易不再计入
+	owners, err := h.cryptoTxOwners(transfers)
+	if err != nil {
+		return err
+	}
+	paid := decimal.Zero
+	var txHash string
+	used := make([]payment.Trc20Transfer, 0)
+	for _, t := range transfers {
+		if owner, ok := owners[t.TxHash]; ok && owner != order.OrderNo {
+			continue
+		}
+		paid = paid.Add(t.Amount)
+		txHash = t.TxHash
+		used = append(used, t)
+	}
+	if txHash == "" {
+		return nil
+	}
+
+	expected, err := decimal.NewFromString(remark.Crypto.Amount)
+	if err != nil {
+		return fmt.Errorf("invalid order amount: %v", err)
+	}
+	remark.Crypto.PaidAmount = paid.String()
+	remark.Crypto.TxHash = txHash
+	remark.Crypto.TxHashes = make([]string, 0, len(used))
+	for _, t := range used {
+		remark.Crypto.TxHashes = append(remark.Crypto.TxHashes, t.TxHash)
+	}
+	diff := paid.Sub(expected)
+	tolerance := h.cryptoService.Tolerance()
+	if diff.LessThan(tolerance.Neg()) {
+		// 少付，记录差额，订单保持待支付状态，等待用户补足
+		remark.Crypto.Discrepancy = fmt.Sprintf("少付 %s USDT", diff.Neg().String())
+		logger.Warnf("加密货币订单 %s 支付金额不足，应付：%s，实付：%s", order.OrderNo, expected, paid)
+		return h.DB.Model(&order).UpdateColumn("remark", utils.JsonEncode(remark)).Error
+	}
+	if diff.GreaterThan(tolerance) {
+		remark.Crypto.Discrepancy = fmt.Sprintf("多付 %s USDT", diff.String())
+		logger.Warnf("加密货币订单 %s 支付金额超出，应付：%s，实付：%s", order.OrderNo, expected, paid)
+	}
+	err = h.DB.Model(&order).UpdateColumn("remark", utils.JsonEncode(remark)).Error
+	if err != nil {
+		return err
+	}
+	// 最后一笔交易在结算时写入支付事件，其他交易先写入支付事件，保证每一笔交易只会计入一个订单
+	err = h.claimCryptoTransfers(order, used[:len(used)-1])
+	if err != nil {
+		return err
+	}
+
+	// USDT 到账金额已经在上面校验过，收款地址在冷却期之后才会重新分配，不需要释放
+	return h.notify(context.Background(), order.OrderNo, txHash, utils.FormatCents(order.Cents()))
+}
+
+// cryptoTxOwners 查询入账交易已经计入的订单，返回交易哈希 => 订单号
+func (h *PaymentHandler) cryptoTxOwners(transfers []payment.Trc20Transfer) (map[string]string, error) {
+	owners := make(map[string]string)
+	if len(transfers) == 0 {
+		return owners, nil
+	}
+	hashes := make([]string, 0, len(transfers))
+	for _, t := range transfers {
+		hashes = append(hashes, t.TxHash)
+	}
+	var events []model.PaymentEvent
+	err := h.DB.Select("trade_no", "order_no").Where("gateway = ? AND trade_no IN ?", h.cryptoService.Name(), hashes).Find(&events).Error
+	if err != nil {
+		return nil, fmt.Errorf("error with fetch payment events: %v", err)
+	}
+	for _, e := range events {
+		owners[e.TradeNo] = e.OrderNo
+	}
+	// 兼容没有写入支付事件之前结算的订单
+	var orders []model.Order
+	err = h.DB.Select("trade_no", "order_no").Where("trade_no IN ?", hashes).Find(&orders).Error
+	if err != nil {
+		return nil, fmt.Errorf("error with fetch orders: %v", err)
+	}
+	for _, o := range orders {
+		owners[o.TradeNo] = o.OrderNo
+	}
+	return owners, nil
+}
+
+// claimCryptoTransfers 把交易写入支付事件，唯一索引保证同一笔交易只能计入一个订单，
+// 写入之后如果发现交易已经被其他订单占用，返回错误等待下一轮重新计算到账金额
+func (h *PaymentHandler) claimCryptoTransfers(order model.Order, transfers []payment.Trc20Transfer) error {
+	if len(transfers) == 0 {
+		return nil
+	}
+	for _, t := range transfers {
+		err := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.PaymentEvent{
+			Gateway:   h.cryptoService.Name(),
+			TradeNo:   t.TxHash,
+			OrderNo:   order.OrderNo,
+			Amount:    t.Amount.String(),
+			CreatedAt: time.Now(),
+		}).Error
+		if err != nil {
+			return fmt.Errorf("error with save payment event: %v", err)
+		}
+	}
+	owners, err := h.cryptoTxOwners(transfers)
+	if err != nil {
+		return err
+	}
+	for _, t := range transfers {
+		if owners[t.TxHash] != order.OrderNo {
+			return fmt.Errorf("transaction %s has been used by order %s", t.TxHash, owners[t.TxHash])
+		}
+	}
+	return nil
+}
+
+// 异步通知回调公共逻辑
+// amount 为支付渠道返回的实际支付金额，必须与订单金额一致才会发放权益
+func (h *PaymentHandler) notify(ctx context.Context, orderNo string, tradeNo string, amount string) error {
+	return h.settle(ctx, orderNo, tradeNo, amount, 0)
+}
+
+// ManualSettle 管理员手动结算订单，用于支付渠道回调丢失但是已经确认收款的订单
+func (h *PaymentHandler) ManualSettle(ctx context.Context, orderNo string, tradeNo string, adminId uint) error {
+	var order model.Order
+	err := h.DB.Where("order_no = ?", orderNo).First(&order).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch order: %v", err)
+	}
+	if tradeNo == "" {
+		tradeNo = order.TradeNo
+	}
+	return h.settle(ctx, orderNo, tradeNo, utils.FormatCents(order.Cents()), adminId)
+}
+
+// settle 结算订单，manualBy 大于 0 表示管理员手动结算
+func (h *PaymentHandler) settle(ctx context.Context, orderNo string, tradeNo string, amount string, manualBy uint) (err error) {
+	ctx, span := tracing.Start(ctx, "payment.settle",
+		trace.WithAttributes(tracing.OrderNo.String(orderNo), tracing.TradeNo.String(tradeNo)))
+	defer func() {
+		tracing.End(span, err)
+	}()
+	var settled *model.Order
+	var settledRemark types.OrderRemark
+	payWay := "unknown"
+	start := time.Now()
+	// 通过行锁保证同一个订单的回调串行执行，不同订单的回调互不影响
+	err = h.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// 已经软删除的订单查询不到，回调不会把删除的订单重新结算
+		var order model.Order
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_no = ?", orderNo).First(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch order: %v", err)
+		}
+		payWay = order.PayWay
+		span.SetAttributes(tracing.Gateway.String(payWay))
+
+		// 先写入支付事件，唯一索引冲突说明这笔交易已经处理过，直接返回。
+		// 使用 ON CONFLICT 而不是 INSERT IGNORE，只忽略唯一索引冲突，其他写入错误正常返回
+		if tradeNo == "" {
+			tradeNo = order.OrderNo
+		}
+		res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&model.PaymentEvent{
+			Gateway:   order.PayWay,
+			TradeNo:   tradeNo,
+			OrderNo:   order.OrderNo,
+			Amount:    amount,
+			CreatedAt: time.Now(),
+		})
+		if res.Error != nil {
+			return fmt.Errorf("error with save payment event: %v", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			logger.Infof("重复的支付通知，订单号：%s，交易号：%s", order.OrderNo, tradeNo)
+			span.SetAttributes(tracing.Outcome.String("duplicate"))
+			return nil
+		}
+
+		// 已支付订单，直接返回
+		if order.Status == types.OrderPaidSuccess {
+			return nil
+		}
+		// 已退款、已取消和用户已删除的订单不能再次发放权益，支付事件保留作为对账依据。
+		// 管理员手动结算时返回错误，渠道回调返回成功，避免渠道一直重试
+		if order.Status != types.OrderNotPaid && order.Status != types.OrderScanned {
+			// 用户已删除的订单即使用户恢复之后也不能重新结算，只能人工补发权益
+			if order.Status == types.OrderOrphaned && manualBy > 0 {
+				return fmt.Errorf("order %s is orphaned and must be fulfilled manually", orderNo)
+			}
+			if manualBy > 0 {
+				return fmt.Errorf("order %s in status %d can not be settled", orderNo, order.Status)
+			}
+			logger.Warnf("[人工处理] 订单 %s 状态为 %d，收到新的支付通知，不再发放权益，金额：%s，交易号：%s",
+				orderNo, order.Status, amount, tradeNo)
+			span.SetAttributes(tracing.Outcome.String("ignored"))
+			return nil
+		}
+
+		// 校验实际支付金额，防止伪造回调或者少付
+		paid, err := utils.ParseCents(amount)
+		if err != nil {
+			return fmt.Errorf("invalid paid amount %q for order %s", amount, orderNo)
+		}
+		if paid != order.Cents() {
+			logger.Warnf("[安全警告] 订单 %s 支付金额不匹配，订单金额：%s，实付金额：%s，交易号：%s", orderNo, utils.FormatCents(order.Cents()), amount, tradeNo)
+			return fmt.Errorf("paid amount mismatch for order %s", orderNo)
+		}
+
+		// 下单之后用户注销了账号，权益无法发放，标记订单之后返回成功，避免支付渠道一直重试回调
+		orphaned, err := h.orderUserDeleted(tx, order)
+		if err != nil {
+			return err
+		}
+		if orphaned {
+			logger.Warnf("[人工处理] 订单 %s 已支付，但是用户已经删除，用户ID：%d，受赠用户ID：%d，金额：%s，交易号：%s",
+				order.OrderNo, order.UserId, order.BeneficiaryId, amount, tradeNo)
+			err = tx.Model(&order).UpdateColumns(map[string]interface{}{
+				"status":   types.OrderOrphaned,
+				"trade_no": tradeNo,
+				"pay_time": time.Now().Unix(),
+			}).Error
+			if err != nil {
+				return fmt.Errorf("error with update order info: %v", err)
+			}
+			return nil
+		}
+
+		var remark types.OrderRemark
+		err = types.DecodeOrderRemark(order.Remark, &remark)
+		if err != nil {
+			return fmt.Errorf("error with decode order remark: %v", err)
+		}
+
+		if remark.PowerPaid > 0 {
+			err = h.finishPowerHold(tx, order, remark.PowerPaid)
+			if err != nil {
+				return err
+			}
+		}
+		// 充值满额赠送的算力记录在订单中，退款时一起扣回，满赠档位按照人民币金额配置
+		if remark.Power > 0 && order.CurrencyCode() == types.DefaultCurrency {
+			remark.Bonus = h.rechargeBonus(order.Cents())
+		}
+		// 发放权益和更新订单状态在同一个事务中完成，避免出现加了算力但订单未支付的情况
+		vipExpireAt, err := h.grantBenefit(tx, order, remark)
+		if err != nil {
+			return err
+		}
+		remark.ReferrerId, remark.ReferralPower, err = h.grantReferralReward(tx, order)
+		if err != nil {
+			return err
+		}
+		if manualBy > 0 {
+			remark.ManualBy = manualBy
+			remark.ManualAt = time.Now().Unix()
+		}
+		order.Remark = utils.JsonEncode(remark)
+
+		// 更新订单状态
+		order.Fee = h.orderFee(order)
+		order.PayTime = time.Now().Unix()
+		order.Status = types.OrderPaidSuccess
+		order.TradeNo = tradeNo
+		err = tx.Updates(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with update order info: %v", err)
+		}
+		var periodEnd int64
+		if remark.Recurring {
+			periodEnd, err = h.extendSubscription(tx, order, remark)
+			if err != nil {
+				return err
+			}
+		}
+		err = h.logFulfillment(tx, order, remark, vipExpireAt, periodEnd)
+		if err != nil {
+			return err
+		}
+		settled = &order
+		settledRemark = remark
+		return nil
+	})
+	metrics.Since(metrics.SettleDuration, start, payWay)
+	if err != nil {
+		metrics.FulfillmentErrors.WithLabelValues(payWay).Inc()
+		return err
+	}
+	// 事务提交之后再执行支付成功的后续处理，后续处理失败不影响订单结算
+	if settled != nil {
+		span.SetAttributes(tracing.Outcome.String("paid"))
+		h.statusCache.Set(settled.OrderNo, service.OrderStatus{UserId: settled.UserId, Status: settled.Status, PayTime: settled.PayTime, PayWay: settled.PayWay, MerchantId: settled.MerchantId})
+		metrics.OrdersPaid.WithLabelValues(settled.PayWay).Inc()
+		metrics.PaidAmount.WithLabelValues(settled.PayWay, settled.CurrencyCode()).Add(float64(settled.Cents()))
+		h.afterPaid(*settled, settledRemark)
+	}
+	return nil
+}
+
+// orderUserDeleted 检查订单的下单用户和受赠用户是否已经删除，查询出错时返回错误，不能当作用户已删除处理
+func (h *PaymentHandler) orderUserDeleted(tx *gorm.DB, order model.Order) (bool, error) {
+	for _, userId := range []uint{order.UserId, order.BeneficiaryId} {
+		if userId == 0 {
+			continue
+		}
+		var user model.User
+		err := tx.Select("id").Where("id", userId).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("error with fetch user info: %v", err)
+		}
+	}
+	return false, nil
+}
+
+// orderFee 按照支付渠道的费率计算订单手续费（分）
+func (h *PaymentHandler) orderFee(order model.Order) int64 {
+	gateway, ok := h.orderGateway(order)
+	if !ok {
+		return 0
+	}
+	rater, ok := gateway.(payment.FeeRater)
+	if !ok || rater.FeeRate() <= 0 {
+		return 0
+	}
+	return decimal.NewFromInt(order.Cents()).Mul(decimal.NewFromFloat(rater.FeeRate())).Round(0).IntPart()
+}
+
+// afterPaid 订单支付成功之后的通知处理
+func (h *PaymentHandler) afterPaid(order model.Order, remark types.OrderRemark) {
+	var user model.User
+	if err := h.DB.Where("id", order.Receiver()).First(&user).Error; err == nil {
+		h.wsService.SendToUser(user.Id, types.ChPay, gin.H{
+			"order_no": order.OrderNo,
+			"status":   order.Status,
+			"power":    remark.TotalPower(),
+			"days":     remark.Days,
+			"balance":  user.Power,
+		})
+	}
+	// 为好友购买时，付款用户只需要知道订单已经支付成功
+	if order.Receiver() != order.UserId {
+		h.wsService.SendToUser(order.UserId, types.ChPay, gin.H{"order_no": order.OrderNo, "status": order.Status})
+	}
+
+	if h.App.SysConfig != nil && h.App.SysConfig.EmailReceiptEnabled {
+		go h.sendReceipt(order, remark)
+	}
+
+	paidEvent := service.OrderPaidEvent{
+		Event:     service.EventOrderPaid,
+		OrderNo:   order.OrderNo,
+		UserId:    order.UserId,
+		Receiver:  order.Receiver(),
+		ProductId: order.ProductId,
+		Product:   order.Subject,
+		Amount:    utils.FormatCents(order.Cents()),
+		Currency:  order.CurrencyCode(),
+		PayWay:    order.PayWay,
+		Power:     remark.TotalPower(),
+		Days:      remark.Days,
+		PaidAt:    order.PayTime,
+	}
+	h.webhook.Publish(order.OrderNo, paidEvent)
+	h.eventBus.Publish(event.Event{Type: service.EventOrderPaid, Key: order.OrderNo, Payload: paidEvent})
+
+	h.notifier.Notify(notifier.Message{
+		Topic: notifier.TopicOrderPaid,
+		Title: "新订单支付成功",
+		Fields: []notifier.Field{
+			{Name: "用户", Value: order.Username},
+			{Name: "商品", Value: order.Subject},
+			{Name: "金额", Value: fmt.Sprintf("%s %s", utils.FormatCents(order.Cents()), order.CurrencyCode())},
+			{Name: "支付方式", Value: order.PayWay},
+			{Name: "订单号", Value: order.OrderNo},
+		},
+	})
+}
+
+// sendReceipt 给付款用户发送邮件收据，用户没有绑定有效的邮箱时不发送
+func (h *PaymentHandler) sendReceipt(order model.Order, remark types.OrderRemark) {
+	var payer model.User
+	if err := h.DB.Where("id", order.UserId).First(&payer).Error; err != nil {
+		return
+	}
+	if !utils.IsValidEmail(payer.Email) {
+		return
+	}
+
+	payWay, ok := types.PayMethods[order.PayWay]
+	if !ok {
+		payWay = order.PayWay
+	}
+	var lines []string
+	lines = append(lines, fmt.Sprintf("您好，%s：", payer.Username))
+	lines = append(lines, "感谢您的购买，您的订单已经支付成功，收据信息如下：")
+	lines = append(lines, fmt.Sprintf("订单号：%s", order.OrderNo))
+	lines = append(lines, fmt.Sprintf("产品名称：%s", order.Subject))
+	if order.CurrencyCode() == types.DefaultCurrency {
+		lines = append(lines, fmt.Sprintf("支付金额：%s 元", utils.FormatCents(order.Cents())))
+	} else {
+		lines = append(lines, fmt.Sprintf("支付金额：%s %s", utils.FormatCents(order.Cents()), order.CurrencyCode()))
+	}
+	lines = append(lines, fmt.Sprintf("支付方式：%s", payWay))
+	lines = append(lines, fmt.Sprintf("支付时间：%s", utils.Stamp2str(order.PayTime)))
+	if remark.Power > 0 {
+		lines = append(lines, fmt.Sprintf("获得算力：%d", remark.Power))
+	}
+	if remark.Bonus > 0 {
+		lines = append(lines, fmt.Sprintf("满额赠送算力：%d", remark.Bonus))
+	}
+	if remark.Days > 0 {
+		lines = append(lines, fmt.Sprintf("会员天数：%d 天", remark.Days))
+	}
+	if remark.Beneficiary != "" {
+		lines = append(lines, fmt.Sprintf("受赠用户：%s", remark.Beneficiary))
+	}
+	subject := fmt.Sprintf("%s 支付收据（订单号：%s）", h.smtpService.AppName(), order.OrderNo)
+	err := h.smtpService.SendMail(payer.Email, subject, strings.Join(lines, "\r\n"))
+	if err != nil {
+		logger.Errorf("error with send receipt for order %s: %v", order.OrderNo, err)
+	}
+}
+
+// grantBenefit 发放订单权益：顺延会员有效期，增加用户算力，记录算力日志，更新产品销量。
+// 返回顺延之后的会员到期时间，订单没有会员天数时为 0
+func (h *PaymentHandler) grantBenefit(tx *gorm.DB, order model.Order, remark types.OrderRemark) (int64, error) {
+	var vipExpireAt int64
+	if remark.Days > 0 {
+		var err error
+		vipExpireAt, err = h.extendVip(tx, order.Receiver(), remark.Days)
+		if err != nil {
+			return 0, err
+		}
+	}
+	err := tx.Model(&model.User{}).Where("id", order.Receiver()).
+		UpdateColumn("power", gorm.Expr("power + ?", remark.Power)).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with increase user power: %v", err)
+	}
+	// 充值的算力按照系统配置的有效期过期
+	err = service.AddBucketPowerGrant(tx, order.Receiver(), types.PowerRecharge, remark.Bucket, remark.Power, service.PowerExpireAt(h.App.SysConfig.PowerExpireDays))
+	if err != nil {
+		return 0, fmt.Errorf("error with create power grant: %v", err)
+	}
+
+	var user model.User
+	err = tx.Where("id", order.Receiver()).First(&user).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with fetch user info: %v", err)
+	}
+	logRemark := fmt.Sprintf("充值算力，金额：%s，订单号：%s", utils.FormatCents(order.Cents()), order.OrderNo)
+	if order.BeneficiaryId > 0 {
+		logRemark = fmt.Sprintf("好友 %s 赠送算力，订单号：%s", order.Username, order.OrderNo)
+	}
+	err = tx.Create(&model.PowerLog{
+		UserId:    user.Id,
+		Username:  user.Username,
+		Type:      types.PowerRecharge,
+		Amount:    remark.Power,
+		Balance:   user.Power,
+		Mark:      types.PowerAdd,
+		Model:     order.PayWay,
+		Remark:    logRemark,
+		CreatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with create power log: %v", err)
+	}
+
+	if remark.Bonus > 0 {
+		err = h.grantBonus(tx, order, user, remark)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// 购物车订单按照每个商品的购买数量增加销量
+	sales := map[uint]int{order.ProductId: 1}
+	if len(remark.Items) > 0 {
+		sales = make(map[uint]int)
+		for _, item := range remark.Items {
+			sales[item.ProductId] += item.Quantity
+		}
+	}
+	for productId, quantity := range sales {
+		err = tx.Model(&model.Product{}).Where("id = ?", productId).
+			UpdateColumn("sales", gorm.Expr("sales + ?", quantity)).Error
+		if err != nil {
+			return 0, fmt.Errorf("error with update product sales: %v", err)
+		}
+	}
+	return vipExpireAt, nil
+}
+
+// extendVip 顺延用户的会员到期时间，未到期时在原到期时间上顺延，已经到期时从现在开始计算，返回新的到期时间
+func (h *PaymentHandler) extendVip(tx *gorm.DB, userId uint, days int) (int64, error) {
+	var user model.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "expired_time").Where("id", userId).First(&user).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with fetch user info: %v", err)
+	}
+	start := time.Now()
+	if user.ExpiredTime > start.Unix() {
+		start = time.Unix(user.ExpiredTime, 0)
+	}
+	expireAt := start.AddDate(0, 0, days).Unix()
+	err = tx.Model(&model.User{}).Where("id", userId).
+		UpdateColumns(map[string]interface{}{"vip": true, "expired_time": expireAt}).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with extend vip: %v", err)
+	}
+	return expireAt, nil
+}
+
+// logFulfillment 记录订单履约日志，没有发放算力的会员续费也会记录。vipExpireAt 为顺延之后的会员到期时间，
+// periodEnd 为自动续费订单顺延之后的订阅周期结束时间，没有顺延时为 0
+func (h *PaymentHandler) logFulfillment(tx *gorm.DB, order model.Order, remark types.OrderRemark, vipExpireAt int64, periodEnd int64) error {
+	var user model.User
+	err := tx.Select("id", "username").Where("id", order.Receiver()).First(&user).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch user info: %v", err)
+	}
+
+	opts := make([]string, 0)
+	if remark.Power > 0 {
+		opts = append(opts, fmt.Sprintf("充值算力 %d", remark.Power))
+	}
+	if remark.Bonus > 0 {
+		opts = append(opts, fmt.Sprintf("满额赠送算力 %d", remark.Bonus))
+	}
+	days := 0
+	if vipExpireAt > 0 {
+		days = remark.Days
+		opt := fmt.Sprintf("会员延期 %d 天，到期时间 %s", days, utils.Stamp2str(vipExpireAt))
+		if remark.TotalPower() == 0 {
+			opt += "，只延期不增加算力"
+		}
+		opts = append(opts, opt)
+	}
+	if periodEnd > 0 {
+		opts = append(opts, fmt.Sprintf("订阅周期顺延至 %s", utils.Stamp2str(periodEnd)))
+	}
+	if len(opts) == 0 {
+		opts = append(opts, "没有发放权益")
+	}
+	err = tx.Create(&model.FulfillmentLog{
+		OrderNo:   order.OrderNo,
+		UserId:    user.Id,
+		Username:  user.Username,
+		PayWay:    order.PayWay,
+		Opt:       strings.Join(opts, "，"),
+		Power:     remark.TotalPower(),
+		Days:      days,
+		ExpireAt:  vipExpireAt,
+		ManualBy:  remark.ManualBy,
+		CreatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error with create fulfillment log: %v", err)
+	}
+	return nil
+}
+
+// rechargeBonus 返回实付金额可以达到的最高档位赠送的算力
+func (h *PaymentHandler) rechargeBonus(cents int64) int {
+	var bonus int
+	var level int64
+	for _, tier := range h.App.SysConfig.RechargeBonusTiers {
+		amount := utils.YuanToCents(tier.Amount)
+		if tier.Power > 0 && cents >= amount && amount >= level {
+			bonus = tier.Power
+			level = amount
+		}
+	}
+	return bonus
+}
+
+// grantBonus 发放充值满额赠送的算力，单独记录一条算力日志方便对账
+func (h *PaymentHandler) grantBonus(tx *gorm.DB, order model.Order, user model.User, remark types.OrderRemark) error {
+	err := tx.Model(&model.User{}).Where("id", user.Id).
+		UpdateColumn("power", gorm.Expr("power + ?", remark.Bonus)).Error
+	if err != nil {
+		return fmt.Errorf("error with increase user power: %v", err)
+	}
+	err = service.AddBucketPowerGrant(tx, user.Id, types.PowerGift, remark.Bucket, remark.Bonus, service.PowerExpireAt(h.App.SysConfig.PowerExpireDays))
+	if err != nil {
+		return fmt.Errorf("error with create power grant: %v", err)
+	}
+	err = tx.Create(&model.PowerLog{
+		UserId:    user.Id,
+		Username:  user.Username,
+		Type:      types.PowerGift,
+		Amount:    remark.Bonus,
+		Balance:   user.Power + remark.Bonus,
+		Mark:      types.PowerAdd,
+		Model:     order.PayWay,
+		Remark:    fmt.Sprintf("充值满额赠送算力，金额：%s，订单号：%s", utils.FormatCents(order.Cents()), order.OrderNo),
+		CreatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("error with create power log: %v", err)
+	}
+	return nil
+}
+
+// grantReferralReward 被邀请用户首次购买成功之后奖励邀请人算力，通过用户的奖励标记保证只奖励一次，
+// 返回获得奖励的邀请人和奖励的算力，记录在订单中，订单全额退款时扣回。
+// 邀请人是付款人自己、受赠人或者和付款人使用相同 IP 时视为自己邀请自己，不发放奖励
+func (h *PaymentHandler) grantReferralReward(tx *gorm.DB, order model.Order) (uint, int, error) {
+	if h.App.SysConfig == nil || h.App.SysConfig.ReferralPower <= 0 {
+		return 0, 0, nil
+	}
+	var payer model.User
+	err := tx.Select("id", "username", "referrer_id", "referral_rewarded").Where("id", order.UserId).First(&payer).Error
+	if err != nil {
+		return 0, 0, fmt.Errorf("error with fetch user info: %v", err)
+	}
+	if payer.ReferrerId == 0 || payer.ReferralRewarded || payer.ReferrerId == payer.Id || payer.ReferrerId == order.BeneficiaryId {
+		return 0, 0, nil
+	}
+	// 只奖励首次购买，功能上线之前已经购买过的用户不再奖励
+	var paid int64
+	err = tx.Model(&model.Order{}).Where("user_id = ? AND status = ? AND id <> ?", payer.Id, types.OrderPaidSuccess, order.Id).
+		Count(&paid).Error
+	if err != nil {
+		return 0, 0, fmt.Errorf("error with count paid orders: %v", err)
+	}
+	if paid > 0 {
+		return 0, 0, nil
+	}
+	var referrer model.User
+	err = tx.Where("id", payer.ReferrerId).First(&referrer).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("error with fetch referrer: %v", err)
+	}
+	if order.ClientIP != "" && referrer.LastLoginIp == order.ClientIP {
+		logger.Warnf("用户 %s 的邀请人 %s 与下单 IP 相同，不发放邀请奖励，订单号：%s", payer.Username, referrer.Username, order.OrderNo)
+		return 0, 0, nil
+	}
+
+	res := tx.Model(&model.User{}).Where("id = ? AND referral_rewarded = ?", payer.Id, false).UpdateColumn("referral_rewarded", true)
+	if res.Error != nil {
+		return 0, 0, fmt.Errorf("error with update referral reward flag: %v", res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return 0, 0, nil
+	}
+	power := h.App.SysConfig.ReferralPower
+	err = tx.Model(&model.User{}).Where("id", referrer.Id).UpdateColumn("power", gorm.Expr("power + ?", power)).Error
+	if err != nil {
+		return 0, 0, fmt.Errorf("error with increase referrer power: %v", err)
+	}
+	err = service.AddPowerGrant(tx, referrer.Id, types.PowerInvite, power, 0)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error with create power grant: %v", err)
+	}
+	err = tx.Create(&model.PowerLog{
+		UserId:    referrer.Id,
+		Username:  referrer.Username,
+		Type:      types.PowerInvite,
+		Amount:    power,
+		Balance:   referrer.Power + power,
+		Mark:      types.PowerAdd,
+		Remark:    fmt.Sprintf("邀请用户首次购买奖励，用户：%s，订单号：%s", payer.Username, order.OrderNo),
+		CreatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return 0, 0, fmt.Errorf("error with create power log: %v", err)
+	}
+	return referrer.Id, power, nil
+}
+
+// RefundOrder 订单原路退款，并按退款比例扣回订单发放的算力。
+// amount 为退款金额（分），小于等于 0 表示退还剩余全部金额，全部退款之后订单状态变为已退款。
+// 扣回权益和更新退款状态分别在两个事务中完成，调用渠道退款接口时不持有订单和用户的行锁。
+// 提交失败的退款保持待提交状态，再次退款时使用相同的退款请求号重新提交，渠道按照请求号去重
+func (h *PaymentHandler) RefundOrder(orderNo string, amount int64, reason string, adminId uint) error {
+	defer h.statusCache.Delete(orderNo)
+	refund, err := h.prepareRefund(orderNo, amount, adminId)
+	if err != nil || refund == nil {
+		return err
+	}
+	refundNo, err := refund.refunder.Refund(refund.order, payment.RefundParams{
+		RefundNo: refundRequestNo(orderNo, refund.index),
+		Amount:   refund.amount,
+		Reason:   reason,
+	})
+	if err != nil {
+		return fmt.Errorf("error with refund order: %v", err)
+	}
+	return h.finishRefund(orderNo, refund.index, refundNo)
+}
+
+// pendingRefund 已经扣回权益，等待提交到支付渠道的退款
+type pendingRefund struct {
+	order    model.Order
+	refunder payment.Refunder
+	index    int   // 第几次退款，从 0 开始，用于生成退款请求号
+	amount   int64 // 退款金额（分）
+}
+
+// prepareRefund 锁定订单，扣回权益并记录一笔待提交的退款。订单已经全部退款时返回 nil，
+// 有待提交的退款时返回这一笔退款，不会重复扣回权益
+func (h *PaymentHandler) prepareRefund(orderNo string, amount int64, adminId uint) (*pendingRefund, error) {
+	var refund *pendingRefund
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		var order model.Order
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_no = ?", orderNo).First(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch order: %v", err)
+		}
+		if order.Status == types.OrderRefunded {
+			return nil
+		}
+		if order.Status != types.OrderPaidSuccess {
+			return errors.New("订单未支付，无法退款")
+		}
+
+		gateway, ok := h.orderGateway(order)
+		if !ok {
+			return fmt.Errorf("支付渠道 %s 未启用或者不存在", order.PayWay)
+		}
+		refunder, ok := gateway.(payment.Refunder)
+		if !ok {
+			return fmt.Errorf("支付渠道 %s 不支持退款", order.PayWay)
+		}
+
+		var remark types.OrderRemark
+		err = types.DecodeOrderRemark(order.Remark, &remark)
+		if err != nil {
+			return fmt.Errorf("error with decode order remark: %v", err)
+		}
+		if order.RefundStatus == payment.RefundPending && len(remark.Refunds) > 0 {
+			index := len(remark.Refunds) - 1
+			logger.Warnf("订单 %s 有待提交的退款，重新提交，退款金额：%s", orderNo, utils.FormatCents(remark.Refunds[index].Amount))
+			refund = &pendingRefund{order: order, refunder: refunder, index: index, amount: remark.Refunds[index].Amount}
+			return nil
+		}
+
+		remain := order.Cents() - remark.RefundedCents()
+		if amount <= 0 {
+			amount = remain
+		}
+		if amount > remain {
+			return fmt.Errorf("退款金额超出可退金额 %s", utils.FormatCents(remain))
+		}
+		fully := amount == remain
+
+		// 按照退款比例扣回算力，最后一次退款扣回剩余的全部算力，避免舍入误差
+		power := remark.TotalPower() - remark.RevokedPower()
+		if !fully {
+			power = int(int64(remark.TotalPower()) * amount / order.Cents())
+		}
+
+		// 先扣回算力再发起退款，渠道退款失败时退款保持待提交状态，已经扣回的算力不会退回
+		deducted, err := h.revokeBenefit(tx, order, remark.Bucket, power,
+			fmt.Sprintf("订单退款，扣回算力，退款金额：%s，订单号：%s", utils.FormatCents(amount), order.OrderNo))
+		if err != nil {
+			return err
+		}
+		// 组合支付抵扣的算力按照退款比例退回给下单用户，最后一次退款退回剩余的全部算力
+		powerPaid := remark.PowerPaid - remark.RefundedPowerPaid()
+		if !fully {
+			powerPaid = int(int64(remark.PowerPaid) * amount / order.Cents())
+		}
+		if powerPaid > 0 {
+			err = h.returnPowerPaid(tx, order, powerPaid)
+			if err != nil {
+				return err
+			}
+		}
+		// 会员天数在全额退款时扣回
+		if fully && remark.Days > 0 {
+			err = h.revokeVip(tx, order.Receiver(), remark.Days)
+			if err != nil {
+				return err
+			}
+		}
+		// 邀请奖励按照首次购买发放，订单全额退款之后扣回
+		if fully && remark.ReferralPower > 0 {
+			_, err = h.revokePower(tx, remark.ReferrerId, order.PayWay, types.PowerBucketDefault, remark.ReferralPower,
+				fmt.Sprintf("邀请用户的首次购买订单已退款，扣回邀请奖励，订单号：%s", order.OrderNo))
+			if err != nil {
+				return err
+			}
+		}
+		if fully {
+			err = tx.Model(&model.Product{}).Where("id = ? AND sales > 0", order.ProductId).
+				UpdateColumn("sales", gorm.Expr("sales - ?", 1)).Error
+			if err != nil {
+				return fmt.Errorf("error with update product sales: %v", err)
+			}
+		}
+
+		remark.Refunds = append(remark.Refunds, types.RefundRemark{
+			Amount:    amount,
+			Power:     deducted,
+			RefundBy:  adminId,
+			RefundAt:  time.Now().Unix(),
+			Status:    payment.RefundPending,
+			PowerPaid: powerPaid,
+		})
+		order.Remark = utils.JsonEncode(remark)
+		order.RefundCents = remark.RefundedCents()
+		order.RefundStatus = payment.RefundPending
+		err = tx.Updates(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with update order info: %v", err)
+		}
+		refund = &pendingRefund{order: order, refunder: refunder, index: len(remark.Refunds) - 1, amount: amount}
+		return nil
+	})
+	return refund, err
+}
+
+// revokeVip 扣回会员天数，扣回之后已经到期的取消会员身份
+func (h *PaymentHandler) revokeVip(tx *gorm.DB, userId uint, days int) error {
+	var user model.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Select("id", "expired_time").Where("id", userId).First(&user).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch user info: %v", err)
+	}
+	now := time.Now().Unix()
+	if user.ExpiredTime <= now {
+		return nil
+	}
+	expireAt := max(time.Unix(user.ExpiredTime, 0).AddDate(0, 0, -days).Unix(), now)
+	err = tx.Model(&model.User{}).Where("id", userId).
+		UpdateColumns(map[string]interface{}{"vip": expireAt > now, "expired_time": expireAt}).Error
+	if err != nil {
+		return fmt.Errorf("error with revoke vip: %v", err)
+	}
+	return nil
+}
+
+// returnPowerPaid 退款时把组合支付抵扣的算力退回给下单用户
+func (h *PaymentHandler) returnPowerPaid(tx *gorm.DB, order model.Order, amount int) error {
+	err := tx.Model(&model.User{}).Where("id", order.UserId).UpdateColumn("power", gorm.Expr("power + ?", amount)).Error
+	if err != nil {
+		return fmt.Errorf("error with increase user power: %v", err)
+	}
+	err = service.AddPowerGrant(tx, order.UserId, types.PowerRefund, amount, 0)
+	if err != nil {
+		return fmt.Errorf("error with create power grant: %v", err)
+	}
+	var user model.User
+	err = tx.Where("id", order.UserId).First(&user).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch user info: %v", err)
+	}
+	return tx.Create(&model.PowerLog{
+		UserId:    user.Id,
+		Username:  user.Username,
+		Type:      types.PowerRefund,
+		Amount:    amount,
+		Balance:   user.Power,
+		Mark:      types.PowerAdd,
+		Model:     order.PayWay,
+		Remark:    fmt.Sprintf("订单退款，退回组合支付抵扣的算力，订单号：%s", order.OrderNo),
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// finishRefund 渠道受理退款之后记录渠道的退款交易号，全部退款之后订单状态变为已退款
+func (h *PaymentHandler) finishRefund(orderNo string, index int, refundNo string) error {
+	return h.DB.Transaction(func(tx *gorm.DB) error {
+		var order model.Order
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_no = ?", orderNo).First(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch order: %v", err)
+		}
+		var remark types.OrderRemark
+		err = types.DecodeOrderRemark(order.Remark, &remark)
+		if err != nil {
+			return fmt.Errorf("error with decode order remark: %v", err)
+		}
+		// 并发重新提交同一笔退款时只更新一次
+		if index >= len(remark.Refunds) || remark.Refunds[index].Status != payment.RefundPending {
+			return nil
+		}
+		remark.Refunds[index].RefundNo = refundNo
+		remark.Refunds[index].Status = payment.RefundProcessing
+		order.Remark = utils.JsonEncode(remark)
+		order.RefundStatus = payment.RefundProcessing
+		if remark.RefundedCents() >= order.Cents() {
+			order.Status = types.OrderRefunded
+		}
+		err = tx.Updates(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with update order info: %v", err)
+		}
+		return nil
+	})
+}
+
+// refundRequestNo 订单第 index 次（从 0 开始）退款的退款请求号，同一次退款使用固定的请求号，重复提交不会重复退款
+func refundRequestNo(orderNo string, index int) string {
+	return fmt.Sprintf("%s%02d", orderNo, index+1)
+}
+
+// RefundState 订单退款状态的查询结果
+type RefundState struct {
+	Status   string               // 最近一次退款的状态
+	Refunded int64                // 渠道确认已退款的金额（分）
+	Refunds  []types.RefundRemark // 每一次退款的记录和状态
+}
+
+// QueryRefund 向支付渠道查询订单每一次退款的状态，并更新到订单中。
+// 退款失败不会自动退回已经扣回的算力，需要管理员核实之后处理
+func (h *PaymentHandler) QueryRefund(orderNo string) (RefundState, error) {
+	var state RefundState
+	var order model.Order
+	err := h.DB.Where("order_no = ?", orderNo).First(&order).Error
+	if err != nil {
+		return state, fmt.Errorf("error with fetch order: %v", err)
+	}
+	var remark types.OrderRemark
+	err = types.DecodeOrderRemark(order.Remark, &remark)
+	if err != nil {
+		return state, fmt.Errorf("error with decode order remark: %v", err)
+	}
+	if len(remark.Refunds) == 0 {
+		return state, errors.New("订单没有退款记录")
+	}
+	gateway, ok := h.orderGateway(order)
+	if !ok {
+		return state, fmt.Errorf("支付渠道 %s 未启用或者不存在", order.PayWay)
+	}
+	querier, ok := gateway.(payment.RefundQuerier)
+	if !ok {
+		return state, fmt.Errorf("支付渠道 %s 不支持查询退款状态", order.PayWay)
+	}
+
+	// 先查询渠道再锁定订单更新，避免在事务中等待渠道接口
+	statuses := make([]string, len(remark.Refunds))
+	for i := range remark.Refunds {
+		// 还没有提交到渠道的退款需要重新发起退款，不能查询
+		if remark.Refunds[i].Status == payment.RefundPending {
+			statuses[i] = payment.RefundPending
+			continue
+		}
+		result, err := querier.RefundQuery(order, refundRequestNo(order.OrderNo, i))
+		if err != nil {
+			return state, err
+		}
+		statuses[i] = result.Status
+		if result.Status == payment.RefundSuccess {
+			state.Refunded += result.Amount
+		}
+		if result.Status == payment.RefundFailed {
+			logger.Warnf("订单 %s 第 %d 次退款失败，退款金额：%s，需要人工处理", orderNo, i+1, utils.FormatCents(remark.Refunds[i].Amount))
+		}
+	}
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("order_no = ?", orderNo).First(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch order: %v", err)
+		}
+		remark = types.OrderRemark{}
+		err = types.DecodeOrderRemark(order.Remark, &remark)
+		if err != nil {
+			return fmt.Errorf("error with decode order remark: %v", err)
+		}
+		// 查询期间可能又发起了新的退款，只更新已经查询过的退款记录
+		for i := 0; i < len(statuses) && i < len(remark.Refunds); i++ {
+			remark.Refunds[i].Status = statuses[i]
+		}
+		order.RefundStatus = remark.Refunds[len(remark.Refunds)-1].Status
+		return tx.Model(&order).UpdateColumns(map[string]interface{}{
+			"remark":        utils.JsonEncode(remark),
+			"refund_status": order.RefundStatus,
+		}).Error
+	})
+	if err != nil {
+		return state, err
+	}
+	state.Status = order.RefundStatus
+	state.Refunds = remark.Refunds
+	return state, nil
+}
+
+// revokeBenefit 扣回订单发放的算力，用户算力不足时最多扣到 0，返回实际扣回的算力
+func (h *PaymentHandler) revokeBenefit(tx *gorm.DB, order model.Order, bucket string, power int, remark string) (int, error) {
+	return h.revokePower(tx, order.Receiver(), order.PayWay, bucket, power, remark)
+}
+
+// revokePower 扣回用户的算力，用户算力不足时最多扣到 0，返回实际扣回的算力
+func (h *PaymentHandler) revokePower(tx *gorm.DB, userId uint, payWay string, bucket string, power int, remark string) (int, error) {
+	var user model.User
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id", userId).First(&user).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with fetch user info: %v", err)
+	}
+
+	deduct := max(min(power, user.Power), 0)
+	if deduct > 0 {
+		err = tx.Model(&model.User{}).Where("id", user.Id).
+			UpdateColumn("power", gorm.Expr("power - ?", deduct)).Error
+		if err != nil {
+			return 0, fmt.Errorf("error with decrease user power: %v", err)
+		}
+		err = service.ConsumePowerGrants(tx, user.Id, bucket, deduct)
+		if err != nil {
+			return 0, fmt.Errorf("error with decrease user power: %v", err)
+		}
+	}
+	err = tx.Create(&model.PowerLog{
+		UserId:    user.Id,
+		Username:  user.Username,
+		Type:      types.PowerRevoke,
+		Amount:    deduct,
+		Balance:   user.Power - deduct,
+		Mark:      types.PowerSub,
+		Model:     payWay,
+		Remark:    remark,
+		CreatedAt: time.Now(),
+	}).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with create power log: %v", err)
+	}
+	return deduct, nil
+}
+
+// GetPayWays 获取支付方式，返回展示名称、图标、排序和支持的平台，前端无需为每个支付方式单独处理
+func (h *PaymentHandler) GetPayWays(c *gin.Context) {
+	payWays := make([]gin.H, 0)
+	_, gateways := h.merchants.Resolve(c.Request.Host)
+	for _, gateway := range gateways.All() {
+		// 沙盒环境的支付方式需要标记出来，前端提示用户当前为测试支付
+		sandbox := false
+		if sandboxer, ok := gateway.(payment.Sandboxer); ok {
+			sandbox = sandboxer.Sandbox()
+		}
+		for _, payType := range gateway.PayTypes() {
+			item := h.payWayItem(gateway.Name(), payType)
+			item["sandbox"] = sandbox
+			// 有最低金额限制的支付方式，前端只在订单金额达到要求时展示
+			if limiter, ok := gateway.(payment.MinAmounter); ok && limiter.MinAmount(payType) > 0 {
+				item["min_amount"] = limiter.MinAmount(payType)
+			}
+			payWays = append(payWays, item)
+		}
+	}
+	payWays = append(payWays, h.payWayItem("balance", "power"))
+	sort.SliceStable(payWays, func(i, j int) bool {
+		return payWays[i]["sort"].(int) < payWays[j]["sort"].(int)
+	})
+	resp.SUCCESS(c, payWays)
+}
+
+// 支付类型的默认展示名称，没有配置名称时使用
+var payTypeNames = map[string]string{
+	"alipay":                "支付宝",
+	payment.PayTypeAlipayFq: "花呗分期",
+	"wxpay":                 "微信支付",
+	payment.PayTypeWxMini:   "微信支付",
+	"qqpay":                 "QQ钱包",
+	"jdpay":                 "京东支付",
+	"douyin":                "抖音支付",
+	"paypal":                "PayPal",
+	"card":                  "银行卡",
+	"usdt":                  "USDT",
+	"power":                 "算力余额",
+}
+
+// payWayItem 生成前端展示的支付方式，优先使用同时匹配渠道和支付类型的配置，其次使用只匹配渠道的配置。
+// 没有配置平台时，小程序支付只支持手机端，其他支付方式手机端和电脑端都支持
+func (h *PaymentHandler) payWayItem(payWay string, payType string) gin.H {
+	var display types.PayWayConfig
+	for _, config := range h.App.Config.PayWays {
+		if config.PayWay != payWay {
+			continue
+		}
+		if config.PayType == payType {
+			display = config
+			break
+		}
+		if config.PayType == "" && display.PayWay == "" {
+			display = config
+		}
+	}
+	name := display.Name
+	if name == "" {
+		name = payTypeNames[payType]
+	}
+	if name == "" {
+		name = payType
+	}
+	mobile, pc := true, payType != payment.PayTypeWxMini
+	if len(display.Platforms) > 0 {
+		mobile, pc = false, false
+		for _, platform := range display.Platforms {
+			switch strings.ToLower(platform) {
+			case "mobile":
+				mobile = true
+			case "pc":
+				pc = true
+			}
+		}
+	}
+	return gin.H{
+		"pay_way":  payWay,
+		"pay_type": payType,
+		"name":     name,
+		"icon":     display.Icon,
+		"sort":     display.Sort,
+		"mobile":   mobile,
+		"pc":       pc,
+	}
+}
+
+// Notify 支付渠道异步回调
+func (h *PaymentHandler) Notify(c *gin.Context) {
+	callbackLog, err := h.saveCallbackLog(c)
+	if err != nil {
+		logger.Warnf("拒绝来自 %s 的支付回调：%v", h.remoteIP(c), err)
+		h.updateCallbackLog(callbackLog, err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.String(http.StatusRequestEntityTooLarge, "fail")
+		} else {
+			c.String(http.StatusBadRequest, "fail")
+		}
+		return
+	}
+	// 回调地址中没有商户 ID 时（如配置了固定的回调地址）按照域名匹配商户
+	gateways := h.merchants.Registry(c.Param("merchant"))
+	if c.Param("merchant") == "" {
+		_, gateways = h.merchants.Resolve(c.Request.Host)
+	}
+	gateway, ok := gateways.Get(c.Param("name"))
+	if !ok {
+		h.updateCallbackLog(callbackLog, errors.New("unknown gateway"))
+		c.String(http.StatusNotFound, "fail")
+		return
+	}
+	start := time.Now()
+	defer func() {
+		metrics.Since(metrics.NotifyDuration, start, gateway.Name())
+	}()
+	if limiter, ok := gateway.(payment.NotifyIPLimiter); ok && len(limiter.NotifyIPs()) > 0 {
+		ip := h.remoteIP(c)
+		if !payment.IPAllowed(limiter.NotifyIPs(), ip) {
+			logger.Warnf("[安全警告] 拒绝来自 %s 的 %s 支付回调", ip, gateway.Name())
+			metrics.Callbacks.WithLabelValues(gateway.Name(), metrics.OutcomeRejected).Inc()
+			h.monitor.Record(gateway.Name(), fmt.Errorf("ip %s not allowed", ip))
+			h.updateCallbackLog(callbackLog, fmt.Errorf("ip %s not allowed", ip))
+			c.String(http.StatusForbidden, "forbidden")
+			return
+		}
+	}
+
+	// 渠道校验回调时可能需要请求渠道接口查询订单，超时返回失败让渠道稍后重新回调
+	verifyCtx, verifySpan := tracing.Start(c.Request.Context(), "payment.gateway.verify",
+		trace.WithAttributes(tracing.Gateway.String(gateway.Name())))
+	timeoutCtx, cancel := context.WithTimeout(verifyCtx, h.payTimeout())
+	defer cancel()
+	result, err := gateway.Notify(c.Request.WithContext(timeoutCtx))
+	metrics.Since(metrics.GatewayDuration, start, gateway.Name(), "verify")
+	tracing.End(verifySpan, err)
+	h.monitor.Record(gateway.Name(), err)
+	logger.Infof("收到 %s 订单支付回调：%+v", gateway.Name(), result)
+	outcome := metrics.OutcomeIgnored
+	if errors.Is(err, payment.ErrGatewayTimeout) {
+		logger.Errorf("%s 回调校验超时，等待渠道重新回调：%v", gateway.Name(), err)
+		outcome = metrics.OutcomeFailed
+		h.updateCallbackLog(callbackLog, err)
+	} else if err != nil {
+		logger.Error("订单校验失败：", err)
+		outcome = metrics.OutcomeFailed
+		h.updateCallbackLog(callbackLog, err)
+	} else if result.OutTradeNo != "" || result.Subscription != nil || result.Dispute != nil { // 非支付成功、订阅和争议变化的通知不需要处理
+		// 回调挂在下单的链路下，同时关联渠道回调请求本身的链路
+		notifyCtx, span := tracing.Start(h.orderTraceContext(c.Request.Context(), result.OutTradeNo), "payment.notify",
+			trace.WithLinks(trace.LinkFromContext(c.Request.Context())),
+			trace.WithAttributes(tracing.Gateway.String(gateway.Name()), tracing.OrderNo.String(result.OutTradeNo),
+				tracing.TradeNo.String(result.TradeId)))
+		// 签名校验通过之后放入队列由后台任务结算，直接给支付渠道返回成功，避免结算慢导致渠道重复回调
+		task := notifyTask{
+			Gateway:      gateway.Name(),
+			OrderNo:      result.OutTradeNo,
+			TradeNo:      result.TradeId,
+			Amount:       result.Amount,
+			Subscription: result.Subscription,
+			Dispute:      result.Dispute,
+			Trace:        tracing.Inject(notifyCtx),
+		}
+		if callbackLog != nil {
+			task.CallbackLogId = callbackLog.Id
+		}
+		err = h.notifyQueue.Push(task)
+		tracing.End(span, err)
+		if err != nil {
+			// 入队失败时返回失败，让支付渠道稍后重新回调
+			logger.Error("error with push notify task: ", err)
+			outcome = metrics.OutcomeFailed
+			h.updateCallbackLog(callbackLog, err)
+		} else {
+			outcome = metrics.OutcomeQueued
+			if callbackLog != nil {
+				h.setCallbackLogResult(callbackLog.Id, "queued")
+			}
+		}
+	} else {
+		h.updateCallbackLog(callbackLog, nil)
+	}
+	metrics.Callbacks.WithLabelValues(gateway.Name(), outcome).Inc()
+
+	if replier, ok := gateway.(payment.NotifyReplier); ok {
+		replier.Reply(c.Writer, err)
+		return
+	}
+	if err != nil {
+		c.String(http.StatusOK, "fail")
 		return
 	}
-
 	c.String(http.StatusOK, "success")
 }
+
+// orderTraceContext 返回下单时记录的链路上下文，订单没有记录链路或者没有启用链路追踪时返回 ctx
+func (h *PaymentHandler) orderTraceContext(ctx context.Context, orderNo string) context.Context {
+	if orderNo == "" || !tracing.Active(ctx) {
+		return ctx
+	}
+	var order model.Order
+	if h.DB.WithContext(ctx).Select("remark").Where("order_no = ?", orderNo).First(&order).Error != nil {
+		return ctx
+	}
+	var remark types.OrderRemark
+	if types.DecodeOrderRemark(order.Remark, &remark) != nil {
+		return ctx
+	}
+	return tracing.Extract(ctx, remark.Trace)
+}
+
+// payTimeout 调用支付渠道接口的超时时间
+func (h *PaymentHandler) payTimeout() time.Duration {
+	if h.App.Config.PayTimeout > 0 {
+		return time.Duration(h.App.Config.PayTimeout) * time.Second
+	}
+	return 10 * time.Second
+}
+
+// notifyTask 签名校验通过等待结算的支付回调
+type notifyTask struct {
+	Gateway       string                     `json:"gateway"`
+	OrderNo       string                     `json:"order_no"`
+	TradeNo       string                     `json:"trade_no"`
+	Amount        string                     `json:"amount"`
+	CallbackLogId uint                       `json:"callback_log_id"`
+	Subscription  *payment.SubscriptionEvent `json:"subscription,omitempty"` // 自动续费订阅的状态变化
+	Dispute       *payment.DisputeEvent      `json:"dispute,omitempty"`      // 交易争议的状态变化
+	Attempts      int                        `json:"attempts,omitempty"`     // 已经失败的次数
+	Trace         map[string]string          `json:"trace,omitempty"`        // 回调的链路上下文，重试时仍然挂在同一条链路下
+}
+
+const (
+	notifyMaxBackoff    = 30 * time.Minute // 失败重试的最大间隔
+	notifyAlertAttempts = 10               // 失败次数达到之后每次失败都记录错误日志，提醒人工处理
+	slowNotifyThreshold = 3 * time.Second
+)
+
+// notifyBackoff 第 attempts 次失败之后的重试间隔：1s, 2s, 4s... 最长 30 分钟
+func notifyBackoff(attempts int) time.Duration {
+	if attempts > 11 {
+		return notifyMaxBackoff
+	}
+	delay := time.Duration(1<<(attempts-1)) * time.Second
+	if delay > notifyMaxBackoff {
+		return notifyMaxBackoff
+	}
+	return delay
+}
+
+// RunNotifyWorker 后台结算队列中的支付回调。消息保存在 Redis 中，处理完成才会删除，
+// 重启时会把上次没有处理完的消息放回队列，订单结算本身是幂等的，重复处理不会重复发放权益。
+// 支付渠道已经收到了成功的响应，不会再次回调，所以结算失败的消息不能丢弃，移到死信队列之后按照退避间隔一直重试
+func (h *PaymentHandler) RunNotifyWorker() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geekai_payment_notify_queue_depth",
+		Help: "Number of verified payment callbacks waiting to be settled.",
+	}, func() float64 {
+		return float64(h.notifyQueue.Len())
+	})
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "geekai_payment_notify_dead_letter_depth",
+		Help: "Number of failed payment callbacks waiting to be retried.",
+	}, func() float64 {
+		return float64(h.notifyQueue.DeadLetterLen())
+	})
+	if n, err := h.notifyQueue.Recover(); err != nil {
+		logger.Error("error with recover payment notify queue: ", err)
+	} else if n > 0 {
+		logger.Infof("Recovered %d unfinished payment notify tasks", n)
+	}
+
+	go func() {
+		logger.Info("Running payment notify worker ...")
+		for {
+			var task notifyTask
+			raw, err := h.notifyQueue.Pop(&task)
+			if err != nil {
+				logger.Error("error with pop payment notify task: ", err)
+				if raw == "" {
+					time.Sleep(time.Second)
+					continue
+				}
+				// 消息格式错误，重试也没有意义，直接丢弃
+				_ = h.notifyQueue.Ack(raw)
+				continue
+			}
+
+			err = h.handleNotifyTask(task)
+			if err == nil {
+				if err = h.notifyQueue.Ack(raw); err != nil {
+					logger.Error("error with ack payment notify task: ", err)
+				}
+				continue
+			}
+			// 失败的消息移到死信队列，不阻塞后面的消息，移动失败时消息留在处理中队列，重启之后恢复
+			task.Attempts++
+			delay := notifyBackoff(task.Attempts)
+			if task.Attempts >= notifyAlertAttempts {
+				logger.Errorf("[人工处理] %s 订单已经结算失败 %d 次，订单号：%s，%v 之后重试", task.Gateway, task.Attempts, task.OrderNo, delay)
+			}
+			if err = h.notifyQueue.Defer(raw, task, delay); err != nil {
+				logger.Error("error with defer payment notify task: ", err)
+			}
+		}
+	}()
+
+	// 把到达重试时间的失败消息放回队列
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			if _, err := h.notifyQueue.Promote(100); err != nil {
+				logger.Error("error with promote payment notify tasks: ", err)
+			}
+		}
+	}()
+}
+
+// handleNotifyTask 处理一次队列中的支付回调，失败时由调用方移到死信队列稍后重试
+func (h *PaymentHandler) handleNotifyTask(task notifyTask) error {
+	start := time.Now()
+	// 结算挂在回调的链路下
+	ctx := tracing.Extract(context.Background(), task.Trace)
+	var err error
+	if task.Subscription != nil {
+		err = h.handleSubscription(ctx, task)
+	} else if task.Dispute != nil {
+		err = h.handleDispute(task.Gateway, *task.Dispute)
+	} else {
+		err = h.notify(ctx, task.OrderNo, task.TradeNo, task.Amount)
+	}
+	if err != nil {
+		logger.Errorf("%s 订单结算失败（第 %d 次），订单号：%s，错误：%v", task.Gateway, task.Attempts+1, task.OrderNo, err)
+	}
+	if elapsed := time.Since(start); elapsed > slowNotifyThreshold {
+		logger.Warnf("%s 支付回调结算过慢，订单号：%s，耗时：%v", task.Gateway, task.OrderNo, elapsed)
+	}
+	if task.CallbackLogId > 0 {
+		result := "success"
+		if err != nil {
+			result = err.Error()
+		}
+		h.setCallbackLogResult(task.CallbackLogId, result)
+	}
+	return err
+}
+
+// handleDispute 记录交易争议（拒付）并通知管理员在截止时间之前处理，同一个争议的重复回调只处理一次。
+// 开启了 DisputeRevokePower 时扣回订单剩余的算力，之后再退款不会重复扣回
+func (h *PaymentHandler) handleDispute(gatewayName string, event payment.DisputeEvent) error {
+	if event.Type == payment.DisputeClosed {
+		err := h.DB.Model(&model.OrderDispute{}).Where("gateway = ? AND dispute_id = ?", gatewayName, event.DisputeId).
+			UpdateColumns(map[string]interface{}{"status": event.Status, "closed_at": time.Now().Unix()}).Error
+		if err != nil {
+			return fmt.Errorf("error with update dispute: %v", err)
+		}
+		logger.Infof("%s 交易争议已结束，争议 ID：%s，结果：%s", gatewayName, event.DisputeId, event.Status)
+		return nil
+	}
+
+	session := h.DB.Where("pay_way", gatewayName)
+	if event.OrderNo != "" {
+		session = session.Where("order_no", event.OrderNo)
+	} else {
+		session = session.Where("trade_no IN ?", event.TradeNos)
+	}
+	var order model.Order
+	err := session.First(&order).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch disputed order: %v", err)
+	}
+
+	dispute := model.OrderDispute{
+		DisputeId: event.DisputeId,
+		Gateway:   gatewayName,
+		OrderNo:   order.OrderNo,
+		UserId:    order.UserId,
+		Amount:    event.Amount,
+		Currency:  event.Currency,
+		Reason:    event.Reason,
+		Status:    event.Status,
+		DueBy:     event.DueBy,
+		CreatedAt: time.Now(),
+	}
+	created := false
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		tx.Model(&model.OrderDispute{}).Where("gateway = ? AND dispute_id = ?", gatewayName, event.DisputeId).Count(&count)
+		if count > 0 {
+			return nil
+		}
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id", order.Id).First(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch order: %v", err)
+		}
+		var remark types.OrderRemark
+		err = types.DecodeOrderRemark(order.Remark, &remark)
+		if err != nil {
+			return fmt.Errorf("error with decode order remark: %v", err)
+		}
+		if h.App.Config.DisputeRevokePower && order.Status == types.OrderPaidSuccess {
+			power := remark.TotalPower() - remark.RevokedPower()
+			deducted, err := h.revokeBenefit(tx, order, remark.Bucket, power,
+				fmt.Sprintf("交易争议，扣回算力，争议金额：%s %s，订单号：%s", event.Amount, event.Currency, order.OrderNo))
+			if err != nil {
+				return err
+			}
+			dispute.PowerRevoked = deducted
+			remark.DisputePower += deducted
+		}
+		err = tx.Create(&dispute).Error
+		if err != nil {
+			return fmt.Errorf("error with create dispute: %v", err)
+		}
+		created = true
+		return tx.Model(&order).UpdateColumns(map[string]interface{}{
+			"disputed": true,
+			"remark":   utils.JsonEncode(remark),
+		}).Error
+	})
+	if err != nil || !created {
+		return err
+	}
+
+	logger.Warnf("%s 交易争议，订单号：%s，争议 ID：%s，原因：%s", gatewayName, order.OrderNo, event.DisputeId, event.Reason)
+	deadline := "-"
+	if event.DueBy > 0 {
+		deadline = time.Unix(event.DueBy, 0).Format("2006-01-02 15:04:05")
+	}
+	h.notifier.Notify(notifier.Message{
+		Topic: notifier.TopicDispute,
+		Title: "用户发起交易争议（拒付）",
+		Fields: []notifier.Field{
+			{Name: "订单号", Value: order.OrderNo},
+			{Name: "用户", Value: order.Username},
+			{Name: "争议金额", Value: fmt.Sprintf("%s %s", event.Amount, event.Currency)},
+			{Name: "支付方式", Value: gatewayName},
+			{Name: "争议原因", Value: event.Reason},
+			{Name: "举证截止时间", Value: deadline},
+			{Name: "扣回算力", Value: strconv.Itoa(dispute.PowerRevoked)},
+		},
+	})
+	return nil
+}
+
+// handleSubscription 处理自动续费订阅的状态变化，重复的回调不会重复发放权益
+func (h *PaymentHandler) handleSubscription(ctx context.Context, task notifyTask) error {
+	event := task.Subscription
+	switch event.Type {
+	case payment.SubscriptionStarted:
+		// 首次订阅的订单和普通订单一样结算，结算成功之后记录订阅
+		err := h.notify(ctx, task.OrderNo, task.TradeNo, task.Amount)
+		if err != nil {
+			return err
+		}
+		var order model.Order
+		err = h.DB.Where("order_no = ?", task.OrderNo).First(&order).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch order: %v", err)
+		}
+		var remark types.OrderRemark
+		_ = types.DecodeOrderRemark(order.Remark, &remark)
+		subscription := model.Subscription{
+			UserId:           order.UserId,
+			ProductId:        order.ProductId,
+			PayWay:           task.Gateway,
+			SubscriptionNo:   event.SubscriptionNo,
+			OrderNo:          order.OrderNo,
+			Status:           types.SubscriptionActive,
+			CurrentPeriodEnd: time.Unix(order.PayTime, 0).AddDate(0, 0, remark.Days).Unix(),
+		}
+		return h.DB.Where("pay_way = ? AND subscription_no = ?", task.Gateway, event.SubscriptionNo).
+			FirstOrCreate(&subscription).Error
+	case payment.SubscriptionSigned:
+		return h.startAgreement(task.Gateway, task.OrderNo, event.SubscriptionNo)
+	case payment.SubscriptionRenewed:
+		return h.renewSubscription(ctx, task.Gateway, *event)
+	case payment.SubscriptionFailed:
+		return h.renewalFailed(task.Gateway, *event)
+	case payment.SubscriptionEnded:
+		// 订阅终止之后不再续费，已经发放的会员权益到期之后自然失效，
+		// 用户主动取消（如支付宝解约）的订阅在当前周期结束之前保持取消中的状态，由定时任务置为失效
+		return h.DB.Model(&model.Subscription{}).
+			Where("pay_way = ? AND subscription_no = ? AND (status <> ? OR current_period_end <= ?)",
+				task.Gateway, event.SubscriptionNo, types.SubscriptionCancelling, time.Now().Unix()).
+			UpdateColumns(map[string]interface{}{"status": types.SubscriptionCancelled, "next_charge_at": 0}).Error
+	}
+	return nil
+}
+
+// renewSubscription 续费扣款成功之后生成续费订单并结算，通过交易号保证同一次扣款只生成一个订单
+func (h *PaymentHandler) renewSubscription(ctx context.Context, payWay string, event payment.SubscriptionEvent) error {
+	var subscription model.Subscription
+	err := h.DB.Where("pay_way = ? AND subscription_no = ?", payWay, event.SubscriptionNo).First(&subscription).Error
+	if err != nil {
+		// 首次订阅的回调可能还没有处理，返回错误等待重试
+		return fmt.Errorf("error with fetch subscription %s: %v", event.SubscriptionNo, err)
+	}
+
+	var order model.Order
+	err = h.DB.Where("pay_way = ? AND trade_no = ?", payWay, event.TradeNo).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		order, err = h.createRenewalOrder(subscription, event)
+	}
+	if err != nil {
+		return err
+	}
+	err = h.settle(ctx, order.OrderNo, event.TradeNo, event.Amount, 0)
+	if err != nil {
+		return err
+	}
+
+	if event.PeriodEnd > 0 {
+		return h.DB.Model(&subscription).UpdateColumn("current_period_end", event.PeriodEnd).Error
+	}
+	return nil
+}
+
+// createRenewalOrder 按照订阅产品当前的配置生成续费订单，订单金额以实际扣款金额为准
+func (h *PaymentHandler) createRenewalOrder(subscription model.Subscription, event payment.SubscriptionEvent) (model.Order, error) {
+	var order model.Order
+	var product model.Product
+	err := h.DB.Where("id", subscription.ProductId).First(&product).Error
+	if err != nil {
+		return order, fmt.Errorf("error with fetch product: %v", err)
+	}
+	var user model.User
+	err = h.DB.Where("id", subscription.UserId).First(&user).Error
+	if err != nil {
+		return order, fmt.Errorf("error with fetch user: %v", err)
+	}
+	cents, err := utils.ParseCents(event.Amount)
+	if err != nil {
+		return order, fmt.Errorf("invalid renewal amount %s: %v", event.Amount, err)
+	}
+	orderNo, err := h.snowflake.Next(false)
+	if err != nil {
+		return order, fmt.Errorf("error with generate trade no: %v", err)
+	}
+	currency := event.Currency
+	if currency == "" {
+		currency = product.CurrencyCode()
+	}
+	order = model.Order{
+		UserId:      user.Id,
+		Username:    user.Username,
+		ProductId:   product.Id,
+		OrderNo:     orderNo,
+		TradeNo:     event.TradeNo,
+		Subject:     product.Name,
+		Amount:      utils.CentsToYuan(cents),
+		AmountCents: cents,
+		Currency:    currency,
+		Status:      types.OrderNotPaid,
+		PayWay:      subscription.PayWay,
+		PayType:     "subscription",
+		Remark: utils.JsonEncode(types.OrderRemark{
+			Days:           product.Days,
+			Power:          product.Power,
+			Bucket:         product.Bucket,
+			Name:           product.Name,
+			Price:          product.Price,
+			Discount:       product.Discount,
+			Recurring:      true,
+			SubscriptionNo: subscription.SubscriptionNo,
+		}),
+	}
+	err = h.DB.Create(&order).Error
+	if err != nil {
+		return order, fmt.Errorf("error with create renewal order: %v", err)
+	}
+	return order, nil
+}
+
+// extendSubscription 自动续费订单结算之后把订阅顺延一个周期，需要商户主动扣款的渠道同时更新下次扣款时间，返回新的周期结束时间。
+// 续费订单通过订阅 ID 找到订阅，首期订单通过订单号查找，Stripe 的首期订单结算时订阅还没有创建，直接跳过
+func (h *PaymentHandler) extendSubscription(tx *gorm.DB, order model.Order, remark types.OrderRemark) (int64, error) {
+	var subscription model.Subscription
+	session := tx.Where("pay_way = ?", order.PayWay)
+	if remark.SubscriptionNo != "" {
+		session = session.Where("subscription_no = ?", remark.SubscriptionNo)
+	} else {
+		session = session.Where("order_no = ?", order.OrderNo)
+	}
+	err := session.First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error with fetch subscription: %v", err)
+	}
+
+	start := subscription.CurrentPeriodEnd
+	if start < order.PayTime {
+		start = order.PayTime
+	}
+	periodEnd := time.Unix(start, 0).AddDate(0, 0, remark.Days).Unix()
+	updates := map[string]interface{}{"current_period_end": periodEnd, "failed_attempts": 0}
+	if subscription.Status == types.SubscriptionPastDue {
+		updates["status"] = types.SubscriptionActive
+	}
+	if _, ok := h.charger(order.PayWay); ok && subscription.Status != types.SubscriptionCancelled {
+		updates["next_charge_at"] = periodEnd
+	}
+	err = tx.Model(&subscription).UpdateColumns(updates).Error
+	if err != nil {
+		return 0, fmt.Errorf("error with extend subscription: %v", err)
+	}
+	return periodEnd, nil
+}
+
+// charger 需要商户主动发起续费扣款的支付渠道
+func (h *PaymentHandler) charger(payWay string) (payment.RecurringCharger, bool) {
+	gateway, ok := h.gateways.Get(payWay)
+	if !ok {
+		return nil, false
+	}
+	charger, ok := gateway.(payment.RecurringCharger)
+	return charger, ok
+}
+
+// startAgreement 周期扣款签约成功之后记录订阅，并对首期订单发起扣款，首期扣款失败时进入宽限期按照续费失败处理
+func (h *PaymentHandler) startAgreement(payWay string, orderNo string, agreementNo string) error {
+	charger, ok := h.charger(payWay)
+	if !ok {
+		return fmt.Errorf("gateway %s does not support recurring charge", payWay)
+	}
+	var order model.Order
+	err := h.DB.Where("order_no = ?", orderNo).First(&order).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch order: %v", err)
+	}
+	now := time.Now().Unix()
+	subscription := model.Subscription{
+		UserId:           order.UserId,
+		ProductId:        order.ProductId,
+		PayWay:           payWay,
+		SubscriptionNo:   agreementNo,
+		OrderNo:          order.OrderNo,
+		Status:           types.SubscriptionActive,
+		CurrentPeriodEnd: now,
+		NextChargeAt:     now,
+	}
+	err = h.DB.Where("pay_way = ? AND subscription_no = ?", payWay, agreementNo).FirstOrCreate(&subscription).Error
+	if err != nil {
+		return fmt.Errorf("error with save subscription: %v", err)
+	}
+	if order.Status == types.OrderPaidSuccess || !h.claimCharge(subscription) {
+		return nil
+	}
+	h.chargeSubscription(charger, subscription, &order)
+	return nil
+}
+
+// subscriptionRetryInterval 扣款失败或者处理中的订阅下次尝试扣款的间隔
+const subscriptionRetryInterval = 24 * time.Hour
+
+// ChargeSubscriptions 定时对到期的订阅发起续费扣款，只处理需要商户主动扣款的渠道，Stripe 等渠道由渠道自动续费
+func (h *PaymentHandler) ChargeSubscriptions() {
+	go func() {
+		logger.Info("Running subscription charging ...")
+		for {
+			h.chargeDueSubscriptions()
+			// 已经取消自动续费的订阅在当前周期结束之后失效
+			err := h.DB.Model(&model.Subscription{}).
+				Where("status = ? AND current_period_end < ?", types.SubscriptionCancelling, time.Now().Unix()).
+				UpdateColumn("status", types.SubscriptionCancelled).Error
+			if err != nil {
+				logger.Error("error with expire cancelling subscriptions: ", err)
+			}
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
+
+func (h *PaymentHandler) chargeDueSubscriptions() {
+	var subscriptions []model.Subscription
+	err := h.DB.Where("status IN ? AND next_charge_at > 0 AND next_charge_at <= ?",
+		[]types.SubscriptionStatus{types.SubscriptionActive, types.SubscriptionPastDue}, time.Now().Unix()).
+		Limit(100).Find(&subscriptions).Error
+	if err != nil {
+		logger.Error("error with fetch due subscriptions: ", err)
+		return
+	}
+	for _, subscription := range subscriptions {
+		charger, ok := h.charger(subscription.PayWay)
+		if !ok || !h.claimCharge(subscription) {
+			continue
+		}
+		// 续费金额与首期订单一致，不能超过签约时约定的单次扣款金额
+		var first model.Order
+		err = h.DB.Where("order_no = ?", subscription.OrderNo).First(&first).Error
+		if err != nil {
+			logger.Errorf("error with fetch first order of subscription %s: %v", subscription.SubscriptionNo, err)
+			continue
+		}
+		order, err := h.createRenewalOrder(subscription, payment.SubscriptionEvent{
+			Amount:   utils.FormatCents(first.Cents()),
+			Currency: first.CurrencyCode(),
+		})
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		h.chargeSubscription(charger, subscription, &order)
+	}
+}
+
+// claimCharge 先把下次扣款时间往后推，多个实例同时运行时只有一个实例能够发起扣款
+func (h *PaymentHandler) claimCharge(subscription model.Subscription) bool {
+	res := h.DB.Model(&model.Subscription{}).
+		Where("id = ? AND next_charge_at = ?", subscription.Id, subscription.NextChargeAt).
+		UpdateColumn("next_charge_at", time.Now().Add(subscriptionRetryInterval).Unix())
+	if res.Error != nil {
+		logger.Errorf("error with claim subscription %s: %v", subscription.SubscriptionNo, res.Error)
+		return false
+	}
+	return res.RowsAffected > 0
+}
+
+// chargeSubscription 发起扣款，扣款成功之后和异步回调一样通过 notify 结算订单，
+// 处理中的扣款等待异步回调结算，下次扣款时间已经在 claimCharge 中顺延，不会重复扣款
+func (h *PaymentHandler) chargeSubscription(charger payment.RecurringCharger, subscription model.Subscription, order *model.Order) {
+	result, err := charger.Charge(order, subscription.SubscriptionNo)
+	if err != nil {
+		h.chargeFailed(subscription, err)
+		return
+	}
+	if !result.Success() {
+		logger.Infof("订阅 %s 扣款处理中，订单号：%s，%s", subscription.SubscriptionNo, order.OrderNo, result.Message)
+		return
+	}
+	err = h.notify(context.Background(), order.OrderNo, result.TradeId, result.Amount)
+	if err != nil {
+		logger.Errorf("error with settle subscription order %s: %v", order.OrderNo, err)
+	}
+}
+
+// dunningRetryIntervals 续费扣款失败之后的重试间隔，按照失败次数逐渐拉长，超过宽限期之后不再重试
+var dunningRetryIntervals = []time.Duration{24 * time.Hour, 48 * time.Hour, 96 * time.Hour}
+
+// graceDeadline 续费扣款失败的宽限期截止时间，宽限期内订阅保持有效
+func (h *PaymentHandler) graceDeadline(subscription model.Subscription) time.Time {
+	graceDays := 3
+	if h.App.SysConfig != nil && h.App.SysConfig.SubscriptionGraceDays > 0 {
+		graceDays = h.App.SysConfig.SubscriptionGraceDays
+	}
+	return time.Unix(subscription.CurrentPeriodEnd, 0).AddDate(0, 0, graceDays)
+}
+
+// chargeFailed 主动扣款失败之后进入宽限期，按照重试间隔安排下次扣款，最后一次重试安排在宽限期截止时，
+// 宽限期截止之后扣款仍然失败则解约，订阅失效
+func (h *PaymentHandler) chargeFailed(subscription model.Subscription, reason error) {
+	logger.Warnf("订阅 %s 续费扣款失败：%v", subscription.SubscriptionNo, reason)
+	attempts := subscription.FailedAttempts + 1
+	deadline := h.graceDeadline(subscription)
+	if !time.Now().Before(deadline) {
+		h.lapseSubscription(subscription, attempts, reason.Error())
+		return
+	}
+
+	interval := dunningRetryIntervals[min(attempts, len(dunningRetryIntervals))-1]
+	next := time.Now().Add(interval)
+	if next.After(deadline) {
+		next = deadline
+	}
+	h.recordChargeFailure(subscription, attempts, reason.Error(), next.Unix(), deadline.Unix())
+}
+
+// renewalFailed 渠道自动续费扣款失败的回调，重试由支付渠道安排，最终失败之后渠道会终止订阅
+func (h *PaymentHandler) renewalFailed(payWay string, event payment.SubscriptionEvent) error {
+	var subscription model.Subscription
+	err := h.DB.Where("pay_way = ? AND subscription_no = ?", payWay, event.SubscriptionNo).First(&subscription).Error
+	if err != nil {
+		return fmt.Errorf("error with fetch subscription %s: %v", event.SubscriptionNo, err)
+	}
+	if subscription.Status == types.SubscriptionCancelled {
+		return nil
+	}
+	h.recordChargeFailure(subscription, subscription.FailedAttempts+1, event.Reason, event.NextRetryAt, 0)
+	return nil
+}
+
+// recordChargeFailure 记录扣款失败次数和原因，并给用户发送催缴邮件，nextRetry 为 0 表示不会再重试
+func (h *PaymentHandler) recordChargeFailure(subscription model.Subscription, attempts int, reason string, nextRetry int64, deadline int64) {
+	updates := map[string]interface{}{
+		"status":          types.SubscriptionPastDue,
+		"failed_attempts": attempts,
+		"last_failure":    failureReason(reason),
+	}
+	if subscription.NextChargeAt > 0 && nextRetry > 0 {
+		updates["next_charge_at"] = nextRetry
+	}
+	err := h.DB.Model(&subscription).UpdateColumns(updates).Error
+	if err != nil {
+		logger.Errorf("error with update subscription %s: %v", subscription.SubscriptionNo, err)
+	}
+	go h.sendDunningMail(subscription, attempts, nextRetry, deadline)
+}
+
+// failureReason 扣款失败原因最多保存 255 个字符
+func failureReason(reason string) string {
+	runes := []rune(reason)
+	return string(runes[:min(len(runes), 255)])
+}
+
+// lapseSubscription 超过宽限期仍然扣款失败，解除自动续费并让订阅失效
+func (h *PaymentHandler) lapseSubscription(subscription model.Subscription, attempts int, reason string) {
+	logger.Warnf("订阅 %s 超过宽限期仍然扣款失败，自动解约", subscription.SubscriptionNo)
+	if gateway, ok := h.gateways.Get(subscription.PayWay); ok {
+		if subscriber, ok := gateway.(payment.Subscriber); ok {
+			if err := subscriber.CancelSubscription(subscription.SubscriptionNo); err != nil {
+				logger.Errorf("error with cancel subscription %s: %v", subscription.SubscriptionNo, err)
+			}
+		}
+	}
+	err := h.DB.Model(&subscription).UpdateColumns(map[string]interface{}{
+		"status":          types.SubscriptionCancelled,
+		"next_charge_at":  0,
+		"failed_attempts": attempts,
+		"last_failure":    failureReason(reason),
+	}).Error
+	if err != nil {
+		logger.Errorf("error with update subscription %s: %v", subscription.SubscriptionNo, err)
+	}
+	go h.sendDunningMail(subscription, attempts, 0, 0)
+}
+
+// sendDunningMail 续费扣款失败的催缴邮件，随着失败次数增加提醒的措辞逐渐加重，nextRetry 为 0 表示自动续费已经终止
+func (h *PaymentHandler) sendDunningMail(subscription model.Subscription, attempts int, nextRetry int64, deadline int64) {
+	if h.smtpService == nil {
+		return
+	}
+	var user model.User
+	if err := h.DB.Where("id", subscription.UserId).First(&user).Error; err != nil || !utils.IsValidEmail(user.Email) {
+		return
+	}
+	payWay, ok := types.PayMethods[subscription.PayWay]
+	if !ok {
+		payWay = subscription.PayWay
+	}
+
+	var subject, body string
+	switch {
+	case nextRetry == 0:
+		subject = fmt.Sprintf("%s 自动续费已终止", h.smtpService.AppName())
+		body = fmt.Sprintf("您好，%s：\r\n您的自动续费已经连续 %d 次扣款失败，自动续费已终止，会员权益不再续期。如需继续使用，请重新购买。",
+			user.Username, attempts)
+	case attempts == 1:
+		subject = fmt.Sprintf("%s 自动续费扣款失败", h.smtpService.AppName())
+		body = fmt.Sprintf("您好，%s：\r\n您的自动续费通过%s扣款失败，我们将于 %s 再次尝试扣款，请确保账户余额充足。",
+			user.Username, payWay, utils.Stamp2str(nextRetry))
+	default:
+		subject = fmt.Sprintf("【重要】%s 自动续费第 %d 次扣款失败", h.smtpService.AppName(), attempts)
+		body = fmt.Sprintf("您好，%s：\r\n您的自动续费已经连续 %d 次扣款失败，我们将于 %s 再次尝试扣款。",
+			user.Username, attempts, utils.Stamp2str(nextRetry))
+		if deadline > 0 {
+			body += fmt.Sprintf("如果 %s 之前仍然扣款失败，自动续费将会终止，会员权益不再续期。", utils.Stamp2str(deadline))
+		} else {
+			body += "多次扣款失败之后自动续费将会终止，会员权益不再续期。"
+		}
+		body += "请尽快检查您的支付账户。"
+	}
+	if err := h.smtpService.SendMail(user.Email, subject, body); err != nil {
+		logger.Errorf("error with send dunning mail to %s: %v", user.Email, err)
+	}
+}
+
+// remoteIP 请求的真实来源 IP，只有直连地址是可信代理时才读取 X-Forwarded-For，
+// 从右往左跳过可信代理，第一个不可信的地址就是真实来源，防止伪造请求头绕过白名单
+func (h *PaymentHandler) remoteIP(c *gin.Context) string {
+	ip, _, err := net.SplitHostPort(strings.TrimSpace(c.Request.RemoteAddr))
+	if err != nil {
+		ip = c.Request.RemoteAddr
+	}
+	trusted := h.App.Config.TrustedProxies
+	if !payment.IPAllowed(trusted, ip) {
+		return ip
+	}
+	items := strings.Split(c.GetHeader("X-Forwarded-For"), ",")
+	for i := len(items) - 1; i >= 0; i-- {
+		item := strings.TrimSpace(items[i])
+		if item == "" {
+			continue
+		}
+		ip = item
+		if !payment.IPAllowed(trusted, item) {
+			break
+		}
+	}
+	return ip
+}
+
+// maxCallbackBody 支付回调请求体的大小上限，渠道的回调通知都远小于这个大小
+const maxCallbackBody = 64 << 10
+
+// saveCallbackLog 在处理回调之前保存原始请求，读取之后把请求体放回去，不影响渠道的签名校验。
+// 请求体超过大小上限或者读取失败时返回错误，只保存已经读取的部分
+func (h *PaymentHandler) saveCallbackLog(c *gin.Context) (*model.PaymentCallbackLog, error) {
+	body, readErr := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxCallbackBody))
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	item := &model.PaymentCallbackLog{
+		Gateway:   c.Param("name"),
+		Method:    c.Request.Method,
+		URL:       c.Request.URL.String(),
+		Headers:   utils.JsonEncode(c.Request.Header),
+		Body:      string(body),
+		ClientIP:  h.remoteIP(c),
+		CreatedAt: time.Now(),
+	}
+	if err := h.DB.Create(item).Error; err != nil {
+		logger.Error("error with save callback log: ", err)
+		return nil, readErr
+	}
+	return item, readErr
+}
+
+// updateCallbackLog 记录回调的处理结果
+func (h *PaymentHandler) updateCallbackLog(item *model.PaymentCallbackLog, err error) {
+	if item == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = err.Error()
+	}
+	h.setCallbackLogResult(item.Id, result)
+}
+
+func (h *PaymentHandler) setCallbackLogResult(id uint, result string) {
+	if r := []rune(result); len(r) > 1000 {
+		result = string(r[:1000])
+	}
+	h.DB.Model(&model.PaymentCallbackLog{}).Where("id = ?", id).UpdateColumn("result", result)
+}
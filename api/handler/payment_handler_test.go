@@ -0,0 +1,859 @@
+package handler
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core"
+	"geekai/core/types"
+	"geekai/service"
+	"geekai/service/event"
+	"geekai/service/notifier"
+	"geekai/service/payment"
+	"geekai/service/tracing"
+	"geekai/store"
+	"geekai/store/model"
+	"geekai/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/glebarez/sqlite"
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"gorm.io/gorm"
+)
+
+// newTestPaymentHandler 使用 sqlite 和 miniredis 创建没有启用任何支付渠道的 PaymentHandler。
+// sqlite 会忽略 FOR UPDATE，写事务使用 IMMEDIATE 模式串行执行，并发回调的去重只能依赖 payment_events 的唯一索引
+func newTestPaymentHandler(t *testing.T) *PaymentHandler {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s/test.db?_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)", t.TempDir())
+	db, err := gorm.Open(sqlite.Open(dsn), store.NewGormConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	err = db.AutoMigrate(&model.User{}, &model.Order{}, &model.Product{}, &model.PaymentEvent{},
+		&model.PowerLog{}, &model.PowerGrant{}, &model.PowerHold{}, &model.FulfillmentLog{}, &model.WebhookDelivery{}, &model.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec("CREATE UNIQUE INDEX gateway_trade_no ON chatgpt_payment_events (gateway, trade_no)").Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisCli := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	appConfig := &types.AppConfig{StaticDir: t.TempDir()}
+	server := &core.AppServer{Config: appConfig, SysConfig: &types.SystemConfig{}}
+	notifierService := notifier.NewService(appConfig)
+	h, err := NewPaymentHandler(server, nil, nil, nil, nil, nil, nil, payment.NewCryptoService(appConfig, db), db, nil, nil,
+		service.NewWebsocketService(), nil, service.NewWebhookService(appConfig, db), notifierService,
+		service.NewOrderStatusCache(redisCli), service.NewOrderCaptchaService(appConfig, redisCli),
+		service.NewQrcodeLogoService(appConfig, embed.FS{}), nil, event.NewBus(appConfig),
+		payment.NewCallbackMonitor(appConfig, notifierService), redisCli, embed.FS{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// fakeGateway 测试用的支付渠道，记录下单次数，crypto 为 true 时模拟加密货币渠道在订单备注中写入收款地址，
+// 支付回调返回 notify
+type fakeGateway struct {
+	payURL string
+	crypto bool
+	pays   int
+	notify payment.NotifyVo
+}
+
+func (g *fakeGateway) Name() string {
+	return "fake"
+}
+
+func (g *fakeGateway) PayTypes() []string {
+	return []string{"fake"}
+}
+
+func (g *fakeGateway) Pay(order *model.Order, ctx payment.PayContext) (string, error) {
+	g.pays++
+	if g.crypto {
+		var remark types.OrderRemark
+		_ = types.DecodeOrderRemark(order.Remark, &remark)
+		remark.Crypto = &types.CryptoRemark{Address: "TTestAddress", Amount: "1.40"}
+		order.Remark = utils.JsonEncode(remark)
+	}
+	return fmt.Sprintf("%s?order_no=%s&n=%d", g.payURL, order.OrderNo, g.pays), nil
+}
+
+func (g *fakeGateway) Notify(request *http.Request) (payment.NotifyVo, error) {
+	return g.notify, nil
+}
+
+// refundGateway 支持退款的测试渠道，记录每次退款请求，fail 为 true 时模拟渠道退款接口失败
+type refundGateway struct {
+	fakeGateway
+	fail    bool
+	refunds []payment.RefundParams
+}
+
+func (g *refundGateway) Refund(order model.Order, params payment.RefundParams) (string, error) {
+	g.refunds = append(g.refunds, params)
+	if g.fail {
+		return "", errors.New("gateway unavailable")
+	}
+	return "R" + params.RefundNo, nil
+}
+
+// newPayOrder 构造一个未保存的算力充值订单，用于提交给支付渠道
+func newPayOrder(user model.User, orderNo string, payType string) model.Order {
+	return model.Order{
+		UserId:      user.Id,
+		Username:    user.Username,
+		ProductId:   1,
+		OrderNo:     orderNo,
+		Subject:     "算力充值",
+		Amount:      9.99,
+		AmountCents: 999,
+		Status:      types.OrderNotPaid,
+		PayWay:      "fake",
+		PayType:     payType,
+		Remark:      utils.JsonEncode(types.OrderRemark{Power: 100, Name: "算力充值", Price: 9.99}),
+	}
+}
+
+// submitTestOrder 调用 submitOrder 下单，返回 HTTP 响应
+func submitTestOrder(h *PaymentHandler, gateway payment.PaymentGateway, order model.Order) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/payment/pay", nil)
+	h.submitOrder(c, gateway, order, payment.PayContext{PayType: order.PayType, ClientIP: "127.0.0.1"})
+	return w
+}
+
+// responsePayURL 解析下单接口返回的支付地址
+func responsePayURL(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var res struct {
+		Code types.BizCode
+		Data string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Code != types.Success {
+		t.Fatalf("submitOrder() body = %s", w.Body.String())
+	}
+	return res.Data
+}
+
+// createTestOrder 创建一个待支付的算力充值订单
+func createTestOrder(t *testing.T, h *PaymentHandler, user model.User, orderNo string, power int) model.Order {
+	t.Helper()
+	order := model.Order{
+		UserId:      user.Id,
+		Username:    user.Username,
+		OrderNo:     orderNo,
+		Subject:     "算力充值",
+		Amount:      9.99,
+		AmountCents: 999,
+		Status:      types.OrderNotPaid,
+		PayWay:      "alipay",
+		Remark:      utils.JsonEncode(types.OrderRemark{Power: power, Name: "算力充值", Price: 9.99}),
+	}
+	if err := h.DB.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestSettleDuplicateCallbacks(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "alice"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, user, "202401010001", 100)
+
+	// 支付渠道同时推送多次同一笔交易的回调
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- h.notify(context.Background(), order.OrderNo, "T202401010001", "9.99")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("notify() error = %v", err)
+		}
+	}
+
+	var events int64
+	h.DB.Model(&model.PaymentEvent{}).Where("gateway = ? AND trade_no = ?", "alipay", "T202401010001").Count(&events)
+	if events != 1 {
+		t.Errorf("payment events = %d, want 1", events)
+	}
+	h.DB.First(&user, user.Id)
+	if user.Power != 100 {
+		t.Errorf("user power = %d, want 100", user.Power)
+	}
+	var logs, grants, fulfillments int64
+	h.DB.Model(&model.PowerLog{}).Where("user_id = ? AND type = ?", user.Id, types.PowerRecharge).Count(&logs)
+	if logs != 1 {
+		t.Errorf("power logs = %d, want 1", logs)
+	}
+	h.DB.Model(&model.PowerGrant{}).Where("user_id = ?", user.Id).Count(&grants)
+	if grants != 1 {
+		t.Errorf("power grants = %d, want 1", grants)
+	}
+	h.DB.Model(&model.FulfillmentLog{}).Where("order_no = ?", order.OrderNo).Count(&fulfillments)
+	if fulfillments != 1 {
+		t.Errorf("fulfillment logs = %d, want 1", fulfillments)
+	}
+	h.DB.First(&order, order.Id)
+	if order.Status != types.OrderPaidSuccess || order.TradeNo != "T202401010001" {
+		t.Errorf("order status = %v, trade no = %s", order.Status, order.TradeNo)
+	}
+}
+
+func TestSettleAmountMismatch(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "bob"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, user, "202401010002", 100)
+
+	if err := h.notify(context.Background(), order.OrderNo, "T202401010002", "0.01"); err == nil {
+		t.Fatal("notify() with wrong amount should fail")
+	}
+	// 金额不匹配时事务回滚，支付事件不能保留，否则正确的回调会被当作重复通知
+	var events int64
+	h.DB.Model(&model.PaymentEvent{}).Where("order_no = ?", order.OrderNo).Count(&events)
+	if events != 0 {
+		t.Errorf("payment events = %d, want 0", events)
+	}
+	if err := h.notify(context.Background(), order.OrderNo, "T202401010002", "9.99"); err != nil {
+		t.Fatalf("notify() error = %v", err)
+	}
+	h.DB.First(&user, user.Id)
+	if user.Power != 100 {
+		t.Errorf("user power = %d, want 100", user.Power)
+	}
+}
+
+// 已退款和已取消的订单收到新交易号的回调或者被手动结算时，不能再次发放权益
+func TestSettleTerminalOrders(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "grace"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	for i, status := range []types.OrderStatus{types.OrderRefunded, types.OrderCancelled} {
+		orderNo := fmt.Sprintf("20240106000%d", i)
+		order := createTestOrder(t, h, user, orderNo, 100)
+		h.DB.Model(&order).UpdateColumn("status", status)
+
+		if err := h.notify(context.Background(), orderNo, "T"+orderNo, "9.99"); err != nil {
+			t.Errorf("notify() status %d error = %v", status, err)
+		}
+		if err := h.ManualSettle(context.Background(), orderNo, "M"+orderNo, 1); err == nil {
+			t.Errorf("ManualSettle() status %d should fail", status)
+		}
+		h.DB.First(&order, order.Id)
+		if order.Status != status {
+			t.Errorf("order status = %d, want %d", order.Status, status)
+		}
+	}
+	h.DB.First(&user, user.Id)
+	if user.Power != 0 {
+		t.Errorf("user power = %d, want 0", user.Power)
+	}
+	var fulfillments int64
+	h.DB.Model(&model.FulfillmentLog{}).Count(&fulfillments)
+	if fulfillments != 0 {
+		t.Errorf("fulfillment logs = %d, want 0", fulfillments)
+	}
+}
+
+// 受赠用户删除之后订单标记为待人工处理，即使受赠用户恢复，回调和手动结算也不能再次发放权益
+func TestSettleOrphanedOrder(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	payer := model.User{Username: "heidi"}
+	friend := model.User{Username: "ivan"}
+	if err := h.DB.Create(&payer).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := h.DB.Create(&friend).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, payer, "202401070001", 100)
+	h.DB.Model(&order).UpdateColumn("beneficiary_id", friend.Id)
+	h.DB.Delete(&friend)
+
+	if err := h.notify(context.Background(), order.OrderNo, "T202401070001", "9.99"); err != nil {
+		t.Fatalf("notify() error = %v", err)
+	}
+	h.DB.First(&order, order.Id)
+	if order.Status != types.OrderOrphaned {
+		t.Fatalf("order status = %d, want orphaned", order.Status)
+	}
+
+	// 受赠用户恢复之后重新结算
+	restored := model.User{Username: friend.Username}
+	restored.Id = friend.Id
+	if err := h.DB.Create(&restored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := h.ManualSettle(context.Background(), order.OrderNo, "M202401070001", 1); err == nil {
+		t.Error("ManualSettle() on an orphaned order should fail")
+	}
+	if err := h.notify(context.Background(), order.OrderNo, "T202401070002", "9.99"); err != nil {
+		t.Errorf("notify() error = %v", err)
+	}
+	h.DB.First(&order, order.Id)
+	if order.Status != types.OrderOrphaned {
+		t.Errorf("order status = %d, want orphaned", order.Status)
+	}
+	for _, id := range []uint{payer.Id, friend.Id} {
+		var user model.User
+		h.DB.First(&user, id)
+		if user.Power != 0 {
+			t.Errorf("user %d power = %d, want 0", id, user.Power)
+		}
+	}
+}
+
+// beginBarrier 包装数据库连接池，开启事务之前等待 n 个事务同时到达，用来验证不同订单的结算没有互相等待。
+// sqlite 的写事务本身是串行的，只能验证结算在到达数据库之前可以并行，MySQL 中不同订单的行锁互不影响
+type beginBarrier struct {
+	*sql.DB
+	n       int
+	mu      sync.Mutex
+	arrived int
+	release chan struct{}
+}
+
+func (b *beginBarrier) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	b.mu.Lock()
+	b.arrived++
+	if b.arrived == b.n {
+		close(b.release)
+	}
+	b.mu.Unlock()
+	select {
+	case <-b.release:
+	case <-time.After(5 * time.Second):
+		return nil, errors.New("timeout waiting for concurrent settlements")
+	}
+	return b.DB.BeginTx(ctx, opts)
+}
+
+func TestSettleConcurrentOrders(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "carol"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	const n = 10
+	orders := make([]model.Order, n)
+	for i := range orders {
+		orders[i] = createTestOrder(t, h, user, fmt.Sprintf("2024010200%02d", i), 100)
+	}
+
+	// 开启结算事务之前等待 n 个结算同时到达，结算被全局锁串行化时等待超时
+	sqlDB, err := h.DB.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	barrier := &beginBarrier{DB: sqlDB, n: n, release: make(chan struct{})}
+	h.DB = h.DB.Session(&gorm.Session{Context: context.Background()})
+	h.DB.Statement.ConnPool = barrier
+
+	// 不同订单的回调并发结算，每个订单再推送一次重复回调
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for _, order := range orders {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(orderNo string) {
+				defer wg.Done()
+				errs <- h.notify(context.Background(), orderNo, "T"+orderNo, "9.99")
+			}(order.OrderNo)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("notify() error = %v", err)
+		}
+	}
+
+	var paid, events, logs int64
+	h.DB.Model(&model.Order{}).Where("user_id = ? AND status = ?", user.Id, types.OrderPaidSuccess).Count(&paid)
+	if paid != n {
+		t.Errorf("paid orders = %d, want %d", paid, n)
+	}
+	h.DB.Model(&model.PaymentEvent{}).Count(&events)
+	if events != n {
+		t.Errorf("payment events = %d, want %d", events, n)
+	}
+	h.DB.Model(&model.PowerLog{}).Where("user_id = ?", user.Id).Count(&logs)
+	if logs != n {
+		t.Errorf("power logs = %d, want %d", logs, n)
+	}
+	h.DB.First(&user, user.Id)
+	if user.Power != 100*n {
+		t.Errorf("user power = %d, want %d", user.Power, 100*n)
+	}
+}
+
+func TestSubmitOrderQrcodeFailure(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "dave"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// 上传了损坏的二维码 Logo，生成二维码失败
+	dir := filepath.Join(h.App.Config.StaticDir, "qrcode-logo")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "usdt.png"), []byte("not a png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	gateway := &fakeGateway{payURL: "tron:TTestAddress", crypto: true}
+	w := submitTestOrder(h, gateway, newPayOrder(user, "202401030001", "usdt"))
+	if w.Code == http.StatusOK {
+		t.Fatalf("submitOrder() status = %d, body = %s, want failure", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Body.String(), "qrcode") {
+		t.Errorf("submitOrder() body = %s, want qrcode error", w.Body.String())
+	}
+	var orders int64
+	h.DB.Model(&model.Order{}).Count(&orders)
+	if orders != 0 {
+		t.Errorf("orders = %d, want 0", orders)
+	}
+}
+
+func TestSubmitOrderReusesPendingOrder(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "erin"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	gateway := &fakeGateway{payURL: "https://pay.example.com/cashier"}
+
+	w := submitTestOrder(h, gateway, newPayOrder(user, "202401040001", "fake"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("submitOrder() status = %d, body = %s", w.Code, w.Body.String())
+	}
+	// 重复点击支付，复用第一个订单并重新生成支付地址
+	w = submitTestOrder(h, gateway, newPayOrder(user, "202401040002", "fake"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("submitOrder() status = %d, body = %s", w.Code, w.Body.String())
+	}
+	if got := responsePayURL(t, w); got != "https://pay.example.com/cashier?order_no=202401040001&n=2" {
+		t.Errorf("pay url = %s, want a new pay url for the pending order", got)
+	}
+	var orders int64
+	h.DB.Model(&model.Order{}).Count(&orders)
+	if orders != 1 {
+		t.Errorf("orders = %d, want 1", orders)
+	}
+
+	// 支付方式不同时创建新订单
+	w = submitTestOrder(h, gateway, newPayOrder(user, "202401040003", "other"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("submitOrder() status = %d, body = %s", w.Code, w.Body.String())
+	}
+	h.DB.Model(&model.Order{}).Count(&orders)
+	if orders != 2 {
+		t.Errorf("orders = %d, want 2", orders)
+	}
+
+	// 待支付订单超时之后不再复用
+	h.DB.Model(&model.Order{}).Where("order_no = ?", "202401040001").
+		UpdateColumn("created_at", time.Now().Add(-h.orderTimeout("fake")-time.Minute))
+	w = submitTestOrder(h, gateway, newPayOrder(user, "202401040004", "fake"))
+	if got := responsePayURL(t, w); !strings.Contains(got, "order_no=202401040004") {
+		t.Errorf("pay url = %s, want a new order", got)
+	}
+}
+
+// TestPaymentTrace 下单、渠道下单、支付回调和结算在同一条链路中
+func TestPaymentTrace(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	h := newTestPaymentHandler(t)
+	if err := h.DB.AutoMigrate(&model.PaymentCallbackLog{}); err != nil {
+		t.Fatal(err)
+	}
+	user := model.User{Username: "frank"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	gateway := &fakeGateway{
+		payURL: "https://pay.example.com/cashier",
+		notify: payment.NotifyVo{Status: payment.Success, OutTradeNo: "202401050001", TradeId: "T202401050001", Amount: "9.99"},
+	}
+	h.gateways.Register(gateway)
+
+	w := submitTestOrder(h, gateway, newPayOrder(user, "202401050001", "fake"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("submitOrder() status = %d, body = %s", w.Code, w.Body.String())
+	}
+
+	// 渠道的回调请求是另外一条链路，由 HTTP 中间件创建
+	reqCtx, reqSpan := tracing.Start(context.Background(), "POST /api/payment/notify/:name")
+	w = httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/payment/notify/fake", nil).WithContext(reqCtx)
+	c.Params = gin.Params{{Key: "name", Value: "fake"}}
+	h.Notify(c)
+	reqSpan.End()
+	if w.Body.String() != "success" {
+		t.Fatalf("Notify() body = %s", w.Body.String())
+	}
+
+	var task notifyTask
+	if _, err := h.notifyQueue.Pop(&task); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.handleNotifyTask(task); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	submit, ok := spans["payment.submitOrder"]
+	if !ok {
+		t.Fatal("payment.submitOrder span not recorded")
+	}
+	traceId := submit.SpanContext().TraceID()
+	for _, name := range []string{"payment.gateway.pay", "payment.notify", "payment.settle"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("%s span not recorded", name)
+			continue
+		}
+		if span.SpanContext().TraceID() != traceId {
+			t.Errorf("%s trace id = %s, want %s", name, span.SpanContext().TraceID(), traceId)
+		}
+	}
+	if got := spans["payment.settle"].Parent().SpanID(); got != spans["payment.notify"].SpanContext().SpanID() {
+		t.Errorf("payment.settle parent = %s, want payment.notify", got)
+	}
+	if links := spans["payment.notify"].Links(); len(links) != 1 || links[0].SpanContext.TraceID() != reqSpan.SpanContext().TraceID() {
+		t.Errorf("payment.notify links = %+v, want the callback request", links)
+	}
+	if spans["payment.gateway.verify"].SpanContext().TraceID() != reqSpan.SpanContext().TraceID() {
+		t.Error("payment.gateway.verify should belong to the callback request trace")
+	}
+
+	var order model.Order
+	h.DB.Where("order_no = ?", "202401050001").First(&order)
+	if order.Status != types.OrderPaidSuccess {
+		t.Errorf("order status = %v, want paid", order.Status)
+	}
+}
+
+// 渠道退款失败时退款保持待提交状态，再次退款使用相同的退款请求号重新提交，不会重复扣回算力
+func TestRefundOrderRetry(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	gateway := &refundGateway{fail: true}
+	h.gateways.Register(gateway)
+	user := model.User{Username: "judy"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, user, "202401080001", 100)
+	h.DB.Model(&order).UpdateColumn("pay_way", "fake")
+	if err := h.notify(context.Background(), order.OrderNo, "T202401080001", "9.99"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.RefundOrder(order.OrderNo, 0, "test", 1); err == nil {
+		t.Fatal("RefundOrder() should fail when the gateway fails")
+	}
+	h.DB.First(&order, order.Id)
+	if order.Status != types.OrderPaidSuccess || order.RefundStatus != payment.RefundPending {
+		t.Fatalf("order status = %d, refund status = %s, want paid and pending", order.Status, order.RefundStatus)
+	}
+
+	gateway.fail = false
+	if err := h.RefundOrder(order.OrderNo, 0, "test", 1); err != nil {
+		t.Fatalf("RefundOrder() error = %v", err)
+	}
+	if err := h.RefundOrder(order.OrderNo, 0, "test", 1); err != nil {
+		t.Fatalf("RefundOrder() on a refunded order error = %v", err)
+	}
+	if len(gateway.refunds) != 2 || gateway.refunds[0].RefundNo != gateway.refunds[1].RefundNo {
+		t.Errorf("gateway refunds = %+v, want the same request submitted twice", gateway.refunds)
+	}
+	h.DB.First(&order, order.Id)
+	if order.Status != types.OrderRefunded || order.RefundStatus != payment.RefundProcessing {
+		t.Errorf("order status = %d, refund status = %s, want refunded and processing", order.Status, order.RefundStatus)
+	}
+	var remark types.OrderRemark
+	_ = types.DecodeOrderRemark(order.Remark, &remark)
+	if len(remark.Refunds) != 1 || remark.Refunds[0].RefundNo != "R"+gateway.refunds[0].RefundNo {
+		t.Errorf("refunds = %+v", remark.Refunds)
+	}
+
+	h.DB.First(&user, user.Id)
+	if user.Power != 0 {
+		t.Errorf("user power = %d, want 0", user.Power)
+	}
+	var revokes int64
+	h.DB.Model(&model.PowerLog{}).Where("user_id = ? AND type = ?", user.Id, types.PowerRevoke).Count(&revokes)
+	if revokes != 1 {
+		t.Errorf("revoke logs = %d, want 1", revokes)
+	}
+}
+
+// 全额退款扣回发放的算力和邀请奖励，并退回组合支付抵扣的算力
+func TestRefundOrderBalances(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	h.App.SysConfig.ReferralPower = 50
+	h.gateways.Register(&refundGateway{})
+	referrer := model.User{Username: "kate"}
+	if err := h.DB.Create(&referrer).Error; err != nil {
+		t.Fatal(err)
+	}
+	payer := model.User{Username: "leo", Power: 200, ReferrerId: referrer.Id}
+	if err := h.DB.Create(&payer).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, payer, "202401090001", 100)
+	h.DB.Model(&order).UpdateColumns(map[string]interface{}{
+		"pay_way": "fake",
+		"remark":  utils.JsonEncode(types.OrderRemark{Power: 100, Name: "算力充值", Price: 9.99, PowerPaid: 80}),
+	})
+	if err := h.notify(context.Background(), order.OrderNo, "T202401090001", "9.99"); err != nil {
+		t.Fatal(err)
+	}
+	h.DB.First(&payer, payer.Id)
+	h.DB.First(&referrer, referrer.Id)
+	if payer.Power != 220 || referrer.Power != 50 {
+		t.Fatalf("after settle payer power = %d, referrer power = %d, want 220 and 50", payer.Power, referrer.Power)
+	}
+
+	if err := h.RefundOrder(order.OrderNo, 0, "test", 1); err != nil {
+		t.Fatalf("RefundOrder() error = %v", err)
+	}
+	h.DB.First(&payer, payer.Id)
+	h.DB.First(&referrer, referrer.Id)
+	if payer.Power != 200 {
+		t.Errorf("payer power = %d, want 200", payer.Power)
+	}
+	if referrer.Power != 0 {
+		t.Errorf("referrer power = %d, want 0", referrer.Power)
+	}
+	var remark types.OrderRemark
+	h.DB.First(&order, order.Id)
+	_ = types.DecodeOrderRemark(order.Remark, &remark)
+	if remark.RefundedPowerPaid() != 80 {
+		t.Errorf("returned power paid = %d, want 80", remark.RefundedPowerPaid())
+	}
+}
+
+// 会员订单在未到期的会员有效期上顺延
+func TestSettleExtendsVip(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	expiredTime := time.Now().AddDate(0, 0, 10).Unix()
+	user := model.User{Username: "mike", ExpiredTime: expiredTime}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, user, "202401100001", 0)
+	h.DB.Model(&order).UpdateColumn("remark", utils.JsonEncode(types.OrderRemark{Days: 30, Name: "月卡", Price: 9.99}))
+	if err := h.notify(context.Background(), order.OrderNo, "T202401100001", "9.99"); err != nil {
+		t.Fatal(err)
+	}
+	h.DB.First(&user, user.Id)
+	want := time.Unix(expiredTime, 0).AddDate(0, 0, 30).Unix()
+	if !user.Vip || user.ExpiredTime != want {
+		t.Errorf("vip = %v, expired time = %d, want true and %d", user.Vip, user.ExpiredTime, want)
+	}
+	// 没有发放算力的会员续费也要记录履约日志
+	var log model.FulfillmentLog
+	if err := h.DB.Where("order_no = ?", order.OrderNo).First(&log).Error; err != nil {
+		t.Fatal(err)
+	}
+	if log.Days != 30 || log.ExpireAt != want || log.Power != 0 || !strings.Contains(log.Opt, "只延期不增加算力") {
+		t.Errorf("fulfillment log = %+v", log)
+	}
+}
+
+// 会员订单全额退款之后扣回顺延的会员天数
+func TestRefundOrderRevokesVip(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	h.gateways.Register(&refundGateway{})
+	expiredTime := time.Now().AddDate(0, 0, 10).Unix()
+	user := model.User{Username: "nina", Vip: true, ExpiredTime: expiredTime}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	order := createTestOrder(t, h, user, "202401110001", 0)
+	h.DB.Model(&order).UpdateColumns(map[string]interface{}{
+		"pay_way": "fake",
+		"remark":  utils.JsonEncode(types.OrderRemark{Days: 30, Name: "月卡", Price: 9.99}),
+	})
+	if err := h.notify(context.Background(), order.OrderNo, "T202401110001", "9.99"); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.RefundOrder(order.OrderNo, 0, "test", 1); err != nil {
+		t.Fatalf("RefundOrder() error = %v", err)
+	}
+	h.DB.First(&user, user.Id)
+	if !user.Vip || user.ExpiredTime != expiredTime {
+		t.Errorf("vip = %v, expired time = %d, want true and %d", user.Vip, user.ExpiredTime, expiredTime)
+	}
+}
+
+// 超过大小上限的回调请求直接拒绝，回调日志记录连接的来源 IP，不信任 X-Forwarded-For
+func TestNotifyCallbackLog(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	if err := h.DB.AutoMigrate(&model.PaymentCallbackLog{}); err != nil {
+		t.Fatal(err)
+	}
+	h.gateways.Register(&fakeGateway{})
+	gin.SetMode(gin.TestMode)
+	notify := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodPost, "/api/payment/notify/fake", strings.NewReader(body))
+		c.Request.RemoteAddr = "203.0.113.7:4321"
+		c.Request.Header.Set("X-Forwarded-For", "198.51.100.1")
+		c.Params = gin.Params{{Key: "name", Value: "fake"}}
+		h.Notify(c)
+		return w
+	}
+
+	if w := notify(strings.Repeat("a", maxCallbackBody+1)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Notify() oversized body status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if w := notify("trade_status=TRADE_SUCCESS"); w.Code != http.StatusOK {
+		t.Errorf("Notify() status = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var logs []model.PaymentCallbackLog
+	h.DB.Order("id").Find(&logs)
+	if len(logs) != 2 {
+		t.Fatalf("callback logs = %d, want 2", len(logs))
+	}
+	if len(logs[0].Body) != maxCallbackBody {
+		t.Errorf("oversized body saved %d bytes, want %d", len(logs[0].Body), maxCallbackBody)
+	}
+	for _, log := range logs {
+		if log.ClientIP != "203.0.113.7" {
+			t.Errorf("callback log client ip = %s, want 203.0.113.7", log.ClientIP)
+		}
+	}
+}
+
+func TestCustomPayRangeMessage(t *testing.T) {
+	tests := []struct {
+		min, max float64
+		want     string
+	}{
+		{1, 0, "充值金额不能小于 1.00 元"},
+		{1, 500, "充值金额必须在 1.00 - 500.00 元之间"},
+	}
+	for _, tt := range tests {
+		if got := customPayRangeMessage(tt.min, tt.max); got != tt.want {
+			t.Errorf("customPayRangeMessage(%v, %v) = %q, want %q", tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestLoadSignKey(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	if len(h.signKey) != 32 {
+		t.Fatalf("sign key = %q, want a generated key", h.signKey)
+	}
+	// 重启之后读取数据库中保存的秘钥
+	if got := loadSignKey(h.App.Config, h.DB); got != h.signKey {
+		t.Errorf("sign key after restart = %q, want %q", got, h.signKey)
+	}
+	// 配置文件中的秘钥优先
+	if got := loadSignKey(&types.AppConfig{PaySignKey: "configured"}, h.DB); got != "configured" {
+		t.Errorf("sign key = %q, want configured", got)
+	}
+}
+
+func TestDoPay(t *testing.T) {
+	h := newTestPaymentHandler(t)
+	user := model.User{Username: "grace"}
+	if err := h.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	gateway := &fakeGateway{payURL: "https://pay.example.com/cashier"}
+	h.gateways.Register(gateway)
+	order := newPayOrder(user, "202401070001", "fake")
+	if err := h.DB.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	doPay := func(link string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, link, nil)
+		h.DoPay(c)
+		return w
+	}
+	link := h.payLink("https://ai.example.com/", order.OrderNo)
+	if !strings.HasPrefix(link, "https://ai.example.com/api/payment/doPay?") {
+		t.Fatalf("pay link = %s", link)
+	}
+	// 重启之后之前生成的支付链接仍然有效
+	h.signKey = loadSignKey(h.App.Config, h.DB)
+	w := doPay(link)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://pay.example.com/cashier?order_no=202401070001&n=1" {
+		t.Errorf("DoPay() status = %d, location = %s", w.Code, w.Header().Get("Location"))
+	}
+
+	// 篡改订单号之后签名校验失败
+	w = doPay(strings.Replace(link, "202401070001", "202401070002", 1))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("DoPay() with forged order no status = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if gateway.pays != 1 {
+		t.Errorf("gateway pays = %d, want 1", gateway.pays)
+	}
+}
@@ -9,40 +9,73 @@ package handler
 
 import (
 	"geekai/core"
+	"geekai/service/geoip"
 	"geekai/store/model"
 	"geekai/store/vo"
 	"geekai/utils"
 	"geekai/utils/resp"
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
+	"sort"
 )
 
 type ProductHandler struct {
 	BaseHandler
+	geoip *geoip.Service
 }
 
-func NewProductHandler(app *core.AppServer, db *gorm.DB) *ProductHandler {
-	return &ProductHandler{BaseHandler: BaseHandler{App: app, DB: db}}
+func NewProductHandler(app *core.AppServer, db *gorm.DB, geoipService *geoip.Service) *ProductHandler {
+	return &ProductHandler{BaseHandler: BaseHandler{App: app, DB: db}, geoip: geoipService}
 }
 
-// List 模型列表
+// List 已上架的产品列表，type 参数筛选会员套餐（vip）或者算力包（power），
+// sort 参数按照实际售价从低到高（price）或者销量从高到低（sales）排序，默认按照后台设置的顺序排列
 func (h *ProductHandler) List(c *gin.Context) {
+	session := h.DB.Where("enabled", true)
+	switch c.Query("type") {
+	case "vip":
+		session = session.Where("days > 0")
+	case "power":
+		session = session.Where("days = 0 AND power > 0")
+	}
 	var items []model.Product
+	err := session.Order("sort_num ASC").Find(&items).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
 	var list = make([]vo.Product, 0)
-	res := h.DB.Where("enabled", true).Order("sort_num ASC").Find(&items)
-	if res.Error == nil {
-		for _, item := range items {
-			var product vo.Product
-			err := utils.CopyObject(item, &product)
-			if err == nil {
-				product.Id = item.Id
-				product.CreatedAt = item.CreatedAt.Unix()
-				product.UpdatedAt = item.UpdatedAt.Unix()
-				list = append(list, product)
-			} else {
-				logger.Error(err)
-			}
+	// 展示用户所在国家或地区的价格，与下单时的价格一致
+	country := h.geoip.Country(c.ClientIP())
+	for _, item := range items {
+		item, region := item.ForRegion(country)
+		var product vo.Product
+		err := utils.CopyObject(item, &product)
+		if err != nil {
+			logger.Error(err)
+			continue
 		}
+		product.Region = region
+		product.RegionPrices = nil
+		product.NotifyURL = ""
+		product.ReturnURL = ""
+		product.EffectivePrice = utils.CentsToYuan(utils.YuanToCents(item.Price) - utils.YuanToCents(item.Discount))
+		product.Id = item.Id
+		product.CreatedAt = item.CreatedAt.Unix()
+		product.UpdatedAt = item.UpdatedAt.Unix()
+		list = append(list, product)
+	}
+
+	switch c.Query("sort") {
+	case "price":
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].EffectivePrice < list[j].EffectivePrice
+		})
+	case "sales":
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].Sales > list[j].Sales
+		})
 	}
 	resp.SUCCESS(c, list)
 }
@@ -63,7 +63,7 @@ func (h *SdJobHandler) preCheck(c *gin.Context) bool {
 		return false
 	}
 
-	if user.Power < h.App.SysConfig.SdPower {
+	if service.AvailablePower(h.DB, user.Id, types.PowerBucketImage) < h.App.SysConfig.SdPower {
 		resp.ERROR(c, "当前用户剩余算力不足以完成本次绘画！")
 		return false
 	}
@@ -152,7 +152,7 @@ func (h *SdJobHandler) Image(c *gin.Context) {
 	})
 
 	// update user's power
-	err = h.userService.DecreasePower(job.UserId, job.Power, model.PowerLog{
+	err = h.userService.DecreasePower(job.UserId, job.Power, types.PowerBucketImage, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  "stable-diffusion",
 		Remark: fmt.Sprintf("绘图操作，任务ID：%s", job.TaskId),
@@ -258,11 +258,7 @@ func (h *SdJobHandler) Remove(c *gin.Context) {
 
 	// 如果任务未完成，或者任务失败，则恢复用户算力
 	if job.Progress != 100 {
-		err := h.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-			Type:   types.PowerRefund,
-			Model:  "stable-diffusion",
-			Remark: fmt.Sprintf("任务失败，退回算力。任务ID：%s， Err: %s", job.TaskId, job.ErrMsg),
-		})
+		err := h.sdService.RefundPower(job.Id)
 		if err != nil {
 			tx.Rollback()
 			resp.ERROR(c, err.Error())
@@ -0,0 +1,159 @@
+package handler
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"errors"
+	"geekai/core"
+	"geekai/core/types"
+	"geekai/service/payment"
+	"geekai/store/model"
+	"geekai/store/vo"
+	"geekai/utils"
+	"geekai/utils/resp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// SubscriptionHandler 用户自动续费订阅管理
+type SubscriptionHandler struct {
+	BaseHandler
+	gateways *payment.Registry
+}
+
+func NewSubscriptionHandler(app *core.AppServer, db *gorm.DB, paymentHandler *PaymentHandler) *SubscriptionHandler {
+	return &SubscriptionHandler{BaseHandler: BaseHandler{App: app, DB: db}, gateways: paymentHandler.Gateways()}
+}
+
+// Get 当前的订阅，优先返回还在生效的订阅，没有订阅时返回空
+func (h *SubscriptionHandler) Get(c *gin.Context) {
+	userId := h.GetLoginUserId(c)
+	var subscription model.Subscription
+	err := h.DB.Where("user_id = ? AND status <> ?", userId, types.SubscriptionCancelled).Order("id DESC").First(&subscription).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = h.DB.Where("user_id = ?", userId).Order("id DESC").First(&subscription).Error
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		resp.SUCCESS(c, nil)
+		return
+	}
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+
+	item := vo.Subscription{
+		ProductId:        subscription.ProductId,
+		PayWay:           subscription.PayWay,
+		Status:           string(subscription.Status),
+		CurrentPeriodEnd: subscription.CurrentPeriodEnd,
+		FailedAttempts:   subscription.FailedAttempts,
+		LastFailure:      subscription.LastFailure,
+	}
+	item.Id = subscription.Id
+	item.CreatedAt = subscription.CreatedAt.Unix()
+	item.UpdatedAt = subscription.UpdatedAt.Unix()
+	switch subscription.Status {
+	case types.SubscriptionActive:
+		item.NextRenewalAt = subscription.CurrentPeriodEnd
+	case types.SubscriptionPastDue:
+		item.NextRenewalAt = subscription.NextChargeAt
+	case types.SubscriptionCancelling:
+		item.Resumable = h.resumer(subscription.PayWay) != nil && subscription.CurrentPeriodEnd > time.Now().Unix()
+	}
+	// 续费金额和周期以首期订单为准，产品之后调整价格不影响已有的订阅
+	var order model.Order
+	if h.DB.Where("order_no = ?", subscription.OrderNo).First(&order).Error == nil {
+		var remark types.OrderRemark
+		_ = types.DecodeOrderRemark(order.Remark, &remark)
+		item.ProductName = remark.Name
+		item.Days = remark.Days
+		item.Amount = utils.CentsToYuan(order.Cents())
+		item.Currency = order.CurrencyCode()
+	}
+	resp.SUCCESS(c, item)
+}
+
+// Cancel 取消自动续费，当前周期结束之后不再扣款，已经发放的会员权益到期之后失效
+func (h *SubscriptionHandler) Cancel(c *gin.Context) {
+	var subscription model.Subscription
+	err := h.DB.Where("user_id = ? AND status IN ?", h.GetLoginUserId(c),
+		[]types.SubscriptionStatus{types.SubscriptionActive, types.SubscriptionPastDue}).
+		Order("id DESC").First(&subscription).Error
+	if err != nil {
+		resp.NotFound(c, "没有正在自动续费的订阅")
+		return
+	}
+
+	gateway, ok := h.gateways.Get(subscription.PayWay)
+	if !ok {
+		resp.ERROR(c, "支付渠道已停用，请联系管理员取消自动续费")
+		return
+	}
+	subscriber, ok := gateway.(payment.Subscriber)
+	if !ok {
+		resp.ERROR(c, "该支付渠道不支持取消自动续费")
+		return
+	}
+	err = subscriber.CancelSubscription(subscription.SubscriptionNo)
+	if err != nil {
+		logger.Errorf("error with cancel subscription %s: %v", subscription.SubscriptionNo, err)
+		resp.ERROR(c, "取消自动续费失败，请稍后再试")
+		return
+	}
+
+	err = h.DB.Model(&subscription).UpdateColumn("status", types.SubscriptionCancelling).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// Resume 恢复已取消的自动续费，只能在当前周期结束之前恢复
+func (h *SubscriptionHandler) Resume(c *gin.Context) {
+	var subscription model.Subscription
+	err := h.DB.Where("user_id = ? AND status = ? AND current_period_end > ?", h.GetLoginUserId(c),
+		types.SubscriptionCancelling, time.Now().Unix()).
+		Order("id DESC").First(&subscription).Error
+	if err != nil {
+		resp.NotFound(c, "没有可以恢复的自动续费订阅")
+		return
+	}
+
+	resumer := h.resumer(subscription.PayWay)
+	if resumer == nil {
+		resp.ERROR(c, "该支付渠道取消之后不能恢复自动续费，请在当前周期结束之后重新订阅")
+		return
+	}
+	err = resumer.ResumeSubscription(subscription.SubscriptionNo)
+	if err != nil {
+		logger.Errorf("error with resume subscription %s: %v", subscription.SubscriptionNo, err)
+		resp.ERROR(c, "恢复自动续费失败，请稍后再试")
+		return
+	}
+
+	err = h.DB.Model(&subscription).UpdateColumn("status", types.SubscriptionActive).Error
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c)
+}
+
+// resumer 支持恢复自动续费的支付渠道，渠道未启用或者不支持时返回 nil
+func (h *SubscriptionHandler) resumer(payWay string) payment.SubscriptionResumer {
+	gateway, ok := h.gateways.Get(payWay)
+	if !ok {
+		return nil
+	}
+	resumer, _ := gateway.(payment.SubscriptionResumer)
+	return resumer
+}
@@ -70,7 +70,7 @@ func (h *SunoHandler) Create(c *gin.Context) {
 		return
 	}
 
-	if user.Power < h.App.SysConfig.SunoPower {
+	if service.AvailablePower(h.DB, user.Id, types.PowerBucketDefault) < h.App.SysConfig.SunoPower {
 		resp.ERROR(c, "您的算力不足，请充值后再试！")
 		return
 	}
@@ -133,7 +133,7 @@ func (h *SunoHandler) Create(c *gin.Context) {
 	})
 
 	// update user's power
-	err = h.userService.DecreasePower(job.UserId, job.Power, model.PowerLog{
+	err = h.userService.DecreasePower(job.UserId, job.Power, types.PowerBucketDefault, model.PowerLog{
 		Type:      types.PowerConsume,
 		Remark:    fmt.Sprintf("Suno 文生歌曲，%s", job.ModelName),
 		CreatedAt: time.Now(),
@@ -227,11 +227,7 @@ func (h *SunoHandler) Remove(c *gin.Context) {
 	}
 
 	// 恢复用户算力
-	err = h.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-		Type:   types.PowerRefund,
-		Model:  job.ModelName,
-		Remark: fmt.Sprintf("Suno 任务失败，退回算力。任务ID：%s，Err:%s", job.TaskId, job.ErrMsg),
-	})
+	err = h.sunoService.RefundPower(job.Id)
 	if err != nil {
 		tx.Rollback()
 		resp.ERROR(c, err.Error())
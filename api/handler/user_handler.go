@@ -165,6 +165,7 @@ func (h *UserHandler) Register(c *gin.Context) {
 	// 被邀请人也获得赠送算力
 	if data.InviteCode != "" {
 		user.Power += h.App.SysConfig.InvitePower
+		user.ReferrerId = inviteCode.UserId
 	}
 	if h.licenseService.GetLicense().Configs.DeCopy {
 		user.Nickname = fmt.Sprintf("用户@%d", utils.RandomNumber(6))
@@ -177,6 +178,11 @@ func (h *UserHandler) Register(c *gin.Context) {
 		resp.ERROR(c, err.Error())
 		return
 	}
+	if err := service.AddPowerGrant(tx, user.Id, types.PowerGift, user.Power, 0); err != nil {
+		tx.Rollback()
+		resp.ERROR(c, err.Error())
+		return
+	}
 
 	// 记录邀请关系
 	if data.InviteCode != "" {
@@ -435,6 +441,9 @@ func (h *UserHandler) CLoginCallback(c *gin.Context) {
 			logger.Error(tx.Error)
 			return
 		}
+		if err := service.AddPowerGrant(h.DB, user.Id, types.PowerGift, user.Power, 0); err != nil {
+			logger.Error("error with create power grant: ", err)
+		}
 		session["username"] = user.Username
 		session["password"] = password
 	} else { // login directly
@@ -495,13 +504,14 @@ func (h *UserHandler) Session(c *gin.Context) {
 }
 
 type userProfile struct {
-	Id          uint   `json:"id"`
-	Nickname    string `json:"nickname"`
-	Username    string `json:"username"`
-	Avatar      string `json:"avatar"`
-	Power       int    `json:"power"`
-	ExpiredTime int64  `json:"expired_time"`
-	Vip         bool   `json:"vip"`
+	Id           uint           `json:"id"`
+	Nickname     string         `json:"nickname"`
+	Username     string         `json:"username"`
+	Avatar       string         `json:"avatar"`
+	Power        int            `json:"power"`
+	PowerBuckets map[string]int `json:"power_buckets"` // 各个分组的剩余算力
+	ExpiredTime  int64          `json:"expired_time"`
+	Vip          bool           `json:"vip"`
 }
 
 func (h *UserHandler) Profile(c *gin.Context) {
@@ -521,6 +531,7 @@ func (h *UserHandler) Profile(c *gin.Context) {
 	}
 
 	profile.Id = user.Id
+	profile.PowerBuckets = service.PowerBuckets(h.DB, user.Id)
 	resp.SUCCESS(c, profile)
 }
 
@@ -714,3 +725,35 @@ func (h *UserHandler) BindEmail(c *gin.Context) {
 	_ = h.redis.Del(c, key) // 删除短信验证码
 	resp.SUCCESS(c)
 }
+
+// TransferPower 转赠算力给其他用户
+func (h *UserHandler) TransferPower(c *gin.Context) {
+	var data struct {
+		Username string `json:"username"` // 接收用户的用户名
+		Power    int    `json:"power"`
+	}
+	if err := c.ShouldBindJSON(&data); err != nil || data.Username == "" || data.Power <= 0 {
+		resp.ERROR(c, types.InvalidArgs)
+		return
+	}
+
+	user, err := h.GetLoginUser(c)
+	if err != nil {
+		resp.NotAuth(c)
+		return
+	}
+	var receiver model.User
+	err = h.DB.Where("username", data.Username).First(&receiver).Error
+	if err != nil {
+		resp.ERROR(c, "接收用户不存在")
+		return
+	}
+
+	balance, receiverBalance, err := h.userService.TransferPower(user.Id, receiver.Id, data.Power,
+		h.App.SysConfig.TransferDailyLimit, h.App.SysConfig.TransferMinBalance)
+	if err != nil {
+		resp.ERROR(c, err.Error())
+		return
+	}
+	resp.SUCCESS(c, gin.H{"power": balance, "receiver_power": receiverBalance})
+}
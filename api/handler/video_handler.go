@@ -63,7 +63,7 @@ func (h *VideoHandler) LumaCreate(c *gin.Context) {
 		return
 	}
 
-	if user.Power < h.App.SysConfig.LumaPower {
+	if service.AvailablePower(h.DB, user.Id, types.PowerBucketDefault) < h.App.SysConfig.LumaPower {
 		resp.ERROR(c, "您的算力不足，请充值后再试！")
 		return
 	}
@@ -105,7 +105,7 @@ func (h *VideoHandler) LumaCreate(c *gin.Context) {
 	})
 
 	// update user's power
-	err = h.userService.DecreasePower(job.UserId, job.Power, model.PowerLog{
+	err = h.userService.DecreasePower(job.UserId, job.Power, types.PowerBucketDefault, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  "luma",
 		Remark: fmt.Sprintf("Luma 文生视频，任务ID：%d", job.Id),
@@ -186,11 +186,7 @@ func (h *VideoHandler) Remove(c *gin.Context) {
 	}
 
 	// 恢复算力
-	err = h.userService.IncreasePower(job.UserId, job.Power, model.PowerLog{
-		Type:   types.PowerRefund,
-		Model:  "luma",
-		Remark: fmt.Sprintf("Luma 任务失败，退回算力。任务ID：%s，Err:%s", job.TaskId, job.ErrMsg),
-	})
+	err = h.videoService.RefundPower(job.Id)
 	if err != nil {
 		tx.Rollback()
 		resp.ERROR(c, err.Error())
@@ -59,6 +59,7 @@ func (h *WebsocketHandler) Client(c *gin.Context) {
 		return
 	}
 
+	client.UserId = user.Id
 	h.wsService.Clients.Put(clientId, client)
 	logger.Infof("New websocket connected, IP: %s", c.RemoteIP())
 	go func() {
@@ -17,12 +17,17 @@ import (
 	logger2 "geekai/logger"
 	"geekai/service"
 	"geekai/service/dalle"
+	"geekai/service/event"
+	"geekai/service/geoip"
 	"geekai/service/mj"
+	"geekai/service/notifier"
 	"geekai/service/oss"
 	"geekai/service/payment"
+	"geekai/service/power"
 	"geekai/service/sd"
 	"geekai/service/sms"
 	"geekai/service/suno"
+	"geekai/service/tracing"
 	"geekai/service/video"
 	"geekai/store"
 	"io"
@@ -88,11 +93,25 @@ func main() {
 				log.Fatal(err)
 			}
 			config.Path = configFile
+			// 启动时校验已启用的支付通道配置，避免用户支付时才发现配置缺失
+			if errs := config.ValidatePayment(); len(errs) > 0 {
+				for _, err := range errs {
+					logger.Error("支付通道配置有误：", err)
+				}
+				if config.StrictPayConfig {
+					log.Fatal("支付通道配置不完整，请检查配置文件")
+				}
+			}
 			if debug {
 				_ = core.SaveConfig(config)
 			}
 			return config
 		}),
+		// 链路追踪，退出时上报剩余的链路数据
+		fx.Provide(tracing.NewProvider),
+		fx.Invoke(func(lifecycle fx.Lifecycle, provider *tracing.Provider) {
+			lifecycle.Append(fx.Hook{OnStop: provider.Shutdown})
+		}),
 		// 创建应用服务
 		fx.Provide(core.NewServer),
 		// 初始化
@@ -137,6 +156,7 @@ func main() {
 		fx.Provide(handler.NewSdJobHandler),
 		fx.Provide(handler.NewPaymentHandler),
 		fx.Provide(handler.NewOrderHandler),
+		fx.Provide(handler.NewSubscriptionHandler),
 		fx.Provide(handler.NewProductHandler),
 		fx.Provide(handler.NewConfigHandler),
 		fx.Provide(handler.NewPowerLogHandler),
@@ -147,6 +167,8 @@ func main() {
 		fx.Provide(admin.NewUserHandler),
 		fx.Provide(admin.NewChatAppHandler),
 		fx.Provide(admin.NewRedeemHandler),
+		fx.Provide(admin.NewRedeemCodeHandler),
+		fx.Provide(admin.NewCouponHandler),
 		fx.Provide(admin.NewDashboardHandler),
 		fx.Provide(admin.NewChatModelHandler),
 		fx.Provide(admin.NewProductHandler),
@@ -160,6 +182,7 @@ func main() {
 			return service.NewCaptchaService(config.ApiConfig)
 		}),
 		fx.Provide(oss.NewUploaderManager),
+		fx.Provide(power.NewService),
 		fx.Provide(dalle.NewService),
 		fx.Invoke(func(s *dalle.Service) {
 			s.Run()
@@ -170,6 +193,14 @@ func main() {
 
 		// 邮件服务
 		fx.Provide(service.NewSmtpService),
+		fx.Provide(service.NewWebhookService),
+		fx.Provide(notifier.NewService),
+		fx.Provide(service.NewOrderStatusCache),
+		fx.Provide(service.NewOrderCaptchaService),
+		fx.Provide(service.NewQrcodeLogoService),
+		fx.Provide(geoip.NewService),
+		fx.Provide(event.NewBus),
+		fx.Provide(payment.NewCallbackMonitor),
 		// License 服务
 		fx.Provide(service.NewLicenseService),
 		fx.Invoke(func(licenseService *service.LicenseService) {
@@ -209,10 +240,15 @@ func main() {
 			s.DownloadFiles()
 		}),
 		fx.Provide(service.NewUserService),
+		fx.Provide(service.NewRateLimiter),
 		fx.Provide(payment.NewAlipayService),
 		fx.Provide(payment.NewHuPiPay),
 		fx.Provide(payment.NewJPayService),
 		fx.Provide(payment.NewWechatService),
+		fx.Provide(payment.NewStripeService),
+		fx.Provide(payment.NewPaypalService),
+		fx.Provide(payment.NewCryptoService),
+		fx.Provide(payment.NewReconcileService),
 		fx.Provide(service.NewSnowflake),
 		fx.Provide(service.NewXXLJobExecutor),
 		fx.Invoke(func(exec *service.XXLJobExecutor, config *types.AppConfig) {
@@ -242,6 +278,7 @@ func main() {
 			group.POST("bind/mobile", h.BindMobile)
 			group.POST("bind/email", h.BindEmail)
 			group.POST("resetPass", h.ResetPass)
+			group.POST("power/transfer", h.TransferPower)
 			group.GET("clogin", h.CLogin)
 			group.GET("clogin/callback", h.CLoginCallback)
 		}),
@@ -351,6 +388,18 @@ func main() {
 			group.POST("set", h.Set)
 			group.POST("remove", h.Remove)
 		}),
+		fx.Invoke(func(s *core.AppServer, h *admin.RedeemCodeHandler) {
+			group := s.Engine.Group("/api/admin/redeem/code/")
+			group.GET("list", h.List)
+			group.POST("create", h.Create)
+			group.POST("remove", h.Remove)
+		}),
+		fx.Invoke(func(s *core.AppServer, h *admin.CouponHandler) {
+			group := s.Engine.Group("/api/admin/coupon/")
+			group.GET("list", h.List)
+			group.POST("save", h.Save)
+			group.GET("remove", h.Remove)
+		}),
 		fx.Invoke(func(s *core.AppServer, h *admin.DashboardHandler) {
 			group := s.Engine.Group("/api/admin/dashboard/")
 			group.GET("stats", h.Stats)
@@ -370,11 +419,26 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *handler.PaymentHandler) {
 			group := s.Engine.Group("/api/payment/")
 			group.POST("doPay", h.Pay)
+			group.GET("doPay", h.DoPay)
+			group.POST("payCustom", h.PayCustom)
+			group.POST("payCart", h.PayCart)
+			group.POST("redeem", h.RedeemOrder)
+			group.GET("queryOrder", h.QueryOrder)
 			group.GET("payWays", h.GetPayWays)
-			group.POST("notify/alipay", h.AlipayNotify)
-			group.GET("notify/geek", h.GeekPayNotify)
-			group.POST("notify/wechat", h.WechatPayNotify)
-			group.POST("notify/hupi", h.HuPiPayNotify)
+			group.GET("notify/:name", h.Notify)
+			group.POST("notify/:name", h.Notify)
+			group.GET("notify/:name/:merchant", h.Notify)
+			group.POST("notify/:name/:merchant", h.Notify)
+		}),
+		fx.Invoke(func(h *handler.PaymentHandler, s *payment.ReconcileService, w *service.WebhookService, n *notifier.Service, b *event.Bus) {
+			h.RunNotifyWorker()
+			h.CheckCryptoPayments()
+			h.CancelExpiredOrders()
+			h.ChargeSubscriptions()
+			s.Run(h.Merchants())
+			w.Run()
+			n.Run()
+			b.Run()
 		}),
 		fx.Invoke(func(s *core.AppServer, h *admin.ProductHandler) {
 			group := s.Engine.Group("/api/admin/product/")
@@ -387,13 +451,36 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *admin.OrderHandler) {
 			group := s.Engine.Group("/api/admin/order/")
 			group.POST("list", h.List)
+			group.GET("list", h.Search)
+			group.GET("export", h.Export)
 			group.GET("remove", h.Remove)
+			group.GET("restore", h.Restore)
 			group.GET("clear", h.Clear)
+			group.POST("markPaid", h.MarkOrderPaid)
+			group.POST("refund", h.RefundOrder)
+			group.GET("refundStatus", h.RefundStatus)
+			group.GET("reconcile/list", h.ReconcileReports)
+			group.GET("reconcile", h.Reconcile)
+		}),
+		fx.Invoke(func(s *core.AppServer, h *admin.OrderHandler) {
+			group := s.Engine.Group("/api/admin/payment/")
+			group.GET("stats", h.Stats)
+			group.GET("health", h.Health)
+			group.GET("qrcode/logo", h.QrcodeLogos)
+			group.POST("qrcode/logo", h.UploadQrcodeLogo)
+			group.GET("qrcode/logo/remove", h.RemoveQrcodeLogo)
 		}),
 		fx.Invoke(func(s *core.AppServer, h *handler.OrderHandler) {
 			group := s.Engine.Group("/api/order/")
 			group.GET("list", h.List)
 			group.GET("query", h.Query)
+			group.GET("invoice", h.Invoice)
+		}),
+		fx.Invoke(func(s *core.AppServer, h *handler.SubscriptionHandler) {
+			group := s.Engine.Group("/api/subscription/")
+			group.POST("cancel", h.Cancel)
+			group.POST("resume", h.Resume)
+			s.Engine.GET("/api/subscription", h.Get)
 		}),
 		fx.Invoke(func(s *core.AppServer, h *handler.ProductHandler) {
 			group := s.Engine.Group("/api/product/")
@@ -446,6 +533,17 @@ func main() {
 		fx.Invoke(func(s *core.AppServer, h *admin.PowerLogHandler) {
 			group := s.Engine.Group("/api/admin/powerLog/")
 			group.POST("list", h.List)
+			group.POST("refund", h.Refund)
+		}),
+		fx.Provide(admin.NewMetricsHandler),
+		fx.Invoke(func(s *core.AppServer, h *admin.MetricsHandler) {
+			s.Engine.GET("/api/admin/metrics", h.Metrics)
+		}),
+		fx.Provide(admin.NewPowerCostHandler),
+		fx.Invoke(func(s *core.AppServer, h *admin.PowerCostHandler) {
+			group := s.Engine.Group("/api/admin/power/cost/")
+			group.GET("list", h.List)
+			group.POST("update", h.Update)
 		}),
 		fx.Provide(admin.NewMenuHandler),
 		fx.Invoke(func(s *core.AppServer, h *admin.MenuHandler) {
@@ -14,6 +14,7 @@ import (
 	logger2 "geekai/logger"
 	"geekai/service"
 	"geekai/service/oss"
+	"geekai/service/power"
 	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
@@ -36,10 +37,11 @@ type Service struct {
 	notifyQueue   *store.RedisQueue
 	userService   *service.UserService
 	wsService     *service.WebsocketService
+	powerService  *power.Service
 	clientIds     map[uint]string
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, userService *service.UserService, wsService *service.WebsocketService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, userService *service.UserService, wsService *service.WebsocketService, powerService *power.Service) *Service {
 	return &Service{
 		httpClient:    req.C().SetTimeout(time.Minute * 3),
 		db:            db,
@@ -48,6 +50,7 @@ func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Clien
 		wsService:     wsService,
 		uploadManager: manager,
 		userService:   userService,
+		powerService:  powerService,
 		clientIds:     map[uint]string{},
 	}
 }
@@ -109,7 +112,7 @@ type ErrRes struct {
 	} `json:"error"`
 }
 
-func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
+func (s *Service) Image(task types.DallTask, sync bool) (content string, err error) {
 	logger.Debugf("绘画参数：%+v", task)
 	prompt := task.Prompt
 	// translate prompt
@@ -123,12 +126,12 @@ func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
 
 	var user model.User
 	s.db.Where("id", task.UserId).First(&user)
-	if user.Power < task.Power {
+	if service.AvailablePower(s.db, user.Id, types.PowerBucketImage) < task.Power {
 		return "", errors.New("insufficient of power")
 	}
 
 	// 扣减算力
-	err := s.userService.DecreasePower(int(user.Id), task.Power, model.PowerLog{
+	err = s.userService.DecreasePower(int(user.Id), task.Power, types.PowerBucketImage, model.PowerLog{
 		Type:   types.PowerConsume,
 		Model:  "dall-e-3",
 		Remark: fmt.Sprintf("绘画提示词：%s", utils.CutWords(task.Prompt, 10)),
@@ -136,6 +139,16 @@ func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("error with decrease power: %v", err)
 	}
+	// 扣减算力之后任务失败，自动退回算力
+	defer func() {
+		if err != nil {
+			err2 := s.powerService.Refund(task.UserId, task.Power,
+				fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", task.JobId, err.Error()), fmt.Sprintf("dall-e-3:%d", task.JobId))
+			if err2 != nil {
+				logger.Errorf("error with refund power for job %d: %v", task.JobId, err2)
+			}
+		}
+	}()
 
 	// get image generation API KEY
 	var apiKey model.ApiKey
@@ -187,7 +200,6 @@ func (s *Service) Image(task types.DallTask, sync bool) (string, error) {
 	}
 
 	s.notifyQueue.RPush(service.NotifyMessage{ClientId: task.ClientId, UserId: int(task.UserId), JobId: int(task.JobId), Message: service.TaskStatusFailed})
-	var content string
 	if sync {
 		imgURL, err := s.downloadImage(task.JobId, int(task.UserId), res.Data[0].Url)
 		if err != nil {
@@ -289,3 +301,17 @@ func (s *Service) downloadImage(jobId uint, userId int, orgURL string) (string,
 	s.notifyQueue.RPush(service.NotifyMessage{ClientId: s.clientIds[jobId], UserId: userId, JobId: int(jobId), Message: service.TaskStatusFinished})
 	return imgURL, nil
 }
+
+// RefundPower 退回失败任务消耗的算力，同一个任务只会退回一次
+func (s *Service) RefundPower(jobId uint) error {
+	var job model.DallJob
+	if err := s.db.Where("id", jobId).First(&job).Error; err != nil {
+		return err
+	}
+	err := s.powerService.Refund(job.UserId, job.Power,
+		fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", job.Id, job.ErrMsg), fmt.Sprintf("dall-e-3:%d", job.Id))
+	if err != nil {
+		logger.Errorf("error with refund power for job %d: %v", job.Id, err)
+	}
+	return err
+}
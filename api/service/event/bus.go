@@ -0,0 +1,90 @@
+package event
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// 领域事件发布，供数据管道等下游系统订阅
+
+import (
+	"geekai/core/types"
+	logger2 "geekai/logger"
+)
+
+var logger = logger2.GetLogger()
+
+const (
+	bufferSize   = 1000 // 缓冲区大小，缓冲区满了之后丢弃新的事件
+	maxBatchSize = 100  // 每次最多发送的事件数量
+)
+
+// Event 领域事件，Key 用于消息分区，同一个 Key 的事件保证顺序
+type Event struct {
+	Type    string
+	Key     string
+	Payload interface{}
+}
+
+// Publisher 事件发布渠道，接入新的消息队列只需要实现该接口并在 NewBus 中注册
+type Publisher interface {
+	Name() string
+	Publish(events []Event) error
+}
+
+// Bus 事件总线，事件先写入缓冲区再由后台协程批量发送。
+// 消息队列不可用时只记录日志并丢弃事件，不会阻塞业务流程
+type Bus struct {
+	publishers []Publisher
+	queue      chan Event
+}
+
+func NewBus(appConfig *types.AppConfig) *Bus {
+	b := &Bus{queue: make(chan Event, bufferSize)}
+	if config := appConfig.KafkaConfig; config.Enabled && len(config.Brokers) > 0 {
+		b.publishers = append(b.publishers, NewKafkaPublisher(config))
+	}
+	return b
+}
+
+// Publish 把事件放入缓冲区，缓冲区已满时丢弃事件
+func (b *Bus) Publish(e Event) {
+	if len(b.publishers) == 0 {
+		return
+	}
+	select {
+	case b.queue <- e:
+	default:
+		logger.Warnf("event buffer is full, drop %s event: %s", e.Type, e.Key)
+	}
+}
+
+// Run 后台发送协程
+func (b *Bus) Run() {
+	if len(b.publishers) == 0 {
+		return
+	}
+	go func() {
+		logger.Info("Running event bus ...")
+		for e := range b.queue {
+			// 取出缓冲区中已有的事件合并发送
+			events := []Event{e}
+		drain:
+			for len(events) < maxBatchSize {
+				select {
+				case e = <-b.queue:
+					events = append(events, e)
+				default:
+					break drain
+				}
+			}
+			for _, p := range b.publishers {
+				if err := p.Publish(events); err != nil {
+					logger.Errorf("error with publish %d events to %s, dropped: %v", len(events), p.Name(), err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package event
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPublisher 直接连接 Kafka 集群发送消息，按照事件的 Key 哈希分区，保证同一个 Key 的事件顺序
+type KafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaPublisher(config types.KafkaConfig) *KafkaPublisher {
+	return &KafkaPublisher{writer: &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Topic:        config.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		// Bus 已经合并了缓冲区中的事件，这里不需要再等待凑满批次
+		BatchSize:    maxBatchSize,
+		BatchTimeout: 10 * time.Millisecond,
+		WriteTimeout: 5 * time.Second,
+	}}
+}
+
+func (p *KafkaPublisher) Name() string {
+	return "kafka"
+}
+
+func (p *KafkaPublisher) Publish(events []Event) error {
+	messages, err := kafkaMessages(events)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return p.writer.WriteMessages(ctx, messages...)
+}
+
+// kafkaMessages 把事件转换成 Kafka 消息，消息体为 JSON 格式的 Payload，事件类型写入消息头
+func kafkaMessages(events []Event) ([]kafka.Message, error) {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, e := range events {
+		value, err := json.Marshal(e.Payload)
+		if err != nil {
+			return nil, fmt.Errorf("error with encode %s event %s: %v", e.Type, e.Key, err)
+		}
+		messages = append(messages, kafka.Message{
+			Key:     []byte(e.Key),
+			Value:   value,
+			Headers: []kafka.Header{{Key: "type", Value: []byte(e.Type)}},
+		})
+	}
+	return messages, nil
+}
@@ -0,0 +1,43 @@
+package event
+
+import (
+	"testing"
+)
+
+func TestKafkaMessages(t *testing.T) {
+	events := []Event{
+		{Type: "order.paid", Key: "202401010001", Payload: map[string]interface{}{"order_no": "202401010001", "amount": "9.99"}},
+		{Type: "order.refunded", Key: "202401010002", Payload: nil},
+	}
+	messages, err := kafkaMessages(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != len(events) {
+		t.Fatalf("messages = %d, want %d", len(messages), len(events))
+	}
+	tests := []struct {
+		key   string
+		value string
+		typ   string
+	}{
+		{"202401010001", `{"amount":"9.99","order_no":"202401010001"}`, "order.paid"},
+		{"202401010002", `null`, "order.refunded"},
+	}
+	for i, tt := range tests {
+		m := messages[i]
+		if string(m.Key) != tt.key || string(m.Value) != tt.value {
+			t.Errorf("message %d = %s: %s, want %s: %s", i, m.Key, m.Value, tt.key, tt.value)
+		}
+		if len(m.Headers) != 1 || m.Headers[0].Key != "type" || string(m.Headers[0].Value) != tt.typ {
+			t.Errorf("message %d headers = %v, want type %s", i, m.Headers, tt.typ)
+		}
+	}
+}
+
+func TestKafkaMessagesInvalidPayload(t *testing.T) {
+	_, err := kafkaMessages([]Event{{Type: "order.paid", Key: "1", Payload: make(chan int)}})
+	if err == nil {
+		t.Fatal("kafkaMessages() with invalid payload should fail")
+	}
+}
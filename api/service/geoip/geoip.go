@@ -0,0 +1,72 @@
+package geoip
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	logger2 "geekai/logger"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+var logger = logger2.GetLogger()
+
+// Service 通过 MaxMind GeoIP2 / GeoLite2 Country 数据库查询 IP 所在的国家或地区，
+// 没有启用或者查询不到时返回空字符串
+type Service struct {
+	reader *maxminddb.Reader
+}
+
+func NewService(appConfig *types.AppConfig) (*Service, error) {
+	config := appConfig.GeoIPConfig
+	if !config.Enabled {
+		return &Service{}, nil
+	}
+	buf, err := os.ReadFile(config.Database)
+	if err != nil {
+		return nil, fmt.Errorf("error with read GeoIP database: %v", err)
+	}
+	reader, err := maxminddb.FromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("error with load GeoIP database: %v", err)
+	}
+	return &Service{reader: reader}, nil
+}
+
+// countryRecord Country 数据库中需要用到的字段
+type countryRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Country 查询 IP 所在国家或地区的 ISO 3166-1 代码，如 CN, US
+func (s *Service) Country(ip string) string {
+	addr := net.ParseIP(ip)
+	if s.reader == nil || addr == nil {
+		return ""
+	}
+	var record countryRecord
+	err := s.reader.Lookup(addr, &record)
+	if err != nil {
+		logger.Errorf("error with lookup GeoIP for %s: %v", ip, err)
+		return ""
+	}
+	// 优先使用 IP 实际所在的国家，没有时使用 IP 注册的国家
+	if record.Country.IsoCode != "" {
+		return strings.ToUpper(record.Country.IsoCode)
+	}
+	return strings.ToUpper(record.RegisteredCountry.IsoCode)
+}
@@ -0,0 +1,146 @@
+package geoip
+
+import (
+	"geekai/core/types"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// writeTestDatabase 生成一个测试用的 Country 数据库，返回文件路径
+func writeTestDatabase(t testing.TB) string {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoLite2-Country", RecordSize: 24})
+	if err != nil {
+		t.Fatal(err)
+	}
+	country := func(key string, code string) mmdbtype.Map {
+		return mmdbtype.Map{mmdbtype.String(key): mmdbtype.Map{"iso_code": mmdbtype.String(code)}}
+	}
+	records := []struct {
+		network string
+		data    mmdbtype.Map
+	}{
+		{"1.2.3.0/24", country("country", "us")},
+		{"81.2.69.0/24", mmdbtype.Map{
+			"country":            mmdbtype.Map{"iso_code": mmdbtype.String("GB")},
+			"registered_country": mmdbtype.Map{"iso_code": mmdbtype.String("SE")},
+		}},
+		{"89.160.20.0/24", country("registered_country", "SE")},
+		{"2a02:cf40::/29", country("country", "NO")},
+		{"175.16.199.0/24", mmdbtype.Map{"continent": mmdbtype.Map{"code": mmdbtype.String("AS")}}},
+	}
+	for _, r := range records {
+		_, network, err := net.ParseCIDR(r.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = tree.Insert(network, r.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = tree.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCountry(t *testing.T) {
+	s, err := NewService(&types.AppConfig{GeoIPConfig: types.GeoIPConfig{Enabled: true, Database: writeTestDatabase(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"1.2.3.4", "US"},
+		{"::ffff:1.2.3.4", "US"},
+		{"81.2.69.160", "GB"},
+		{"89.160.20.128", "SE"},
+		{"2a02:cf40::1", "NO"},
+		{"175.16.199.1", ""},
+		{"8.8.8.8", ""},
+		{"2001:4860::8888", ""},
+		{"", ""},
+		{"not an ip", ""},
+		{"1.2.3.4:80", ""},
+	}
+	for _, tt := range tests {
+		if got := s.Country(tt.ip); got != tt.want {
+			t.Errorf("Country(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestCountryDisabled(t *testing.T) {
+	s, err := NewService(&types.AppConfig{GeoIPConfig: types.GeoIPConfig{Database: "not-exists.mmdb"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Country("1.2.3.4"); got != "" {
+		t.Errorf("Country() = %q, want empty", got)
+	}
+}
+
+func TestNewServiceInvalidDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "broken.mmdb")
+	if err := os.WriteFile(path, []byte("not a maxmind database"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, database := range []string{path, filepath.Join(t.TempDir(), "missing.mmdb")} {
+		_, err := NewService(&types.AppConfig{GeoIPConfig: types.GeoIPConfig{Enabled: true, Database: database}})
+		if err == nil {
+			t.Errorf("NewService(%s) should fail", database)
+		}
+	}
+}
+
+func FuzzCountry(f *testing.F) {
+	s, err := NewService(&types.AppConfig{GeoIPConfig: types.GeoIPConfig{Enabled: true, Database: writeTestDatabase(f)}})
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, ip := range []string{"1.2.3.4", "::ffff:81.2.69.160", "2a02:cf40::1", "", "1.2.3", "::"} {
+		f.Add(ip)
+	}
+	f.Fuzz(func(t *testing.T, ip string) {
+		code := s.Country(ip)
+		if code != "" && net.ParseIP(ip) == nil {
+			t.Errorf("Country(%q) = %q for an invalid ip", ip, code)
+		}
+	})
+}
+
+// FuzzDatabase 损坏的数据库文件只能返回错误，不能导致查询时 panic
+func FuzzDatabase(f *testing.F) {
+	valid, err := os.ReadFile(writeTestDatabase(f))
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(valid)
+	f.Add(valid[:len(valid)/2])
+	f.Add([]byte("\xab\xcd\xefMaxMind.com"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader, err := maxminddb.FromBytes(data)
+		if err != nil {
+			return
+		}
+		s := &Service{reader: reader}
+		for _, ip := range []string{"1.2.3.4", "81.2.69.160", "2a02:cf40::1"} {
+			s.Country(ip)
+		}
+	})
+}
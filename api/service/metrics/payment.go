@@ -0,0 +1,69 @@
+package metrics
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// 支付模块的监控指标
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 支付回调的处理结果
+const (
+	OutcomeSuccess  = "success"  // 订单结算成功
+	OutcomeQueued   = "queued"   // 校验通过，已放入队列等待结算
+	OutcomeIgnored  = "ignored"  // 非支付成功的通知，无需处理
+	OutcomeFailed   = "failed"   // 校验失败、入队失败或者结算失败
+	OutcomeRejected = "rejected" // 来源 IP 不在白名单中
+)
+
+var (
+	OrdersCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geekai_payment_orders_created_total",
+		Help: "Number of payment orders created.",
+	}, []string{"pay_way"})
+	OrdersPaid = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geekai_payment_orders_paid_total",
+		Help: "Number of payment orders settled.",
+	}, []string{"pay_way"})
+	PaidAmount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geekai_payment_paid_amount_cents_total",
+		Help: "Total settled order amount in minor currency units.",
+	}, []string{"pay_way", "currency"})
+	Callbacks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geekai_payment_callbacks_total",
+		Help: "Number of payment gateway callbacks by outcome.",
+	}, []string{"gateway", "outcome"})
+	NotifyDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "geekai_payment_notify_duration_seconds",
+		Help: "Time spent handling payment gateway callbacks.",
+	}, []string{"gateway"})
+	FulfillmentErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "geekai_payment_fulfillment_errors_total",
+		Help: "Number of orders that failed to settle.",
+	}, []string{"pay_way"})
+	// 按照阶段统计耗时，用来判断回调慢是支付渠道慢还是数据库慢
+	GatewayDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "geekai_payment_gateway_duration_seconds",
+		Help: "Time spent calling payment gateways.",
+	}, []string{"gateway", "op"})
+	SettleDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "geekai_payment_settle_duration_seconds",
+		Help: "Time spent settling orders in the database.",
+	}, []string{"pay_way"})
+)
+
+// Since 记录从 start 开始的耗时（秒）
+func Since(h *prometheus.HistogramVec, start time.Time, values ...string) time.Duration {
+	elapsed := time.Since(start)
+	h.WithLabelValues(values...).Observe(elapsed.Seconds())
+	return elapsed
+}
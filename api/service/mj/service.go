@@ -12,6 +12,7 @@ import (
 	"geekai/core/types"
 	"geekai/service"
 	"geekai/service/oss"
+	"geekai/service/power"
 	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
@@ -30,10 +31,11 @@ type Service struct {
 	db              *gorm.DB
 	wsService       *service.WebsocketService
 	uploaderManager *oss.UploaderManager
+	powerService    *power.Service
 	clientIds       map[uint]string
 }
 
-func NewService(redisCli *redis.Client, db *gorm.DB, client *Client, manager *oss.UploaderManager, wsService *service.WebsocketService) *Service {
+func NewService(redisCli *redis.Client, db *gorm.DB, client *Client, manager *oss.UploaderManager, wsService *service.WebsocketService, powerService *power.Service) *Service {
 	return &Service{
 		db:              db,
 		taskQueue:       store.NewRedisQueue("MidJourney_Task_Queue", redisCli),
@@ -41,6 +43,7 @@ func NewService(redisCli *redis.Client, db *gorm.DB, client *Client, manager *os
 		client:          client,
 		wsService:       wsService,
 		uploaderManager: manager,
+		powerService:    powerService,
 		clientIds:       map[uint]string{},
 	}
 }
@@ -121,6 +124,7 @@ func (s *Service) Run() {
 				job.ErrMsg = errMsg
 				// update the task progress
 				s.db.Updates(&job)
+				s.RefundPower(job.Id)
 				// 任务失败，通知前端
 				s.notifyQueue.RPush(service.NotifyMessage{ClientId: task.ClientId, UserId: task.UserId, JobId: int(job.Id), Message: service.TaskStatusFailed})
 				continue
@@ -246,6 +250,7 @@ func (s *Service) SyncTaskProgress() {
 					job.Progress = service.FailTaskProgress
 					job.ErrMsg = "任务超时"
 					s.db.Updates(&job)
+					s.RefundPower(job.Id)
 					continue
 				}
 
@@ -266,6 +271,7 @@ func (s *Service) SyncTaskProgress() {
 						"err_msg":  task.FailReason,
 					})
 					logger.Errorf("task failed: %v", task.FailReason)
+					s.RefundPower(job.Id)
 					s.notifyQueue.RPush(service.NotifyMessage{
 						ClientId: s.clientIds[job.Id],
 						UserId:   job.UserId,
@@ -307,3 +313,17 @@ func (s *Service) SyncTaskProgress() {
 		}
 	}()
 }
+
+// RefundPower 退回失败任务消耗的算力，同一个任务只会退回一次
+func (s *Service) RefundPower(jobId uint) error {
+	var job model.MidJourneyJob
+	if err := s.db.Where("id", jobId).First(&job).Error; err != nil {
+		return err
+	}
+	err := s.powerService.Refund(uint(job.UserId), job.Power,
+		fmt.Sprintf("任务失败，退回算力。任务ID：%d，Err: %s", job.Id, job.ErrMsg), fmt.Sprintf("mid-journey:%d", job.Id))
+	if err != nil {
+		logger.Errorf("error with refund power for job %d: %v", job.Id, err)
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package notifier
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DingTalkNotifier 钉钉群聊自定义机器人，消息以 Markdown 的形式展示
+type DingTalkNotifier struct {
+	config types.DingTalkConfig
+	client *http.Client
+}
+
+func NewDingTalkNotifier(config types.DingTalkConfig) *DingTalkNotifier {
+	return &DingTalkNotifier{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *DingTalkNotifier) Name() string {
+	return "dingtalk"
+}
+
+func (n *DingTalkNotifier) Send(msg Message) error {
+	var text strings.Builder
+	text.WriteString(fmt.Sprintf("#### %s\n\n", msg.Title))
+	for _, f := range msg.Fields {
+		// 钉钉的 Markdown 需要空行才会换行
+		text.WriteString(fmt.Sprintf("**%s**：%s\n\n", f.Name, strings.ReplaceAll(f.Value, "\n", "\n\n")))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"msgtype":  "markdown",
+		"markdown": map[string]string{"title": msg.Title, "text": text.String()},
+	})
+	if err != nil {
+		return err
+	}
+
+	webhookURL := n.config.WebhookURL
+	// 机器人开启了加签时需要在地址上带上时间戳和签名
+	if n.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().UnixMilli(), 10)
+		webhookURL = fmt.Sprintf("%s&timestamp=%s&sign=%s", webhookURL, timestamp, url.QueryEscape(n.Sign(timestamp)))
+	}
+	resp, err := n.client.Post(webhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("error with decode response, status code: %d, %v", resp.StatusCode, err)
+	}
+	if res.ErrCode != 0 {
+		return fmt.Errorf("dingtalk error: %d, %s", res.ErrCode, res.ErrMsg)
+	}
+	return nil
+}
+
+// Sign 钉钉机器人加签：使用秘钥对 timestamp + "\n" + 秘钥 进行 HMAC-SHA256 签名，再进行 Base64 编码
+func (n *DingTalkNotifier) Sign(timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(n.config.Secret))
+	mac.Write([]byte(timestamp + "\n" + n.config.Secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
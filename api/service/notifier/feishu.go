@@ -0,0 +1,95 @@
+package notifier
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// FeishuNotifier 飞书（Lark）群聊自定义机器人，消息以卡片的形式展示
+type FeishuNotifier struct {
+	config types.FeishuConfig
+	client *http.Client
+}
+
+func NewFeishuNotifier(config types.FeishuConfig) *FeishuNotifier {
+	return &FeishuNotifier{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *FeishuNotifier) Name() string {
+	return "feishu"
+}
+
+func (n *FeishuNotifier) Send(msg Message) error {
+	fields := make([]map[string]interface{}, 0, len(msg.Fields))
+	for _, f := range msg.Fields {
+		fields = append(fields, map[string]interface{}{
+			"is_short": true,
+			"text":     map[string]string{"tag": "lark_md", "content": fmt.Sprintf("**%s**\n%s", f.Name, f.Value)},
+		})
+	}
+	template := "green"
+	if msg.Topic == TopicPaymentAlert || msg.Topic == TopicDispute {
+		template = "red"
+	}
+	payload := map[string]interface{}{
+		"msg_type": "interactive",
+		"card": map[string]interface{}{
+			"header": map[string]interface{}{
+				"template": template,
+				"title":    map[string]string{"tag": "plain_text", "content": msg.Title},
+			},
+			"elements": []interface{}{
+				map[string]interface{}{"tag": "div", "fields": fields},
+			},
+		},
+	}
+	// 机器人开启了签名校验时需要带上时间戳和签名
+	if n.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		payload["timestamp"] = timestamp
+		payload["sign"] = n.Sign(timestamp)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(n.config.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("error with decode response, status code: %d, %v", resp.StatusCode, err)
+	}
+	if res.Code != 0 {
+		return fmt.Errorf("feishu error: %d, %s", res.Code, res.Msg)
+	}
+	return nil
+}
+
+// Sign 飞书机器人签名：以 timestamp + "\n" + 秘钥 作为 HMAC-SHA256 的秘钥对空字符串签名，再进行 Base64 编码
+func (n *FeishuNotifier) Sign(timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(timestamp+"\n"+n.config.Secret))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,103 @@
+package notifier
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// 发送到运营群聊（飞书、钉钉、Slack 等）的消息通知
+
+import (
+	"geekai/core/types"
+	logger2 "geekai/logger"
+	"geekai/utils"
+)
+
+var logger = logger2.GetLogger()
+
+// 消息类型，各个渠道可以只订阅部分类型的消息
+const (
+	TopicOrderPaid    = "order_paid"    // 新订单支付成功
+	TopicPaymentAlert = "payment_alert" // 支付回调校验失败率过高告警
+	TopicDispute      = "dispute"       // 用户发起交易争议（拒付）
+)
+
+// Field 消息中的一个字段，如 用户：张三
+type Field struct {
+	Name  string
+	Value string
+}
+
+// Message 与具体渠道无关的通知消息，由各个渠道转换成自己的消息格式
+type Message struct {
+	Topic  string
+	Title  string
+	Fields []Field
+}
+
+// Notifier 消息通知渠道，接入新的群聊机器人只需要实现该接口并在 NewService 中注册
+type Notifier interface {
+	Name() string
+	Send(msg Message) error
+}
+
+// channel 已启用的通知渠道及其订阅的消息类型，topics 为空表示接收所有消息
+type channel struct {
+	notifier Notifier
+	topics   []string
+}
+
+func (c channel) subscribed(topic string) bool {
+	return len(c.topics) == 0 || utils.Contains(c.topics, topic)
+}
+
+// Service 把消息异步发送到订阅了该类型消息的通知渠道，发送失败只记录日志，不影响业务流程
+type Service struct {
+	channels []channel
+	queue    chan Message
+}
+
+func NewService(appConfig *types.AppConfig) *Service {
+	s := &Service{queue: make(chan Message, 100)}
+	if config := appConfig.FeishuConfig; config.Enabled && config.WebhookURL != "" {
+		s.channels = append(s.channels, channel{notifier: NewFeishuNotifier(config), topics: config.Topics})
+	}
+	if config := appConfig.DingTalkConfig; config.Enabled && config.WebhookURL != "" {
+		s.channels = append(s.channels, channel{notifier: NewDingTalkNotifier(config), topics: config.Topics})
+	}
+	return s
+}
+
+// Notify 把消息放入发送队列，队列已满时丢弃消息，不会阻塞调用方
+func (s *Service) Notify(msg Message) {
+	if len(s.channels) == 0 {
+		return
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		logger.Warnf("notify queue is full, drop message: %s", msg.Title)
+	}
+}
+
+// Run 后台发送协程
+func (s *Service) Run() {
+	if len(s.channels) == 0 {
+		return
+	}
+	go func() {
+		logger.Info("Running notify service ...")
+		for msg := range s.queue {
+			for _, c := range s.channels {
+				if !c.subscribed(msg.Topic) {
+					continue
+				}
+				if err := c.notifier.Send(msg); err != nil {
+					logger.Errorf("error with send %s notification %s: %v", c.notifier.Name(), msg.Title, err)
+				}
+			}
+		}
+	}()
+}
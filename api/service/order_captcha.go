@@ -0,0 +1,117 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/imroc/req/v3"
+)
+
+// 人机验证服务的服务端校验地址
+var captchaVerifyURLs = map[string]string{
+	"recaptcha": "https://www.google.com/recaptcha/api/siteverify",
+	"hcaptcha":  "https://api.hcaptcha.com/siteverify",
+}
+
+// OrderCaptchaService 下单人机验证，支持 reCAPTCHA 和 hCaptcha。
+// 按照 IP 统计每小时的下单次数，超过阈值之后才要求验证，正常用户基本不会看到验证
+type OrderCaptchaService struct {
+	config types.CaptchaConfig
+	redis  *redis.Client
+	client *req.Client
+}
+
+func NewOrderCaptchaService(appConfig *types.AppConfig, client *redis.Client) *OrderCaptchaService {
+	return &OrderCaptchaService{
+		config: appConfig.OrderCaptcha,
+		redis:  client,
+		client: req.C().SetTimeout(10 * time.Second),
+	}
+}
+
+// Enabled 是否开启了下单人机验证
+func (s *OrderCaptchaService) Enabled() bool {
+	return s.config.Enabled && s.config.SecretKey != ""
+}
+
+// Params 前端渲染验证组件需要的参数
+func (s *OrderCaptchaService) Params() map[string]string {
+	return map[string]string{"provider": s.config.Provider, "site_key": s.config.SiteKey}
+}
+
+// Required 记录一次下单，返回该 IP 是否需要人机验证，Redis 出错时不要求验证
+func (s *OrderCaptchaService) Required(ctx context.Context, ip string) bool {
+	if !s.Enabled() {
+		return false
+	}
+	threshold := s.config.Threshold
+	if threshold <= 0 {
+		threshold = 3
+	}
+	key := fmt.Sprintf("order_captcha/%s", ip)
+	count, err := s.redis.Incr(ctx, key).Result()
+	if err != nil {
+		logger.Error("error with increase order captcha counter: ", err)
+		return false
+	}
+	if count == 1 {
+		s.redis.Expire(ctx, key, time.Hour)
+	}
+	return count > int64(threshold)
+}
+
+// Verify 向验证服务校验前端提交的令牌
+func (s *OrderCaptchaService) Verify(token string, ip string) error {
+	if token == "" {
+		return errors.New("请完成人机验证")
+	}
+	verifyURL, ok := captchaVerifyURLs[strings.ToLower(s.config.Provider)]
+	if !ok {
+		return fmt.Errorf("不支持的人机验证服务：%s", s.config.Provider)
+	}
+
+	var res struct {
+		Success    bool     `json:"success"`
+		Score      *float64 `json:"score"` // 只有 reCAPTCHA v3 返回分数
+		ErrorCodes []string `json:"error-codes"`
+	}
+	r, err := s.client.R().SetFormData(map[string]string{
+		"secret":   s.config.SecretKey,
+		"response": token,
+		"remoteip": ip,
+	}).SetSuccessResult(&res).Post(verifyURL)
+	// 验证服务不可用时放行，避免影响正常用户下单，订单频率仍然受到限制
+	if err != nil {
+		logger.Error("error with verify captcha token: ", err)
+		return nil
+	}
+	if r.IsErrorState() {
+		logger.Error("error with verify captcha token, status: ", r.Status)
+		return nil
+	}
+	if !res.Success {
+		logger.Infof("人机验证失败，IP：%s，错误：%v", ip, res.ErrorCodes)
+		return errors.New("人机验证失败，请重新验证")
+	}
+	minScore := s.config.MinScore
+	if minScore <= 0 {
+		minScore = 0.5
+	}
+	if res.Score != nil && *res.Score < minScore {
+		logger.Infof("人机验证分数过低，IP：%s，分数：%.2f", ip, *res.Score)
+		return errors.New("人机验证失败，请重新验证")
+	}
+	return nil
+}
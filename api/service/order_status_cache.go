@@ -0,0 +1,93 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"geekai/core/types"
+	"geekai/utils"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// orderStatusTTL 订单状态缓存的有效期，即使漏掉了某次状态变更，最多也只会返回这么久的旧状态
+const orderStatusTTL = 10 * time.Second
+
+// OrderStatusCache 前端轮询订单状态时使用的缓存，避免每次轮询都查询数据库。
+// 订单状态变更之后直接写入新的状态，轮询接口回源数据库之后只在缓存不存在时写入，
+// 保证回源时读到的旧状态不会覆盖刚刚写入的支付成功状态
+type OrderStatusCache struct {
+	redis *redis.Client
+}
+
+func NewOrderStatusCache(client *redis.Client) *OrderStatusCache {
+	return &OrderStatusCache{redis: client}
+}
+
+func orderStatusKey(orderNo string) string {
+	return fmt.Sprintf("order_status/%s", orderNo)
+}
+
+// OrderStatus 缓存的订单状态，包含轮询接口校验订单归属和返回结果需要的字段
+type OrderStatus struct {
+	UserId  uint              `json:"user_id"`
+	Status  types.OrderStatus `json:"status"`
+	PayTime int64             `json:"pay_time"`
+	PayWay  string            `json:"pay_way"`
+	// 订单所属的商户 ID，查询支付状态时使用商户的支付渠道
+	MerchantId string `json:"merchant_id,omitempty"`
+}
+
+// Get 读取缓存的订单状态，缓存不存在或者 Redis 出错时返回 false
+func (c *OrderStatusCache) Get(orderNo string) (OrderStatus, bool) {
+	var status OrderStatus
+	value, err := c.redis.Get(context.Background(), orderStatusKey(orderNo)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			logger.Errorf("error with get order status cache for %s: %v", orderNo, err)
+		}
+		return status, false
+	}
+	if err = json.Unmarshal(value, &status); err != nil {
+		return status, false
+	}
+	return status, true
+}
+
+// Fill 回源数据库之后写入缓存，缓存已经存在时不覆盖
+func (c *OrderStatusCache) Fill(orderNo string, status OrderStatus) {
+	err := c.redis.SetNX(context.Background(), orderStatusKey(orderNo), utils.JsonEncode(status), orderStatusTTL).Err()
+	if err != nil {
+		logger.Errorf("error with fill order status cache for %s: %v", orderNo, err)
+	}
+}
+
+// Set 订单状态变更之后写入新的状态
+func (c *OrderStatusCache) Set(orderNo string, status OrderStatus) {
+	err := c.redis.Set(context.Background(), orderStatusKey(orderNo), utils.JsonEncode(status), orderStatusTTL).Err()
+	if err != nil {
+		logger.Errorf("error with set order status cache for %s: %v", orderNo, err)
+	}
+}
+
+// Delete 订单状态变更之后删除缓存，下次查询时从数据库重新加载
+func (c *OrderStatusCache) Delete(orderNos ...string) {
+	if len(orderNos) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(orderNos))
+	for _, orderNo := range orderNos {
+		keys = append(keys, orderStatusKey(orderNo))
+	}
+	if err := c.redis.Del(context.Background(), keys...).Err(); err != nil {
+		logger.Errorf("error with delete order status cache: %v", err)
+	}
+}
@@ -9,13 +9,21 @@ package payment
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"geekai/core/types"
 	logger2 "geekai/logger"
+	"geekai/store/model"
+	"geekai/utils"
 	"github.com/go-pay/gopay"
 	"github.com/go-pay/gopay/alipay"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type AlipayService struct {
@@ -53,31 +61,51 @@ func NewAlipayService(appConfig *types.AppConfig) (*AlipayService, error) {
 	return &AlipayService{config: &config, client: client}, nil
 }
 
+// PayTypeAlipayFq 花呗分期支付
+const PayTypeAlipayFq = "alipay_fq"
+
+// 支付宝支持的花呗分期期数
+var huabeiInstallments = []int{3, 6, 12}
+
 type AlipayParams struct {
-	OutTradeNo string `json:"out_trade_no"`
-	Subject    string `json:"subject"`
-	TotalFee   string `json:"total_fee"`
-	ReturnURL  string `json:"return_url"`
-	NotifyURL  string `json:"notify_url"`
+	OutTradeNo   string `json:"out_trade_no"`
+	Subject      string `json:"subject"`
+	TotalFee     string `json:"total_fee"`
+	ReturnURL    string `json:"return_url"`
+	NotifyURL    string `json:"notify_url"`
+	Installments int    `json:"installments"` // 花呗分期期数，0 表示不分期
+}
+
+// setInstallments 设置花呗分期参数
+func (s *AlipayService) setInstallments(bm gopay.BodyMap, params AlipayParams) {
+	if params.Installments <= 0 {
+		return
+	}
+	bm.SetBodyMap("extend_params", func(bm gopay.BodyMap) {
+		bm.Set("hb_fq_num", strconv.Itoa(params.Installments)).
+			Set("hb_fq_seller_percent", strconv.Itoa(s.config.HuabeiSellerPercent))
+	})
 }
 
-func (s *AlipayService) PayMobile(params AlipayParams) (string, error) {
+func (s *AlipayService) PayMobile(ctx context.Context, params AlipayParams) (string, error) {
 	bm := make(gopay.BodyMap)
 	bm.Set("subject", params.Subject)
 	bm.Set("out_trade_no", params.OutTradeNo)
 	bm.Set("quit_url", params.ReturnURL)
 	bm.Set("total_amount", params.TotalFee)
 	bm.Set("product_code", "QUICK_WAP_WAY")
-	return s.client.SetNotifyUrl(params.NotifyURL).SetReturnUrl(params.ReturnURL).TradeWapPay(context.Background(), bm)
+	s.setInstallments(bm, params)
+	return s.client.SetNotifyUrl(params.NotifyURL).SetReturnUrl(params.ReturnURL).TradeWapPay(ctx, bm)
 }
 
-func (s *AlipayService) PayPC(params AlipayParams) (string, error) {
+func (s *AlipayService) PayPC(ctx context.Context, params AlipayParams) (string, error) {
 	bm := make(gopay.BodyMap)
 	bm.Set("subject", params.Subject)
 	bm.Set("out_trade_no", params.OutTradeNo)
 	bm.Set("total_amount", params.TotalFee)
 	bm.Set("product_code", "FAST_INSTANT_TRADE_PAY")
-	return s.client.SetNotifyUrl(params.NotifyURL).SetReturnUrl(params.ReturnURL).TradePagePay(context.Background(), bm)
+	s.setInstallments(bm, params)
+	return s.client.SetNotifyUrl(params.NotifyURL).SetReturnUrl(params.ReturnURL).TradePagePay(ctx, bm)
 }
 
 // TradeVerify 交易验证
@@ -98,15 +126,19 @@ func (s *AlipayService) TradeVerify(request *http.Request) NotifyVo {
 		}
 	}
 
-	return s.TradeQuery(request.Form.Get("out_trade_no"))
+	return s.tradeQuery(request.Context(), request.Form.Get("out_trade_no"))
 }
 
 func (s *AlipayService) TradeQuery(outTradeNo string) NotifyVo {
+	return s.tradeQuery(context.Background(), outTradeNo)
+}
+
+func (s *AlipayService) tradeQuery(ctx context.Context, outTradeNo string) NotifyVo {
 	bm := make(gopay.BodyMap)
 	bm.Set("out_trade_no", outTradeNo)
 
 	//查询订单
-	rsp, err := s.client.TradeQuery(context.Background(), bm)
+	rsp, err := s.client.TradeQuery(ctx, bm)
 	if err != nil {
 		return NotifyVo{
 			Status:  Failure,
@@ -131,6 +163,50 @@ func (s *AlipayService) TradeQuery(outTradeNo string) NotifyVo {
 	}
 }
 
+// Refund 发起退款，调用 alipay.trade.refund 接口
+func (s *AlipayService) Refund(order model.Order, params RefundParams) (string, error) {
+	bm := make(gopay.BodyMap)
+	bm.Set("out_trade_no", order.OrderNo)
+	if order.TradeNo != "" {
+		bm.Set("trade_no", order.TradeNo)
+	}
+	bm.Set("refund_amount", utils.FormatCents(params.Amount))
+	bm.Set("refund_reason", params.Reason)
+	bm.Set("out_request_no", params.RefundNo)
+	rsp, err := s.client.TradeRefund(context.Background(), bm)
+	if err != nil {
+		return "", fmt.Errorf("error with request alipay refund: %v", err)
+	}
+	if rsp.Response.FundChange != "Y" {
+		// 资金未发生变化，有可能是重复的退款请求，需要核实已退款金额
+		logger.Warnf("支付宝退款资金未发生变化，订单号：%s，已退款金额：%s", order.OrderNo, rsp.Response.RefundFee)
+	}
+	return rsp.Response.TradeNo, nil
+}
+
+// RefundQuery 查询退款状态，调用 alipay.trade.fastpay.refund.query 接口。
+// 支付宝退款是同步处理的，查询不到退款记录说明退款没有成功
+func (s *AlipayService) RefundQuery(order model.Order, refundNo string) (RefundResult, error) {
+	bm := make(gopay.BodyMap)
+	bm.Set("out_trade_no", order.OrderNo)
+	bm.Set("out_request_no", refundNo)
+	rsp, err := s.client.TradeFastPayRefundQuery(context.Background(), bm)
+	if err != nil {
+		return RefundResult{}, fmt.Errorf("error with query alipay refund: %v", err)
+	}
+	if rsp.Response.RefundStatus == "REFUND_SUCCESS" {
+		amount, err := utils.ParseCents(rsp.Response.RefundAmount)
+		if err != nil {
+			return RefundResult{}, fmt.Errorf("invalid alipay refund amount %q: %v", rsp.Response.RefundAmount, err)
+		}
+		return RefundResult{Status: RefundSuccess, Amount: amount}, nil
+	}
+	if rsp.Response.OutRequestNo == "" {
+		return RefundResult{Status: RefundFailed}, nil
+	}
+	return RefundResult{Status: RefundProcessing}, nil
+}
+
 func readKey(filename string) (string, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
@@ -138,3 +214,235 @@ func readKey(filename string) (string, error) {
 	}
 	return string(data), nil
 }
+
+func (s *AlipayService) Name() string {
+	return "alipay"
+}
+
+func (s *AlipayService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *AlipayService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *AlipayService) Sandbox() bool {
+	return s.config.SandBox
+}
+
+func (s *AlipayService) NotifyIPs() []string {
+	return s.config.NotifyIPs
+}
+
+// HealthCheck 查询一个不存在的订单，返回交易不存在说明网关和密钥都是正常的
+func (s *AlipayService) HealthCheck() error {
+	bm := make(gopay.BodyMap)
+	bm.Set("out_trade_no", healthCheckOrderNo)
+	_, err := s.client.TradeQuery(context.Background(), bm)
+	if bizErr, ok := alipay.IsBizError(err); ok && bizErr.SubCode == "ACQ.TRADE_NOT_EXIST" {
+		return nil
+	}
+	return err
+}
+
+func (s *AlipayService) PayTypes() []string {
+	if s.config.HuabeiMinAmount > 0 {
+		return []string{"alipay", PayTypeAlipayFq}
+	}
+	return []string{"alipay"}
+}
+
+// MinAmount 花呗分期只对不低于配置金额的订单开放
+func (s *AlipayService) MinAmount(payType string) float64 {
+	if payType == PayTypeAlipayFq {
+		return s.config.HuabeiMinAmount
+	}
+	return 0
+}
+
+func (s *AlipayService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	params := AlipayParams{
+		OutTradeNo: order.OrderNo,
+		Subject:    order.Subject,
+		TotalFee:   utils.FormatCents(order.Cents()),
+		ReturnURL:  returnURL(ctx, s.config.ReturnURL),
+		NotifyURL:  notifyURL(ctx, s.config.NotifyURL, s.Name()),
+	}
+	if ctx.PayType == PayTypeAlipayFq {
+		if s.config.HuabeiMinAmount <= 0 {
+			return "", errors.New("未开启花呗分期")
+		}
+		if order.Cents() < utils.YuanToCents(s.config.HuabeiMinAmount) {
+			return "", fmt.Errorf("订单金额不低于 %s 元才可以使用花呗分期", utils.FormatCents(utils.YuanToCents(s.config.HuabeiMinAmount)))
+		}
+		if !slices.Contains(huabeiInstallments, ctx.Installments) {
+			return "", errors.New("花呗分期期数只能是 3、6 或者 12 期")
+		}
+		params.Installments = ctx.Installments
+	}
+	if ctx.Recurring {
+		return s.signAgreement(order, ctx)
+	}
+	var payURL string
+	var err error
+	if ctx.Device == "wechat" || ctx.DeepLink {
+		payURL, err = s.PayMobile(ctx.Ctx(), params)
+	} else {
+		payURL, err = s.PayPC(ctx.Ctx(), params)
+	}
+	if err != nil {
+		return "", timeoutError(ctx.Ctx(), fmt.Errorf("error with generate pay url: %v", err))
+	}
+	return payURL, nil
+}
+
+// DeepLink 通过支付宝 App 打开手机网站支付页面
+func (s *AlipayService) DeepLink(payURL string) string {
+	return "alipays://platformapi/startapp?appId=20000067&url=" + url.QueryEscape(payURL)
+}
+
+// 周期扣款的个人签约产品码和商户扣款产品码
+const (
+	cyclePayPersonalProductCode = "CYCLE_PAY_AUTH_P"
+	cyclePayProductCode         = "GENERAL_WITHHOLDING"
+)
+
+// cyclePayMinDays 支付宝周期扣款按天扣款时周期不能少于 7 天
+const cyclePayMinDays = 7
+
+// signAgreement 自动续费产品先跳转到支付宝签约页面，签约成功之后由商户按照续费周期主动扣款，
+// 首期订单号作为商户签约号，签约回调时据此找到首期订单发起第一次扣款
+func (s *AlipayService) signAgreement(order *model.Order, ctx PayContext) (string, error) {
+	if !s.config.CyclePay {
+		return "", errors.New("未开通支付宝周期扣款，请选择其他支付方式")
+	}
+	var remark types.OrderRemark
+	if err := types.DecodeOrderRemark(order.Remark, &remark); err != nil || remark.Days <= 0 {
+		return "", errors.New("自动续费的产品必须设置会员天数")
+	}
+	if remark.Days < cyclePayMinDays {
+		return "", fmt.Errorf("支付宝自动续费的周期不能少于 %d 天", cyclePayMinDays)
+	}
+	signScene := s.config.SignScene
+	if signScene == "" {
+		signScene = "INDUSTRY|DIGITAL_MEDIA"
+	}
+	channel := "QRCODE"
+	if ctx.Device == "wechat" || ctx.DeepLink {
+		channel = "ALIPAYAPP"
+	}
+	bm := make(gopay.BodyMap)
+	bm.Set("personal_product_code", cyclePayPersonalProductCode).
+		Set("product_code", cyclePayProductCode).
+		Set("sign_scene", signScene).
+		Set("external_agreement_no", order.OrderNo).
+		Set("notify_url", notifyURL(ctx, s.config.NotifyURL, s.Name())).
+		Set("return_url", returnURL(ctx, s.config.ReturnURL)).
+		SetBodyMap("access_params", func(bm gopay.BodyMap) {
+			bm.Set("channel", channel)
+		}).
+		SetBodyMap("period_rule_params", func(bm gopay.BodyMap) {
+			bm.Set("period_type", "DAY").
+				Set("period", remark.Days).
+				Set("execute_time", time.Now().Format(time.DateOnly)).
+				Set("single_amount", utils.FormatCents(order.Cents()))
+		})
+	signURL, err := s.client.PageExecute(ctx.Ctx(), bm, "alipay.user.agreement.page.sign")
+	if err != nil {
+		return "", timeoutError(ctx.Ctx(), fmt.Errorf("error with generate agreement sign url: %v", err))
+	}
+	return signURL, nil
+}
+
+// Charge 使用周期扣款协议从用户的支付宝账户扣款
+func (s *AlipayService) Charge(order *model.Order, agreementNo string) (NotifyVo, error) {
+	bm := make(gopay.BodyMap)
+	bm.Set("out_trade_no", order.OrderNo).
+		Set("total_amount", utils.FormatCents(order.Cents())).
+		Set("subject", order.Subject).
+		Set("product_code", cyclePayProductCode).
+		SetBodyMap("agreement_params", func(bm gopay.BodyMap) {
+			bm.Set("agreement_no", agreementNo)
+		})
+	// 后台任务发起的扣款没有站点地址，只有配置了回调地址才接收异步通知，扣款结果以同步返回为准
+	if s.config.NotifyURL != "" {
+		bm.Set("notify_url", s.config.NotifyURL)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	rsp, err := s.client.TradePay(ctx, bm)
+	if err != nil {
+		return NotifyVo{Status: Failure, Message: err.Error()}, fmt.Errorf("error with charge agreement %s: %v", agreementNo, err)
+	}
+	// 10003 表示扣款处理中，结果通过异步通知返回
+	if rsp.Response.Code != "10000" {
+		return NotifyVo{Status: Failure, Message: rsp.Response.Msg}, nil
+	}
+	return NotifyVo{
+		Status:     Success,
+		OutTradeNo: rsp.Response.OutTradeNo,
+		TradeId:    rsp.Response.TradeNo,
+		Amount:     rsp.Response.TotalAmount,
+		Message:    "OK",
+	}, nil
+}
+
+// CancelSubscription 解除周期扣款协议，解约之后不能再扣款，已经发放的会员权益到期之后失效
+func (s *AlipayService) CancelSubscription(agreementNo string) error {
+	bm := make(gopay.BodyMap)
+	bm.Set("agreement_no", agreementNo).
+		Set("personal_product_code", cyclePayPersonalProductCode)
+	_, err := s.client.UserAgreementPageUnSign(context.Background(), bm)
+	if err != nil {
+		return fmt.Errorf("error with unsign agreement %s: %v", agreementNo, err)
+	}
+	return nil
+}
+
+// agreementNotify 周期扣款签约和解约的异步通知，签约场景下 external_agreement_no 为首期订单号
+func (s *AlipayService) agreementNotify(request *http.Request) (NotifyVo, error) {
+	bm, err := alipay.ParseNotifyToBodyMap(request)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with parse notify request: %v", err)
+	}
+	_, err = alipay.VerifySignWithCert(s.config.AlipayPublicKey, bm)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with verify sign: %v", err)
+	}
+
+	event := &SubscriptionEvent{SubscriptionNo: bm.GetString("agreement_no")}
+	switch bm.GetString("notify_type") {
+	case "dut_user_sign":
+		if bm.GetString("status") != "NORMAL" {
+			return NotifyVo{}, nil
+		}
+		event.Type = SubscriptionSigned
+	case "dut_user_unsign":
+		event.Type = SubscriptionEnded
+	default:
+		return NotifyVo{}, nil
+	}
+	return NotifyVo{
+		Status:       Success,
+		OutTradeNo:   bm.GetString("external_agreement_no"),
+		Message:      "OK",
+		Subscription: event,
+	}, nil
+}
+
+func (s *AlipayService) Notify(request *http.Request) (NotifyVo, error) {
+	err := request.ParseForm()
+	if err != nil {
+		return NotifyVo{}, err
+	}
+	// 签约和解约的通知与交易通知使用同一个回调地址，通过 notify_type 区分
+	if strings.HasPrefix(request.Form.Get("notify_type"), "dut_user_") {
+		return s.agreementNotify(request)
+	}
+	result := s.TradeVerify(request)
+	if !result.Success() {
+		return result, timeoutError(request.Context(), errors.New(result.Message))
+	}
+	return result, nil
+}
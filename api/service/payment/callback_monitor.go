@@ -0,0 +1,116 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	"geekai/service/notifier"
+	"geekai/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 告警中最多展示的错误信息条数
+const maxAlertErrors = 5
+
+type callbackEvent struct {
+	time time.Time
+	err  string // 为空表示校验通过
+}
+
+type callbackStat struct {
+	events    []callbackEvent
+	lastAlert time.Time
+}
+
+// CallbackMonitor 统计各个支付渠道回调校验的失败率，失败率超过阈值时发送告警，同一个渠道的告警有最小间隔。
+// 统计数据保存在内存中，多实例部署时每个实例单独统计
+type CallbackMonitor struct {
+	config   types.PayAlertConfig
+	notifier *notifier.Service
+	lock     sync.Mutex
+	stats    map[string]*callbackStat
+}
+
+func NewCallbackMonitor(appConfig *types.AppConfig, notifier *notifier.Service) *CallbackMonitor {
+	config := appConfig.PayAlertConfig
+	if config.Window <= 0 {
+		config.Window = 300
+	}
+	if config.MinSamples <= 0 {
+		config.MinSamples = 5
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = 0.5
+	}
+	if config.Interval <= 0 {
+		config.Interval = 1800
+	}
+	return &CallbackMonitor{config: config, notifier: notifier, stats: make(map[string]*callbackStat)}
+}
+
+// Record 记录一次回调校验结果，err 为 nil 表示校验通过
+func (m *CallbackMonitor) Record(gateway string, err error) {
+	now := time.Now()
+	event := callbackEvent{time: now}
+	if err != nil {
+		event.err = err.Error()
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	stat, ok := m.stats[gateway]
+	if !ok {
+		stat = &callbackStat{}
+		m.stats[gateway] = stat
+	}
+	// 丢弃统计窗口之外的记录
+	expired := now.Add(-time.Duration(m.config.Window) * time.Second)
+	i := 0
+	for i < len(stat.events) && stat.events[i].time.Before(expired) {
+		i++
+	}
+	stat.events = append(stat.events[i:], event)
+
+	if err == nil || len(stat.events) < m.config.MinSamples {
+		return
+	}
+	if now.Sub(stat.lastAlert) < time.Duration(m.config.Interval)*time.Second {
+		return
+	}
+	failures := 0
+	errs := make([]string, 0, maxAlertErrors)
+	for j := len(stat.events) - 1; j >= 0; j-- {
+		if stat.events[j].err == "" {
+			continue
+		}
+		failures++
+		if len(errs) < maxAlertErrors {
+			errs = append(errs, utils.CutWords(stat.events[j].err, 100))
+		}
+	}
+	rate := float64(failures) / float64(len(stat.events))
+	if rate < m.config.Threshold {
+		return
+	}
+
+	stat.lastAlert = now
+	logger.Errorf("[支付告警] %s 回调校验失败率 %.0f%%（%d/%d）", gateway, rate*100, failures, len(stat.events))
+	m.notifier.Notify(notifier.Message{
+		Topic: notifier.TopicPaymentAlert,
+		Title: fmt.Sprintf("%s 支付回调校验失败率过高", gateway),
+		Fields: []notifier.Field{
+			{Name: "支付渠道", Value: gateway},
+			{Name: "失败率", Value: fmt.Sprintf("%.0f%%（%d/%d）", rate*100, failures, len(stat.events))},
+			{Name: "统计窗口", Value: fmt.Sprintf("最近 %d 秒", m.config.Window)},
+			{Name: "最近错误", Value: strings.Join(errs, "\n")},
+		},
+	})
+}
@@ -0,0 +1,311 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	tronGridApiURL   = "https://api.trongrid.io"
+	usdtTrc20Address = "TR7NHqjeKQxGTCi8q8ZY4pL8otSzgjLj6t" // USDT TRC20 合约地址
+	// Nile 测试网，测试币可以在 https://nileex.io 领取
+	tronNileApiURL       = "https://nile.trongrid.io"
+	usdtNileTrc20Address = "TXYZopYRdj2D9XRtbG411XZZ3kM5VkAeBf"
+)
+
+var ErrNoCryptoAddress = errors.New("暂无可用的收款地址，请稍后再试")
+
+// CryptoService USDT(TRC20) 支付服务
+// 每个待支付订单独占一个收款地址，通过 TronGrid 接口轮询地址的入账记录来确认支付
+type CryptoService struct {
+	config   *types.CryptoConfig
+	db       *gorm.DB
+	client   *http.Client
+	lock     sync.Mutex
+	reserved map[string]time.Time // 已分配的收款地址 => 过期时间
+}
+
+func NewCryptoService(appConfig *types.AppConfig, db *gorm.DB) *CryptoService {
+	config := appConfig.CryptoConfig
+	if config.Sandbox { // 沙盒模式下把主网的默认配置切换到测试网
+		if config.ApiURL == "" || config.ApiURL == tronGridApiURL {
+			config.ApiURL = tronNileApiURL
+		}
+		if config.Contract == "" || config.Contract == usdtTrc20Address {
+			config.Contract = usdtNileTrc20Address
+		}
+	}
+	if config.ApiURL == "" {
+		config.ApiURL = tronGridApiURL
+	}
+	if config.Contract == "" {
+		config.Contract = usdtTrc20Address
+	}
+	if config.Interval <= 0 {
+		config.Interval = 30
+	}
+	if config.AddressCooldown <= 0 {
+		config.AddressCooldown = 86400
+	}
+	return &CryptoService{
+		config:   &config,
+		db:       db,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		reserved: make(map[string]time.Time),
+	}
+}
+
+// Interval 入账查询的时间间隔
+func (s *CryptoService) Interval() time.Duration {
+	return time.Duration(s.config.Interval) * time.Second
+}
+
+// Allocate 为订单分配一个空闲的收款地址，inUse 为待支付订单和冷却期内的订单已经占用的地址
+func (s *CryptoService) Allocate(inUse []string, ttl time.Duration) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	used := make(map[string]bool)
+	for _, addr := range inUse {
+		used[addr] = true
+	}
+	now := time.Now()
+	for _, addr := range s.config.Addresses {
+		if used[addr] {
+			continue
+		}
+		if expire, ok := s.reserved[addr]; ok && expire.After(now) {
+			continue
+		}
+		s.reserved[addr] = now.Add(ttl)
+		return addr, nil
+	}
+	return "", ErrNoCryptoAddress
+}
+
+// Release 释放收款地址，只用于订单创建失败的情况，已经创建的订单结束之后地址需要经过冷却期才能重新分配
+func (s *CryptoService) Release(address string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.reserved, address)
+}
+
+// Convert 把人民币金额按照汇率换算成 USDT 数量，保留两位小数并向上取整，rate 为 0 时使用配置文件中的汇率
+func (s *CryptoService) Convert(amount float64, rate float64) (string, error) {
+	if rate <= 0 {
+		rate = s.config.ExchangeRate
+	}
+	if rate <= 0 {
+		return "", errors.New("invalid USDT exchange rate")
+	}
+	usdt := decimal.NewFromFloat(amount).Div(decimal.NewFromFloat(rate)).RoundUp(2)
+	return usdt.StringFixed(2), nil
+}
+
+// Tolerance 允许的支付金额误差
+func (s *CryptoService) Tolerance() decimal.Decimal {
+	return decimal.NewFromFloat(s.config.Tolerance)
+}
+
+// Trc20Transfer 地址入账记录
+type Trc20Transfer struct {
+	TxHash    string          `json:"transaction_id"`
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Amount    decimal.Decimal `json:"-"`
+	Timestamp int64           `json:"block_timestamp"`
+}
+
+// maxTransferPages 查询入账记录的最大分页数，防止异常情况下无限翻页
+const maxTransferPages = 20
+
+// Transfers 查询指定地址从 since 开始已确认的 USDT 入账记录，按照 TronGrid 返回的 fingerprint 翻页查询全部记录
+func (s *CryptoService) Transfers(address string, since time.Time) ([]Trc20Transfer, error) {
+	params := url.Values{}
+	params.Set("only_confirmed", "true")
+	params.Set("only_to", "true")
+	params.Set("limit", "50")
+	params.Set("order_by", "block_timestamp,asc")
+	params.Set("contract_address", s.config.Contract)
+	params.Set("min_timestamp", fmt.Sprintf("%d", since.UnixMilli()))
+
+	transfers := make([]Trc20Transfer, 0)
+	for page := 0; page < maxTransferPages; page++ {
+		items, fingerprint, err := s.transferPage(address, params)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, items...)
+		if fingerprint == "" {
+			return transfers, nil
+		}
+		params.Set("fingerprint", fingerprint)
+	}
+	return nil, fmt.Errorf("too many transfers for address %s", address)
+}
+
+// transferPage 查询一页入账记录，返回下一页的 fingerprint，没有下一页时为空
+func (s *CryptoService) transferPage(address string, params url.Values) ([]Trc20Transfer, string, error) {
+	apiURL := fmt.Sprintf("%s/v1/accounts/%s/transactions/trc20?%s", s.config.ApiURL, address, params.Encode())
+
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if s.config.ApiKey != "" {
+		req.Header.Set("TRON-PRO-API-KEY", s.config.ApiKey)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("error with request TronGrid: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", fmt.Errorf("error with reading response: %v", err)
+	}
+
+	var r struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+		Meta    struct {
+			Fingerprint string `json:"fingerprint"`
+		} `json:"meta"`
+		Data []struct {
+			Trc20Transfer
+			Type      string `json:"type"`
+			Value     string `json:"value"`
+			TokenInfo struct {
+				Decimals int32 `json:"decimals"`
+			} `json:"token_info"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, "", fmt.Errorf("error with decode response: %v", err)
+	}
+	if !r.Success {
+		return nil, "", fmt.Errorf("error with query transfers: %s", r.Error)
+	}
+
+	transfers := make([]Trc20Transfer, 0, len(r.Data))
+	for _, item := range r.Data {
+		if item.Type != "Transfer" || item.To != address {
+			continue
+		}
+		value, err := decimal.NewFromString(item.Value)
+		if err != nil {
+			continue
+		}
+		item.Trc20Transfer.Amount = value.Shift(-item.TokenInfo.Decimals)
+		transfers = append(transfers, item.Trc20Transfer)
+	}
+	return transfers, r.Meta.Fingerprint, nil
+}
+
+// HealthCheck 查询第一个收款地址最近的入账记录，校验 TronGrid 接口是否可用
+func (s *CryptoService) HealthCheck() error {
+	if len(s.config.Addresses) == 0 {
+		return ErrNoCryptoAddress
+	}
+	_, err := s.Transfers(s.config.Addresses[0], time.Now())
+	return err
+}
+
+// PayURI 钱包扫码支付的 URI
+func (s *CryptoService) PayURI(address string, amount string) string {
+	return fmt.Sprintf("tron:%s?token=%s&amount=%s", address, s.config.Contract, amount)
+}
+
+// PendingOrders 获取有效期内未支付的加密货币订单
+func (s *CryptoService) PendingOrders(timeout time.Duration) ([]model.Order, error) {
+	var orders []model.Order
+	err := s.db.Where("pay_way = ? AND status IN ? AND created_at > ?", s.Name(),
+		[]types.OrderStatus{types.OrderNotPaid, types.OrderScanned}, time.Now().Add(-timeout)).Find(&orders).Error
+	return orders, err
+}
+
+// busyAddresses 获取不能分配的收款地址，包括待支付订单占用的地址，以及结束时间在冷却期内的订单使用过的地址。
+// 订单最晚在创建之后 timeout 结束，所以创建时间在 timeout + 冷却时间之内的订单都需要计算在内，不区分订单状态
+func (s *CryptoService) busyAddresses(timeout time.Duration) []string {
+	addresses := make([]string, 0)
+	var orders []model.Order
+	since := time.Now().Add(-timeout - time.Duration(s.config.AddressCooldown)*time.Second)
+	err := s.db.Unscoped().Select("remark").Where("pay_way = ? AND created_at > ?", s.Name(), since).Find(&orders).Error
+	if err != nil {
+		logger.Error("error with fetch crypto orders: ", err)
+		return addresses
+	}
+	for _, order := range orders {
+		var remark types.OrderRemark
+		if types.DecodeOrderRemark(order.Remark, &remark) == nil && remark.Crypto != nil {
+			addresses = append(addresses, remark.Crypto.Address)
+		}
+	}
+	return addresses
+}
+
+func (s *CryptoService) Name() string {
+	return "crypto"
+}
+
+func (s *CryptoService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *CryptoService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *CryptoService) Sandbox() bool {
+	return s.config.Sandbox
+}
+
+func (s *CryptoService) PayTypes() []string {
+	return []string{"usdt"}
+}
+
+// Pay 为订单分配收款地址，收款信息保存在订单备注中
+func (s *CryptoService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	usdt, err := s.Convert(utils.CentsToYuan(order.Cents()), ctx.ExchangeRate)
+	if err != nil {
+		return "", err
+	}
+	address, err := s.Allocate(s.busyAddresses(ctx.Expire), ctx.Expire)
+	if err != nil {
+		return "", err
+	}
+
+	var remark types.OrderRemark
+	err = types.DecodeOrderRemark(order.Remark, &remark)
+	if err != nil {
+		s.Release(address)
+		return "", fmt.Errorf("error with decode order remark: %v", err)
+	}
+	remark.Crypto = &types.CryptoRemark{Address: address, Amount: usdt}
+	order.Remark = utils.JsonEncode(remark)
+	return s.PayURI(address, usdt), nil
+}
+
+// Notify 加密货币支付没有异步回调，通过轮询地址入账记录确认支付
+func (s *CryptoService) Notify(request *http.Request) (NotifyVo, error) {
+	return NotifyVo{}, errors.New("crypto payment does not support notify")
+}
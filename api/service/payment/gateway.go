@@ -0,0 +1,265 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// PayContext 下单请求的上下文信息
+type PayContext struct {
+	PayType      string          // 支付类型，如 alipay, wxpay
+	Device       string          // 设备类型，wechat 表示在微信客户端中打开
+	Host         string          // 前端站点地址，用于生成回调和跳转地址
+	ClientIP     string          // 用户 IP 地址
+	Expire       time.Duration   // 订单有效期
+	DeepLink     bool            // 是否为原生 App 发起的支付，需要返回可以直接唤起钱包的地址
+	SiteName     string          // 站点名称，部分渠道会展示在支付页面上
+	OpenId       string          // 微信用户的 openid，在微信内使用 JSAPI 支付时需要
+	Installments int             // 花呗分期期数
+	Recurring    bool            // 是否为自动续费的订阅，支付渠道需要创建订阅而不是一次性支付
+	NotifyURL    string          // 产品单独设置的异步通知地址，优先于渠道配置
+	ReturnURL    string          // 产品单独设置的支付完成跳转地址，优先于渠道配置
+	MerchantId   string          // 订单所属的商户 ID，默认商户为空
+	ExchangeRate float64         // 管理后台设置的 USDT 汇率（1 USDT 兑换的人民币），0 表示使用渠道配置
+	Context      context.Context // 调用渠道接口使用的 context，由 handler 设置超时时间
+}
+
+// Ctx 调用渠道接口使用的 context，未设置时不限制超时时间
+func (c PayContext) Ctx() context.Context {
+	if c.Context != nil {
+		return c.Context
+	}
+	return context.Background()
+}
+
+// ErrGatewayTimeout 调用支付渠道接口超时，调用方可以稍后重试
+var ErrGatewayTimeout = errors.New("支付渠道响应超时，请稍后重试")
+
+// timeoutError context 超时导致的错误统一包装成 ErrGatewayTimeout，方便调用方识别
+func timeoutError(ctx context.Context, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", ErrGatewayTimeout, err)
+	}
+	return err
+}
+
+// PaymentGateway 支付渠道，新增支付渠道只需要实现该接口并注册到 Registry
+type PaymentGateway interface {
+	// Name 渠道标识，对应订单的 pay_way 字段
+	Name() string
+	// PayTypes 渠道支持的支付类型，对应订单的 pay_type 字段
+	PayTypes() []string
+	// Pay 发起支付，返回支付地址，渠道需要附加订单信息时可以直接修改 order
+	Pay(order *model.Order, ctx PayContext) (string, error)
+	// Notify 校验异步回调，返回的 OutTradeNo 为空表示无需处理的通知，需要请求渠道接口时使用 request.Context()
+	Notify(request *http.Request) (NotifyVo, error)
+}
+
+// NotifyReplier 需要自定义异步回调响应的支付渠道实现该接口，默认响应 success 或者 fail
+type NotifyReplier interface {
+	Reply(w http.ResponseWriter, err error)
+}
+
+// TradeQuerier 支持主动查询订单支付状态的支付渠道
+type TradeQuerier interface {
+	TradeQuery(outTradeNo string) NotifyVo
+}
+
+// DeepLinker 支持通过 scheme 地址直接唤起钱包 App 的支付渠道
+type DeepLinker interface {
+	DeepLink(payURL string) string
+}
+
+// ParamsPayer 部分支付方式返回的是前端调起支付需要的参数而不是支付地址，如微信 JSAPI 支付，
+// ReturnsParams 返回 true 时 Pay 返回的是 JSON 格式的支付参数
+type ParamsPayer interface {
+	ReturnsParams(ctx PayContext) bool
+}
+
+// Subscriber 支持自动续费订阅的支付渠道
+type Subscriber interface {
+	// CancelSubscription 取消自动续费，当前周期结束之后不再扣款
+	CancelSubscription(subscriptionNo string) error
+}
+
+// RecurringCharger 需要商户按照续费周期主动发起扣款的支付渠道，如支付宝周期扣款。
+// 扣款成功返回的 NotifyVo 和异步回调一样用于结算订单，Status 不是 Success 且 err 为空表示扣款处理中，等待异步回调
+type RecurringCharger interface {
+	Charge(order *model.Order, subscriptionNo string) (NotifyVo, error)
+}
+
+// SubscriptionResumer 支持恢复已取消的自动续费的支付渠道，当前周期结束之前可以恢复
+type SubscriptionResumer interface {
+	ResumeSubscription(subscriptionNo string) error
+}
+
+// MinAmounter 部分支付方式有最低订单金额限制，如花呗分期，返回 0 表示没有限制
+type MinAmounter interface {
+	MinAmount(payType string) float64
+}
+
+// OrderTimeouter 单独配置了订单超时时间的支付渠道，返回 0 表示使用系统配置的超时时间
+type OrderTimeouter interface {
+	OrderTimeout() time.Duration
+}
+
+// Sandboxer 支持沙盒（测试）环境的支付渠道，返回当前是否运行在沙盒环境
+type Sandboxer interface {
+	Sandbox() bool
+}
+
+// HealthChecker 支持连通性检测的支付渠道，使用不会产生交易的接口校验网络和密钥是否可用
+type HealthChecker interface {
+	HealthCheck() error
+}
+
+// healthCheckOrderNo 健康检查时查询的订单号，该订单不存在，渠道返回订单不存在即表示接口和密钥正常
+const healthCheckOrderNo = "HEALTH_CHECK_000000"
+
+// CurrencySupporter 支持外币结算的支付渠道，未实现该接口的渠道只支持人民币结算
+type CurrencySupporter interface {
+	SupportsCurrency(currency string) bool
+}
+
+// SupportsCurrency 支付渠道是否支持使用该货币结算
+func SupportsCurrency(gateway PaymentGateway, currency string) bool {
+	if supporter, ok := gateway.(CurrencySupporter); ok {
+		return supporter.SupportsCurrency(currency)
+	}
+	return currency == types.DefaultCurrency
+}
+
+// NotifyIPLimiter 配置了回调来源 IP 白名单的支付渠道，返回空列表表示不限制
+type NotifyIPLimiter interface {
+	NotifyIPs() []string
+}
+
+// IPAllowed 判断 IP 是否在白名单中，白名单支持 CIDR 和单个 IP
+func IPAllowed(allowList []string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, item := range allowList {
+		if !strings.Contains(item, "/") {
+			if other := net.ParseIP(item); other != nil && other.Equal(addr) {
+				return true
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err == nil && ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// FeeRater 收取手续费的支付渠道，返回手续费费率
+type FeeRater interface {
+	FeeRate() float64
+}
+
+// RefundParams 退款参数
+type RefundParams struct {
+	RefundNo string // 退款请求号，同一个退款请求号重复提交只会退款一次
+	Amount   int64  // 退款金额（分），部分退款时小于订单金额
+	Reason   string // 退款原因
+}
+
+// Refunder 支持原路退款的支付渠道，返回渠道的退款交易号
+type Refunder interface {
+	Refund(order model.Order, params RefundParams) (string, error)
+}
+
+// 退款状态
+const (
+	RefundPending    = "pending"    // 已扣回权益，还没有提交到支付渠道或者提交失败
+	RefundProcessing = "processing" // 退款处理中
+	RefundSuccess    = "success"    // 退款成功
+	RefundFailed     = "failed"     // 退款失败或者退款关闭
+)
+
+// RefundResult 渠道退款查询结果
+type RefundResult struct {
+	Status string // 退款状态
+	Amount int64  // 退款金额（分）
+}
+
+// RefundQuerier 支持查询退款状态的支付渠道，refundNo 为发起退款时的退款请求号
+type RefundQuerier interface {
+	RefundQuery(order model.Order, refundNo string) (RefundResult, error)
+}
+
+// Registry 支付渠道注册表
+type Registry struct {
+	gateways map[string]PaymentGateway
+	names    []string // 注册顺序，保证支付方式列表的顺序稳定
+}
+
+func NewRegistry() *Registry {
+	return &Registry{gateways: make(map[string]PaymentGateway)}
+}
+
+// Register 注册支付渠道，同名渠道会被覆盖
+func (r *Registry) Register(gateway PaymentGateway) {
+	if _, ok := r.gateways[gateway.Name()]; !ok {
+		r.names = append(r.names, gateway.Name())
+	}
+	r.gateways[gateway.Name()] = gateway
+}
+
+func (r *Registry) Get(name string) (PaymentGateway, bool) {
+	gateway, ok := r.gateways[name]
+	return gateway, ok
+}
+
+// All 按照注册顺序返回所有支付渠道
+func (r *Registry) All() []PaymentGateway {
+	items := make([]PaymentGateway, 0, len(r.names))
+	for _, name := range r.names {
+		items = append(items, r.gateways[name])
+	}
+	return items
+}
+
+// notifyURL 异步通知地址，优先使用配置的地址（用于本地调试支付）
+func notifyURL(ctx PayContext, configured string, name string) string {
+	if ctx.NotifyURL != "" {
+		return ctx.NotifyURL
+	}
+	if configured != "" {
+		return configured
+	}
+	// 商户的回调地址带上商户 ID，使用商户自己的秘钥校验回调
+	if ctx.MerchantId != "" {
+		return fmt.Sprintf("%s/api/payment/notify/%s/%s", ctx.Host, name, url.PathEscape(ctx.MerchantId))
+	}
+	return fmt.Sprintf("%s/api/payment/notify/%s", ctx.Host, name)
+}
+
+// returnURL 支付完成之后的跳转地址
+func returnURL(ctx PayContext, configured string) string {
+	if ctx.ReturnURL != "" {
+		return ctx.ReturnURL
+	}
+	if configured != "" {
+		return configured
+	}
+	return fmt.Sprintf("%s/payReturn", ctx.Host)
+}
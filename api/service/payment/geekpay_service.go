@@ -8,11 +8,14 @@ package payment
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"geekai/core/types"
+	"geekai/store/model"
 	"geekai/utils"
 	"io"
 	"net/http"
@@ -47,11 +50,11 @@ type GeekPayParams struct {
 	ReturnURL  string `json:"return_url"`
 }
 
-// Pay 支付订单
-func (s *GeekPayService) Pay(params GeekPayParams) (*GeekPayResp, error) {
+// CreateOrder 支付订单
+func (s *GeekPayService) CreateOrder(ctx context.Context, params GeekPayParams) (*GeekPayResp, error) {
 	p := map[string]string{
-		"pid": s.config.AppId,
-		//"method":       params.Method,
+		"pid":          s.config.AppId,
+		"method":       params.Method,
 		"device":       params.Device,
 		"type":         params.Type,
 		"out_trade_no": params.OutTradeNo,
@@ -64,7 +67,7 @@ func (s *GeekPayService) Pay(params GeekPayParams) (*GeekPayResp, error) {
 	}
 	p["sign"] = s.Sign(p)
 	p["sign_type"] = "MD5"
-	return s.sendRequest(s.config.ApiURL, p)
+	return s.sendRequest(ctx, s.config.ApiURL, p)
 }
 
 func (s *GeekPayService) Sign(params map[string]string) string {
@@ -100,9 +103,12 @@ type GeekPayResp struct {
 	UrlScheme string `json:"urlscheme"` // 小程序跳转支付链接
 }
 
-func (s *GeekPayService) sendRequest(endpoint string, params map[string]string) (*GeekPayResp, error) {
+func (s *GeekPayService) sendRequest(ctx context.Context, endpoint string, params map[string]string) (*GeekPayResp, error) {
 	form := url.Values{}
 	for k, v := range params {
+		if v == "" { // 空值不参与签名，也不提交，保持和签名参数一致
+			continue
+		}
 		form.Add(k, v)
 	}
 
@@ -115,11 +121,19 @@ func (s *GeekPayService) sendRequest(endpoint string, params map[string]string)
 		},
 	}
 	client := &http.Client{Transport: tr}
-	resp, err := client.PostForm(apiURL, form)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(form.Encode()))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, timeoutError(ctx, networkError(ctx, err))
+	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, temporary(fmt.Errorf("error with request api: %s", resp.Status))
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	logger.Debugf(string(body))
@@ -137,3 +151,121 @@ func (s *GeekPayService) sendRequest(endpoint string, params map[string]string)
 	}
 	return &r, nil
 }
+
+// HealthCheck 查询商户信息，校验商户 ID 和密钥是否有效
+func (s *GeekPayService) HealthCheck() error {
+	params := url.Values{}
+	params.Set("act", "query")
+	params.Set("pid", s.config.AppId)
+	params.Set("key", s.config.PrivateKey)
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("%s/api.php?%s", s.config.ApiURL, params.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var r struct {
+		Code int    `json:"code"`
+		Msg  string `json:"msg"`
+	}
+	if err = json.Unmarshal(body, &r); err != nil {
+		return fmt.Errorf("error with decode response: %v", err)
+	}
+	if r.Code != 1 {
+		return errors.New(r.Msg)
+	}
+	return nil
+}
+
+func (s *GeekPayService) Name() string {
+	return "geek"
+}
+
+func (s *GeekPayService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *GeekPayService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *GeekPayService) Sandbox() bool {
+	return s.config.Sandbox
+}
+
+func (s *GeekPayService) NotifyIPs() []string {
+	return s.config.NotifyIPs
+}
+
+func (s *GeekPayService) PayTypes() []string {
+	return s.config.Methods
+}
+
+func (s *GeekPayService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	host := ctx.Host
+	if s.config.ReturnURL != "" {
+		host = utils.GetBaseURL(s.config.ReturnURL)
+	}
+	returnURL := fmt.Sprintf("%s/payReturn", host)
+	// 电脑端使用默认的收银台页面，手机端使用跳转支付，直接唤起支付宝或者微信
+	method := ""
+	if ctx.Device == "wechat" || ctx.Device == "mobile" { // 手机端支付完成之后跳回手机端用户中心页面
+		returnURL = fmt.Sprintf("%s/mobile/profile", host)
+		method = "jump"
+	}
+	if ctx.ReturnURL != "" {
+		returnURL = ctx.ReturnURL
+	}
+	params := GeekPayParams{
+		OutTradeNo: order.OrderNo,
+		Method:     method,
+		Name:       order.Subject,
+		Money:      utils.FormatCents(order.Cents()),
+		ClientIP:   ctx.ClientIP,
+		Device:     ctx.Device,
+		Type:       ctx.PayType,
+		ReturnURL:  returnURL,
+		NotifyURL:  notifyURL(ctx, s.config.NotifyURL, s.Name()),
+	}
+	var res *GeekPayResp
+	err := withRetry(ctx.Ctx(), s.Name(), func() error {
+		var err error
+		res, err = s.CreateOrder(ctx.Ctx(), params)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return res.PayURL, nil
+}
+
+func (s *GeekPayService) Notify(request *http.Request) (NotifyVo, error) {
+	var params = make(map[string]string)
+	query := request.URL.Query()
+	for k := range query {
+		params[k] = query.Get(k)
+	}
+
+	// 非支付成功的通知直接忽略
+	if params["trade_status"] != "TRADE_SUCCESS" {
+		return NotifyVo{}, nil
+	}
+
+	// 使用常量时间比较签名，错误信息中也不能带上正确的签名，防止通过响应时间或者日志推算出签名
+	sign := s.Sign(params)
+	if subtle.ConstantTimeCompare([]byte(sign), []byte(params["sign"])) != 1 {
+		return NotifyVo{}, fmt.Errorf("签名验证失败, %s", params["sign"])
+	}
+	return NotifyVo{
+		Status:     Success,
+		OutTradeNo: params["out_trade_no"],
+		TradeId:    params["trade_no"],
+		Amount:     params["money"],
+		Message:    "OK",
+	}, nil
+}
@@ -8,11 +8,14 @@ package payment
 // * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"geekai/core/types"
+	"geekai/store/model"
 	"geekai/utils"
 	"io"
 	"net/http"
@@ -24,6 +27,7 @@ import (
 )
 
 type HuPiPayService struct {
+	config    *types.HuPiPayConfig
 	appId     string
 	appSecret string
 	apiURL    string
@@ -31,6 +35,7 @@ type HuPiPayService struct {
 
 func NewHuPiPay(config *types.AppConfig) *HuPiPayService {
 	return &HuPiPayService{
+		config:    &config.HuPiPayConfig,
 		appId:     config.HuPiPayConfig.AppId,
 		appSecret: config.HuPiPayConfig.AppSecret,
 		apiURL:    config.HuPiPayConfig.ApiURL,
@@ -61,8 +66,8 @@ type HuPiPayResp struct {
 	ErrMsg    string      `json:"errmsg,omitempty"`
 }
 
-// Pay 执行支付请求操作
-func (s *HuPiPayService) Pay(params HuPiPayParams) (HuPiPayResp, error) {
+// CreateOrder 执行支付请求操作
+func (s *HuPiPayService) CreateOrder(ctx context.Context, params HuPiPayParams) (HuPiPayResp, error) {
 	data := url.Values{}
 	simple := strconv.FormatInt(time.Now().Unix(), 10)
 	params.AppId = s.appId
@@ -78,11 +83,14 @@ func (s *HuPiPayService) Pay(params HuPiPayParams) (HuPiPayResp, error) {
 	data.Add("hash", s.Sign(data))
 	// 发送支付请求
 	apiURL := fmt.Sprintf("%s/payment/do.html", s.apiURL)
-	resp, err := http.PostForm(apiURL, data)
+	resp, err := postForm(ctx, apiURL, data)
 	if err != nil {
-		return HuPiPayResp{}, fmt.Errorf("error with requst api: %v", err)
+		return HuPiPayResp{}, timeoutError(ctx, networkError(ctx, fmt.Errorf("error with requst api: %w", err)))
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return HuPiPayResp{}, temporary(fmt.Errorf("error with requst api: %s", resp.Status))
+	}
 	all, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return HuPiPayResp{}, fmt.Errorf("error with reading response: %v", err)
@@ -126,8 +134,39 @@ func (s *HuPiPayService) Sign(params url.Values) string {
 	return hex.EncodeToString(md5bs[:])
 }
 
+// Verify 校验回调参数的签名和 appid，签名覆盖除 hash 之外的全部参数
+func (s *HuPiPayService) Verify(form url.Values) error {
+	hash := form.Get("hash")
+	if hash == "" {
+		return errors.New("missing hash")
+	}
+	params := url.Values{}
+	for key, values := range form {
+		if key != "hash" {
+			params[key] = values
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(s.Sign(params))) != 1 {
+		return errors.New("invalid hash")
+	}
+	if appId := form.Get("appid"); appId != "" && appId != s.appId {
+		return fmt.Errorf("appid mismatch: %s", appId)
+	}
+	return nil
+}
+
+// postForm 提交表单请求，ctx 超时或者取消时中断请求
+func postForm(ctx context.Context, apiURL string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return http.DefaultClient.Do(req)
+}
+
 // Check 校验订单状态
-func (s *HuPiPayService) Check(outTradeNo string) error {
+func (s *HuPiPayService) Check(ctx context.Context, outTradeNo string) error {
 	data := url.Values{}
 	data.Add("appid", s.appId)
 	data.Add("out_trade_order", outTradeNo)
@@ -137,9 +176,9 @@ func (s *HuPiPayService) Check(outTradeNo string) error {
 	data.Add("hash", s.Sign(data))
 
 	apiURL := fmt.Sprintf("%s/payment/query.html", s.apiURL)
-	resp, err := http.PostForm(apiURL, data)
+	resp, err := postForm(ctx, apiURL, data)
 	if err != nil {
-		return fmt.Errorf("error with http reqeust: %v", err)
+		return timeoutError(ctx, fmt.Errorf("error with http reqeust: %v", err))
 	}
 
 	defer resp.Body.Close()
@@ -169,3 +208,154 @@ func (s *HuPiPayService) Check(outTradeNo string) error {
 		return errors.New("order not paid：" + r.ErrMsg)
 	}
 }
+
+// HealthCheck 查询一个不存在的订单，只要网关正常返回数据就认为接口可用
+// 虎皮椒查询接口不区分订单不存在和签名错误，所以无法校验密钥是否有效
+func (s *HuPiPayService) HealthCheck() error {
+	data := url.Values{}
+	data.Add("appid", s.appId)
+	data.Add("out_trade_order", healthCheckOrderNo)
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	data.Add("time", stamp)
+	data.Add("nonce_str", stamp)
+	data.Add("hash", s.Sign(data))
+
+	resp, err := http.PostForm(fmt.Sprintf("%s/payment/query.html", s.apiURL), data)
+	if err != nil {
+		return fmt.Errorf("error with http reqeust: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code: %d", resp.StatusCode)
+	}
+	var r struct {
+		ErrCode int `json:"errcode"`
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error with reading response: %v", err)
+	}
+	return utils.JsonDecode(string(body), &r)
+}
+
+// Refund 虎皮椒退款接口
+func (s *HuPiPayService) Refund(order model.Order, params RefundParams) (string, error) {
+	data := url.Values{}
+	data.Add("appid", s.appId)
+	data.Add("trade_order_id", order.OrderNo)
+	data.Add("refund_fee", utils.FormatCents(params.Amount))
+	data.Add("reason", params.Reason)
+	stamp := strconv.FormatInt(time.Now().Unix(), 10)
+	data.Add("time", stamp)
+	data.Add("nonce_str", stamp)
+	data.Add("hash", s.Sign(data))
+
+	apiURL := fmt.Sprintf("%s/payment/refund.html", s.apiURL)
+	resp, err := http.PostForm(apiURL, data)
+	if err != nil {
+		return "", fmt.Errorf("error with http reqeust: %v", err)
+	}
+
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error with reading response: %v", err)
+	}
+
+	var r struct {
+		ErrCode int `json:"errcode"`
+		Data    struct {
+			RefundStatus string `json:"refund_status"`
+			OutRefundNo  string `json:"out_refund_no"`
+		} `json:"data,omitempty"`
+		ErrMsg string `json:"errmsg"`
+	}
+	err = utils.JsonDecode(string(body), &r)
+	if err != nil {
+		return "", fmt.Errorf("error with decode response: %v", err)
+	}
+	if r.ErrCode != 0 {
+		return "", errors.New("error with refund order: " + r.ErrMsg)
+	}
+	if r.Data.OutRefundNo == "" {
+		return params.RefundNo, nil
+	}
+	return r.Data.OutRefundNo, nil
+}
+
+func (s *HuPiPayService) Name() string {
+	return "hupi"
+}
+
+func (s *HuPiPayService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *HuPiPayService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *HuPiPayService) Sandbox() bool {
+	return s.config.Sandbox
+}
+
+func (s *HuPiPayService) NotifyIPs() []string {
+	return s.config.NotifyIPs
+}
+
+func (s *HuPiPayService) PayTypes() []string {
+	return []string{"wxpay"}
+}
+
+func (s *HuPiPayService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	wapName := s.config.WapName
+	if wapName == "" {
+		wapName = ctx.SiteName
+	}
+	params := HuPiPayParams{
+		Version:      "1.1",
+		TradeOrderId: order.OrderNo,
+		TotalFee:     utils.FormatCents(order.Cents()),
+		Title:        order.Subject,
+		NotifyURL:    notifyURL(ctx, s.config.NotifyURL, s.Name()),
+		ReturnURL:    returnURL(ctx, s.config.ReturnURL),
+		WapName:      wapName,
+	}
+	var r HuPiPayResp
+	err := withRetry(ctx.Ctx(), s.Name(), func() error {
+		var err error
+		r, err = s.CreateOrder(ctx.Ctx(), params)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return r.URL, nil
+}
+
+func (s *HuPiPayService) Notify(request *http.Request) (NotifyVo, error) {
+	err := request.ParseForm()
+	if err != nil {
+		return NotifyVo{}, err
+	}
+
+	// 金额等参数直接取自回调表单，必须先校验签名，防止伪造或者篡改回调参数
+	if err = s.Verify(request.PostForm); err != nil {
+		return NotifyVo{}, err
+	}
+	if request.PostForm.Get("status") != "OD" {
+		return NotifyVo{Status: Failure, Message: "order not paid"}, nil
+	}
+
+	orderNo := request.PostForm.Get("trade_order_id")
+	if err = s.Check(request.Context(), orderNo); err != nil {
+		return NotifyVo{}, err
+	}
+	return NotifyVo{
+		Status:     Success,
+		OutTradeNo: orderNo,
+		TradeId:    request.PostForm.Get("open_order_id"),
+		Amount:     request.PostForm.Get("total_fee"),
+		Message:    "OK",
+	}, nil
+}
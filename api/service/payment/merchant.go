@@ -0,0 +1,108 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	"net"
+	"strings"
+)
+
+// Merchants 多品牌部署时每个商户的支付渠道。每个商户使用自己的渠道实例（商户号和秘钥），
+// 商户没有单独配置的渠道使用默认渠道。默认商户的 ID 为空字符串
+type Merchants struct {
+	defaults   *Registry
+	registries map[string]*Registry // 商户 ID => 商户的支付渠道
+	hosts      map[string]string    // 域名 => 商户 ID
+	ids        []string
+}
+
+func NewMerchants(defaults *Registry, appConfig *types.AppConfig) (*Merchants, error) {
+	m := &Merchants{
+		defaults:   defaults,
+		registries: make(map[string]*Registry),
+		hosts:      make(map[string]string),
+		ids:        []string{""},
+	}
+	for _, merchant := range appConfig.Merchants {
+		if merchant.Id == "" {
+			return nil, fmt.Errorf("merchant id is required")
+		}
+		if _, ok := m.registries[merchant.Id]; ok {
+			return nil, fmt.Errorf("duplicate merchant id: %s", merchant.Id)
+		}
+		registry := NewRegistry()
+		for _, gateway := range defaults.All() {
+			registry.Register(gateway)
+		}
+		// 复用默认配置中的其他字段，只替换商户的渠道配置
+		config := *appConfig
+		config.AlipayConfig = merchant.AlipayConfig
+		config.WechatPayConfig = merchant.WechatPayConfig
+		if merchant.AlipayConfig.Enabled {
+			alipay, err := NewAlipayService(&config)
+			if err != nil {
+				return nil, fmt.Errorf("error with create alipay service for merchant %s: %v", merchant.Id, err)
+			}
+			registry.Register(alipay)
+		}
+		if merchant.WechatPayConfig.Enabled {
+			wechat, err := NewWechatService(&config)
+			if err != nil {
+				return nil, fmt.Errorf("error with create wechat pay service for merchant %s: %v", merchant.Id, err)
+			}
+			registry.Register(wechat)
+		}
+		for _, host := range merchant.Hosts {
+			m.hosts[strings.ToLower(host)] = merchant.Id
+		}
+		m.registries[merchant.Id] = registry
+		m.ids = append(m.ids, merchant.Id)
+	}
+	return m, nil
+}
+
+// Resolve 按照请求的域名匹配商户，没有匹配的商户时返回默认商户
+func (m *Merchants) Resolve(host string) (string, *Registry) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if id, ok := m.hosts[strings.ToLower(host)]; ok {
+		return id, m.registries[id]
+	}
+	return "", m.defaults
+}
+
+// Registry 商户的支付渠道，商户不存在（如配置已经删除）时返回默认渠道
+func (m *Merchants) Registry(merchantId string) *Registry {
+	if registry, ok := m.registries[merchantId]; ok {
+		return registry
+	}
+	return m.defaults
+}
+
+// Ids 全部商户的 ID，第一个为默认商户
+func (m *Merchants) Ids() []string {
+	return m.ids
+}
+
+// Own 商户单独配置的支付渠道，不包括使用的默认渠道，默认商户返回全部默认渠道
+func (m *Merchants) Own(merchantId string) []PaymentGateway {
+	registry := m.Registry(merchantId)
+	if registry == m.defaults {
+		return m.defaults.All()
+	}
+	items := make([]PaymentGateway, 0)
+	for _, gateway := range registry.All() {
+		if d, ok := m.defaults.Get(gateway.Name()); !ok || d != gateway {
+			items = append(items, gateway)
+		}
+	}
+	return items
+}
@@ -0,0 +1,363 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"github.com/go-pay/gopay"
+	"github.com/go-pay/gopay/paypal"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	paypalApiURL        = "https://api-m.paypal.com"
+	paypalSandboxApiURL = "https://api-m.sandbox.paypal.com"
+)
+
+// PayPal webhook 事件类型
+const (
+	PaypalEventOrderApproved   = "CHECKOUT.ORDER.APPROVED"
+	PaypalEventCaptureComplete = "PAYMENT.CAPTURE.COMPLETED"
+	PaypalEventDisputeCreated  = "CUSTOMER.DISPUTE.CREATED"
+	PaypalEventDisputeResolved = "CUSTOMER.DISPUTE.RESOLVED"
+)
+
+// PaypalService PayPal 支付服务，使用 Orders v2 接口
+type PaypalService struct {
+	config     *types.PaypalConfig
+	client     *paypal.Client
+	httpClient *http.Client
+}
+
+func NewPaypalService(appConfig *types.AppConfig) (*PaypalService, error) {
+	config := appConfig.PaypalConfig
+	if !config.Enabled {
+		logger.Info("Disabled PayPal service")
+		return nil, nil
+	}
+
+	client, err := paypal.NewClient(config.ClientId, config.Secret, !config.Sandbox)
+	if err != nil {
+		return nil, fmt.Errorf("error with initialize paypal service: %v", err)
+	}
+
+	return &PaypalService{config: &config, client: client, httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+type PaypalParams struct {
+	OutTradeNo string `json:"out_trade_no"`
+	Subject    string `json:"subject"`
+	TotalFee   string `json:"total_fee"`
+	Currency   string `json:"currency"`
+	ReturnURL  string `json:"return_url"`
+	CancelURL  string `json:"cancel_url"`
+}
+
+// PaypalEvent PayPal webhook 事件
+type PaypalEvent struct {
+	Id           string          `json:"id"`
+	EventType    string          `json:"event_type"`
+	ResourceType string          `json:"resource_type"`
+	Resource     json.RawMessage `json:"resource"`
+}
+
+// PayUrl 创建 PayPal 订单，返回用户授权支付的地址
+func (s *PaypalService) PayUrl(params PaypalParams) (string, error) {
+	units := []*paypal.PurchaseUnit{{
+		ReferenceId: params.OutTradeNo,
+		CustomId:    params.OutTradeNo,
+		Description: params.Subject,
+		Amount: &paypal.Amount{
+			CurrencyCode: params.Currency,
+			Value:        params.TotalFee,
+		},
+	}}
+	bm := make(gopay.BodyMap)
+	bm.Set("intent", "CAPTURE").
+		Set("purchase_units", units).
+		SetBodyMap("application_context", func(b gopay.BodyMap) {
+			b.Set("user_action", "PAY_NOW").
+				Set("shipping_preference", "NO_SHIPPING").
+				Set("return_url", params.ReturnURL).
+				Set("cancel_url", params.CancelURL)
+		})
+
+	rsp, err := s.client.CreateOrder(context.Background(), bm)
+	if err != nil {
+		return "", fmt.Errorf("error with create paypal order: %v", err)
+	}
+	if rsp.Code != paypal.Success {
+		return "", fmt.Errorf("error with create paypal order: %s", rsp.Error)
+	}
+	for _, link := range rsp.Response.Links {
+		if link.Rel == "approve" || link.Rel == "payer-action" {
+			return link.Href, nil
+		}
+	}
+	return "", errors.New("error with create paypal order: no approve link found")
+}
+
+// VerifyWebhook 调用 PayPal 接口校验 webhook 签名，并返回解析后的事件
+func (s *PaypalService) VerifyWebhook(request *http.Request) (PaypalEvent, error) {
+	var event PaypalEvent
+	payload, err := io.ReadAll(request.Body)
+	if err != nil {
+		return event, fmt.Errorf("error with read request body: %v", err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"auth_algo":         request.Header.Get("PAYPAL-AUTH-ALGO"),
+		"cert_url":          request.Header.Get("PAYPAL-CERT-URL"),
+		"transmission_id":   request.Header.Get("PAYPAL-TRANSMISSION-ID"),
+		"transmission_sig":  request.Header.Get("PAYPAL-TRANSMISSION-SIG"),
+		"transmission_time": request.Header.Get("PAYPAL-TRANSMISSION-TIME"),
+		"webhook_id":        s.config.WebhookId,
+		"webhook_event":     json.RawMessage(payload),
+	})
+	if err != nil {
+		return event, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.apiURL()+"/v1/notifications/verify-webhook-signature", bytes.NewReader(body))
+	if err != nil {
+		return event, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+s.client.AccessToken)
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return event, fmt.Errorf("error with verify webhook signature: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var r struct {
+		VerificationStatus string `json:"verification_status"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		return event, fmt.Errorf("error with decode verify result: %v", err)
+	}
+	if r.VerificationStatus != "SUCCESS" {
+		return event, fmt.Errorf("webhook signature verification failed: %s", r.VerificationStatus)
+	}
+
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return event, fmt.Errorf("error with decode webhook event: %v", err)
+	}
+	return event, nil
+}
+
+// TradeVerify 根据 webhook 事件确认交易，用户授权的订单需要先扣款(capture)
+func (s *PaypalService) TradeVerify(event PaypalEvent) NotifyVo {
+	switch event.EventType {
+	case PaypalEventOrderApproved:
+		var order paypal.OrderDetail
+		if err := json.Unmarshal(event.Resource, &order); err != nil {
+			return NotifyVo{Status: Failure, Message: "error with decode order: " + err.Error()}
+		}
+		return s.capture(order.Id)
+	case PaypalEventCaptureComplete:
+		var capture struct {
+			paypal.Capture
+			SupplementaryData struct {
+				RelatedIds struct {
+					OrderId string `json:"order_id"`
+				} `json:"related_ids"`
+			} `json:"supplementary_data"`
+		}
+		if err := json.Unmarshal(event.Resource, &capture); err != nil {
+			return NotifyVo{Status: Failure, Message: "error with decode capture: " + err.Error()}
+		}
+		if capture.Status != "COMPLETED" || capture.Amount == nil {
+			return NotifyVo{Status: Failure, Message: "capture not completed: " + capture.Status}
+		}
+		return NotifyVo{
+			Status:     Success,
+			OutTradeNo: capture.CustomId,
+			TradeId:    capture.SupplementaryData.RelatedIds.OrderId,
+			Amount:     capture.Amount.Value,
+			Message:    "OK",
+		}
+	}
+	return NotifyVo{Status: Failure, Message: "unsupported event type: " + event.EventType}
+}
+
+func (s *PaypalService) capture(orderId string) NotifyVo {
+	rsp, err := s.client.OrderCapture(context.Background(), orderId, nil)
+	if err != nil {
+		return NotifyVo{Status: Failure, Message: "error with capture paypal order: " + err.Error()}
+	}
+	// 重复回调时订单可能已经被扣款，此时查询订单详情
+	if rsp.Code != paypal.Success {
+		detail, err := s.client.OrderDetail(context.Background(), orderId, nil)
+		if err != nil || detail.Code != paypal.Success {
+			return NotifyVo{Status: Failure, Message: "error with capture paypal order: " + rsp.Error}
+		}
+		rsp.Response = detail.Response
+	}
+
+	order := rsp.Response
+	if order.Status != "COMPLETED" || len(order.PurchaseUnits) == 0 {
+		return NotifyVo{Status: Failure, Message: "paypal order not completed: " + order.Status}
+	}
+	unit := order.PurchaseUnits[0]
+	vo := NotifyVo{Status: Success, OutTradeNo: unit.CustomId, TradeId: order.Id, Message: "OK"}
+	if unit.Payments != nil && len(unit.Payments.Captures) > 0 && unit.Payments.Captures[0].Amount != nil {
+		vo.Amount = unit.Payments.Captures[0].Amount.Value
+	}
+	if vo.OutTradeNo == "" {
+		vo.OutTradeNo = unit.ReferenceId
+	}
+	return vo
+}
+
+// PaypalDispute PayPal 争议（拒付），custom 为下单时设置的商户订单号
+type PaypalDispute struct {
+	DisputeId     string `json:"dispute_id"`
+	Reason        string `json:"reason"`
+	Status        string `json:"status"`
+	DisputeAmount struct {
+		CurrencyCode string `json:"currency_code"`
+		Value        string `json:"value"`
+	} `json:"dispute_amount"`
+	SellerResponseDueDate string `json:"seller_response_due_date"`
+	DisputeOutcome        struct {
+		OutcomeCode string `json:"outcome_code"`
+	} `json:"dispute_outcome"`
+	DisputedTransactions []struct {
+		SellerTransactionId string `json:"seller_transaction_id"`
+		Custom              string `json:"custom"`
+	} `json:"disputed_transactions"`
+}
+
+// dispute 用户对交易发起争议，争议结束时 Status 使用处理结果
+func (s *PaypalService) dispute(event PaypalEvent, eventType string) (NotifyVo, error) {
+	var dispute PaypalDispute
+	err := json.Unmarshal(event.Resource, &dispute)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with decode dispute: %v", err)
+	}
+	result := &DisputeEvent{
+		Type:      eventType,
+		DisputeId: dispute.DisputeId,
+		Amount:    dispute.DisputeAmount.Value,
+		Currency:  dispute.DisputeAmount.CurrencyCode,
+		Reason:    dispute.Reason,
+		Status:    dispute.Status,
+	}
+	if eventType == DisputeClosed && dispute.DisputeOutcome.OutcomeCode != "" {
+		result.Status = dispute.DisputeOutcome.OutcomeCode
+	}
+	if dueBy, err := time.Parse(time.RFC3339, dispute.SellerResponseDueDate); err == nil {
+		result.DueBy = dueBy.Unix()
+	}
+	for _, transaction := range dispute.DisputedTransactions {
+		if result.OrderNo == "" {
+			result.OrderNo = transaction.Custom
+		}
+		result.TradeNos = append(result.TradeNos, transaction.SellerTransactionId)
+	}
+	return NotifyVo{Status: Success, Message: "OK", Dispute: result}, nil
+}
+
+// HealthCheck 获取 AccessToken，校验 ClientId 和 Secret 是否有效
+func (s *PaypalService) HealthCheck() error {
+	_, err := s.client.GetAccessToken()
+	return err
+}
+
+func (s *PaypalService) apiURL() string {
+	if s.config.Sandbox {
+		return paypalSandboxApiURL
+	}
+	return paypalApiURL
+}
+
+func (s *PaypalService) Name() string {
+	return "paypal"
+}
+
+func (s *PaypalService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *PaypalService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *PaypalService) Sandbox() bool {
+	return s.config.Sandbox
+}
+
+func (s *PaypalService) NotifyIPs() []string {
+	return s.config.NotifyIPs
+}
+
+func (s *PaypalService) SupportsCurrency(currency string) bool {
+	return utils.Contains(types.Currencies, currency)
+}
+
+func (s *PaypalService) PayTypes() []string {
+	return []string{"paypal"}
+}
+
+func (s *PaypalService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	returnURL := returnURL(ctx, s.config.ReturnURL)
+	return s.PayUrl(PaypalParams{
+		OutTradeNo: order.OrderNo,
+		Subject:    order.Subject,
+		TotalFee:   utils.FormatCents(order.Cents()),
+		Currency:   order.CurrencyCode(),
+		ReturnURL:  returnURL,
+		CancelURL:  returnURL,
+	})
+}
+
+func (s *PaypalService) Notify(request *http.Request) (NotifyVo, error) {
+	event, err := s.VerifyWebhook(request)
+	if err != nil {
+		return NotifyVo{}, err
+	}
+
+	logger.Infof("收到 PayPal 事件回调：%s, %s", event.Id, event.EventType)
+	switch event.EventType {
+	case PaypalEventDisputeCreated:
+		return s.dispute(event, DisputeCreated)
+	case PaypalEventDisputeResolved:
+		return s.dispute(event, DisputeClosed)
+	}
+	if event.EventType != PaypalEventOrderApproved && event.EventType != PaypalEventCaptureComplete {
+		return NotifyVo{}, nil
+	}
+
+	result := s.TradeVerify(event)
+	if !result.Success() {
+		return result, errors.New(result.Message)
+	}
+	return result, nil
+}
+
+// Reply PayPal 只有收到 2xx 状态码才认为通知成功，否则会重试
+func (s *PaypalService) Reply(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("fail"))
+		return
+	}
+	_, _ = w.Write([]byte("success"))
+}
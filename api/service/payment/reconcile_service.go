@@ -0,0 +1,181 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// 对账差异类型
+const (
+	ReconcileAmountMismatch = "amount_mismatch" // 金额不一致
+	ReconcileGatewayUnpaid  = "gateway_unpaid"  // 本地已支付，支付渠道未支付
+	ReconcileLocalUnpaid    = "local_unpaid"    // 支付渠道已支付，本地未支付（回调丢失）
+	ReconcileMissingOrder   = "missing_order"   // 支付渠道有交易，本地没有对应的订单
+)
+
+// TradeLister 支持按时间范围拉取交易记录的支付渠道，用于发现本地缺失的订单
+type TradeLister interface {
+	ListTrades(start time.Time, end time.Time) ([]NotifyVo, error)
+}
+
+// ReconcileService 对账服务，定期比对本地订单和支付渠道的交易记录，差异写入对账报告
+type ReconcileService struct {
+	db *gorm.DB
+}
+
+func NewReconcileService(db *gorm.DB) *ReconcileService {
+	return &ReconcileService{db: db}
+}
+
+// Run 每天凌晨 3 点对前一天的订单进行对账
+func (s *ReconcileService) Run(merchants *Merchants) {
+	go func() {
+		logger.Info("Running payment reconcile service ...")
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), 3, 0, 0, 0, now.Location())
+			if !next.After(now) {
+				next = next.AddDate(0, 0, 1)
+			}
+			time.Sleep(next.Sub(now))
+
+			end := time.Now()
+			reports, err := s.Reconcile(merchants, end.Add(-24*time.Hour), end)
+			if err != nil {
+				logger.Errorf("error with reconcile orders: %v", err)
+				continue
+			}
+			logger.Infof("对账完成，发现差异 %d 条", len(reports))
+		}
+	}()
+}
+
+// Reconcile 对指定时间范围内的订单进行对账
+func (s *ReconcileService) Reconcile(merchants *Merchants, start time.Time, end time.Time) ([]model.ReconcileReport, error) {
+	batchNo := end.Format("2006-01-02")
+	reports := make([]model.ReconcileReport, 0)
+
+	// 本地已支付的订单，核对支付渠道的支付状态和金额
+	var paidOrders []model.Order
+	err := s.db.Where("status = ? AND pay_time >= ? AND pay_time < ?", types.OrderPaidSuccess, start.Unix(), end.Unix()).Find(&paidOrders).Error
+	if err != nil {
+		return nil, fmt.Errorf("error with fetch paid orders: %v", err)
+	}
+	for _, order := range paidOrders {
+		querier, ok := s.querier(merchants.Registry(order.MerchantId), order.PayWay)
+		if !ok {
+			continue
+		}
+		result := querier.TradeQuery(order.OrderNo)
+		report := model.ReconcileReport{
+			BatchNo:     batchNo,
+			MerchantId:  order.MerchantId,
+			Gateway:     order.PayWay,
+			OrderNo:     order.OrderNo,
+			TradeNo:     order.TradeNo,
+			LocalAmount: utils.FormatCents(order.Cents()),
+		}
+		if !result.Success() {
+			report.Type = ReconcileGatewayUnpaid
+			report.Message = string([]rune(result.Message)[:min(len([]rune(result.Message)), 200)])
+			reports = append(reports, report)
+			continue
+		}
+		paid, err := utils.ParseCents(result.Amount)
+		if err != nil || paid != order.Cents() {
+			report.Type = ReconcileAmountMismatch
+			report.GatewayAmount = result.Amount
+			reports = append(reports, report)
+		}
+	}
+
+	// 本地未支付的订单，核对支付渠道是否已经收款
+	var unpaidOrders []model.Order
+	err = s.db.Where("status IN ? AND created_at >= ? AND created_at < ?",
+		[]types.OrderStatus{types.OrderNotPaid, types.OrderScanned, types.OrderCancelled}, start, end).Find(&unpaidOrders).Error
+	if err != nil {
+		return nil, fmt.Errorf("error with fetch unpaid orders: %v", err)
+	}
+	for _, order := range unpaidOrders {
+		querier, ok := s.querier(merchants.Registry(order.MerchantId), order.PayWay)
+		if !ok {
+			continue
+		}
+		result := querier.TradeQuery(order.OrderNo)
+		if result.Success() {
+			reports = append(reports, model.ReconcileReport{
+				BatchNo:       batchNo,
+				MerchantId:    order.MerchantId,
+				Gateway:       order.PayWay,
+				OrderNo:       order.OrderNo,
+				TradeNo:       result.TradeId,
+				Type:          ReconcileLocalUnpaid,
+				LocalAmount:   utils.FormatCents(order.Cents()),
+				GatewayAmount: result.Amount,
+			})
+		}
+	}
+
+	// 支付渠道的交易记录，找出本地没有对应订单的交易，每个商户只拉取商户自己的渠道，避免重复拉取默认渠道
+	for _, merchantId := range merchants.Ids() {
+		for _, gateway := range merchants.Own(merchantId) {
+			lister, ok := gateway.(TradeLister)
+			if !ok {
+				continue
+			}
+			trades, err := lister.ListTrades(start, end)
+			if err != nil {
+				logger.Errorf("error with list %s trades: %v", gateway.Name(), err)
+				continue
+			}
+			for _, trade := range trades {
+				var count int64
+				s.db.Model(&model.Order{}).Where("order_no = ?", trade.OutTradeNo).Count(&count)
+				if count > 0 {
+					continue
+				}
+				reports = append(reports, model.ReconcileReport{
+					BatchNo:       batchNo,
+					MerchantId:    merchantId,
+					Gateway:       gateway.Name(),
+					OrderNo:       trade.OutTradeNo,
+					TradeNo:       trade.TradeId,
+					Type:          ReconcileMissingOrder,
+					GatewayAmount: trade.Amount,
+				})
+			}
+		}
+	}
+
+	if len(reports) > 0 {
+		for i := range reports {
+			reports[i].CreatedAt = time.Now()
+		}
+		err = s.db.CreateInBatches(&reports, 100).Error
+		if err != nil {
+			return nil, fmt.Errorf("error with save reconcile reports: %v", err)
+		}
+	}
+	return reports, nil
+}
+
+func (s *ReconcileService) querier(registry *Registry, name string) (TradeQuerier, bool) {
+	gateway, ok := registry.Get(name)
+	if !ok {
+		return nil, false
+	}
+	querier, ok := gateway.(TradeQuerier)
+	return querier, ok
+}
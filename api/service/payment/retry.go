@@ -0,0 +1,79 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// 下单接口遇到临时错误时的重试次数和首次重试的等待时间，之后每次等待时间翻倍
+const (
+	retryAttempts = 3
+	retryBackoff  = 200 * time.Millisecond
+)
+
+// temporaryError 可以重试的临时错误，如网络错误和渠道返回的 5xx 错误，
+// 渠道返回的 4xx 和业务错误（参数错误、签名错误等）重试也不会成功，不能标记为临时错误
+type temporaryError struct {
+	err error
+}
+
+func (e temporaryError) Error() string {
+	return e.err.Error()
+}
+
+func (e temporaryError) Unwrap() error {
+	return e.err
+}
+
+// temporary 把错误标记为临时错误
+func temporary(err error) error {
+	if err == nil {
+		return nil
+	}
+	return temporaryError{err: err}
+}
+
+// networkError 网络错误标记为临时错误，ctx 已经超时或者取消时不再重试
+func networkError(ctx context.Context, err error) error {
+	var netErr net.Error
+	if ctx.Err() == nil && errors.As(err, &netErr) {
+		return temporary(err)
+	}
+	return err
+}
+
+func isTemporary(err error) bool {
+	var e temporaryError
+	return errors.As(err, &e)
+}
+
+// withRetry 调用可以重复执行的渠道接口（如生成支付地址），遇到临时错误时按照指数退避重试，
+// 剩余时间不够等待下一次重试时直接返回，保证总耗时不超过 ctx 的截止时间
+func withRetry(ctx context.Context, name string, fn func() error) error {
+	backoff := retryBackoff
+	for i := 1; ; i++ {
+		err := fn()
+		if err == nil || !isTemporary(err) || i >= retryAttempts {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff {
+			return err
+		}
+		logger.Warnf("%s 下单失败，%v 后进行第 %d 次重试：%v", name, backoff, i, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
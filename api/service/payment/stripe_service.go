@@ -0,0 +1,513 @@
+package payment
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stripeApiURL = "https://api.stripe.com"
+
+// stripeSignTolerance webhook 签名时间戳允许的最大误差
+const stripeSignTolerance = 5 * time.Minute
+
+// StripeService Stripe 支付服务
+type StripeService struct {
+	config *types.StripeConfig
+	client *http.Client
+}
+
+func NewStripeService(appConfig *types.AppConfig) (*StripeService, error) {
+	config := appConfig.StripeConfig
+	if !config.Enabled {
+		logger.Info("Disabled Stripe service")
+		return nil, nil
+	}
+	if config.SecretKey == "" || config.WebhookSecret == "" {
+		return nil, errors.New("error with initialize stripe service: secret key and webhook secret are required")
+	}
+	// Stripe 通过密钥区分测试和正式环境，沙盒模式下拒绝使用正式密钥，防止测试时产生真实扣款
+	if config.Sandbox && !strings.HasPrefix(config.SecretKey, "sk_test_") {
+		return nil, errors.New("error with initialize stripe service: sandbox mode requires a test secret key (sk_test_xxx)")
+	}
+	if config.ApiURL == "" {
+		config.ApiURL = stripeApiURL
+	}
+
+	return &StripeService{config: &config, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+type StripeParams struct {
+	OutTradeNo   string `json:"out_trade_no"`
+	Subject      string `json:"subject"`
+	TotalFee     int64  `json:"total_fee"` // 订单金额，单位为货币最小单位（分）
+	Currency     string `json:"currency"`
+	ReturnURL    string `json:"return_url"`
+	CancelURL    string `json:"cancel_url"`
+	IntervalDays int    `json:"interval_days"` // 自动续费的周期天数，大于 0 时创建订阅
+}
+
+// Stripe 订阅的计费周期最长为一年
+const stripeMaxIntervalDays = 365
+
+// StripeEvent Stripe webhook 事件
+type StripeEvent struct {
+	Id   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// StripeCheckoutSession Stripe 收银台会话
+type StripeCheckoutSession struct {
+	Id                string            `json:"id"`
+	Url               string            `json:"url"`
+	ClientReferenceId string            `json:"client_reference_id"`
+	PaymentIntent     string            `json:"payment_intent"`
+	PaymentStatus     string            `json:"payment_status"`
+	AmountTotal       int64             `json:"amount_total"`
+	Currency          string            `json:"currency"`
+	Metadata          map[string]string `json:"metadata"`
+	Mode              string            `json:"mode"`         // payment 一次性支付，subscription 订阅
+	Subscription      string            `json:"subscription"` // 订阅模式下创建的订阅 ID
+	Invoice           string            `json:"invoice"`      // 订阅模式下首期账单 ID
+}
+
+// StripeInvoice Stripe 账单，订阅每个周期扣款都会生成一张账单
+type StripeInvoice struct {
+	Id            string `json:"id"`
+	Subscription  string `json:"subscription"`
+	BillingReason string `json:"billing_reason"` // subscription_create 首期账单，subscription_cycle 周期续费账单
+	AmountPaid    int64  `json:"amount_paid"`
+	Currency      string `json:"currency"`
+	AttemptCount  int    `json:"attempt_count"`        // 扣款尝试次数
+	NextAttempt   int64  `json:"next_payment_attempt"` // 下次重试扣款的时间，不再重试时为空
+	Lines         struct {
+		Data []struct {
+			Period struct {
+				Start int64 `json:"start"`
+				End   int64 `json:"end"`
+			} `json:"period"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+// StripeSubscription Stripe 订阅
+// StripeDispute Stripe 争议（拒付）
+type StripeDispute struct {
+	Id              string `json:"id"`
+	Amount          int64  `json:"amount"`
+	Currency        string `json:"currency"`
+	Reason          string `json:"reason"`
+	Status          string `json:"status"`
+	Charge          string `json:"charge"`
+	PaymentIntent   string `json:"payment_intent"`
+	EvidenceDetails struct {
+		DueBy int64 `json:"due_by"`
+	} `json:"evidence_details"`
+}
+
+type StripeSubscription struct {
+	Id                string `json:"id"`
+	Status            string `json:"status"`
+	CancelAtPeriodEnd bool   `json:"cancel_at_period_end"`
+	CurrentPeriodEnd  int64  `json:"current_period_end"`
+}
+
+// PayUrl 创建 Checkout Session，返回 Stripe 托管的支付页面地址，设置了续费周期时创建订阅
+func (s *StripeService) PayUrl(params StripeParams) (string, error) {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	if params.IntervalDays > 0 {
+		if params.IntervalDays > stripeMaxIntervalDays {
+			return "", fmt.Errorf("自动续费的周期不能超过 %d 天", stripeMaxIntervalDays)
+		}
+		form.Set("mode", "subscription")
+		form.Set("line_items[0][price_data][recurring][interval]", "day")
+		form.Set("line_items[0][price_data][recurring][interval_count]", strconv.Itoa(params.IntervalDays))
+		form.Set("subscription_data[metadata][order_no]", params.OutTradeNo)
+	}
+	form.Set("success_url", params.ReturnURL)
+	if params.CancelURL != "" {
+		form.Set("cancel_url", params.CancelURL)
+	}
+	form.Set("client_reference_id", params.OutTradeNo)
+	form.Set("metadata[order_no]", params.OutTradeNo)
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(params.Currency))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.FormatInt(params.TotalFee, 10))
+	form.Set("line_items[0][price_data][product_data][name]", params.Subject)
+
+	var session StripeCheckoutSession
+	err := s.sendRequest(http.MethodPost, "/v1/checkout/sessions", form, &session)
+	if err != nil {
+		return "", fmt.Errorf("error with create checkout session: %v", err)
+	}
+	return session.Url, nil
+}
+
+// TradeVerify 校验 webhook 签名，并返回解析后的事件
+func (s *StripeService) TradeVerify(request *http.Request) (StripeEvent, error) {
+	var event StripeEvent
+	payload, err := io.ReadAll(request.Body)
+	if err != nil {
+		return event, fmt.Errorf("error with read request body: %v", err)
+	}
+
+	err = s.verifySign(payload, request.Header.Get("Stripe-Signature"))
+	if err != nil {
+		return event, err
+	}
+
+	err = json.Unmarshal(payload, &event)
+	if err != nil {
+		return event, fmt.Errorf("error with decode webhook event: %v", err)
+	}
+	return event, nil
+}
+
+// verifySign 校验 Stripe-Signature 请求头，格式如：t=1492774577,v1=5257a869...
+func (s *StripeService) verifySign(payload []byte, header string) error {
+	var timestamp string
+	var signs []string
+	for _, item := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signs = append(signs, kv[1])
+		}
+	}
+	if timestamp == "" || len(signs) == 0 {
+		return errors.New("invalid stripe signature header")
+	}
+
+	t, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid stripe signature timestamp: %v", err)
+	}
+	if time.Since(time.Unix(t, 0)).Abs() > stripeSignTolerance {
+		return errors.New("stripe signature timestamp is out of tolerance")
+	}
+
+	mac := hmac.New(sha256.New, []byte(s.config.WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	expected := mac.Sum(nil)
+	for _, sign := range signs {
+		sig, err := hex.DecodeString(sign)
+		if err != nil {
+			continue
+		}
+		if hmac.Equal(expected, sig) {
+			return nil
+		}
+	}
+	return errors.New("stripe signature mismatch")
+}
+
+func (s *StripeService) sendRequest(method string, path string, form url.Values, result interface{}) error {
+	req, err := http.NewRequest(method, s.config.ApiURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.config.SecretKey, "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var r struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(body, &r)
+		return fmt.Errorf("status code: %d, message: %s", resp.StatusCode, r.Error.Message)
+	}
+	return json.Unmarshal(body, result)
+}
+
+// HealthCheck 查询账户余额，校验 API 密钥是否有效
+func (s *StripeService) HealthCheck() error {
+	var balance struct {
+		Object string `json:"object"`
+	}
+	return s.sendRequest(http.MethodGet, "/v1/balance", url.Values{}, &balance)
+}
+
+func (s *StripeService) Name() string {
+	return "stripe"
+}
+
+func (s *StripeService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *StripeService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *StripeService) Sandbox() bool {
+	return s.config.Sandbox
+}
+
+func (s *StripeService) NotifyIPs() []string {
+	return s.config.NotifyIPs
+}
+
+func (s *StripeService) SupportsCurrency(currency string) bool {
+	return utils.Contains(types.Currencies, currency)
+}
+
+func (s *StripeService) PayTypes() []string {
+	return []string{"card"}
+}
+
+func (s *StripeService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	returnURL := returnURL(ctx, s.config.ReturnURL)
+	params := StripeParams{
+		OutTradeNo: order.OrderNo,
+		Subject:    order.Subject,
+		TotalFee:   order.Cents(),
+		Currency:   order.CurrencyCode(),
+		ReturnURL:  returnURL,
+		CancelURL:  returnURL,
+	}
+	if ctx.Recurring {
+		var remark types.OrderRemark
+		if err := types.DecodeOrderRemark(order.Remark, &remark); err != nil || remark.Days <= 0 {
+			return "", errors.New("自动续费的产品必须设置会员天数")
+		}
+		params.IntervalDays = remark.Days
+	}
+	return s.PayUrl(params)
+}
+
+// CancelSubscription 设置订阅在当前周期结束时取消，周期结束之后 Stripe 会发送 customer.subscription.deleted 事件
+func (s *StripeService) CancelSubscription(subscriptionNo string) error {
+	form := url.Values{}
+	form.Set("cancel_at_period_end", "true")
+	var subscription StripeSubscription
+	err := s.sendRequest(http.MethodPost, "/v1/subscriptions/"+url.PathEscape(subscriptionNo), form, &subscription)
+	if err != nil {
+		return fmt.Errorf("error with cancel subscription: %v", err)
+	}
+	return nil
+}
+
+// ResumeSubscription 恢复自动续费，撤销当前周期结束时取消订阅的设置
+func (s *StripeService) ResumeSubscription(subscriptionNo string) error {
+	form := url.Values{}
+	form.Set("cancel_at_period_end", "false")
+	var subscription StripeSubscription
+	err := s.sendRequest(http.MethodPost, "/v1/subscriptions/"+url.PathEscape(subscriptionNo), form, &subscription)
+	if err != nil {
+		return fmt.Errorf("error with resume subscription: %v", err)
+	}
+	return nil
+}
+
+func (s *StripeService) Notify(request *http.Request) (NotifyVo, error) {
+	event, err := s.TradeVerify(request)
+	if err != nil {
+		return NotifyVo{}, err
+	}
+
+	logger.Infof("收到 Stripe 事件回调：%s, %s", event.Id, event.Type)
+	// 只处理支付完成、订阅和争议相关的事件，其他事件直接返回成功，避免 Stripe 重试
+	switch event.Type {
+	case "charge.dispute.created":
+		return s.dispute(event, DisputeCreated)
+	case "charge.dispute.closed":
+		return s.dispute(event, DisputeClosed)
+	case "checkout.session.completed":
+		return s.checkoutCompleted(event)
+	case "invoice.paid":
+		return s.invoicePaid(event)
+	case "invoice.payment_failed":
+		return s.invoicePaymentFailed(event)
+	case "customer.subscription.deleted":
+		var subscription StripeSubscription
+		if err = json.Unmarshal(event.Data.Object, &subscription); err != nil {
+			return NotifyVo{}, fmt.Errorf("error with decode subscription: %v", err)
+		}
+		return NotifyVo{
+			Status:       Success,
+			Message:      "OK",
+			Subscription: &SubscriptionEvent{Type: SubscriptionEnded, SubscriptionNo: subscription.Id},
+		}, nil
+	}
+	return NotifyVo{}, nil
+}
+
+func (s *StripeService) checkoutCompleted(event StripeEvent) (NotifyVo, error) {
+	var session StripeCheckoutSession
+	err := json.Unmarshal(event.Data.Object, &session)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with decode checkout session: %v", err)
+	}
+	if session.PaymentStatus != "paid" {
+		return NotifyVo{}, nil
+	}
+	result := NotifyVo{
+		Status:     Success,
+		OutTradeNo: session.ClientReferenceId,
+		TradeId:    session.PaymentIntent,
+		Amount:     utils.FormatCents(session.AmountTotal),
+		Message:    "OK",
+	}
+	// 订阅模式没有 payment_intent，使用首期账单 ID 作为交易号
+	if session.Mode == "subscription" {
+		result.TradeId = session.Invoice
+		result.Subscription = &SubscriptionEvent{Type: SubscriptionStarted, SubscriptionNo: session.Subscription}
+	}
+	return result, nil
+}
+
+// dispute 用户对交易发起争议（拒付），一次性支付订单的交易号为 payment_intent
+func (s *StripeService) dispute(event StripeEvent, eventType string) (NotifyVo, error) {
+	var dispute StripeDispute
+	err := json.Unmarshal(event.Data.Object, &dispute)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with decode dispute: %v", err)
+	}
+	return NotifyVo{
+		Status:  Success,
+		Message: "OK",
+		Dispute: &DisputeEvent{
+			Type:      eventType,
+			DisputeId: dispute.Id,
+			TradeNos:  []string{dispute.PaymentIntent, dispute.Charge},
+			Amount:    utils.FormatCents(dispute.Amount),
+			Currency:  strings.ToUpper(dispute.Currency),
+			Reason:    dispute.Reason,
+			Status:    dispute.Status,
+			DueBy:     dispute.EvidenceDetails.DueBy,
+		},
+	}, nil
+}
+
+// invoicePaid 订阅周期续费扣款成功，首期账单已经在 checkout.session.completed 事件中处理
+func (s *StripeService) invoicePaid(event StripeEvent) (NotifyVo, error) {
+	var invoice StripeInvoice
+	err := json.Unmarshal(event.Data.Object, &invoice)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with decode invoice: %v", err)
+	}
+	if invoice.Subscription == "" || invoice.BillingReason != "subscription_cycle" {
+		return NotifyVo{}, nil
+	}
+	renewed := &SubscriptionEvent{
+		Type:           SubscriptionRenewed,
+		SubscriptionNo: invoice.Subscription,
+		TradeNo:        invoice.Id,
+		Amount:         utils.FormatCents(invoice.AmountPaid),
+		Currency:       strings.ToUpper(invoice.Currency),
+	}
+	if len(invoice.Lines.Data) > 0 {
+		renewed.PeriodEnd = invoice.Lines.Data[0].Period.End
+	}
+	return NotifyVo{Status: Success, Message: "OK", Subscription: renewed}, nil
+}
+
+// invoicePaymentFailed 续费账单扣款失败，Stripe 按照后台配置的策略重试，最终失败之后取消订阅
+func (s *StripeService) invoicePaymentFailed(event StripeEvent) (NotifyVo, error) {
+	var invoice StripeInvoice
+	err := json.Unmarshal(event.Data.Object, &invoice)
+	if err != nil {
+		return NotifyVo{}, fmt.Errorf("error with decode invoice: %v", err)
+	}
+	if invoice.Subscription == "" || invoice.BillingReason != "subscription_cycle" {
+		return NotifyVo{}, nil
+	}
+	failed := &SubscriptionEvent{
+		Type:           SubscriptionFailed,
+		SubscriptionNo: invoice.Subscription,
+		TradeNo:        invoice.Id,
+		Reason:         fmt.Sprintf("Stripe 续费账单 %s 第 %d 次扣款失败", invoice.Id, invoice.AttemptCount),
+		NextRetryAt:    invoice.NextAttempt,
+	}
+	return NotifyVo{Status: Success, Message: "OK", Subscription: failed}, nil
+}
+
+// ListTrades 拉取指定时间范围内已支付的 Checkout Session，用于对账
+func (s *StripeService) ListTrades(start time.Time, end time.Time) ([]NotifyVo, error) {
+	trades := make([]NotifyVo, 0)
+	startingAfter := ""
+	for {
+		query := url.Values{}
+		query.Set("limit", "100")
+		query.Set("created[gte]", strconv.FormatInt(start.Unix(), 10))
+		query.Set("created[lt]", strconv.FormatInt(end.Unix(), 10))
+		if startingAfter != "" {
+			query.Set("starting_after", startingAfter)
+		}
+		var list struct {
+			Data    []StripeCheckoutSession `json:"data"`
+			HasMore bool                    `json:"has_more"`
+		}
+		err := s.sendRequest(http.MethodGet, "/v1/checkout/sessions?"+query.Encode(), url.Values{}, &list)
+		if err != nil {
+			return nil, fmt.Errorf("error with list checkout sessions: %v", err)
+		}
+		for _, session := range list.Data {
+			if session.PaymentStatus != "paid" {
+				continue
+			}
+			trades = append(trades, NotifyVo{
+				Status:     Success,
+				OutTradeNo: session.ClientReferenceId,
+				TradeId:    session.PaymentIntent,
+				Amount:     utils.FormatCents(session.AmountTotal),
+			})
+		}
+		if !list.HasMore || len(list.Data) == 0 {
+			break
+		}
+		startingAfter = list.Data[len(list.Data)-1].Id
+	}
+	return trades, nil
+}
+
+// Reply Stripe 只有收到 2xx 状态码才认为通知成功，否则会重试
+func (s *StripeService) Reply(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte("fail"))
+		return
+	}
+	_, _ = w.Write([]byte("success"))
+}
@@ -1,12 +1,55 @@
 package payment
 
 type NotifyVo struct {
-	Status     int
-	OutTradeNo string // 商户订单号
-	TradeId    string // 交易ID
-	Amount     string // 交易金额
-	Message    string
-	Subject    string
+	Status       int
+	OutTradeNo   string // 商户订单号
+	TradeId      string // 交易ID
+	Amount       string // 交易金额
+	Message      string
+	Subject      string
+	Subscription *SubscriptionEvent // 自动续费订阅的状态变化，非订阅相关的回调为空
+	Dispute      *DisputeEvent      // 交易争议（拒付）的状态变化，非争议相关的回调为空
+}
+
+// 订阅事件类型
+const (
+	SubscriptionStarted = "started" // 首次订阅支付成功，OutTradeNo 为首次订阅的订单号
+	SubscriptionRenewed = "renewed" // 续费扣款成功
+	SubscriptionEnded   = "ended"   // 订阅已经终止，不再续费
+	SubscriptionFailed  = "failed"  // 续费扣款失败，渠道会按照自己的策略重试
+	SubscriptionSigned  = "signed"  // 周期扣款签约成功，OutTradeNo 为签约时关联的首期订单号，由商户主动发起扣款
+)
+
+// SubscriptionEvent 支付渠道回调中的订阅状态变化
+type SubscriptionEvent struct {
+	Type           string `json:"type"`
+	SubscriptionNo string `json:"subscription_no"` // 支付渠道的订阅 ID
+	TradeNo        string `json:"trade_no"`        // 续费扣款的交易号
+	Amount         string `json:"amount"`          // 续费扣款金额（元）
+	Currency       string `json:"currency"`
+	PeriodEnd      int64  `json:"period_end"`    // 续费之后当前周期的结束时间
+	Reason         string `json:"reason"`        // 续费扣款失败的原因
+	NextRetryAt    int64  `json:"next_retry_at"` // 渠道下次重试扣款的时间，0 表示不再重试
+}
+
+// 争议事件类型
+const (
+	DisputeCreated = "created" // 用户发起争议（拒付），需要在截止时间之前向渠道提交证据
+	DisputeClosed  = "closed"  // 争议已经结束，Status 为渠道返回的处理结果
+)
+
+// DisputeEvent 支付渠道回调中的交易争议（拒付），
+// 渠道能返回商户订单号时优先使用订单号查找订单，否则使用渠道交易号查找
+type DisputeEvent struct {
+	Type      string   `json:"type"`
+	DisputeId string   `json:"dispute_id"` // 支付渠道的争议 ID
+	OrderNo   string   `json:"order_no"`
+	TradeNos  []string `json:"trade_nos"` // 争议交易的渠道交易号
+	Amount    string   `json:"amount"`    // 争议金额（元）
+	Currency  string   `json:"currency"`
+	Reason    string   `json:"reason"`
+	Status    string   `json:"status"`
+	DueBy     int64    `json:"due_by"` // 提交证据的截止时间，0 表示渠道没有返回
 }
 
 func (v NotifyVo) Success() bool {
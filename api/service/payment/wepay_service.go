@@ -9,14 +9,22 @@ package payment
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
 	"github.com/go-pay/gopay"
 	"github.com/go-pay/gopay/wechat/v3"
 	"net/http"
+	"strings"
 	"time"
 )
 
+// PayTypeWxMini 微信小程序支付，使用小程序的 APPID 和小程序用户的 openid 下单
+const PayTypeWxMini = "wxpay_mini"
+
 type WechatPayService struct {
 	config *types.WechatPayConfig
 	client *wechat.ClientV3
@@ -47,16 +55,26 @@ func NewWechatService(appConfig *types.AppConfig) (*WechatPayService, error) {
 }
 
 type WechatPayParams struct {
-	OutTradeNo string `json:"out_trade_no"`
-	TotalFee   int    `json:"total_fee"`
-	Subject    string `json:"subject"`
-	ClientIP   string `json:"client_ip"`
-	ReturnURL  string `json:"return_url"`
-	NotifyURL  string `json:"notify_url"`
+	OutTradeNo string        `json:"out_trade_no"`
+	TotalFee   int           `json:"total_fee"`
+	Subject    string        `json:"subject"`
+	ClientIP   string        `json:"client_ip"`
+	ReturnURL  string        `json:"return_url"`
+	NotifyURL  string        `json:"notify_url"`
+	OpenId     string        `json:"openid"` // 付款用户的 openid，JSAPI 支付需要
+	Expire     time.Duration `json:"-"`      // 订单有效期，默认 10 分钟
+}
+
+// expireTime 订单失效时间
+func (p WechatPayParams) expireTime() string {
+	if p.Expire <= 0 {
+		p.Expire = 10 * time.Minute
+	}
+	return time.Now().Add(p.Expire).Format(time.RFC3339)
 }
 
-func (s *WechatPayService) PayUrlNative(params WechatPayParams) (string, error) {
-	expire := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
+func (s *WechatPayService) PayUrlNative(ctx context.Context, params WechatPayParams) (string, error) {
+	expire := params.expireTime()
 	// 初始化 BodyMap
 	bm := make(gopay.BodyMap)
 	bm.Set("appid", s.config.AppId).
@@ -70,9 +88,12 @@ func (s *WechatPayService) PayUrlNative(params WechatPayParams) (string, error)
 				Set("currency", "CNY")
 		})
 
-	wxRsp, err := s.client.V3TransactionNative(context.Background(), bm)
+	wxRsp, err := s.client.V3TransactionNative(ctx, bm)
 	if err != nil {
-		return "", fmt.Errorf("error with client v3 transaction Native: %v", err)
+		return "", timeoutError(ctx, networkError(ctx, fmt.Errorf("error with client v3 transaction Native: %w", err)))
+	}
+	if wxRsp.Code >= http.StatusInternalServerError {
+		return "", temporary(fmt.Errorf("error status with generating pay url: %v", wxRsp.Error))
 	}
 	if wxRsp.Code != wechat.Success {
 		return "", fmt.Errorf("error status with generating pay url: %v", wxRsp.Error)
@@ -80,8 +101,8 @@ func (s *WechatPayService) PayUrlNative(params WechatPayParams) (string, error)
 	return wxRsp.Response.CodeUrl, nil
 }
 
-func (s *WechatPayService) PayUrlH5(params WechatPayParams) (string, error) {
-	expire := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
+func (s *WechatPayService) PayUrlH5(ctx context.Context, params WechatPayParams) (string, error) {
+	expire := params.expireTime()
 	// 初始化 BodyMap
 	bm := make(gopay.BodyMap)
 	bm.Set("appid", s.config.AppId).
@@ -101,9 +122,12 @@ func (s *WechatPayService) PayUrlH5(params WechatPayParams) (string, error) {
 				})
 		})
 
-	wxRsp, err := s.client.V3TransactionH5(context.Background(), bm)
+	wxRsp, err := s.client.V3TransactionH5(ctx, bm)
 	if err != nil {
-		return "", fmt.Errorf("error with client v3 transaction H5: %v", err)
+		return "", timeoutError(ctx, networkError(ctx, fmt.Errorf("error with client v3 transaction H5: %w", err)))
+	}
+	if wxRsp.Code >= http.StatusInternalServerError {
+		return "", temporary(fmt.Errorf("error with generating pay url: %v", wxRsp.Error))
 	}
 	if wxRsp.Code != wechat.Success {
 		return "", fmt.Errorf("error with generating pay url: %v", wxRsp.Error)
@@ -111,6 +135,61 @@ func (s *WechatPayService) PayUrlH5(params WechatPayParams) (string, error) {
 	return wxRsp.Response.H5Url, nil
 }
 
+// PayJSAPI 微信内网页使用的 JSAPI 支付，返回前端调用 WeixinJSBridge 发起支付需要的参数
+func (s *WechatPayService) PayJSAPI(ctx context.Context, params WechatPayParams) (*wechat.JSAPIPayParams, error) {
+	prepayId, err := s.prepay(ctx, s.config.AppId, params)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.PaySignOfJSAPI(s.config.AppId, prepayId)
+}
+
+// PayApplet 小程序支付，返回小程序调用 wx.requestPayment 需要的参数
+func (s *WechatPayService) PayApplet(ctx context.Context, params WechatPayParams) (*wechat.AppletParams, error) {
+	if s.config.MiniAppId == "" {
+		return nil, errors.New("未开启小程序支付")
+	}
+	prepayId, err := s.prepay(ctx, s.config.MiniAppId, params)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.PaySignOfApplet(s.config.MiniAppId, prepayId)
+}
+
+// prepay JSAPI 下单，公众号和小程序使用相同的下单接口，只是 APPID 和 openid 不同
+func (s *WechatPayService) prepay(ctx context.Context, appId string, params WechatPayParams) (string, error) {
+	if params.OpenId == "" {
+		return "", errors.New("缺少付款用户的 openid")
+	}
+	expire := params.expireTime()
+	bm := make(gopay.BodyMap)
+	bm.Set("appid", appId).
+		Set("mchid", s.config.MchId).
+		Set("description", params.Subject).
+		Set("out_trade_no", params.OutTradeNo).
+		Set("time_expire", expire).
+		Set("notify_url", params.NotifyURL).
+		SetBodyMap("amount", func(bm gopay.BodyMap) {
+			bm.Set("total", params.TotalFee).
+				Set("currency", "CNY")
+		}).
+		SetBodyMap("payer", func(bm gopay.BodyMap) {
+			bm.Set("openid", params.OpenId)
+		})
+
+	wxRsp, err := s.client.V3TransactionJsapi(ctx, bm)
+	if err != nil {
+		return "", timeoutError(ctx, networkError(ctx, fmt.Errorf("error with client v3 transaction JSAPI: %w", err)))
+	}
+	if wxRsp.Code >= http.StatusInternalServerError {
+		return "", temporary(fmt.Errorf("error with generating prepay id: %v", wxRsp.Error))
+	}
+	if wxRsp.Code != wechat.Success {
+		return "", fmt.Errorf("error with generating prepay id: %v", wxRsp.Error)
+	}
+	return wxRsp.Response.PrepayId, nil
+}
+
 type NotifyResponse struct {
 	Code    string `json:"code"`
 	Message string `xml:"message"`
@@ -120,7 +199,7 @@ type NotifyResponse struct {
 func (s *WechatPayService) TradeVerify(request *http.Request) NotifyVo {
 	notifyReq, err := wechat.V3ParseNotify(request)
 	if err != nil {
-		return NotifyVo{Status: 1, Message: fmt.Sprintf("error with client v3 parse notify: %v", err)}
+		return NotifyVo{Status: Failure, Message: fmt.Sprintf("error with client v3 parse notify: %v", err)}
 	}
 
 	// TODO: 这里验签程序有 Bug，一直报错：crypto/rsa: verification error，先暂时取消验签
@@ -139,6 +218,195 @@ func (s *WechatPayService) TradeVerify(request *http.Request) NotifyVo {
 		Status:     Success,
 		OutTradeNo: result.OutTradeNo,
 		TradeId:    result.TransactionId,
-		Amount:     fmt.Sprintf("%.2f", float64(result.Amount.Total)/100),
+		Amount:     utils.FormatCents(int64(result.Amount.Total)),
+	}
+}
+
+// TradeQuery 主动查询订单支付状态
+func (s *WechatPayService) TradeQuery(outTradeNo string) NotifyVo {
+	rsp, err := s.client.V3TransactionQueryOrder(context.Background(), wechat.OutTradeNo, outTradeNo)
+	if err != nil {
+		return NotifyVo{Status: Failure, Message: fmt.Sprintf("error with query order %s: %v", outTradeNo, err)}
+	}
+	if rsp.Code != wechat.Success || rsp.Response == nil {
+		return NotifyVo{Status: Failure, Message: fmt.Sprintf("error with query order %s: %s", outTradeNo, rsp.Error)}
+	}
+
+	result := rsp.Response
+	if result.TradeState != "SUCCESS" {
+		return NotifyVo{Status: Failure, Message: "订单未支付：" + result.TradeState}
+	}
+	vo := NotifyVo{
+		Status:     Success,
+		OutTradeNo: result.OutTradeNo,
+		TradeId:    result.TransactionId,
+		Message:    "OK",
+	}
+	if result.Amount != nil {
+		vo.Amount = utils.FormatCents(int64(result.Amount.Total))
+	}
+	return vo
+}
+
+// HealthCheck 查询一个不存在的订单，返回订单不存在（404）说明网关和密钥都是正常的
+func (s *WechatPayService) HealthCheck() error {
+	rsp, err := s.client.V3TransactionQueryOrder(context.Background(), wechat.OutTradeNo, healthCheckOrderNo)
+	if err != nil {
+		return err
+	}
+	if rsp.Code != wechat.Success && rsp.Code != http.StatusNotFound {
+		return fmt.Errorf("status code: %d, message: %s", rsp.Code, rsp.Error)
+	}
+	return nil
+}
+
+// Refund 发起退款，退款结果以微信返回的退款单号为准
+func (s *WechatPayService) Refund(order model.Order, params RefundParams) (string, error) {
+	bm := make(gopay.BodyMap)
+	bm.Set("out_refund_no", params.RefundNo).
+		Set("reason", params.Reason).
+		SetBodyMap("amount", func(bm gopay.BodyMap) {
+			bm.Set("refund", params.Amount).
+				Set("total", order.Cents()).
+				Set("currency", "CNY")
+		})
+	if order.TradeNo != "" {
+		bm.Set("transaction_id", order.TradeNo)
+	} else {
+		bm.Set("out_trade_no", order.OrderNo)
+	}
+
+	rsp, err := s.client.V3Refund(context.Background(), bm)
+	if err != nil {
+		return "", fmt.Errorf("error with request wechat refund: %v", err)
+	}
+	if rsp.Code != wechat.Success || rsp.Response == nil {
+		return "", fmt.Errorf("error with request wechat refund: %s", rsp.Error)
+	}
+	if rsp.Response.Status == "ABNORMAL" || rsp.Response.Status == "CLOSED" {
+		return "", fmt.Errorf("wechat refund failed with status: %s", rsp.Response.Status)
+	}
+	return rsp.Response.RefundId, nil
+}
+
+// RefundQuery 查询退款状态，refundNo 为发起退款时的商户退款单号
+func (s *WechatPayService) RefundQuery(order model.Order, refundNo string) (RefundResult, error) {
+	rsp, err := s.client.V3RefundQuery(context.Background(), refundNo, nil)
+	if err != nil {
+		return RefundResult{}, fmt.Errorf("error with query wechat refund: %v", err)
+	}
+	if rsp.Code == http.StatusNotFound {
+		return RefundResult{Status: RefundFailed}, nil
+	}
+	if rsp.Code != wechat.Success || rsp.Response == nil {
+		return RefundResult{}, fmt.Errorf("error with query wechat refund: %s", rsp.Error)
+	}
+	result := RefundResult{Status: RefundProcessing}
+	switch rsp.Response.Status {
+	case "SUCCESS":
+		result.Status = RefundSuccess
+	case "CLOSED", "ABNORMAL":
+		result.Status = RefundFailed
+	}
+	if rsp.Response.Amount != nil {
+		result.Amount = int64(rsp.Response.Amount.Refund)
+	}
+	return result, nil
+}
+
+func (s *WechatPayService) Name() string {
+	return "wechat"
+}
+
+func (s *WechatPayService) OrderTimeout() time.Duration {
+	return time.Duration(s.config.OrderTimeout) * time.Second
+}
+
+func (s *WechatPayService) FeeRate() float64 {
+	return s.config.FeeRate
+}
+
+func (s *WechatPayService) Sandbox() bool {
+	return s.config.Sandbox
+}
+
+func (s *WechatPayService) NotifyIPs() []string {
+	return s.config.NotifyIPs
+}
+
+func (s *WechatPayService) PayTypes() []string {
+	if s.config.MiniAppId != "" {
+		return []string{"wxpay", PayTypeWxMini}
+	}
+	return []string{"wxpay"}
+}
+
+func (s *WechatPayService) Pay(order *model.Order, ctx PayContext) (string, error) {
+	params := WechatPayParams{
+		OutTradeNo: order.OrderNo,
+		TotalFee:   int(order.Cents()),
+		Subject:    order.Subject,
+		NotifyURL:  notifyURL(ctx, s.config.NotifyURL, s.Name()),
+		Expire:     ctx.Expire,
+	}
+	// 同一个商户订单号重复下单会返回相同的支付地址，可以放心重试
+	var payURL string
+	err := withRetry(ctx.Ctx(), s.Name(), func() error {
+		var err error
+		params.OpenId = ctx.OpenId
+		switch {
+		case ctx.PayType == PayTypeWxMini:
+			var applet *wechat.AppletParams
+			applet, err = s.PayApplet(ctx.Ctx(), params)
+			if err == nil {
+				payURL = utils.JsonEncode(applet)
+			}
+		case s.ReturnsParams(ctx):
+			var jsapi *wechat.JSAPIPayParams
+			jsapi, err = s.PayJSAPI(ctx.Ctx(), params)
+			if err == nil {
+				payURL = utils.JsonEncode(jsapi)
+			}
+		// Native 支付返回的 code_url 为 weixin:// 地址，App 可以直接唤起微信
+		case ctx.Device == "wechat" && !ctx.DeepLink:
+			params.ClientIP = ctx.ClientIP
+			payURL, err = s.PayUrlH5(ctx.Ctx(), params)
+		default:
+			payURL, err = s.PayUrlNative(ctx.Ctx(), params)
+		}
+		return err
+	})
+	return payURL, err
+}
+
+// ReturnsParams 小程序支付，以及在微信内打开并且已经获取到用户的 openid 时使用 JSAPI 支付，其他情况使用 Native 或者 H5 支付
+func (s *WechatPayService) ReturnsParams(ctx PayContext) bool {
+	return ctx.PayType == PayTypeWxMini || (ctx.Device == "wechat" && ctx.OpenId != "" && !ctx.DeepLink)
+}
+
+// DeepLink Native 支付地址本身就是 weixin:// 地址
+func (s *WechatPayService) DeepLink(payURL string) string {
+	if strings.HasPrefix(payURL, "weixin://") {
+		return payURL
+	}
+	return ""
+}
+
+func (s *WechatPayService) Notify(request *http.Request) (NotifyVo, error) {
+	result := s.TradeVerify(request)
+	if !result.Success() {
+		return result, errors.New(result.Message)
+	}
+	return result, nil
+}
+
+// Reply 微信支付 V3 以 HTTP 状态码判断通知是否处理成功，失败时需要返回非 2xx 状态码才会重试
+func (s *WechatPayService) Reply(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_ = json.NewEncoder(w).Encode(map[string]string{"code": "FAIL", "message": err.Error()})
+		return
 	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"code": "SUCCESS", "message": "成功"})
 }
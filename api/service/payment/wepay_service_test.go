@@ -0,0 +1,57 @@
+package payment
+
+import (
+	"encoding/json"
+	"geekai/core/types"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWechatPayNotifyFailure(t *testing.T) {
+	s := &WechatPayService{config: &types.WechatPayConfig{ApiV3Key: "0123456789abcdef0123456789abcdef"}}
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid json", "not json"},
+		{"missing resource", `{"id":"EV-1","event_type":"TRANSACTION.SUCCESS"}`},
+		{"bad cipher text", `{"id":"EV-1","event_type":"TRANSACTION.SUCCESS","resource":{"algorithm":"AEAD_AES_256_GCM","ciphertext":"YWJj","nonce":"0123456789ab","associated_data":"transaction"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/api/payment/notify/wxpay", strings.NewReader(tt.body))
+			result, err := s.Notify(request)
+			if err == nil || result.Success() {
+				t.Fatalf("Notify() = %+v, %v, want error", result, err)
+			}
+
+			// 校验失败时给微信返回非 2xx 状态码和 FAIL，微信稍后会重新通知
+			w := httptest.NewRecorder()
+			s.Reply(w, err)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("Reply() status = %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			var reply map[string]string
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Fatalf("Reply() body %q is not json: %v", w.Body.String(), err)
+			}
+			if reply["code"] != "FAIL" || reply["message"] == "" {
+				t.Errorf("Reply() body = %v, want FAIL with message", reply)
+			}
+		})
+	}
+}
+
+func TestWechatPayReplySuccess(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&WechatPayService{}).Reply(w, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("Reply() status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var reply map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || reply["code"] != "SUCCESS" {
+		t.Errorf("Reply() body = %q, want SUCCESS", w.Body.String())
+	}
+}
@@ -0,0 +1,83 @@
+package power
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"fmt"
+	"geekai/core/types"
+	logger2 "geekai/logger"
+	"geekai/service"
+	"geekai/store/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
+	"time"
+)
+
+var logger = logger2.GetLogger()
+
+// Service 算力退回服务
+type Service struct {
+	db *gorm.DB
+}
+
+func NewService(db *gorm.DB) *Service {
+	return &Service{db: db}
+}
+
+// Refund 退回用户算力，relatedId 为关联的任务标识，例如 mj:123，同一个 relatedId 只会退回一次
+func (s *Service) Refund(userId uint, amount int, reason string, relatedId string) error {
+	if amount <= 0 {
+		return nil
+	}
+	// 任务标识的前缀为模型名称
+	modelName, _, _ := strings.Cut(relatedId, ":")
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&model.PowerRefund{
+			UserId:    userId,
+			RelatedId: relatedId,
+			Amount:    amount,
+			Reason:    reason,
+			CreatedAt: time.Now(),
+		})
+		if res.Error != nil {
+			return fmt.Errorf("error with create refund record: %v", res.Error)
+		}
+		// 已经退回过了
+		if res.RowsAffected == 0 {
+			logger.Infof("power of %s has been refunded already", relatedId)
+			return nil
+		}
+
+		err := tx.Model(&model.User{}).Where("id", userId).UpdateColumn("power", gorm.Expr("power + ?", amount)).Error
+		if err != nil {
+			return fmt.Errorf("error with increase user power: %v", err)
+		}
+		err = service.AddPowerGrant(tx, userId, types.PowerRefund, amount, 0)
+		if err != nil {
+			return fmt.Errorf("error with create power grant: %v", err)
+		}
+
+		var user model.User
+		err = tx.Where("id", userId).First(&user).Error
+		if err != nil {
+			return fmt.Errorf("error with fetch user info: %v", err)
+		}
+		return tx.Create(&model.PowerLog{
+			UserId:    user.Id,
+			Username:  user.Username,
+			Type:      types.PowerRefund,
+			Amount:    amount,
+			Balance:   user.Power,
+			Mark:      types.PowerAdd,
+			Model:     modelName,
+			Remark:    reason,
+			CreatedAt: time.Now(),
+		}).Error
+	})
+}
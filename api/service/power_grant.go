@@ -0,0 +1,99 @@
+package service
+
+import (
+	"geekai/core/types"
+	"geekai/store/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// 用户表的 power 字段作为剩余算力的汇总值继续使用，所有增减算力的地方都需要同步记录算力批次，
+// 这样在过期任务扣除算力之后，power 字段始终等于未过期批次的剩余算力之和。
+// 存量用户的剩余算力在升级脚本中作为一个永不过期的批次导入。
+
+// AddPowerGrant 在默认分组记录一个算力发放批次，expiresAt 为 0 表示永不过期
+func AddPowerGrant(tx *gorm.DB, userId uint, powerType types.PowerType, amount int, expiresAt int64) error {
+	return AddBucketPowerGrant(tx, userId, powerType, types.PowerBucketDefault, amount, expiresAt)
+}
+
+// AddBucketPowerGrant 在指定分组记录一个算力发放批次
+func AddBucketPowerGrant(tx *gorm.DB, userId uint, powerType types.PowerType, bucket string, amount int, expiresAt int64) error {
+	if amount <= 0 {
+		return nil
+	}
+	return tx.Create(&model.PowerGrant{
+		UserId:    userId,
+		Type:      int(powerType),
+		Bucket:    bucket,
+		Amount:    amount,
+		Remain:    amount,
+		ExpiresAt: expiresAt,
+		GrantedAt: time.Now(),
+	}).Error
+}
+
+// ConsumePowerGrants 扣减未过期批次的剩余算力，先扣减指定分组的算力，再扣减默认分组的算力，同一分组按照发放时间从早到晚扣减
+func ConsumePowerGrants(tx *gorm.DB, userId uint, bucket string, amount int) error {
+	if amount <= 0 {
+		return nil
+	}
+	var grants []model.PowerGrant
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("user_id = ? AND remain > 0 AND (expires_at = 0 OR expires_at > ?)", userId, time.Now().Unix()).
+		Where("bucket IN ?", []string{types.PowerBucketDefault, bucket}).
+		Order("bucket = '' ASC, id ASC").Find(&grants).Error
+	if err != nil {
+		return err
+	}
+	for _, g := range grants {
+		if amount <= 0 {
+			break
+		}
+		deduct := min(g.Remain, amount)
+		err = tx.Model(&model.PowerGrant{}).Where("id", g.Id).UpdateColumn("remain", gorm.Expr("remain - ?", deduct)).Error
+		if err != nil {
+			return err
+		}
+		amount -= deduct
+	}
+	return nil
+}
+
+// PowerExpireAt 根据有效期天数计算充值算力的过期时间，没有配置有效期则永不过期
+func PowerExpireAt(days int) int64 {
+	if days <= 0 {
+		return 0
+	}
+	return time.Now().AddDate(0, 0, days).Unix()
+}
+
+// AvailablePower 返回用户可用于指定分组的算力，等于总算力减去其他分组未过期批次的剩余算力
+func AvailablePower(db *gorm.DB, userId uint, bucket string) int {
+	var user model.User
+	if err := db.Where("id", userId).First(&user).Error; err != nil {
+		return 0
+	}
+	var reserved int
+	db.Model(&model.PowerGrant{}).
+		Where("user_id = ? AND remain > 0 AND (expires_at = 0 OR expires_at > ?)", userId, time.Now().Unix()).
+		Where("bucket NOT IN ?", []string{types.PowerBucketDefault, bucket}).
+		Select("IFNULL(SUM(remain), 0)").Scan(&reserved)
+	return max(user.Power-reserved, 0)
+}
+
+// PowerBuckets 返回用户各个分组未过期的剩余算力
+func PowerBuckets(db *gorm.DB, userId uint) map[string]int {
+	var rows []struct {
+		Bucket string
+		Total  int
+	}
+	db.Model(&model.PowerGrant{}).
+		Where("user_id = ? AND remain > 0 AND (expires_at = 0 OR expires_at > ?)", userId, time.Now().Unix()).
+		Select("bucket, SUM(remain) AS total").Group("bucket").Scan(&rows)
+	buckets := make(map[string]int)
+	for _, row := range rows {
+		buckets[row.Bucket] = row.Total
+	}
+	return buckets
+}
@@ -0,0 +1,132 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"geekai/core/types"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// 内置的支付二维码中间 Logo，按照支付类型匹配
+var defaultQrcodeLogos = map[string]string{
+	"alipay": "res/img/alipay.jpg",
+	"wxpay":  "res/img/wechat-pay.jpg",
+	"qqpay":  "res/img/qq-pay.jpg",
+}
+
+// 上传 Logo 的限制，Logo 会被缩放成正方形放在二维码中间，所以宽高比不能相差太大
+const (
+	qrcodeLogoMaxBytes = 2 << 20
+	qrcodeLogoMinSize  = 64
+	qrcodeLogoMaxSize  = 1024
+)
+
+var payTypePattern = regexp.MustCompile(`^[a-z0-9_-]{1,20}$`)
+
+// QrcodeLogoService 支付二维码中间的 Logo，优先使用管理员上传的 Logo，没有上传时使用内置的 Logo
+type QrcodeLogoService struct {
+	dir string
+	fs  embed.FS
+}
+
+func NewQrcodeLogoService(appConfig *types.AppConfig, fs embed.FS) *QrcodeLogoService {
+	return &QrcodeLogoService{dir: filepath.Join(appConfig.StaticDir, "qrcode-logo"), fs: fs}
+}
+
+func (s *QrcodeLogoService) path(payType string) string {
+	return filepath.Join(s.dir, payType+".png")
+}
+
+// Logo 返回支付类型对应的 Logo，没有 Logo 时返回 nil
+func (s *QrcodeLogoService) Logo(payType string) io.Reader {
+	if payTypePattern.MatchString(payType) {
+		if data, err := os.ReadFile(s.path(payType)); err == nil {
+			return bytes.NewReader(data)
+		}
+	}
+	if name, ok := defaultQrcodeLogos[payType]; ok {
+		if data, err := s.fs.ReadFile(name); err == nil {
+			return bytes.NewReader(data)
+		}
+	}
+	return nil
+}
+
+// Custom 是否上传了自定义 Logo
+func (s *QrcodeLogoService) Custom(payType string) bool {
+	if !payTypePattern.MatchString(payType) {
+		return false
+	}
+	_, err := os.Stat(s.path(payType))
+	return err == nil
+}
+
+// Save 校验并保存上传的 Logo，只支持 PNG 和 JPEG 格式，统一转换成 PNG 保存
+func (s *QrcodeLogoService) Save(payType string, r io.Reader) error {
+	if !payTypePattern.MatchString(payType) {
+		return fmt.Errorf("无效的支付类型：%s", payType)
+	}
+	data, err := io.ReadAll(io.LimitReader(r, qrcodeLogoMaxBytes+1))
+	if err != nil {
+		return fmt.Errorf("error with read logo: %v", err)
+	}
+	if len(data) > qrcodeLogoMaxBytes {
+		return errors.New("Logo 文件不能超过 2MB")
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || (format != "png" && format != "jpeg") {
+		return errors.New("Logo 只支持 PNG 和 JPEG 格式的图片")
+	}
+	if config.Width < qrcodeLogoMinSize || config.Height < qrcodeLogoMinSize ||
+		config.Width > qrcodeLogoMaxSize || config.Height > qrcodeLogoMaxSize {
+		return fmt.Errorf("Logo 的宽高必须在 %d - %d 像素之间", qrcodeLogoMinSize, qrcodeLogoMaxSize)
+	}
+	if config.Width*5 > config.Height*6 || config.Height*5 > config.Width*6 {
+		return errors.New("Logo 必须是正方形或者接近正方形的图片")
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error with decode logo: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = png.Encode(&buf, img); err != nil {
+		return fmt.Errorf("error with encode logo: %v", err)
+	}
+	if err = os.MkdirAll(s.dir, 0755); err != nil {
+		return fmt.Errorf("error with create logo dir: %v", err)
+	}
+	// 先写临时文件再重命名，避免生成二维码时读到写了一半的文件
+	tmp := s.path(payType) + ".tmp"
+	if err = os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("error with save logo: %v", err)
+	}
+	return os.Rename(tmp, s.path(payType))
+}
+
+// Remove 删除上传的 Logo，恢复使用内置的 Logo
+func (s *QrcodeLogoService) Remove(payType string) error {
+	if !payTypePattern.MatchString(payType) {
+		return fmt.Errorf("无效的支付类型：%s", payType)
+	}
+	err := os.Remove(s.path(payType))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// slidingWindowScript 清理窗口之外的请求记录，窗口内的请求数未超过限制时记录本次请求，返回 1 表示允许请求
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+if redis.call('ZCARD', key) >= limit then
+	return 0
+end
+redis.call('ZADD', key, now, ARGV[4])
+redis.call('PEXPIRE', key, window)
+return 1
+`)
+
+// RateLimiter 基于 Redis 有序集合的滑动窗口限流，多个实例共享计数
+type RateLimiter struct {
+	redis *redis.Client
+}
+
+func NewRateLimiter(client *redis.Client) *RateLimiter {
+	return &RateLimiter{redis: client}
+}
+
+// Allow 判断 key 在最近 window 时间内的请求次数是否已经达到 limit，没有达到时记录本次请求。
+// Redis 不可用时不限流，避免影响正常使用
+func (l *RateLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) bool {
+	if limit <= 0 {
+		return true
+	}
+	now := time.Now().UnixMilli()
+	member := fmt.Sprintf("%d-%d", now, rand.Int63())
+	res, err := slidingWindowScript.Run(ctx, l.redis, []string{key}, now, window.Milliseconds(), limit, member).Int()
+	if err != nil {
+		logger.Error("error with check rate limit: ", err)
+		return true
+	}
+	return res == 1
+}
+
+// AllowModel 按照用户和模型限制每分钟的请求次数，limit 为 0 表示不限制
+func (l *RateLimiter) AllowModel(ctx context.Context, userId uint, model string, limit int) bool {
+	return l.Allow(ctx, fmt.Sprintf("model_rate_limit/%s/%d", model, userId), limit, time.Minute)
+}
@@ -13,6 +13,7 @@ import (
 	logger2 "geekai/logger"
 	"geekai/service"
 	"geekai/service/oss"
+	"geekai/service/power"
 	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
@@ -34,9 +35,10 @@ type Service struct {
 	db            *gorm.DB
 	uploadManager *oss.UploaderManager
 	wsService     *service.WebsocketService
+	powerService  *power.Service
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, levelDB *store.LevelDB, redisCli *redis.Client, wsService *service.WebsocketService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, levelDB *store.LevelDB, redisCli *redis.Client, wsService *service.WebsocketService, powerService *power.Service) *Service {
 	return &Service{
 		httpClient:    req.C(),
 		taskQueue:     store.NewRedisQueue("StableDiffusion_Task_Queue", redisCli),
@@ -44,6 +46,7 @@ func NewService(db *gorm.DB, manager *oss.UploaderManager, levelDB *store.LevelD
 		db:            db,
 		wsService:     wsService,
 		uploadManager: manager,
+		powerService:  powerService,
 	}
 }
 
@@ -87,6 +90,7 @@ func (s *Service) Run() {
 					"progress": service.FailTaskProgress,
 					"err_msg":  err.Error(),
 				})
+				s.RefundPower(uint(task.Id))
 				// 通知前端，任务失败
 				s.notifyQueue.RPush(service.NotifyMessage{ClientId: task.ClientId, UserId: task.UserId, JobId: task.Id, Message: service.TaskStatusFailed})
 				continue
@@ -286,9 +290,24 @@ func (s *Service) CheckTaskStatus() {
 					job.Progress = service.FailTaskProgress
 					job.ErrMsg = "任务超时"
 					s.db.Updates(&job)
+					s.RefundPower(job.Id)
 				}
 			}
 			time.Sleep(time.Second * 5)
 		}
 	}()
 }
+
+// RefundPower 退回失败任务消耗的算力，同一个任务只会退回一次
+func (s *Service) RefundPower(jobId uint) error {
+	var job model.SdJob
+	if err := s.db.Where("id", jobId).First(&job).Error; err != nil {
+		return err
+	}
+	err := s.powerService.Refund(uint(job.UserId), job.Power,
+		fmt.Sprintf("任务失败，退回算力。任务ID：%s， Err: %s", job.TaskId, job.ErrMsg), fmt.Sprintf("stable-diffusion:%d", job.Id))
+	if err != nil {
+		logger.Errorf("error with refund power for job %d: %v", job.Id, err)
+	}
+	return err
+}
@@ -27,10 +27,19 @@ func NewSmtpService(appConfig *types.AppConfig) *SmtpService {
 	}
 }
 
+// AppName 邮件中显示的应用名称
+func (s *SmtpService) AppName() string {
+	return s.config.AppName
+}
+
 func (s *SmtpService) SendVerifyCode(to string, code int) error {
 	subject := fmt.Sprintf("%s 注册验证码", s.config.AppName)
 	body := fmt.Sprintf("【%s】：您的验证码为 %d，请不要告诉他人。如非本人操作，请忽略此邮件。", s.config.AppName, code)
+	return s.SendMail(to, subject, body)
+}
 
+// SendMail 发送纯文本邮件
+func (s *SmtpService) SendMail(to string, subject string, body string) error {
 	auth := smtp.PlainAuth("", s.config.From, s.config.Password, s.config.Host)
 	if s.config.UseTls {
 		return s.sendTLS(auth, to, subject, body)
@@ -9,10 +9,14 @@ package service
 
 import (
 	"fmt"
+	"geekai/core/types"
 	"sync"
 	"time"
 )
 
+// ID 由 41 位毫秒时间戳、10 位节点 ID 和 12 位序列号组成，多实例部署时每个实例必须配置不同的节点 ID
+const maxWorkerID = 1023
+
 // Snowflake 雪花算法实现
 type Snowflake struct {
 	mu            sync.Mutex
@@ -21,12 +25,16 @@ type Snowflake struct {
 	sequence      int
 }
 
-func NewSnowflake() *Snowflake {
+func NewSnowflake(appConfig *types.AppConfig) (*Snowflake, error) {
+	workerID := appConfig.SnowflakeWorkerId
+	if workerID < 0 || workerID > maxWorkerID {
+		return nil, fmt.Errorf("invalid snowflake worker id %d, must be between 0 and %d", workerID, maxWorkerID)
+	}
 	return &Snowflake{
 		lastTimestamp: -1,
-		workerID:      0, // TODO: 增加 WorkID 参数
+		workerID:      workerID,
 		sequence:      0,
-	}
+	}, nil
 }
 
 // Next 生成一个新的唯一ID
@@ -34,9 +42,34 @@ func (s *Snowflake) Next(raw bool) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	id, err := s.next()
+	if err != nil {
+		return "", err
+	}
+	return s.format(id, raw), nil
+}
+
+// NextBatch 一次生成 n 个唯一ID，只加一次锁，需要多个ID时比多次调用 Next 的锁竞争更少
+func (s *Snowflake) NextBatch(n int, raw bool) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		id, err := s.next()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, s.format(id, raw))
+	}
+	return ids, nil
+}
+
+// next 生成ID，调用方需要持有锁
+func (s *Snowflake) next() (int64, error) {
 	timestamp := time.Now().UnixNano() / 1000000 // 转换为毫秒
 	if timestamp < s.lastTimestamp {
-		return "", fmt.Errorf("clock moved backwards. Refusing to generate id for %d milliseconds", s.lastTimestamp-timestamp)
+		return 0, fmt.Errorf("clock moved backwards. Refusing to generate id for %d milliseconds", s.lastTimestamp-timestamp)
 	}
 
 	if timestamp == s.lastTimestamp {
@@ -49,12 +82,16 @@ func (s *Snowflake) Next(raw bool) (string, error) {
 	}
 
 	s.lastTimestamp = timestamp
-	id := (timestamp << 22) | (int64(s.workerID) << 10) | int64(s.sequence)
+	return (timestamp << 22) | (int64(s.workerID) << 12) | int64(s.sequence), nil
+}
+
+// format raw 为 true 时返回原始ID，否则加上日期前缀
+func (s *Snowflake) format(id int64, raw bool) string {
 	if raw {
-		return fmt.Sprintf("%d", id), nil
+		return fmt.Sprintf("%d", id)
 	}
 	now := time.Now()
-	return fmt.Sprintf("%d%02d%02d%d", now.Year(), now.Month(), now.Day(), id), nil
+	return fmt.Sprintf("%d%02d%02d%d", now.Year(), now.Month(), now.Day(), id)
 }
 
 func (s *Snowflake) waitNextMillis() int64 {
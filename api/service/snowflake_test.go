@@ -0,0 +1,100 @@
+package service
+
+import (
+	"geekai/core/types"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestNewSnowflakeWorkerId(t *testing.T) {
+	tests := []struct {
+		workerId int
+		wantErr  bool
+	}{
+		{0, false},
+		{1, false},
+		{maxWorkerID, false},
+		{-1, true},
+		{maxWorkerID + 1, true},
+	}
+	for _, tt := range tests {
+		_, err := NewSnowflake(&types.AppConfig{SnowflakeWorkerId: tt.workerId})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewSnowflake(worker id %d) error = %v, wantErr %v", tt.workerId, err, tt.wantErr)
+		}
+	}
+}
+
+func TestSnowflakeWorkerIdInId(t *testing.T) {
+	s, err := NewSnowflake(&types.AppConfig{SnowflakeWorkerId: 513})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := s.Next(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if worker := (id >> 12) & maxWorkerID; worker != 513 {
+		t.Errorf("worker id in %d = %d, want 513", id, worker)
+	}
+}
+
+// 多个 goroutine 并发通过 Next 和 NextBatch 生成的 ID 不能重复，数量超过单毫秒的序列号上限，覆盖等待下一毫秒的分支
+func TestSnowflakeConcurrentUnique(t *testing.T) {
+	s, err := NewSnowflake(&types.AppConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, perWorker = 16, 1000
+	var wg sync.WaitGroup
+	results := make([][]string, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// 一半的 goroutine 每次批量生成 10 个
+			if i%2 == 1 {
+				ids := make([]string, 0, perWorker)
+				for j := 0; j < perWorker/10; j++ {
+					batch, err := s.NextBatch(10, false)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					ids = append(ids, batch...)
+				}
+				results[i] = ids
+				return
+			}
+			ids := make([]string, 0, perWorker)
+			for j := 0; j < perWorker; j++ {
+				id, err := s.Next(false)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				ids = append(ids, id)
+			}
+			results[i] = ids
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool, workers*perWorker)
+	for _, ids := range results {
+		for _, id := range ids {
+			if seen[id] {
+				t.Fatalf("duplicate id %s", id)
+			}
+			seen[id] = true
+		}
+	}
+	if len(seen) != workers*perWorker {
+		t.Errorf("got %d ids, want %d", len(seen), workers*perWorker)
+	}
+}
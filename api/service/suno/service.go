@@ -15,6 +15,7 @@ import (
 	logger2 "geekai/logger"
 	"geekai/service"
 	"geekai/service/oss"
+	"geekai/service/power"
 	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
@@ -35,10 +36,11 @@ type Service struct {
 	taskQueue     *store.RedisQueue
 	notifyQueue   *store.RedisQueue
 	wsService     *service.WebsocketService
+	powerService  *power.Service
 	clientIds     map[string]string
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, wsService *service.WebsocketService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, wsService *service.WebsocketService, powerService *power.Service) *Service {
 	return &Service{
 		httpClient:    req.C().SetTimeout(time.Minute * 3),
 		db:            db,
@@ -46,6 +48,7 @@ func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Clien
 		notifyQueue:   store.NewRedisQueue("Suno_Notify_Queue", redisCli),
 		uploadManager: manager,
 		wsService:     wsService,
+		powerService:  powerService,
 		clientIds:     map[string]string{},
 	}
 }
@@ -98,6 +101,7 @@ func (s *Service) Run() {
 					"err_msg":  err.Error(),
 					"progress": service.FailTaskProgress,
 				})
+				s.RefundPower(task.Id)
 				s.notifyQueue.RPush(service.NotifyMessage{ClientId: task.ClientId, UserId: task.UserId, JobId: int(task.Id), Message: service.TaskStatusFailed})
 				continue
 			}
@@ -385,6 +389,7 @@ func (s *Service) SyncTaskProgress() {
 					job.Progress = service.FailTaskProgress
 					job.ErrMsg = task.Data.FailReason
 					s.db.Updates(&job)
+					s.RefundPower(job.Id)
 					s.notifyQueue.RPush(service.NotifyMessage{ClientId: s.clientIds[job.TaskId], UserId: job.UserId, JobId: int(job.Id), Message: service.TaskStatusFailed})
 				}
 			}
@@ -457,3 +462,17 @@ func (s *Service) QueryTask(taskId string, channel string) (QueryRespVo, error)
 
 	return res, nil
 }
+
+// RefundPower 退回失败任务消耗的算力，同一个任务只会退回一次
+func (s *Service) RefundPower(jobId uint) error {
+	var job model.SunoJob
+	if err := s.db.Where("id", jobId).First(&job).Error; err != nil {
+		return err
+	}
+	err := s.powerService.Refund(uint(job.UserId), job.Power,
+		fmt.Sprintf("Suno 任务失败，退回算力。任务ID：%s，Err:%s", job.TaskId, job.ErrMsg), fmt.Sprintf("suno:%d", job.Id))
+	if err != nil {
+		logger.Errorf("error with refund power for job %d: %v", job.Id, err)
+	}
+	return err
+}
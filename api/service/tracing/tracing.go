@@ -0,0 +1,142 @@
+package tracing
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+// OpenTelemetry 链路追踪，通过 OpenTelemetry 标准的环境变量配置：
+//
+//	OTEL_EXPORTER_OTLP_ENDPOINT / OTEL_EXPORTER_OTLP_TRACES_ENDPOINT  OTLP/HTTP 接收地址，不设置时不采集链路
+//	OTEL_EXPORTER_OTLP_HEADERS                                       上报时附加的请求头，如鉴权令牌
+//	OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES                    服务名称和资源属性，默认服务名称为 geekai
+//	OTEL_TRACES_SAMPLER / OTEL_TRACES_SAMPLER_ARG                    采样策略，默认全部采样
+//	OTEL_SDK_DISABLED=true                                           关闭链路追踪
+
+import (
+	"context"
+	logger2 "geekai/logger"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var logger = logger2.GetLogger()
+
+// ServiceName 默认的服务名称，可以通过 OTEL_SERVICE_NAME 覆盖
+const ServiceName = "geekai"
+
+const instrumentationName = "geekai"
+
+// Provider 链路数据上报，没有配置 OTLP 地址时不上报，创建的 Span 都是空操作
+type Provider struct {
+	provider *sdktrace.TracerProvider
+}
+
+func NewProvider() (*Provider, error) {
+	// 无论是否上报都透传请求中的链路上下文
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if !enabled() {
+		logger.Info("OpenTelemetry tracing is disabled")
+		return &Provider{}, nil
+	}
+
+	ctx := context.Background()
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// 后面的配置会覆盖前面的，环境变量中的服务名称优先
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	logger.Info("OpenTelemetry tracing is enabled")
+	return &Provider{provider: provider}, nil
+}
+
+func enabled() bool {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Shutdown 上报缓冲区中剩余的链路数据
+func (p *Provider) Shutdown(ctx context.Context) error {
+	if p.provider == nil {
+		return nil
+	}
+	return p.provider.Shutdown(ctx)
+}
+
+// Start 创建一个 Span，ctx 中已有 Span 时作为它的子 Span
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End 结束 Span，err 不为空时记录错误
+func End(span trace.Span, err error) {
+	if err != nil {
+		Fail(span, err)
+	}
+	span.End()
+}
+
+// Fail 记录错误并把 Span 标记为失败
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject 把 ctx 中的链路上下文导出为 W3C traceparent 等字段，用于保存到订单或者消息中，
+// 没有链路时返回 nil
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract 从 Inject 导出的字段中恢复链路上下文，之后创建的 Span 都挂在这条链路下
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	if len(carrier) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// Active ctx 中是否有有效的链路上下文，没有启用链路追踪时可以跳过只为链路准备数据的查询。
+// 当前 Span 没有被采样时仍然返回 true，它的子 Span 可能挂到其他被采样的链路下
+func Active(ctx context.Context) bool {
+	return trace.SpanContextFromContext(ctx).IsValid()
+}
+
+// 支付链路中 Span 的公共属性
+const (
+	OrderNo = attribute.Key("payment.order_no")
+	TradeNo = attribute.Key("payment.trade_no")
+	Gateway = attribute.Key("payment.gateway")
+	PayType = attribute.Key("payment.pay_type")
+	Outcome = attribute.Key("payment.outcome")
+)
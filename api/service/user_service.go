@@ -1,21 +1,28 @@
 package service
 
 import (
+	"errors"
 	"fmt"
+	"geekai/core"
 	"geekai/core/types"
 	"geekai/store/model"
+	"geekai/utils"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"sync"
 	"time"
 )
 
 type UserService struct {
-	db   *gorm.DB
-	lock sync.Mutex
+	app         *core.AppServer
+	db          *gorm.DB
+	lock        sync.Mutex
+	wsService   *WebsocketService
+	smtpService *SmtpService
 }
 
-func NewUserService(db *gorm.DB) *UserService {
-	return &UserService{db: db, lock: sync.Mutex{}}
+func NewUserService(app *core.AppServer, db *gorm.DB, wsService *WebsocketService, smtpService *SmtpService) *UserService {
+	return &UserService{app: app, db: db, lock: sync.Mutex{}, wsService: wsService, smtpService: smtpService}
 }
 
 // IncreasePower 增加用户算力
@@ -29,6 +36,11 @@ func (s *UserService) IncreasePower(userId int, power int, log model.PowerLog) e
 		tx.Rollback()
 		return err
 	}
+	err = AddPowerGrant(tx, uint(userId), log.Type, power, 0)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	var user model.User
 	tx.Where("id", userId).First(&user)
 	err = tx.Create(&model.PowerLog{
@@ -50,8 +62,8 @@ func (s *UserService) IncreasePower(userId int, power int, log model.PowerLog) e
 	return nil
 }
 
-// DecreasePower 减少用户算力
-func (s *UserService) DecreasePower(userId int, power int, log model.PowerLog) error {
+// DecreasePower 减少用户算力，bucket 为消费的算力分组
+func (s *UserService) DecreasePower(userId int, power int, bucket string, log model.PowerLog) error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
@@ -61,6 +73,11 @@ func (s *UserService) DecreasePower(userId int, power int, log model.PowerLog) e
 		tx.Rollback()
 		return fmt.Errorf("扣减算力失败：%v", err)
 	}
+	err = ConsumePowerGrants(tx, uint(userId), bucket, power)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("扣减算力失败：%v", err)
+	}
 	var user model.User
 	tx.Where("id", userId).First(&user)
 	err = tx.Create(&model.PowerLog{
@@ -79,5 +96,144 @@ func (s *UserService) DecreasePower(userId int, power int, log model.PowerLog) e
 		return fmt.Errorf("记录算力日志失败：%v", err)
 	}
 	tx.Commit()
+
+	s.checkLowBalance(user, power)
 	return nil
 }
+
+// TransferPower 用户之间转赠算力，在同一个事务中扣减转出用户的算力并增加接收用户的算力，返回双方转赠之后的算力
+// dailyLimit 为每天最多转赠的算力，0 表示不限制；minBalance 为转赠之后转出用户至少保留的算力
+func (s *UserService) TransferPower(fromId uint, toId uint, amount int, dailyLimit int, minBalance int) (int, int, error) {
+	if amount <= 0 {
+		return 0, 0, errors.New("转赠算力必须大于 0")
+	}
+	if fromId == toId {
+		return 0, 0, errors.New("不能给自己转赠算力")
+	}
+
+	var fromBalance, toBalance int
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// 按照用户 ID 顺序加锁，避免两个用户互相转赠时死锁
+		var users []model.User
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id IN ?", []uint{fromId, toId}).Order("id ASC").Find(&users).Error
+		if err != nil {
+			return err
+		}
+		var from, to model.User
+		for _, u := range users {
+			if u.Id == fromId {
+				from = u
+			} else {
+				to = u
+			}
+		}
+		if from.Id == 0 {
+			return errors.New("转出用户不存在")
+		}
+		if to.Id == 0 || !to.Status {
+			return errors.New("接收用户不存在")
+		}
+
+		if AvailablePower(tx, from.Id, types.PowerBucketDefault)-amount < minBalance {
+			return fmt.Errorf("转赠之后剩余算力不能少于 %d", minBalance)
+		}
+		if dailyLimit > 0 {
+			var transferred int
+			today := time.Now().Format("2006-01-02")
+			tx.Model(&model.PowerLog{}).
+				Where("user_id = ? AND type = ? AND mark = ? AND created_at >= ?", from.Id, types.PowerTransfer, types.PowerSub, today).
+				Select("IFNULL(SUM(amount), 0)").Scan(&transferred)
+			if transferred+amount > dailyLimit {
+				return fmt.Errorf("超出每日转赠额度，今日还可以转赠 %d 算力", max(dailyLimit-transferred, 0))
+			}
+		}
+
+		err = tx.Model(&model.User{}).Where("id", from.Id).UpdateColumn("power", gorm.Expr("power - ?", amount)).Error
+		if err != nil {
+			return err
+		}
+		err = ConsumePowerGrants(tx, from.Id, types.PowerBucketDefault, amount)
+		if err != nil {
+			return err
+		}
+		err = tx.Model(&model.User{}).Where("id", to.Id).UpdateColumn("power", gorm.Expr("power + ?", amount)).Error
+		if err != nil {
+			return err
+		}
+		err = AddPowerGrant(tx, to.Id, types.PowerTransfer, amount, 0)
+		if err != nil {
+			return err
+		}
+
+		fromBalance = from.Power - amount
+		toBalance = to.Power + amount
+		subLog := model.PowerLog{
+			UserId:    from.Id,
+			Username:  from.Username,
+			Type:      types.PowerTransfer,
+			Amount:    amount,
+			Balance:   fromBalance,
+			Mark:      types.PowerSub,
+			Model:     "转赠",
+			Remark:    fmt.Sprintf("转赠算力给用户 %s", to.Username),
+			CreatedAt: time.Now(),
+		}
+		err = tx.Create(&subLog).Error
+		if err != nil {
+			return err
+		}
+		addLog := model.PowerLog{
+			UserId:    to.Id,
+			Username:  to.Username,
+			Type:      types.PowerTransfer,
+			Amount:    amount,
+			Balance:   toBalance,
+			Mark:      types.PowerAdd,
+			Model:     "转赠",
+			Remark:    fmt.Sprintf("用户 %s 转赠算力，转出记录ID：%d", from.Username, subLog.Id),
+			CreatedAt: time.Now(),
+		}
+		err = tx.Create(&addLog).Error
+		if err != nil {
+			return err
+		}
+		// 转出记录关联转入记录
+		return tx.Model(&subLog).UpdateColumn("remark", fmt.Sprintf("%s，转入记录ID：%d", subLog.Remark, addLog.Id)).Error
+	})
+	return fromBalance, toBalance, err
+}
+
+// lowBalanceNotifyInterval 低余额提醒的最小间隔
+const lowBalanceNotifyInterval = 24 * time.Hour
+
+// checkLowBalance 扣减算力之后余额低于提醒阈值时提醒用户充值，同一个用户 24 小时之内只提醒一次
+func (s *UserService) checkLowBalance(user model.User, deducted int) {
+	if s.app.SysConfig == nil {
+		return
+	}
+	threshold := s.app.SysConfig.LowBalanceThreshold
+	if threshold <= 0 || user.Power >= threshold || user.Power+deducted < threshold {
+		return
+	}
+
+	// 通过条件更新抢占提醒时间，避免并发扣费时重复提醒
+	now := time.Now()
+	res := s.db.Model(&model.User{}).
+		Where("id = ? AND last_low_balance_notified_at < ?", user.Id, now.Add(-lowBalanceNotifyInterval).Unix()).
+		UpdateColumn("last_low_balance_notified_at", now.Unix())
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+
+	message := fmt.Sprintf("您的剩余算力为 %d，已低于 %d，请及时充值，以免影响使用。", user.Power, threshold)
+	s.wsService.SendToUser(user.Id, types.ChNotice, message)
+	if utils.IsValidEmail(user.Email) {
+		go func() {
+			subject := fmt.Sprintf("%s 算力余额不足提醒", s.smtpService.AppName())
+			body := fmt.Sprintf("您好，%s：\r\n%s", user.Username, message)
+			if err := s.smtpService.SendMail(user.Email, subject, body); err != nil {
+				logger.Errorf("error with send low balance notice to %s: %v", user.Email, err)
+			}
+		}()
+	}
+}
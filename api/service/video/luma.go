@@ -15,6 +15,7 @@ import (
 	logger2 "geekai/logger"
 	"geekai/service"
 	"geekai/service/oss"
+	"geekai/service/power"
 	"geekai/store"
 	"geekai/store/model"
 	"geekai/utils"
@@ -35,10 +36,11 @@ type Service struct {
 	taskQueue     *store.RedisQueue
 	notifyQueue   *store.RedisQueue
 	wsService     *service.WebsocketService
+	powerService  *power.Service
 	clientIds     map[uint]string
 }
 
-func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, wsService *service.WebsocketService) *Service {
+func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Client, wsService *service.WebsocketService, powerService *power.Service) *Service {
 	return &Service{
 		httpClient:    req.C().SetTimeout(time.Minute * 3),
 		db:            db,
@@ -46,6 +48,7 @@ func NewService(db *gorm.DB, manager *oss.UploaderManager, redisCli *redis.Clien
 		notifyQueue:   store.NewRedisQueue("Video_Notify_Queue", redisCli),
 		wsService:     wsService,
 		uploadManager: manager,
+		powerService:  powerService,
 		clientIds:     map[uint]string{},
 	}
 }
@@ -111,6 +114,7 @@ func (s *Service) Run() {
 				if err != nil {
 					logger.Errorf("update task with error: %v", err)
 				}
+				s.RefundPower(task.Id)
 				s.notifyQueue.RPush(service.NotifyMessage{ClientId: task.ClientId, UserId: task.UserId, JobId: int(task.Id), Message: service.TaskStatusFailed})
 				continue
 			}
@@ -268,6 +272,7 @@ func (s *Service) SyncTaskProgress() {
 						"progress": service.FailTaskProgress, // 102 表示资源未下载完成,
 						"err_msg":  err.Error(),
 					})
+					s.RefundPower(job.Id)
 					continue
 				}
 
@@ -343,3 +348,17 @@ func (s *Service) QueryLumaTask(taskId string, channel string) (LumaTaskVo, erro
 
 	return res, nil
 }
+
+// RefundPower 退回失败任务消耗的算力，同一个任务只会退回一次
+func (s *Service) RefundPower(jobId uint) error {
+	var job model.VideoJob
+	if err := s.db.Where("id", jobId).First(&job).Error; err != nil {
+		return err
+	}
+	err := s.powerService.Refund(uint(job.UserId), job.Power,
+		fmt.Sprintf("Luma 任务失败，退回算力。任务ID：%s，Err:%s", job.TaskId, job.ErrMsg), fmt.Sprintf("luma:%d", job.Id))
+	if err != nil {
+		logger.Errorf("error with refund power for job %d: %v", job.Id, err)
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package service
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"geekai/core/types"
+	"geekai/store/model"
+	"geekai/utils"
+	"io"
+	"net/http"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	WebhookPending = 0
+	WebhookSuccess = 1
+	WebhookFailed  = 2
+
+	EventOrderPaid = "order.paid"
+)
+
+// WebhookService 订单事件回调服务，投递记录先写入数据库再异步发送，失败后按指数退避重试
+type WebhookService struct {
+	config *types.WebhookConfig
+	db     *gorm.DB
+	client *http.Client
+	notify chan struct{}
+}
+
+func NewWebhookService(appConfig *types.AppConfig, db *gorm.DB) *WebhookService {
+	config := appConfig.WebhookConfig
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 5
+	}
+	return &WebhookService{
+		config: &config,
+		db:     db,
+		client: &http.Client{Timeout: 10 * time.Second},
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// OrderPaidEvent 订单支付成功事件
+type OrderPaidEvent struct {
+	Event     string `json:"event"`
+	OrderNo   string `json:"order_no"`
+	UserId    uint   `json:"user_id"`
+	Receiver  uint   `json:"receiver_id"` // 权益接收用户 ID，为好友购买时与 user_id 不同
+	ProductId uint   `json:"product_id"`
+	Product   string `json:"product"`
+	Amount    string `json:"amount"`
+	Currency  string `json:"currency"`
+	PayWay    string `json:"pay_way"`
+	Power     int    `json:"power"`
+	Days      int    `json:"days"`
+	PaidAt    int64  `json:"paid_at"`
+}
+
+// Publish 为每个回调地址创建投递记录，并唤醒投递协程
+func (s *WebhookService) Publish(orderNo string, event interface{}) {
+	if !s.config.Enabled || len(s.config.URLs) == 0 {
+		return
+	}
+	payload := utils.JsonEncode(event)
+	for _, url := range s.config.URLs {
+		err := s.db.Create(&model.WebhookDelivery{
+			Event:       EventOrderPaid,
+			OrderNo:     orderNo,
+			URL:         url,
+			Payload:     payload,
+			Status:      WebhookPending,
+			NextRetryAt: time.Now().Unix(),
+		}).Error
+		if err != nil {
+			logger.Errorf("error with create webhook delivery for order %s: %v", orderNo, err)
+		}
+	}
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run 后台投递协程，每分钟或者有新事件时扫描待投递的记录
+func (s *WebhookService) Run() {
+	if !s.config.Enabled {
+		return
+	}
+	go func() {
+		logger.Info("Running webhook delivery service ...")
+		for {
+			var deliveries []model.WebhookDelivery
+			err := s.db.Where("status = ? AND next_retry_at <= ?", WebhookPending, time.Now().Unix()).
+				Order("id ASC").Limit(100).Find(&deliveries).Error
+			if err != nil {
+				logger.Error("error with fetch webhook deliveries: ", err)
+			}
+			for _, delivery := range deliveries {
+				s.deliver(delivery)
+			}
+			if len(deliveries) == 100 {
+				continue
+			}
+			select {
+			case <-s.notify:
+			case <-time.After(time.Minute):
+			}
+		}
+	}()
+}
+
+func (s *WebhookService) deliver(delivery model.WebhookDelivery) {
+	statusCode, err := s.send(delivery.URL, []byte(delivery.Payload))
+	delivery.Attempts += 1
+	delivery.StatusCode = statusCode
+	if err == nil {
+		delivery.Status = WebhookSuccess
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = utils.CutWords(err.Error(), 30)
+		if delivery.Attempts >= s.config.MaxRetries {
+			delivery.Status = WebhookFailed
+			logger.Errorf("webhook delivery for order %s to %s failed: %v", delivery.OrderNo, delivery.URL, err)
+		} else {
+			// 指数退避：1, 2, 4, 8... 分钟之后重试
+			backoff := time.Duration(1<<(delivery.Attempts-1)) * time.Minute
+			delivery.NextRetryAt = time.Now().Add(backoff).Unix()
+		}
+	}
+	err = s.db.Select("status", "attempts", "status_code", "last_error", "next_retry_at", "updated_at").Updates(&delivery).Error
+	if err != nil {
+		logger.Errorf("error with update webhook delivery %d: %v", delivery.Id, err)
+	}
+}
+
+func (s *WebhookService) send(url string, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature", s.Sign(body))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Sign 使用共享秘钥计算请求体的 HMAC-SHA256 签名
+func (s *WebhookService) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(s.config.Secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,6 +1,9 @@
 package service
 
-import "geekai/core/types"
+import (
+	"geekai/core/types"
+	"geekai/utils"
+)
 
 type WebsocketService struct {
 	Clients *types.LMap[string, *types.WsClient] // clientId => Client
@@ -11,3 +14,12 @@ func NewWebsocketService() *WebsocketService {
 		Clients: types.NewLMap[string, *types.WsClient](),
 	}
 }
+
+// SendToUser 给用户的所有在线客户端推送消息，用户不在线时直接忽略
+func (s *WebsocketService) SendToUser(userId uint, channel types.WsChannel, message interface{}) {
+	for _, client := range s.Clients.ToList() {
+		if client != nil && client.UserId == userId {
+			utils.SendChannelMsg(client, channel, message)
+		}
+	}
+}
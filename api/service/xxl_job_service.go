@@ -16,17 +16,19 @@ import (
 	"geekai/utils"
 	"github.com/xxl-job/xxl-job-executor-go"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"time"
 )
 
 var logger = logger2.GetLogger()
 
 type XXLJobExecutor struct {
-	executor xxl.Executor
-	db       *gorm.DB
+	executor    xxl.Executor
+	db          *gorm.DB
+	smtpService *SmtpService
 }
 
-func NewXXLJobExecutor(config *types.AppConfig, db *gorm.DB) *XXLJobExecutor {
+func NewXXLJobExecutor(config *types.AppConfig, db *gorm.DB, smtpService *SmtpService) *XXLJobExecutor {
 	if !config.XXLConfig.Enabled {
 		logger.Info("XXL-JOB service is disabled")
 		return nil
@@ -41,13 +43,16 @@ func NewXXLJobExecutor(config *types.AppConfig, db *gorm.DB) *XXLJobExecutor {
 		xxl.SetLogger(&customLogger{}),                  //自定义日志
 	)
 	exec.Init()
-	return &XXLJobExecutor{executor: exec, db: db}
+	return &XXLJobExecutor{executor: exec, db: db, smtpService: smtpService}
 }
 
 func (e *XXLJobExecutor) Run() error {
 	e.executor.RegTask("ClearOrders", e.ClearOrders)
 	e.executor.RegTask("ResetVipPower", e.ResetVipPower)
 	e.executor.RegTask("ResetUserPower", e.ResetUserPower)
+	e.executor.RegTask("CheckVipExpired", e.CheckVipExpired)
+	e.executor.RegTask("ExpirePower", e.ExpirePower)
+	e.executor.RegTask("ClearCallbackLogs", e.ClearCallbackLogs)
 	return e.executor.Run()
 }
 
@@ -72,18 +77,138 @@ func (e *XXLJobExecutor) ClearOrders(cxt context.Context, param *xxl.RunReq) (ms
 	timeout := time.Now().Unix() - int64(config.OrderPayTimeout)
 	start := utils.Stamp2str(timeout)
 	// 这里不是用软删除，而是永久删除订单
-	res = e.db.Unscoped().Where("status IN ? AND created_at < ?", []types.OrderStatus{types.OrderNotPaid, types.OrderScanned}, start).Delete(&model.Order{})
+	// 未支付订单由支付渠道各自的超时时间判定后标记为已取消，这里只清理已取消的订单
+	res = e.db.Unscoped().Where("status = ? AND created_at < ?", types.OrderCancelled, start).Delete(&model.Order{})
 	logger.Infof("Clear order successfully, affect rows: %d", res.RowsAffected)
 	return "success"
 }
 
-// ResetVipPower 重置VIP会员算力
-// 自动将 VIP 会员的算力补充到每月赠送的最大值
+// ClearCallbackLogs 清理超过保留天数的支付回调原始日志，需要配置为每天执行
+func (e *XXLJobExecutor) ClearCallbackLogs(cxt context.Context, param *xxl.RunReq) (msg string) {
+	var sysConfig model.Config
+	res := e.db.Where("marker", "system").First(&sysConfig)
+	if res.Error != nil {
+		return "error with get system config: " + res.Error.Error()
+	}
+	var config types.SystemConfig
+	err := utils.JsonDecode(sysConfig.Config, &config)
+	if err != nil {
+		return "error with decode system config: " + err.Error()
+	}
+
+	days := config.CallbackLogDays
+	if days <= 0 { // 默认保留半年，覆盖大部分支付渠道的争议处理期限
+		days = 180
+	}
+	res = e.db.Where("created_at < ?", time.Now().AddDate(0, 0, -days)).Delete(&model.PaymentCallbackLog{})
+	if res.Error != nil {
+		return "error with clear callback logs: " + res.Error.Error()
+	}
+	logger.Infof("Clear payment callback logs successfully, affect rows: %d", res.RowsAffected)
+	return "success"
+}
+
+// ResetVipPower 发放 VIP 会员每月赠送的算力，需要配置为每天执行
+// 以会员到期日作为每月的发放日，每个用户每个月只发放一次，重复执行不会重复发放
 func (e *XXLJobExecutor) ResetVipPower(cxt context.Context, param *xxl.RunReq) (msg string) {
-	logger.Info("开始进行月底账号盘点...")
+	logger.Info("开始发放 VIP 会员每月算力...")
+	var sysConfig model.Config
+	res := e.db.Where("marker", "system").First(&sysConfig)
+	if res.Error != nil {
+		return "error with get system config: " + res.Error.Error()
+	}
+
+	var config types.SystemConfig
+	err := utils.JsonDecode(sysConfig.Config, &config)
+	if err != nil {
+		return "error with decode system config: " + err.Error()
+	}
+
+	if config.VipMonthPower <= 0 {
+		return "success"
+	}
+
+	now := time.Now()
+	var users []model.User
+	res = e.db.Where("vip = ? AND status = ? AND expired_time > ?", true, true, now.Unix()).Find(&users)
+	if res.Error != nil {
+		return "error with fetch vip users: " + res.Error.Error()
+	}
+
+	var counter = 0
+	for _, u := range users {
+		if now.Day() < anniversaryDay(u.ExpiredTime, now) {
+			continue
+		}
+		granted, err := e.grantVipPower(u, now.Format("2006-01"), config.VipMonthPower)
+		if err != nil {
+			logger.Errorf("error with grant vip power for user %d: %v", u.Id, err)
+			continue
+		}
+		if granted {
+			counter++
+		}
+	}
+	logger.Infof("VIP 会员算力发放结束！累计发放 %d 人，每人发放算力：%d", counter, config.VipMonthPower)
 	return "success"
 }
 
+// anniversaryDay 返回会员在当前月份的发放日，到期日大于当月天数时取当月最后一天
+func anniversaryDay(expiredTime int64, now time.Time) int {
+	day := time.Unix(expiredTime, 0).Day()
+	lastDay := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location()).Day()
+	if day > lastDay {
+		return lastDay
+	}
+	return day
+}
+
+// grantVipPower 发放会员当月的算力，当月已经发放过则返回 false
+func (e *XXLJobExecutor) grantVipPower(u model.User, month string, power int) (bool, error) {
+	var granted bool
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Clauses(clause.Insert{Modifier: "IGNORE"}).Create(&model.VipPowerGrant{
+			UserId:    u.Id,
+			Month:     month,
+			Power:     power,
+			CreatedAt: time.Now(),
+		})
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return nil
+		}
+
+		err := tx.Model(&model.User{}).Where("id", u.Id).UpdateColumn("power", gorm.Expr("power + ?", power)).Error
+		if err != nil {
+			return err
+		}
+		err = AddPowerGrant(tx, u.Id, types.PowerGift, power, 0)
+		if err != nil {
+			return err
+		}
+		var user model.User
+		err = tx.Where("id", u.Id).First(&user).Error
+		if err != nil {
+			return err
+		}
+		granted = true
+		return tx.Create(&model.PowerLog{
+			UserId:    u.Id,
+			Username:  u.Username,
+			Type:      types.PowerGift,
+			Amount:    power,
+			Mark:      types.PowerAdd,
+			Balance:   user.Power,
+			Model:     "系统赠送",
+			Remark:    fmt.Sprintf("VIP 会员每月赠送算力，发放月份：%s", month),
+			CreatedAt: time.Now(),
+		}).Error
+	})
+	return granted, err
+}
+
 func (e *XXLJobExecutor) ResetUserPower(cxt context.Context, param *xxl.RunReq) (msg string) {
 	logger.Info("今日算力派发开始：", time.Now())
 	var users []model.User
@@ -119,6 +244,9 @@ func (e *XXLJobExecutor) ResetUserPower(cxt context.Context, param *xxl.RunReq)
 		tx := e.db.Model(&model.User{}).Where("id", u.Id).UpdateColumn("power", gorm.Expr("power + ?", power))
 		// 记录算力充值日志
 		if tx.Error == nil {
+			if err := AddPowerGrant(e.db, u.Id, types.PowerGift, power, 0); err != nil {
+				logger.Errorf("error with create power grant for user %d: %v", u.Id, err)
+			}
 			var user model.User
 			e.db.Where("id", u.Id).First(&user)
 			e.db.Create(&model.PowerLog{
@@ -140,6 +268,126 @@ func (e *XXLJobExecutor) ResetUserPower(cxt context.Context, param *xxl.RunReq)
 	return "success"
 }
 
+// CheckVipExpired 取消已到期用户的 VIP 会员身份，并给即将到期的会员发送续费提醒，需要配置为每天执行
+func (e *XXLJobExecutor) CheckVipExpired(cxt context.Context, param *xxl.RunReq) (msg string) {
+	logger.Info("开始检查 VIP 会员到期...")
+	var sysConfig model.Config
+	res := e.db.Where("marker", "system").First(&sysConfig)
+	if res.Error != nil {
+		return "error with get system config: " + res.Error.Error()
+	}
+
+	var config types.SystemConfig
+	err := utils.JsonDecode(sysConfig.Config, &config)
+	if err != nil {
+		return "error with decode system config: " + err.Error()
+	}
+
+	now := time.Now().Unix()
+	var users []model.User
+	res = e.db.Where("vip = ? AND expired_time > 0 AND expired_time < ?", true, now).Find(&users)
+	if res.Error != nil {
+		return "error with fetch expired vip users: " + res.Error.Error()
+	}
+	for _, u := range users {
+		// 更新时再次判断到期时间，避免覆盖查询之后刚续费的会员
+		res = e.db.Model(&model.User{}).Where("id = ? AND vip = ? AND expired_time < ?", u.Id, true, now).UpdateColumn("vip", false)
+		if res.Error != nil {
+			logger.Errorf("error with cancel vip for user %d: %v", u.Id, res.Error)
+			continue
+		}
+		if res.RowsAffected > 0 {
+			logger.Infof("用户 %s(%d) 的 VIP 会员已于 %s 到期，已取消会员身份", u.Username, u.Id, utils.Stamp2str(u.ExpiredTime))
+		}
+	}
+
+	if config.VipExpireNotifyDays > 0 && e.smtpService != nil {
+		// 任务每天执行一次，只提醒到期时间刚好落在第 N 天的会员，保证每个会员只会收到一次提醒
+		start := now + int64(config.VipExpireNotifyDays-1)*86400
+		var notifyUsers []model.User
+		e.db.Where("vip = ? AND status = ? AND expired_time > ? AND expired_time <= ?", true, true, start, start+86400).Find(&notifyUsers)
+		for _, u := range notifyUsers {
+			if !utils.IsValidEmail(u.Email) {
+				continue
+			}
+			subject := fmt.Sprintf("%s 会员即将到期提醒", e.smtpService.AppName())
+			body := fmt.Sprintf("您好，%s：\r\n您的 VIP 会员将于 %s 到期，到期之后将无法继续享受会员权益，请及时续费。", u.Username, utils.Stamp2str(u.ExpiredTime))
+			if err := e.smtpService.SendMail(u.Email, subject, body); err != nil {
+				logger.Errorf("error with send vip expire notice to %s: %v", u.Email, err)
+			}
+		}
+	}
+	return "success"
+}
+
+// ExpirePower 扣除已过期批次的剩余算力，并记录算力日志
+func (e *XXLJobExecutor) ExpirePower(cxt context.Context, param *xxl.RunReq) (msg string) {
+	logger.Info("开始清理过期算力...")
+	var grants []model.PowerGrant
+	res := e.db.Where("expires_at > 0 AND expires_at <= ? AND remain > 0", time.Now().Unix()).Find(&grants)
+	if res.Error != nil {
+		return "error with fetch expired power grants: " + res.Error.Error()
+	}
+
+	var totalPower = 0
+	for _, g := range grants {
+		expired, err := e.expirePowerGrant(g.Id)
+		if err != nil {
+			logger.Errorf("error with expire power grant %d: %v", g.Id, err)
+			continue
+		}
+		totalPower += expired
+	}
+	logger.Infof("过期算力清理结束！累计清理 %d 个批次，累计扣除算力：%d", len(grants), totalPower)
+	return "success"
+}
+
+// expirePowerGrant 扣除单个过期批次的剩余算力，用户算力最多扣到 0，返回实际扣除的算力
+func (e *XXLJobExecutor) expirePowerGrant(grantId uint) (int, error) {
+	var deduct int
+	err := e.db.Transaction(func(tx *gorm.DB) error {
+		var grant model.PowerGrant
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id", grantId).First(&grant).Error
+		if err != nil {
+			return err
+		}
+		// 加锁之后该批次已经被消费完了
+		if grant.Remain <= 0 {
+			return nil
+		}
+		var user model.User
+		err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("id", grant.UserId).First(&user).Error
+		if err != nil {
+			return err
+		}
+
+		deduct = max(min(grant.Remain, user.Power), 0)
+		err = tx.Model(&model.PowerGrant{}).Where("id", grant.Id).UpdateColumn("remain", 0).Error
+		if err != nil {
+			return err
+		}
+		if deduct == 0 {
+			return nil
+		}
+		err = tx.Model(&model.User{}).Where("id", user.Id).UpdateColumn("power", gorm.Expr("power - ?", deduct)).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&model.PowerLog{
+			UserId:    user.Id,
+			Username:  user.Username,
+			Type:      types.PowerExpire,
+			Amount:    deduct,
+			Mark:      types.PowerSub,
+			Balance:   user.Power - deduct,
+			Model:     "系统",
+			Remark:    fmt.Sprintf("算力已过期，发放时间：%s，过期时间：%s", grant.GrantedAt.Format("2006-01-02 15:04:05"), utils.Stamp2str(grant.ExpiresAt)),
+			CreatedAt: time.Now(),
+		}).Error
+	})
+	return deduct, err
+}
+
 type customLogger struct{}
 
 func (l *customLogger) Info(format string, a ...interface{}) {
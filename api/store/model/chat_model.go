@@ -12,4 +12,5 @@ type ChatModel struct {
 	MaxContext  int     // 最大上下文长度
 	Temperature float32 // 模型温度
 	KeyId       int     // 绑定 API KEY ID
+	RateLimit   int     // 每个用户每分钟最多请求次数，0 表示不限制
 }
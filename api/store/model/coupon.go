@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Coupon 优惠券，下单时抵扣订单金额
+type Coupon struct {
+	Id           uint   `gorm:"primarykey;column:id"`
+	Code         string // 优惠码
+	Type         string // 优惠类型：percent 折扣，fixed 立减
+	Value        int64  // 折扣为百分比（如 80 表示 8 折），立减为金额（分）
+	UsageLimit   int    // 总使用次数，0 表示不限制
+	UsedCount    int    // 已使用次数
+	PerUserLimit int    // 每个用户可使用次数，0 表示不限制
+	ProductId    uint   // 限定产品 ID，0 表示所有产品可用
+	ExpiredAt    int64  // 过期时间，0 表示永不过期
+	Enabled      bool
+	CreatedAt    time.Time
+}
+
+// CouponUsage 优惠券使用记录，订单超时取消之后会释放
+type CouponUsage struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	CouponId  uint
+	UserId    uint
+	OrderNo   string
+	CreatedAt time.Time
+}
@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// FulfillmentLog 订单履约日志，每个订单结算成功之后记录一条，没有发放算力的订单（如会员续费只顺延有效期）也会记录，
+// 用于处理算力和订阅时长等方面的纠纷
+type FulfillmentLog struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	OrderNo   string
+	UserId    uint // 获得权益的用户，赠送订单为受赠用户
+	Username  string
+	PayWay    string
+	Opt       string // 履约内容说明
+	Power     int    // 发放的算力，包含充值满额赠送的算力
+	Days      int    // 实际顺延的会员天数，没有顺延时为 0
+	ExpireAt  int64  // 顺延之后的会员到期时间，没有顺延时为 0
+	ManualBy  uint   // 手动结算订单的管理员 ID
+	CreatedAt time.Time
+}
@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// Invoice 订单发票，每个订单只生成一张发票，发票号根据记录 ID 生成，保证单调递增
+type Invoice struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	InvoiceNo string
+	OrderId   uint
+	UserId    uint
+	CreatedAt time.Time
+}
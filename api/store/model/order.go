@@ -2,21 +2,60 @@ package model
 
 import (
 	"geekai/core/types"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
 )
 
 // Order 充值订单
 type Order struct {
 	BaseModel
-	UserId    uint
-	ProductId uint
-	Username  string
-	OrderNo   string
-	TradeNo   string
-	Subject   string
-	Amount    float64
-	Status    types.OrderStatus
-	Remark    string
-	PayTime   int64
-	PayWay    string // 支付渠道
-	PayType   string // 支付类型
+	UserId      uint
+	ProductId   uint
+	Username    string
+	OrderNo     string
+	TradeNo     string
+	Subject     string
+	Amount      float64 // 订单金额（元），仅用于展示
+	AmountCents int64   // 订单金额（分），计算和校验都以此为准
+	RefundCents int64   // 已退款金额（分）
+	Fee         int64   // 支付渠道手续费（分）
+	Currency    string  // 结算货币，金额以该货币的最小单位存储
+	Status      types.OrderStatus
+	Remark      string
+	PayTime     int64
+	PayWay      string // 支付渠道
+	PayType     string // 支付类型
+	ClientIP    string // 下单 IP
+	UserAgent   string // 下单客户端 User-Agent
+	Region      string // 下单 IP 所在的国家或地区，使用了区域价格时才记录
+	MerchantId  string // 多品牌部署时订单所属的商户 ID，空字符串表示默认商户
+	// 受赠用户 ID，为好友购买时权益发放给受赠用户，0 表示为自己购买
+	BeneficiaryId uint
+	RefundStatus  string         // 最近一次退款的状态：processing、success、failed，没有退款时为空
+	Disputed      bool           // 用户是否对订单发起过交易争议（拒付）
+	DeletedAt     gorm.DeletedAt // 软删除时间，删除的订单不计入统计，也不会被支付回调重新结算
+}
+
+// Cents 订单金额（分），兼容没有 amount_cents 字段数据的历史订单
+func (o Order) Cents() int64 {
+	if o.AmountCents > 0 {
+		return o.AmountCents
+	}
+	return decimal.NewFromFloat(o.Amount).Shift(2).Round(0).IntPart()
+}
+
+// CurrencyCode 订单结算货币，兼容没有 currency 字段数据的历史订单
+func (o Order) CurrencyCode() string {
+	if o.Currency == "" {
+		return types.DefaultCurrency
+	}
+	return o.Currency
+}
+
+// Receiver 订单权益的接收用户
+func (o Order) Receiver() uint {
+	if o.BeneficiaryId > 0 {
+		return o.BeneficiaryId
+	}
+	return o.UserId
 }
@@ -0,0 +1,20 @@
+package model
+
+import "time"
+
+// OrderDispute 交易争议（拒付）记录，同一个争议的重复回调只记录一次
+type OrderDispute struct {
+	Id           uint   `gorm:"primarykey;column:id"`
+	DisputeId    string // 支付渠道的争议 ID
+	Gateway      string // 支付渠道
+	OrderNo      string
+	UserId       uint
+	Amount       string // 争议金额
+	Currency     string
+	Reason       string // 争议原因
+	Status       string // 渠道返回的争议状态，争议结束之后为处理结果
+	DueBy        int64  // 提交证据的截止时间
+	PowerRevoked int    // 扣回的算力
+	ClosedAt     int64  // 争议结束时间
+	CreatedAt    time.Time
+}
@@ -0,0 +1,16 @@
+package model
+
+import "time"
+
+// PaymentCallbackLog 支付渠道异步回调的原始请求，不管校验是否通过都会保存，用于对账和纠纷取证
+type PaymentCallbackLog struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	Gateway   string
+	Method    string
+	URL       string `gorm:"column:url"`
+	Headers   string
+	Body      string
+	ClientIP  string
+	Result    string // 处理结果，success 或者错误信息
+	CreatedAt time.Time
+}
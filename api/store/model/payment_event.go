@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// PaymentEvent 已处理的支付回调事件，通过 gateway + trade_no 唯一索引保证同一笔交易只会结算一次
+type PaymentEvent struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	Gateway   string
+	TradeNo   string
+	OrderNo   string
+	Amount    string
+	CreatedAt time.Time
+}
@@ -0,0 +1,15 @@
+package model
+
+import "time"
+
+// PowerGrant 算力发放批次，用户的剩余算力等于所有未过期批次的剩余算力之和
+type PowerGrant struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	UserId    uint
+	Type      int    // 算力来源，对应 types.PowerType
+	Bucket    string // 算力分组，空字符串表示默认分组
+	Amount    int    // 发放的算力
+	Remain    int    // 剩余未消费的算力
+	ExpiresAt int64  // 过期时间，0 表示永不过期
+	GrantedAt time.Time
+}
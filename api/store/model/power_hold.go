@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// PowerHold 组合支付订单冻结的算力，订单支付成功之后扣除，订单超时取消之后退回
+type PowerHold struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	UserId    uint
+	OrderNo   string
+	Amount    int
+	CreatedAt time.Time
+}
@@ -0,0 +1,13 @@
+package model
+
+import "time"
+
+// PowerRefund 算力退回记录，通过 related_id 唯一索引保证同一个任务只会退回一次
+type PowerRefund struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	UserId    uint
+	RelatedId string
+	Amount    int
+	Reason    string
+	CreatedAt time.Time
+}
@@ -1,14 +1,58 @@
 package model
 
+import (
+	"encoding/json"
+	"geekai/core/types"
+)
+
 // Product 充值产品
 type Product struct {
 	BaseModel
-	Name     string
-	Price    float64
-	Discount float64
-	Days     int
-	Power    int
-	Enabled  bool
-	Sales    int
-	SortNum  int
+	Name       string
+	Price      float64
+	Currency   string // 结算货币，如 CNY, USD
+	Discount   float64
+	Days       int
+	Power      int
+	PowerPrice int    // 使用算力余额购买时的价格，0 表示不支持余额购买
+	Bucket     string // 充值算力所属的分组，空字符串表示默认分组
+	Recurring  bool   // 是否为自动续费的订阅产品，按照 Days 设置的天数周期扣款
+	NotifyURL  string // 单独设置的支付异步通知地址，为空时使用支付渠道的配置
+	ReturnURL  string // 单独设置的支付完成跳转地址，为空时使用支付渠道的配置
+	Enabled    bool
+	Sales      int
+	SortNum    int
+
+	// 区域价格 json，按照下单 IP 所在的国家或地区使用对应的价格，没有匹配时使用默认价格
+	RegionPrices string `gorm:"column:region_prices_json"`
+}
+
+// CurrencyCode 产品结算货币，兼容没有 currency 字段数据的历史产品
+func (p Product) CurrencyCode() string {
+	if p.Currency == "" {
+		return types.DefaultCurrency
+	}
+	return p.Currency
+}
+
+// ForRegion 返回指定国家或地区的产品价格，匹配到区域价格时返回的 Region 为该地区代码，否则返回默认价格
+func (p Product) ForRegion(region string) (product Product, matched string) {
+	if region == "" || p.RegionPrices == "" {
+		return p, ""
+	}
+	var prices []types.RegionPrice
+	if err := json.Unmarshal([]byte(p.RegionPrices), &prices); err != nil {
+		return p, ""
+	}
+	for _, price := range prices {
+		for _, r := range price.Regions {
+			if r == region {
+				p.Price = price.Price
+				p.Discount = price.Discount
+				p.Currency = price.Currency
+				return p, region
+			}
+		}
+	}
+	return p, ""
 }
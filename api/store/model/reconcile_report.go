@@ -0,0 +1,18 @@
+package model
+
+import "time"
+
+// ReconcileReport 对账差异记录
+type ReconcileReport struct {
+	Id            uint   `gorm:"primarykey;column:id"`
+	BatchNo       string // 对账批次，格式为对账日期
+	MerchantId    string // 订单所属的商户 ID，默认商户为空
+	Gateway       string // 支付渠道
+	OrderNo       string
+	TradeNo       string
+	Type          string // 差异类型
+	LocalAmount   string // 本地订单金额
+	GatewayAmount string // 支付渠道交易金额
+	Message       string
+	CreatedAt     time.Time
+}
@@ -0,0 +1,17 @@
+package model
+
+import "time"
+
+// RedeemCode 产品兑换码（礼品卡），核销后按照关联的产品发放权益
+
+type RedeemCode struct {
+	Id         uint   `gorm:"primarykey;column:id"`
+	ProductId  uint   // 关联产品 ID
+	Code       string // 兑换码
+	Batch      string // 批次名称
+	UserId     uint   // 核销用户 ID
+	OrderNo    string // 核销生成的订单号
+	ExpiredAt  int64  // 过期时间，0 表示永不过期
+	RedeemedAt int64  // 核销时间
+	CreatedAt  time.Time
+}
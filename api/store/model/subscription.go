@@ -0,0 +1,23 @@
+package model
+
+import (
+	"geekai/core/types"
+	"time"
+)
+
+// Subscription 自动续费订阅，每个续费周期由支付渠道自动扣款，扣款成功之后生成续费订单并发放权益
+type Subscription struct {
+	Id               uint `gorm:"primarykey;column:id"`
+	UserId           uint
+	ProductId        uint
+	PayWay           string                   // 支付渠道
+	SubscriptionNo   string                   // 支付渠道的订阅 ID，如 Stripe 的 subscription id
+	OrderNo          string                   // 首次订阅的订单号
+	Status           types.SubscriptionStatus // 订阅状态
+	CurrentPeriodEnd int64                    // 当前周期的结束时间，也就是下次续费的时间
+	NextChargeAt     int64                    // 下次主动扣款的时间，只有需要商户发起扣款的渠道（如支付宝周期扣款）才会设置
+	FailedAttempts   int                      // 连续续费扣款失败的次数，扣款成功之后清零
+	LastFailure      string                   // 最近一次续费扣款失败的原因
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
@@ -10,6 +10,7 @@ type User struct {
 	Avatar      string
 	Salt        string // 密码盐
 	Power       int    // 剩余算力
+	FrozenPower int    // 冻结的算力，组合支付的订单支付完成之前冻结抵扣的算力
 	ChatConfig  string `gorm:"column:chat_config_json"` // 聊天配置 json
 	ChatRoles   string `gorm:"column:chat_roles_json"`  // 聊天角色
 	ChatModels  string `gorm:"column:chat_models_json"` // AI 模型，不同的用户拥有不同的聊天模型
@@ -20,4 +21,8 @@ type User struct {
 	OpenId      string `gorm:"column:openid"`
 	Platform    string `json:"platform"`
 	Vip         bool   // 是否 VIP 会员
+	ReferrerId  uint   // 邀请人 ID，通过邀请码注册时记录
+
+	ReferralRewarded         bool  // 是否已经因为该用户首次购买奖励过邀请人
+	LastLowBalanceNotifiedAt int64 // 最后一次低余额提醒时间
 }
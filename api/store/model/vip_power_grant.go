@@ -0,0 +1,12 @@
+package model
+
+import "time"
+
+// VipPowerGrant VIP 会员每月算力发放记录，通过 user_id + month 唯一索引保证每个月只发放一次
+type VipPowerGrant struct {
+	Id        uint `gorm:"primarykey;column:id"`
+	UserId    uint
+	Month     string
+	Power     int
+	CreatedAt time.Time
+}
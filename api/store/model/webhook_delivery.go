@@ -0,0 +1,19 @@
+package model
+
+import "time"
+
+// WebhookDelivery 订单事件回调的投递记录
+type WebhookDelivery struct {
+	Id          uint   `gorm:"primarykey;column:id"`
+	Event       string // 事件类型
+	OrderNo     string
+	URL         string
+	Payload     string // 请求体
+	Status      int    // 投递状态：0 待投递，1 成功，2 失败
+	Attempts    int    // 已投递次数
+	StatusCode  int    // 最后一次投递的 HTTP 状态码
+	LastError   string // 最后一次投递的错误信息
+	NextRetryAt int64  // 下次重试时间
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
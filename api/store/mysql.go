@@ -13,6 +13,7 @@ import (
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 	"gorm.io/gorm/schema"
+	otelgorm "gorm.io/plugin/opentelemetry/tracing"
 	"time"
 )
 
@@ -31,6 +32,11 @@ func NewMysql(config *gorm.Config, appConfig *types.AppConfig) (*gorm.DB, error)
 	if err != nil {
 		return nil, err
 	}
+	// 数据库查询挂在当前请求的链路下，需要通过 db.WithContext(ctx) 传入链路上下文，不记录 SQL 参数
+	err = db.Use(otelgorm.NewPlugin(otelgorm.WithoutMetrics(), otelgorm.WithoutQueryVariables()))
+	if err != nil {
+		return nil, err
+	}
 
 	sqlDB, err := db.DB()
 	if err != nil {
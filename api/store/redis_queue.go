@@ -10,6 +10,8 @@ package store
 import (
 	"context"
 	"geekai/utils"
+	"time"
+
 	"github.com/go-redis/redis/v8"
 )
 
@@ -46,3 +48,93 @@ func (q *RedisQueue) RPop(value interface{}) error {
 	}
 	return utils.JsonDecode(result[1], value)
 }
+
+// ReliableQueue 可靠队列，取出的消息先转移到处理中队列，确认处理完成之后再删除，
+// 进程在处理过程中退出时，重启后可以把处理中的消息恢复到队列里重新处理。
+// 处理失败的消息移到死信队列（按照重试时间排序的有序集合），到期之后放回队列重新处理
+type ReliableQueue struct {
+	name       string
+	processing string
+	deadLetter string
+	client     *redis.Client
+	ctx        context.Context
+}
+
+func NewReliableQueue(name string, client *redis.Client) *ReliableQueue {
+	return &ReliableQueue{
+		name:       name,
+		processing: name + "_Processing",
+		deadLetter: name + "_DeadLetter",
+		client:     client,
+		ctx:        context.Background(),
+	}
+}
+
+func (q *ReliableQueue) Push(value interface{}) error {
+	return q.client.LPush(q.ctx, q.name, utils.JsonEncode(value)).Err()
+}
+
+// Pop 阻塞读取一条消息，返回消息的原始内容，处理完成之后需要调用 Ack 确认
+func (q *ReliableQueue) Pop(value interface{}) (string, error) {
+	raw, err := q.client.BRPopLPush(q.ctx, q.name, q.processing, 0).Result()
+	if err != nil {
+		return "", err
+	}
+	return raw, utils.JsonDecode(raw, value)
+}
+
+// Ack 确认消息已经处理完成，从处理中队列删除
+func (q *ReliableQueue) Ack(raw string) error {
+	return q.client.LRem(q.ctx, q.processing, 1, raw).Err()
+}
+
+// Recover 把处理中队列里的消息全部放回队列，返回恢复的消息数量
+func (q *ReliableQueue) Recover() (int64, error) {
+	var total int64
+	for {
+		err := q.client.RPopLPush(q.ctx, q.processing, q.name).Err()
+		if err == redis.Nil {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+		total++
+	}
+}
+
+// Len 待处理的消息数量
+func (q *ReliableQueue) Len() int64 {
+	return q.client.LLen(q.ctx, q.name).Val()
+}
+
+// promoteScript 把到期的延迟消息移回队列，ZRANGEBYSCORE 和移动在同一个脚本中执行，多个实例同时执行也不会重复移动
+var promoteScript = redis.NewScript(`
+local items = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, v in ipairs(items) do
+	redis.call('ZREM', KEYS[1], v)
+	redis.call('LPUSH', KEYS[2], v)
+end
+return #items
+`)
+
+// Defer 处理失败的消息从处理中队列移到死信队列，delay 之后由 Promote 放回队列重新处理，
+// value 为更新了重试次数等信息之后的消息。两个操作在同一个事务中执行，消息不会丢失
+func (q *ReliableQueue) Defer(raw string, value interface{}, delay time.Duration) error {
+	_, err := q.client.TxPipelined(q.ctx, func(pipe redis.Pipeliner) error {
+		pipe.LRem(q.ctx, q.processing, 1, raw)
+		pipe.ZAdd(q.ctx, q.deadLetter, &redis.Z{Score: float64(time.Now().Add(delay).UnixMilli()), Member: utils.JsonEncode(value)})
+		return nil
+	})
+	return err
+}
+
+// Promote 把死信队列中到达重试时间的消息放回队列，每次最多移动 limit 条，返回移动的消息数量
+func (q *ReliableQueue) Promote(limit int) (int64, error) {
+	return promoteScript.Run(q.ctx, q.client, []string{q.deadLetter, q.name}, time.Now().UnixMilli(), limit).Int64()
+}
+
+// DeadLetterLen 死信队列中等待重试的消息数量
+func (q *ReliableQueue) DeadLetterLen() int64 {
+	return q.client.ZCard(q.ctx, q.deadLetter).Val()
+}
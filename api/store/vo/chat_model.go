@@ -12,5 +12,6 @@ type ChatModel struct {
 	MaxContext  int     `json:"max_context"` // 最大上下文长度
 	Temperature float32 `json:"temperature"` // 模型温度
 	KeyId       int     `json:"key_id,omitempty"`
+	RateLimit   int     `json:"rate_limit"` // 每个用户每分钟最多请求次数，0 表示不限制
 	KeyName     string  `json:"key_name"`
 }
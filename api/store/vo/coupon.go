@@ -0,0 +1,16 @@
+package vo
+
+type Coupon struct {
+	Id           uint   `json:"id"`
+	Code         string `json:"code"`
+	Type         string `json:"type"`
+	Value        int64  `json:"value"`
+	UsageLimit   int    `json:"usage_limit"`
+	UsedCount    int    `json:"used_count"`
+	PerUserLimit int    `json:"per_user_limit"`
+	ProductId    uint   `json:"product_id"`
+	ProductName  string `json:"product_name"`
+	ExpiredAt    int64  `json:"expired_at"`
+	Enabled      bool   `json:"enabled"`
+	CreatedAt    int64  `json:"created_at"`
+}
@@ -6,18 +6,32 @@ import (
 
 type Order struct {
 	BaseVo
-	UserId    uint              `json:"user_id"`
-	ProductId uint              `json:"product_id"`
-	Username  string            `json:"username"`
-	OrderNo   string            `json:"order_no"`
-	TradeNo   string            `json:"trade_no"`
-	Subject   string            `json:"subject"`
-	Amount    float64           `json:"amount"`
-	Status    types.OrderStatus `json:"status"`
-	PayTime   int64             `json:"pay_time"`
-	PayWay    string            `json:"pay_way"`
-	PayType   string            `json:"pay_type"`
-	PayMethod string            `json:"pay_method"`
-	PayName   string            `json:"pay_name"`
-	Remark    types.OrderRemark `json:"remark"`
+	UserId        uint              `json:"user_id"`
+	ProductId     uint              `json:"product_id"`
+	Username      string            `json:"username"`
+	OrderNo       string            `json:"order_no"`
+	TradeNo       string            `json:"trade_no"`
+	Subject       string            `json:"subject"`
+	Amount        float64           `json:"amount"`
+	Currency      string            `json:"currency"`
+	Status        types.OrderStatus `json:"status"`
+	PayTime       int64             `json:"pay_time"`
+	PayWay        string            `json:"pay_way"`
+	PayType       string            `json:"pay_type"`
+	PayMethod     string            `json:"pay_method"`
+	PayName       string            `json:"pay_name"`
+	ClientIP      string            `json:"client_ip"`
+	UserAgent     string            `json:"user_agent"`
+	BeneficiaryId uint              `json:"beneficiary_id"`
+	Remark        types.OrderRemark `json:"remark"`
+}
+
+// OrderDetail 后台查询的订单详情，包含手续费和退款等内部字段
+type OrderDetail struct {
+	Order
+	AmountCents  int64  `json:"amount_cents"`
+	RefundCents  int64  `json:"refund_cents"`
+	RefundStatus string `json:"refund_status"`
+	Fee          int64  `json:"fee"`
+	Disputed     bool   `json:"disputed"`
 }
@@ -1,13 +1,25 @@
 package vo
 
+import "geekai/core/types"
+
 type Product struct {
 	BaseVo
-	Name     string  `json:"name"`
-	Price    float64 `json:"price"`
-	Discount float64 `json:"discount"`
-	Days     int     `json:"days"`
-	Power    int     `json:"power"`
-	Enabled  bool    `json:"enabled"`
-	Sales    int     `json:"sales"`
-	SortNum  int     `json:"sort_num"`
+	Name       string  `json:"name"`
+	Price      float64 `json:"price"`
+	Currency   string  `json:"currency"`
+	Discount   float64 `json:"discount"`
+	Days       int     `json:"days"`
+	Power      int     `json:"power"`
+	PowerPrice int     `json:"power_price"`
+	Bucket     string  `json:"bucket"`
+	Recurring  bool    `json:"recurring"`
+	NotifyURL  string  `json:"notify_url"`
+	ReturnURL  string  `json:"return_url"`
+	Region     string  `json:"region,omitempty"` // 当前价格对应的国家或地区，默认价格为空
+	Enabled    bool    `json:"enabled"`
+	Sales      int     `json:"sales"`
+	SortNum    int     `json:"sort_num"`
+
+	EffectivePrice float64             `json:"effective_price"` // 实际售价，即售价减去优惠金额
+	RegionPrices   []types.RegionPrice `json:"region_prices"`   // 区域价格
 }
@@ -0,0 +1,14 @@
+package vo
+
+type ReconcileReport struct {
+	Id            uint   `json:"id"`
+	BatchNo       string `json:"batch_no"`
+	Gateway       string `json:"gateway"`
+	OrderNo       string `json:"order_no"`
+	TradeNo       string `json:"trade_no"`
+	Type          string `json:"type"`
+	LocalAmount   string `json:"local_amount"`
+	GatewayAmount string `json:"gateway_amount"`
+	Message       string `json:"message"`
+	CreatedAt     int64  `json:"created_at"`
+}
@@ -0,0 +1,15 @@
+package vo
+
+type RedeemCode struct {
+	Id          uint   `json:"id"`
+	ProductId   uint   `json:"product_id"` // 关联产品 ID
+	ProductName string `json:"product_name"`
+	Code        string `json:"code"` // 兑换码
+	Batch       string `json:"batch"`
+	UserId      uint   `json:"user_id"` // 核销用户 ID
+	Username    string `json:"username"`
+	OrderNo     string `json:"order_no"`
+	ExpiredAt   int64  `json:"expired_at"`
+	RedeemedAt  int64  `json:"redeemed_at"`
+	CreatedAt   int64  `json:"created_at"`
+}
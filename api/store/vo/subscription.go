@@ -0,0 +1,18 @@
+package vo
+
+// Subscription 用户的自动续费订阅
+type Subscription struct {
+	BaseVo
+	ProductId        uint    `json:"product_id"`
+	ProductName      string  `json:"product_name"` // 订阅的产品名称
+	Amount           float64 `json:"amount"`       // 每个周期的扣款金额
+	Currency         string  `json:"currency"`
+	Days             int     `json:"days"` // 续费周期（天）
+	PayWay           string  `json:"pay_way"`
+	Status           string  `json:"status"`             // active, cancelling, cancelled, past_due
+	CurrentPeriodEnd int64   `json:"current_period_end"` // 当前周期的结束时间
+	NextRenewalAt    int64   `json:"next_renewal_at"`    // 下次续费时间，不再续费时为 0
+	FailedAttempts   int     `json:"failed_attempts"`    // 连续续费扣款失败的次数
+	LastFailure      string  `json:"last_failure"`       // 最近一次续费扣款失败的原因
+	Resumable        bool    `json:"resumable"`          // 是否可以恢复自动续费
+}
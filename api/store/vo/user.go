@@ -9,6 +9,7 @@ type User struct {
 	Avatar      string   `json:"avatar"`
 	Salt        string   `json:"salt"`          // 密码盐
 	Power       int      `json:"power"`         // 剩余算力
+	FrozenPower int      `json:"frozen_power"`  // 冻结的算力
 	ChatRoles   []string `json:"chat_roles"`    // 聊天角色集合
 	ChatModels  []int    `json:"chat_models"`   // AI模型集合
 	ExpiredTime int64    `json:"expired_time"`  // 账户到期时间
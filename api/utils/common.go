@@ -17,7 +17,8 @@ import (
 	"image"
 	"image/color"
 	"image/draw"
-	"image/jpeg"
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"reflect"
 	"strconv"
@@ -192,9 +193,9 @@ func GenQrcode(text string, size int, logo io.Reader) ([]byte, error) {
 	// 将Logo叠加到二维码图像上
 	qrWithLogo := overlayLogo(qr.Image(size), scaledLogo)
 
-	// 将带Logo的二维码图像以JPEG格式编码为图片数据
+	// 将带Logo的二维码图像以PNG格式编码为图片数据，与不带Logo的二维码格式保持一致
 	var buf bytes.Buffer
-	err = jpeg.Encode(&buf, qrWithLogo, nil)
+	err = png.Encode(&buf, qrWithLogo)
 	if err != nil {
 		return nil, err
 	}
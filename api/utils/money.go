@@ -0,0 +1,38 @@
+package utils
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"github.com/shopspring/decimal"
+)
+
+// 金额统一使用整数分进行计算和存储，只在对接支付渠道和展示时转换成元
+
+// YuanToCents 元转换成分，四舍五入
+func YuanToCents(yuan float64) int64 {
+	return decimal.NewFromFloat(yuan).Shift(2).Round(0).IntPart()
+}
+
+// ParseCents 解析字符串格式的金额（元）为分，如 "9.99" => 999
+func ParseCents(yuan string) (int64, error) {
+	d, err := decimal.NewFromString(yuan)
+	if err != nil {
+		return 0, err
+	}
+	return d.Shift(2).Round(0).IntPart(), nil
+}
+
+// CentsToYuan 分转换成元
+func CentsToYuan(cents int64) float64 {
+	return decimal.New(cents, -2).InexactFloat64()
+}
+
+// FormatCents 把分格式化成保留两位小数的元，如 999 => "9.99"
+func FormatCents(cents int64) string {
+	return decimal.New(cents, -2).StringFixed(2)
+}
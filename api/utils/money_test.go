@@ -0,0 +1,85 @@
+package utils
+
+import "testing"
+
+func TestYuanToCents(t *testing.T) {
+	tests := []struct {
+		yuan float64
+		want int64
+	}{
+		{0, 0},
+		{0.01, 1},
+		{9.99, 999},
+		{19.95, 1995},
+		{0.1 + 0.2, 30},
+		{1.005, 101},
+		{100, 10000},
+		{-9.99, -999},
+	}
+	for _, tt := range tests {
+		if got := YuanToCents(tt.yuan); got != tt.want {
+			t.Errorf("YuanToCents(%v) = %d, want %d", tt.yuan, got, tt.want)
+		}
+	}
+}
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		yuan    string
+		want    int64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"9.99", 999, false},
+		{"19.95", 1995, false},
+		{"0.30000000000000004", 30, false},
+		{"100", 10000, false},
+		{"100.00", 10000, false},
+		{"0.005", 1, false},
+		{"", 0, true},
+		{"abc", 0, true},
+		{"9.9.9", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCents(tt.yuan)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCents(%q) error = %v, wantErr %v", tt.yuan, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseCents(%q) = %d, want %d", tt.yuan, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCents(t *testing.T) {
+	tests := []struct {
+		cents int64
+		want  string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{30, "0.30"},
+		{999, "9.99"},
+		{1995, "19.95"},
+		{10000, "100.00"},
+		{-999, "-9.99"},
+	}
+	for _, tt := range tests {
+		if got := FormatCents(tt.cents); got != tt.want {
+			t.Errorf("FormatCents(%d) = %q, want %q", tt.cents, got, tt.want)
+		}
+	}
+}
+
+func TestCentsRoundTrip(t *testing.T) {
+	for _, cents := range []int64{0, 1, 30, 999, 1995, 10000, 123456789} {
+		if got := YuanToCents(CentsToYuan(cents)); got != cents {
+			t.Errorf("YuanToCents(CentsToYuan(%d)) = %d", cents, got)
+		}
+		got, err := ParseCents(FormatCents(cents))
+		if err != nil || got != cents {
+			t.Errorf("ParseCents(FormatCents(%d)) = %d, %v", cents, got, err)
+		}
+	}
+}
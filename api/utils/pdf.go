@@ -0,0 +1,81 @@
+package utils
+
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+// * Copyright 2023 The Geek-AI Authors. All rights reserved.
+// * Use of this source code is governed by a Apache-2.0 license
+// * that can be found in the LICENSE file.
+// * @Author yangjian102621@163.com
+// * +++++++++++++++++++++++++++++++++++++++++++++++++++++++++++
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf16"
+)
+
+// PDF A4 纸张大小（pt）
+const (
+	PdfPageWidth  = 595.0
+	PdfPageHeight = 842.0
+)
+
+// Pdf 简单的单页 PDF 文档，只支持文本和直线，用于生成发票等固定格式的文档。
+// 中文使用 PDF 阅读器内置的 STSong-Light 字体，不需要嵌入字体文件
+type Pdf struct {
+	content bytes.Buffer
+}
+
+func NewPdf() *Pdf {
+	return &Pdf{}
+}
+
+// Text 在 (x, y) 位置输出文本，坐标原点在页面左上角
+func (p *Pdf) Text(x, y, size float64, text string) {
+	p.content.WriteString(fmt.Sprintf("BT /F1 %.1f Tf %.2f %.2f Td <%s> Tj ET\n", size, x, PdfPageHeight-y, pdfHexString(text)))
+}
+
+// Line 绘制直线，坐标原点在页面左上角
+func (p *Pdf) Line(x1, y1, x2, y2 float64) {
+	p.content.WriteString(fmt.Sprintf("%.2f %.2f m %.2f %.2f l S\n", x1, PdfPageHeight-y1, x2, PdfPageHeight-y2))
+}
+
+// Bytes 输出 PDF 文件内容
+func (p *Pdf) Bytes() []byte {
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.0f %.0f] /Resources << /Font << /F1 5 0 R >> >> /Contents 4 0 R >>", PdfPageWidth, PdfPageHeight),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", p.content.Len(), p.content.String()),
+		"<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [6 0 R] >>",
+		"<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light /CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> /FontDescriptor 7 0 R /DW 1000 >>",
+		"<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880] /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>",
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = buf.Len()
+		buf.WriteString(fmt.Sprintf("%d 0 obj\n%s\nendobj\n", i+1, obj))
+	}
+	xref := buf.Len()
+	buf.WriteString(fmt.Sprintf("xref\n0 %d\n", len(objects)+1))
+	buf.WriteString("0000000000 65535 f \n")
+	for _, offset := range offsets {
+		buf.WriteString(fmt.Sprintf("%010d 00000 n \n", offset))
+	}
+	buf.WriteString(fmt.Sprintf("trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref))
+	return buf.Bytes()
+}
+
+// pdfHexString 把文本编码成 UCS-2 的十六进制字符串，超出基本平面的字符（如 emoji）会被替换成问号
+func pdfHexString(text string) string {
+	var buf bytes.Buffer
+	for _, r := range text {
+		if r > 0xFFFF || utf16.IsSurrogate(r) {
+			r = '?'
+		}
+		buf.WriteString(fmt.Sprintf("%04X", r))
+	}
+	return buf.String()
+}
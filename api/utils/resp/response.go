@@ -41,3 +41,61 @@ func NotAuth(c *gin.Context, messages ...string) {
 		c.JSON(http.StatusUnauthorized, types.BizVo{Code: types.NotAuthorized, Message: "Not Authorized"})
 	}
 }
+
+func NotFound(c *gin.Context, messages ...string) {
+	if messages != nil {
+		c.JSON(http.StatusNotFound, types.BizVo{Code: types.NotFound, Message: messages[0]})
+	} else {
+		c.JSON(http.StatusNotFound, types.BizVo{Code: types.NotFound, Message: "Not Found"})
+	}
+}
+
+func Conflict(c *gin.Context, messages ...string) {
+	if messages != nil {
+		c.JSON(http.StatusConflict, types.BizVo{Code: types.Conflict, Message: messages[0]})
+	} else {
+		c.JSON(http.StatusConflict, types.BizVo{Code: types.Conflict, Message: "Conflict"})
+	}
+}
+
+// Timeout 上游服务响应超时，客户端可以稍后重试
+func Timeout(c *gin.Context, messages ...string) {
+	c.Header("Retry-After", "5")
+	if messages != nil {
+		c.JSON(http.StatusGatewayTimeout, types.BizVo{Code: types.Timeout, Message: messages[0]})
+	} else {
+		c.JSON(http.StatusGatewayTimeout, types.BizVo{Code: types.Timeout, Message: "Timeout"})
+	}
+}
+
+// CaptchaFailed 需要人机验证或者验证没有通过，data 为前端渲染验证组件需要的参数
+func CaptchaFailed(c *gin.Context, message string, data interface{}) {
+	c.JSON(http.StatusPreconditionRequired, types.BizVo{Code: types.CaptchaFailed, Message: message, Data: data})
+}
+
+// TooManyRequests 请求过于频繁
+func TooManyRequests(c *gin.Context, messages ...string) {
+	if messages != nil {
+		c.JSON(http.StatusTooManyRequests, types.BizVo{Code: types.RateLimited, Message: messages[0]})
+	} else {
+		c.JSON(http.StatusTooManyRequests, types.BizVo{Code: types.RateLimited, Message: "Too Many Requests"})
+	}
+}
+
+// PaymentFailed 支付接口的错误响应，error_code 返回稳定的错误码，message 用于展示，
+// HTTP 状态码和 code 按照错误码对应的业务状态码返回。data 为可选的附加数据，如人机验证组件参数
+func PaymentFailed(c *gin.Context, code types.PaymentError, message string, data ...interface{}) {
+	bizCode := code.BizCode()
+	status := http.StatusBadRequest
+	if bizCode != types.Failed {
+		status = int(bizCode)
+	}
+	if bizCode == types.Timeout {
+		c.Header("Retry-After", "5")
+	}
+	res := types.BizVo{Code: bizCode, ErrorCode: string(code), Message: message}
+	if data != nil {
+		res.Data = data[0]
+	}
+	c.JSON(status, res)
+}
@@ -0,0 +1,285 @@
+ALTER TABLE `chatgpt_orders` CHANGE `remark` `remark` VARCHAR(1024) CHARACTER SET utf8mb4 COLLATE utf8mb4_0900_ai_ci NOT NULL COMMENT '备注';
+ALTER TABLE `chatgpt_products` ADD `power_price` INT NOT NULL DEFAULT '0' COMMENT '算力余额购买价格，0 表示不支持' AFTER `power`;
+
+CREATE TABLE `chatgpt_redeem_codes` (
+                                        `id` int NOT NULL,
+                                        `product_id` int NOT NULL COMMENT '关联产品 ID',
+                                        `code` char(32) NOT NULL COMMENT '兑换码',
+                                        `batch` varchar(30) NOT NULL DEFAULT '' COMMENT '批次名称',
+                                        `user_id` int NOT NULL DEFAULT '0' COMMENT '核销用户 ID',
+                                        `order_no` varchar(30) NOT NULL DEFAULT '' COMMENT '核销订单号',
+                                        `expired_at` int NOT NULL DEFAULT '0' COMMENT '过期时间',
+                                        `redeemed_at` int NOT NULL DEFAULT '0' COMMENT '核销时间',
+                                        `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='产品兑换码';
+
+ALTER TABLE `chatgpt_redeem_codes` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `code` (`code`);
+
+ALTER TABLE `chatgpt_redeem_codes` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+ALTER TABLE `chatgpt_orders` ADD INDEX `status_created_at` (`status`, `created_at`);
+
+ALTER TABLE `chatgpt_orders` ADD `amount_cents` BIGINT NOT NULL DEFAULT '0' COMMENT '订单金额（分）' AFTER `amount`;
+UPDATE `chatgpt_orders` SET `amount_cents` = ROUND(`amount` * 100);
+
+ALTER TABLE `chatgpt_orders` ADD `client_ip` VARCHAR(64) NOT NULL DEFAULT '' COMMENT '下单 IP' AFTER `pay_type`, ADD `user_agent` VARCHAR(255) NOT NULL DEFAULT '' COMMENT '下单客户端 User-Agent' AFTER `client_ip`;
+ALTER TABLE `chatgpt_orders` ADD INDEX `client_ip` (`client_ip`);
+
+CREATE TABLE `chatgpt_payment_events` (
+                                          `id` int NOT NULL,
+                                          `gateway` varchar(20) NOT NULL COMMENT '支付渠道',
+                                          `trade_no` varchar(64) NOT NULL COMMENT '支付渠道交易号',
+                                          `order_no` varchar(30) NOT NULL COMMENT '订单号',
+                                          `amount` varchar(20) NOT NULL DEFAULT '' COMMENT '支付金额',
+                                          `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='支付回调事件';
+
+ALTER TABLE `chatgpt_payment_events` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `gateway_trade_no` (`gateway`, `trade_no`);
+
+ALTER TABLE `chatgpt_payment_events` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_reconcile_reports` (
+                                             `id` int NOT NULL,
+                                             `batch_no` varchar(20) NOT NULL COMMENT '对账批次',
+                                             `merchant_id` varchar(30) NOT NULL DEFAULT '' COMMENT '订单所属的商户 ID',
+                                             `gateway` varchar(20) NOT NULL COMMENT '支付渠道',
+                                             `order_no` varchar(64) NOT NULL DEFAULT '' COMMENT '订单号',
+                                             `trade_no` varchar(64) NOT NULL DEFAULT '' COMMENT '支付渠道交易号',
+                                             `type` varchar(20) NOT NULL COMMENT '差异类型',
+                                             `local_amount` varchar(20) NOT NULL DEFAULT '' COMMENT '本地订单金额',
+                                             `gateway_amount` varchar(20) NOT NULL DEFAULT '' COMMENT '支付渠道交易金额',
+                                             `message` varchar(255) NOT NULL DEFAULT '' COMMENT '备注',
+                                             `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='对账报告';
+
+ALTER TABLE `chatgpt_reconcile_reports` ADD PRIMARY KEY (`id`), ADD KEY `batch_no` (`batch_no`);
+
+ALTER TABLE `chatgpt_reconcile_reports` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_coupons` (
+                                   `id` int NOT NULL,
+                                   `code` varchar(30) NOT NULL COMMENT '优惠码',
+                                   `type` varchar(10) NOT NULL COMMENT '优惠类型：percent 折扣，fixed 立减',
+                                   `value` int NOT NULL COMMENT '折扣百分比或者立减金额（分）',
+                                   `usage_limit` int NOT NULL DEFAULT '0' COMMENT '总使用次数，0 表示不限制',
+                                   `used_count` int NOT NULL DEFAULT '0' COMMENT '已使用次数',
+                                   `per_user_limit` int NOT NULL DEFAULT '0' COMMENT '每个用户可使用次数，0 表示不限制',
+                                   `product_id` int NOT NULL DEFAULT '0' COMMENT '限定产品 ID，0 表示不限制',
+                                   `expired_at` int NOT NULL DEFAULT '0' COMMENT '过期时间',
+                                   `enabled` tinyint(1) NOT NULL DEFAULT '1' COMMENT '是否启用',
+                                   `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='优惠券';
+
+ALTER TABLE `chatgpt_coupons` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `code` (`code`);
+
+ALTER TABLE `chatgpt_coupons` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_coupon_usages` (
+                                         `id` int NOT NULL,
+                                         `coupon_id` int NOT NULL COMMENT '优惠券 ID',
+                                         `user_id` int NOT NULL COMMENT '用户 ID',
+                                         `order_no` varchar(30) NOT NULL COMMENT '订单号',
+                                         `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='优惠券使用记录';
+
+ALTER TABLE `chatgpt_coupon_usages` ADD PRIMARY KEY (`id`), ADD KEY `coupon_user` (`coupon_id`, `user_id`), ADD UNIQUE KEY `order_no` (`order_no`);
+
+ALTER TABLE `chatgpt_coupon_usages` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+ALTER TABLE `chatgpt_orders` ADD `beneficiary_id` INT NOT NULL DEFAULT '0' COMMENT '受赠用户 ID' AFTER `user_id`;
+
+ALTER TABLE `chatgpt_orders` ADD `refund_cents` BIGINT NOT NULL DEFAULT '0' COMMENT '已退款金额（分）' AFTER `amount_cents`;
+ALTER TABLE `chatgpt_orders` ADD INDEX `pay_time` (`pay_time`);
+
+ALTER TABLE `chatgpt_orders` ADD `fee` BIGINT NOT NULL DEFAULT '0' COMMENT '支付渠道手续费（分）' AFTER `refund_cents`;
+
+CREATE TABLE `chatgpt_webhook_deliveries` (
+                                              `id` int NOT NULL,
+                                              `event` varchar(30) NOT NULL COMMENT '事件类型',
+                                              `order_no` varchar(30) NOT NULL COMMENT '订单号',
+                                              `url` varchar(255) NOT NULL COMMENT '回调地址',
+                                              `payload` text NOT NULL COMMENT '请求体',
+                                              `status` tinyint NOT NULL DEFAULT '0' COMMENT '投递状态：0 待投递，1 成功，2 失败',
+                                              `attempts` int NOT NULL DEFAULT '0' COMMENT '已投递次数',
+                                              `status_code` int NOT NULL DEFAULT '0' COMMENT '最后一次投递的 HTTP 状态码',
+                                              `last_error` varchar(512) NOT NULL DEFAULT '' COMMENT '最后一次投递的错误信息',
+                                              `next_retry_at` int NOT NULL DEFAULT '0' COMMENT '下次重试时间',
+                                              `created_at` datetime NOT NULL,
+                                              `updated_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='订单事件回调投递记录';
+
+ALTER TABLE `chatgpt_webhook_deliveries` ADD PRIMARY KEY (`id`), ADD KEY `status_next_retry_at` (`status`, `next_retry_at`);
+
+ALTER TABLE `chatgpt_webhook_deliveries` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_vip_power_grants` (
+                                            `id` int NOT NULL,
+                                            `user_id` int NOT NULL COMMENT '用户ID',
+                                            `month` varchar(7) NOT NULL COMMENT '发放月份',
+                                            `power` int NOT NULL COMMENT '发放算力',
+                                            `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='VIP 会员每月算力发放记录';
+
+ALTER TABLE `chatgpt_vip_power_grants` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `user_id_month` (`user_id`, `month`);
+
+ALTER TABLE `chatgpt_vip_power_grants` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_power_grants` (
+                                        `id` int NOT NULL,
+                                        `user_id` int NOT NULL COMMENT '用户ID',
+                                        `type` tinyint(1) NOT NULL COMMENT '算力来源',
+                                        `amount` int NOT NULL COMMENT '发放算力',
+                                        `remain` int NOT NULL COMMENT '剩余算力',
+                                        `expires_at` int NOT NULL DEFAULT '0' COMMENT '过期时间，0 表示永不过期',
+                                        `granted_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='算力发放批次';
+
+ALTER TABLE `chatgpt_power_grants` ADD PRIMARY KEY (`id`), ADD KEY `user_id` (`user_id`), ADD KEY `expires_at` (`expires_at`);
+
+ALTER TABLE `chatgpt_power_grants` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+-- 存量用户的剩余算力作为永不过期的批次导入
+INSERT INTO `chatgpt_power_grants` (`user_id`, `type`, `amount`, `remain`, `expires_at`, `granted_at`) SELECT `id`, 6, `power`, `power`, 0, NOW() FROM `chatgpt_users` WHERE `power` > 0;
+
+CREATE TABLE `chatgpt_power_refunds` (
+                                         `id` int NOT NULL,
+                                         `user_id` int NOT NULL COMMENT '用户ID',
+                                         `related_id` varchar(100) NOT NULL COMMENT '关联的任务标识',
+                                         `amount` int NOT NULL COMMENT '退回算力',
+                                         `reason` varchar(512) NOT NULL DEFAULT '' COMMENT '退回原因',
+                                         `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='算力退回记录';
+
+ALTER TABLE `chatgpt_power_refunds` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `related_id` (`related_id`);
+
+ALTER TABLE `chatgpt_power_refunds` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+ALTER TABLE `chatgpt_products` ADD `bucket` VARCHAR(20) NOT NULL DEFAULT '' COMMENT '算力分组，空表示默认分组' AFTER `power_price`;
+ALTER TABLE `chatgpt_power_grants` ADD `bucket` VARCHAR(20) NOT NULL DEFAULT '' COMMENT '算力分组，空表示默认分组' AFTER `type`;
+
+ALTER TABLE `chatgpt_users` ADD `last_low_balance_notified_at` INT NOT NULL DEFAULT '0' COMMENT '最后一次低余额提醒时间' AFTER `vip`;
+
+ALTER TABLE `chatgpt_products` ADD `currency` CHAR(3) NOT NULL DEFAULT 'CNY' COMMENT '结算货币' AFTER `price`;
+ALTER TABLE `chatgpt_orders` ADD `currency` CHAR(3) NOT NULL DEFAULT 'CNY' COMMENT '结算货币' AFTER `fee`;
+
+CREATE TABLE `chatgpt_invoices` (
+                                    `id` int NOT NULL,
+                                    `invoice_no` varchar(30) NOT NULL DEFAULT '' COMMENT '发票号',
+                                    `order_id` int NOT NULL COMMENT '订单ID',
+                                    `user_id` int NOT NULL COMMENT '用户ID',
+                                    `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='订单发票';
+
+ALTER TABLE `chatgpt_invoices` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `order_id` (`order_id`);
+
+ALTER TABLE `chatgpt_invoices` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_payment_callback_logs` (
+                                                 `id` int NOT NULL,
+                                                 `gateway` varchar(30) NOT NULL COMMENT '支付渠道',
+                                                 `method` varchar(10) NOT NULL COMMENT '请求方法',
+                                                 `url` varchar(1024) NOT NULL COMMENT '请求地址',
+                                                 `headers` text NOT NULL COMMENT '请求头',
+                                                 `body` mediumtext NOT NULL COMMENT '原始请求体',
+                                                 `client_ip` varchar(64) NOT NULL COMMENT '来源 IP',
+                                                 `result` varchar(1024) NOT NULL DEFAULT '' COMMENT '处理结果',
+                                                 `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='支付回调原始日志';
+
+ALTER TABLE `chatgpt_payment_callback_logs` ADD PRIMARY KEY (`id`), ADD KEY `created_at` (`created_at`);
+
+ALTER TABLE `chatgpt_payment_callback_logs` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+ALTER TABLE `chatgpt_orders` ADD INDEX `username` (`username`), ADD INDEX `pay_way_created_at` (`pay_way`, `created_at`), ADD INDEX `created_at` (`created_at`);
+ALTER TABLE `chatgpt_orders` ADD `deleted_at` DATETIME NULL DEFAULT NULL COMMENT '删除时间' AFTER `updated_at`, ADD INDEX `deleted_at` (`deleted_at`);
+
+ALTER TABLE `chatgpt_users` ADD `frozen_power` INT NOT NULL DEFAULT '0' COMMENT '冻结的算力' AFTER `power`;
+
+CREATE TABLE `chatgpt_power_holds` (
+                                      `id` int NOT NULL,
+                                      `user_id` int NOT NULL COMMENT '用户 ID',
+                                      `order_no` varchar(30) NOT NULL COMMENT '订单号',
+                                      `amount` int NOT NULL COMMENT '冻结的算力',
+                                      `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='组合支付冻结的算力';
+
+ALTER TABLE `chatgpt_power_holds` ADD PRIMARY KEY (`id`), ADD KEY `user_id` (`user_id`), ADD UNIQUE KEY `order_no` (`order_no`);
+
+ALTER TABLE `chatgpt_power_holds` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+ALTER TABLE `chatgpt_chat_models` ADD `rate_limit` INT NOT NULL DEFAULT '0' COMMENT '每个用户每分钟最多请求次数，0 表示不限制' AFTER `key_id`;
+
+ALTER TABLE `chatgpt_products` ADD `recurring` TINYINT(1) NOT NULL DEFAULT '0' COMMENT '是否自动续费的订阅产品' AFTER `bucket`;
+
+CREATE TABLE `chatgpt_subscriptions` (
+                                        `id` int NOT NULL,
+                                        `user_id` int NOT NULL COMMENT '用户 ID',
+                                        `product_id` int NOT NULL COMMENT '产品 ID',
+                                        `pay_way` varchar(20) NOT NULL COMMENT '支付渠道',
+                                        `subscription_no` varchar(100) NOT NULL COMMENT '支付渠道的订阅 ID',
+                                        `order_no` varchar(30) NOT NULL COMMENT '首次订阅的订单号',
+                                        `status` varchar(20) NOT NULL COMMENT '订阅状态',
+                                        `current_period_end` int NOT NULL DEFAULT '0' COMMENT '当前周期结束时间',
+                                        `next_charge_at` int NOT NULL DEFAULT '0' COMMENT '下次主动扣款时间',
+                                        `failed_attempts` int NOT NULL DEFAULT '0' COMMENT '连续续费扣款失败次数',
+                                        `last_failure` varchar(255) NOT NULL DEFAULT '' COMMENT '最近一次续费扣款失败的原因',
+                                        `created_at` datetime NOT NULL,
+                                        `updated_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='自动续费订阅';
+
+ALTER TABLE `chatgpt_subscriptions` ADD PRIMARY KEY (`id`), ADD KEY `user_id` (`user_id`), ADD UNIQUE KEY `pay_way_subscription_no` (`pay_way`, `subscription_no`);
+
+ALTER TABLE `chatgpt_subscriptions` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+ALTER TABLE `chatgpt_users` ADD `referrer_id` INT NOT NULL DEFAULT '0' COMMENT '邀请人 ID' AFTER `vip`, ADD `referral_rewarded` TINYINT(1) NOT NULL DEFAULT '0' COMMENT '是否已经奖励过邀请人' AFTER `referrer_id`;
+
+UPDATE `chatgpt_users` u JOIN `chatgpt_invite_logs` l ON l.`user_id` = u.`id` SET u.`referrer_id` = l.`inviter_id`;
+
+ALTER TABLE `chatgpt_products` ADD `region_prices_json` TEXT NULL COMMENT '区域价格' AFTER `recurring`;
+
+ALTER TABLE `chatgpt_orders` ADD `region` VARCHAR(10) NOT NULL DEFAULT '' COMMENT '使用区域价格时下单 IP 所在的国家或地区' AFTER `user_agent`;
+
+ALTER TABLE `chatgpt_products` ADD `notify_url` VARCHAR(255) NOT NULL DEFAULT '' COMMENT '单独设置的支付异步通知地址' AFTER `recurring`, ADD `return_url` VARCHAR(255) NOT NULL DEFAULT '' COMMENT '单独设置的支付完成跳转地址' AFTER `notify_url`;
+
+ALTER TABLE `chatgpt_orders` ADD `merchant_id` VARCHAR(30) NOT NULL DEFAULT '' COMMENT '多品牌部署时订单所属的商户 ID' AFTER `pay_type`;
+
+ALTER TABLE `chatgpt_orders` ADD `refund_status` VARCHAR(20) NOT NULL DEFAULT '' COMMENT '最近一次退款的状态' AFTER `refund_cents`;
+
+ALTER TABLE `chatgpt_orders` ADD `disputed` tinyint(1) NOT NULL DEFAULT '0' COMMENT '用户是否发起过交易争议' AFTER `refund_status`;
+
+CREATE TABLE `chatgpt_order_disputes` (
+                                          `id` int NOT NULL,
+                                          `dispute_id` varchar(64) NOT NULL COMMENT '支付渠道的争议 ID',
+                                          `gateway` varchar(20) NOT NULL COMMENT '支付渠道',
+                                          `order_no` varchar(64) NOT NULL COMMENT '订单号',
+                                          `user_id` int NOT NULL COMMENT '用户 ID',
+                                          `amount` varchar(20) NOT NULL DEFAULT '' COMMENT '争议金额',
+                                          `currency` varchar(10) NOT NULL DEFAULT '' COMMENT '货币',
+                                          `reason` varchar(100) NOT NULL DEFAULT '' COMMENT '争议原因',
+                                          `status` varchar(50) NOT NULL DEFAULT '' COMMENT '争议状态或者处理结果',
+                                          `due_by` int NOT NULL DEFAULT '0' COMMENT '提交证据的截止时间',
+                                          `power_revoked` int NOT NULL DEFAULT '0' COMMENT '扣回的算力',
+                                          `closed_at` int NOT NULL DEFAULT '0' COMMENT '争议结束时间',
+                                          `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='交易争议';
+
+ALTER TABLE `chatgpt_order_disputes` ADD PRIMARY KEY (`id`), ADD UNIQUE KEY `gateway_dispute` (`gateway`, `dispute_id`), ADD KEY `order_no` (`order_no`);
+
+ALTER TABLE `chatgpt_order_disputes` MODIFY `id` int NOT NULL AUTO_INCREMENT;
+
+CREATE TABLE `chatgpt_fulfillment_logs` (
+                                            `id` int NOT NULL,
+                                            `order_no` varchar(64) NOT NULL COMMENT '订单号',
+                                            `user_id` int NOT NULL COMMENT '获得权益的用户 ID',
+                                            `username` varchar(30) NOT NULL COMMENT '用户名',
+                                            `pay_way` varchar(20) NOT NULL DEFAULT '' COMMENT '支付渠道',
+                                            `opt` varchar(255) NOT NULL DEFAULT '' COMMENT '履约内容说明',
+                                            `power` int NOT NULL DEFAULT '0' COMMENT '发放的算力',
+                                            `days` int NOT NULL DEFAULT '0' COMMENT '实际顺延的订阅天数',
+                                            `expire_at` int NOT NULL DEFAULT '0' COMMENT '顺延之后的订阅周期结束时间',
+                                            `manual_by` int NOT NULL DEFAULT '0' COMMENT '手动结算的管理员 ID',
+                                            `created_at` datetime NOT NULL
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci COMMENT='订单履约日志';
+
+ALTER TABLE `chatgpt_fulfillment_logs` ADD PRIMARY KEY (`id`), ADD KEY `order_no` (`order_no`), ADD KEY `user_id` (`user_id`);
+
+ALTER TABLE `chatgpt_fulfillment_logs` MODIFY `id` int NOT NULL AUTO_INCREMENT;